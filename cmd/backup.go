@@ -1,9 +1,16 @@
 package cmd
 
 import (
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/flanksource/commons/console"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 
+	"github.com/flanksource/karina/pkg/phases/consul"
+	"github.com/flanksource/karina/pkg/phases/postgresoperator"
 	"github.com/flanksource/karina/pkg/phases/velero"
 )
 
@@ -17,3 +24,70 @@ var Backup = &cobra.Command{
 		}
 	},
 }
+
+func init() {
+	verify := &cobra.Command{
+		Use:   "verify [velero|consul|postgres]",
+		Short: "Restore the latest backups into temporary namespaces and verify their integrity",
+		Long:  "Restore the latest velero, consul and postgres backups into temporary namespaces or scratch instances, verify their contents and clean up.\nIf no backup types are specified, all are verified.",
+		Args:  cobra.MinimumNArgs(0),
+		Run: func(cmd *cobra.Command, args []string) {
+			p := getPlatform(cmd)
+			namespaces, _ := cmd.Flags().GetStringSlice("velero-namespaces")
+			consulName, _ := cmd.Flags().GetString("consul-name")
+			consulNamespace, _ := cmd.Flags().GetString("consul-namespace")
+			clusters, _ := cmd.Flags().GetStringSlice("postgres-clusters")
+			junitPath, _ := cmd.Flags().GetString("junit-path")
+			suiteName, _ := cmd.Flags().GetString("suite-name")
+			failOnError, _ := cmd.Flags().GetBool("fail-on-error")
+			allowDrift, _ := cmd.Flags().GetBool("allow-drift")
+
+			verifiers := map[string]func(*console.TestResults){
+				"velero": func(test *console.TestResults) {
+					velero.Verify(p, test, allowDrift, namespaces...)
+				},
+				"consul": func(test *console.TestResults) {
+					consul.NewBackupRestore(p, consulName, consulNamespace).Verify(test, allowDrift)
+				},
+				"postgres": func(test *console.TestResults) {
+					postgresoperator.Verify(p, test, allowDrift, clusters...)
+				},
+			}
+			if len(args) == 0 {
+				args = []string{"velero", "consul", "postgres"}
+			}
+
+			test := &console.TestResults{Writer: os.Stdout}
+			for _, name := range args {
+				fn, ok := verifiers[name]
+				if !ok {
+					log.Fatalf("Unknown backup type %s, must be one of velero, consul or postgres", name)
+				}
+				fn(test)
+			}
+			test.Done()
+
+			if junitPath != "" {
+				if suiteName == "" {
+					suiteName = p.Name + "-backups"
+				}
+				test.SuiteName(suiteName)
+				xml, _ := test.ToXML()
+				os.MkdirAll(path.Dir(junitPath), 0755)         // nolint: errcheck
+				ioutil.WriteFile(junitPath, []byte(xml), 0644) // nolint: errcheck
+			}
+			if test.FailCount > 0 && failOnError {
+				os.Exit(1)
+			}
+		},
+	}
+	verify.Flags().StringSlice("velero-namespaces", []string{"kube-system"}, "Namespaces to restore from the latest velero backup")
+	verify.Flags().String("consul-name", "consul-server", "Name of the consul deployment")
+	verify.Flags().String("consul-namespace", "vault", "Namespace where consul runs")
+	verify.Flags().StringSlice("postgres-clusters", nil, "Postgres clusters to verify, defaults to all clusters with WAL archiving enabled")
+	verify.Flags().String("junit-path", "", "Path to export JUnit formatted test results")
+	verify.Flags().String("suite-name", "", "Name of the Test Suite, defaults to <platform name>-backups")
+	verify.Flags().Bool("fail-on-error", true, "Return an exit code of 1 if any verification fails")
+	verify.Flags().Bool("allow-drift", false, "Only warn about restored data that differs from the live data instead of failing the verification")
+	Backup.AddCommand(verify)
+}
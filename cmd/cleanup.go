@@ -1,9 +1,12 @@
 package cmd
 
 import (
+	"time"
+
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 
+	"github.com/flanksource/karina/pkg/k8s"
 	"github.com/flanksource/karina/pkg/provision"
 )
 
@@ -19,12 +22,14 @@ var Cleanup = &cobra.Command{
 	},
 }
 
+var terminateOpts k8s.DrainOptions
+
 var TerminateNodes = &cobra.Command{
 	Use:   "terminate-node [nodes]",
 	Short: "Cordon and terminate the specified nodes",
 	Args:  cobra.MinimumNArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
-		if err := provision.TerminateNodes(getPlatform(cmd), args); err != nil {
+		if err := provision.TerminateNodes(getPlatform(cmd), args, terminateOpts); err != nil {
 			log.Fatalf("Failed terminate nodes %s", err)
 		}
 	},
@@ -39,3 +44,9 @@ var TerminateOrphans = &cobra.Command{
 		}
 	},
 }
+
+func init() {
+	TerminateNodes.Flags().DurationVar(&terminateOpts.Timeout, "timeout", time.Minute*5, "timeout for migrating each local volume")
+	TerminateNodes.Flags().BoolVar(&terminateOpts.MigrateLocalVolumes, "migrate-local-volumes", true, "Copy the data of local volumes to a new volume on another node")
+	TerminateNodes.Flags().BoolVar(&terminateOpts.Force, "force", false, "Discard the data of local volumes that cannot be migrated and terminate nodes that fail to drain")
+}
@@ -1,7 +1,9 @@
 package cmd
 
 import (
+	"fmt"
 	"os"
+	"time"
 
 	log "github.com/flanksource/commons/logger"
 	"github.com/flanksource/karina/pkg/phases/auditbeat"
@@ -9,6 +11,7 @@ import (
 	"github.com/flanksource/karina/pkg/phases/calico"
 	"github.com/flanksource/karina/pkg/phases/certmanager"
 	"github.com/flanksource/karina/pkg/phases/configmapreloader"
+	"github.com/flanksource/karina/pkg/phases/custom"
 	"github.com/flanksource/karina/pkg/phases/dex"
 	"github.com/flanksource/karina/pkg/phases/eck"
 	"github.com/flanksource/karina/pkg/phases/elasticsearch"
@@ -27,12 +30,15 @@ import (
 	"github.com/flanksource/karina/pkg/phases/registrycreds"
 	"github.com/flanksource/karina/pkg/phases/s3uploadcleaner"
 	"github.com/flanksource/karina/pkg/phases/sealedsecrets"
+	"github.com/flanksource/karina/pkg/phases/storage"
 	"github.com/flanksource/karina/pkg/phases/stubs"
 	"github.com/flanksource/karina/pkg/phases/tekton"
+	"github.com/flanksource/karina/pkg/phases/tenant"
 	"github.com/flanksource/karina/pkg/phases/vault"
 	"github.com/flanksource/karina/pkg/phases/velero"
 	"github.com/flanksource/karina/pkg/phases/vsphere"
 	"github.com/flanksource/karina/pkg/platform"
+	"github.com/flanksource/karina/pkg/types"
 	"github.com/spf13/cobra"
 )
 
@@ -60,8 +66,10 @@ var Phases = map[string]DeployFn{
 	"registry-creds":     registrycreds.Install,
 	"s3-upload-cleaner":  s3uploadcleaner.Deploy,
 	"sealed-secrets":     sealedsecrets.Install,
+	"storage":            storage.Install,
 	"stubs":              stubs.Install,
 	"tekton":             tekton.Install,
+	"tenants":            tenant.Deploy,
 	"vault":              vault.Deploy,
 	"velero":             velero.Install,
 }
@@ -72,10 +80,133 @@ var PhasesExtra = map[string]DeployFn{
 	"vsphere":           vsphere.Install,
 }
 
-var PhaseOrder = []string{"calico", "nsx", "base", "stubs", "postgres-operator", "dex", "vault"}
+var PhaseOrder = []string{"calico", "nsx", "base", "storage", "stubs", "postgres-operator", "dex", "vault", "harbor", "tenants"}
 
 var Deploy = &cobra.Command{
-	Use: "deploy",
+	Use:   "deploy [custom phase]",
+	Short: "Deploy a built-in phase, or a phase declared under customPhases",
+	Args:  cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) == 0 {
+			cmd.Help() // nolint: errcheck
+			return
+		}
+		p := getPlatform(cmd)
+		if err := validateCustomPhases(p); err != nil {
+			log.Fatalf("Invalid custom phases: %v", err)
+		}
+		phases, err := custom.Order(p, args[0])
+		if err != nil {
+			log.Fatalf("Failed to order custom phases: %v", err)
+		}
+		// the built-in phases that any of the custom phases depend on are deployed first
+		deployed := make(map[string]bool)
+		for _, phase := range phases {
+			for _, dependency := range phase.DependsOn {
+				fn, ok := getBuiltinPhase(dependency)
+				if !ok || deployed[dependency] {
+					continue
+				}
+				if err := deployPhase(p, dependency, fn); err != nil {
+					log.Fatalf("Failed to deploy %s: %v", dependency, err)
+				}
+				deployed[dependency] = true
+			}
+		}
+		for _, phase := range phases {
+			if err := deployPhase(p, phase.Name, customDeploy(phase)); err != nil {
+				log.Fatalf("Failed to deploy %s: %v", phase.Name, err)
+			}
+		}
+	},
+}
+
+// getBuiltinPhase returns the deploy function of a built-in phase
+func getBuiltinPhase(name string) (DeployFn, bool) {
+	if fn, ok := Phases[name]; ok {
+		return fn, true
+	}
+	fn, ok := PhasesExtra[name]
+	return fn, ok
+}
+
+// validateCustomPhases checks that custom phases have unique names that do not shadow any
+// of the built-in phases or deploy subcommands
+func validateCustomPhases(p *platform.Platform) error {
+	reserved := []string{"all", "phases"}
+	for name := range Phases {
+		reserved = append(reserved, name)
+	}
+	for name := range PhasesExtra {
+		reserved = append(reserved, name)
+	}
+	return custom.Validate(p, reserved...)
+}
+
+var (
+	waitForReady bool
+	waitTimeout  time.Duration
+)
+
+// deployPhase runs a phase and with --wait, waits for the objects it applied to become ready
+func deployPhase(p *platform.Platform, name string, fn DeployFn) error {
+	if !waitForReady {
+		return fn(p)
+	}
+	p.TrackApplied()
+	err := fn(p)
+	objects := p.Applied()
+	if err != nil {
+		return err
+	}
+	p.Infof("Waiting up to %v for %s to become ready", waitTimeout, name)
+	if err := p.WaitForReady("", waitTimeout, objects...); err != nil {
+		return fmt.Errorf("%s is not ready: %v", name, err)
+	}
+	return nil
+}
+
+func customDeploy(phase types.CustomPhase) DeployFn {
+	return func(p *platform.Platform) error {
+		return custom.Deploy(p, phase)
+	}
+}
+
+// deployCustomPhases deploys the custom phases after the phases they depend on, skipping
+// phases whose dependencies failed
+func deployCustomPhases(p *platform.Platform, failed map[string]bool) {
+	phases, err := custom.Order(p)
+	if err != nil {
+		log.Errorf("Failed to order custom phases: %v", err)
+		failed["customPhases"] = true
+		return
+	}
+	for _, phase := range phases {
+		skip := false
+		for _, dependency := range phase.DependsOn {
+			if failed[dependency] {
+				log.Errorf("Skipping %s as %s failed to deploy", phase.Name, dependency)
+				skip = true
+			}
+		}
+		if skip {
+			failed[phase.Name] = true
+			continue
+		}
+		if err := deployPhase(p, phase.Name, customDeploy(phase)); err != nil {
+			log.Errorf("Failed to deploy %s: %v", phase.Name, err)
+			failed[phase.Name] = true
+		}
+	}
+	// disabled phases are not ordered, deploying them deletes their objects
+	for _, phase := range p.CustomPhases {
+		if phase.Disabled {
+			if err := customDeploy(phase)(p); err != nil {
+				log.Errorf("Failed to delete %s: %v", phase.Name, err)
+				failed[phase.Name] = true
+			}
+		}
+	}
 }
 
 func init() {
@@ -91,7 +222,7 @@ func init() {
 				if !flag {
 					continue
 				}
-				if err := Phases[name](p); err != nil {
+				if err := deployPhase(p, name, Phases[name]); err != nil {
 					log.Errorf("Failed to deploy %s: %v", name, err)
 					failed = true
 				}
@@ -103,7 +234,7 @@ func init() {
 				if !flag {
 					continue
 				}
-				if err := fn(p); err != nil {
+				if err := deployPhase(p, name, fn); err != nil {
 					log.Errorf("Failed to deploy %s: %v", name, err)
 					failed = true
 				}
@@ -125,7 +256,7 @@ func init() {
 			Args: cobra.MinimumNArgs(0),
 			Run: func(cmd *cobra.Command, args []string) {
 				p := getPlatform(cmd)
-				if err := _fn(p); err != nil {
+				if err := deployPhase(p, _name, _fn); err != nil {
 					log.Fatalf("Failed to deploy %s: %v", _name, err)
 				}
 			},
@@ -140,7 +271,7 @@ func init() {
 			Args: cobra.MinimumNArgs(0),
 			Run: func(cmd *cobra.Command, args []string) {
 				p := getPlatform(cmd)
-				if err := _fn(p); err != nil {
+				if err := deployPhase(p, _name, _fn); err != nil {
 					log.Fatalf("Failed to deploy %s: %v", _name, err)
 				}
 			},
@@ -153,30 +284,38 @@ func init() {
 		Args:  cobra.MinimumNArgs(0),
 		Run: func(cmd *cobra.Command, args []string) {
 			p := getPlatform(cmd)
+			if err := validateCustomPhases(p); err != nil {
+				log.Fatalf("Invalid custom phases: %v", err)
+			}
 			// we track the failure status, and continue on failure to allow degraded operations
-			failed := false
+			failed := make(map[string]bool)
 
 			// first deploy strictly ordered phases, these phases are often dependencies for other phases
 			for _, name := range PhaseOrder {
-				if err := Phases[name](p); err != nil {
+				if err := deployPhase(p, name, Phases[name]); err != nil {
 					log.Errorf("Failed to deploy %s: %v", name, err)
-					failed = true
+					failed[name] = true
 				}
 				// remove the phase from the map so it isn't run again
 				delete(Phases, name)
 			}
 
 			for name, fn := range Phases {
-				if err := fn(p); err != nil {
+				if err := deployPhase(p, name, fn); err != nil {
 					log.Errorf("Failed to deploy %s: %v", name, err)
-					failed = true
+					failed[name] = true
 				}
 			}
-			if failed {
+
+			// custom phases are deployed last as they may depend on any of the built-in phases
+			deployCustomPhases(p, failed)
+			if len(failed) > 0 {
 				os.Exit(1)
 			}
 		},
 	}
 
 	Deploy.AddCommand(all)
+	Deploy.PersistentFlags().BoolVar(&waitForReady, "wait", false, "Wait for the Deployments, StatefulSets, DaemonSets, Jobs and CRDs applied by each phase to become ready")
+	Deploy.PersistentFlags().DurationVar(&waitTimeout, "wait-timeout", 5*time.Minute, "How long to wait for each phase to become ready")
 }
@@ -2,8 +2,9 @@ package cmd
 
 import (
 	"fmt"
-	"strings"
+	"sort"
 
+	"github.com/flanksource/karina/pkg/platform"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
@@ -20,40 +21,13 @@ func init() {
 		Short: "List all docker images used by the platform",
 		Args:  cobra.MinimumNArgs(0),
 		Run: func(cmd *cobra.Command, args []string) {
-			images := []string{}
-			p := getPlatform(cmd)
-			// in order to list all images we perform an dry-run deployment
-			// with an ApplyHook
-			p.DryRun = true
-			p.ApplyDryRun = true
-			p.TerminationProtection = true
-			p.ApplyHook = func(ns string, obj unstructured.Unstructured) {
-				containers := []interface{}{}
-				if image, found := obj.GetAnnotations()["image"]; found {
+			dryRunImages(getPlatform(cmd), func(name, image string) {
+				if name == "" {
 					fmt.Println(image)
+				} else {
+					fmt.Printf("%s/%s\n", name, image)
 				}
-				list, found, _ := unstructured.NestedSlice(obj.UnstructuredContent(), "spec", "template", "spec", "containers")
-				if found {
-					containers = append(containers, list...)
-				}
-				list, found, _ = unstructured.NestedSlice(obj.UnstructuredContent(), "spec", "template", "spec", "initContainers")
-				if found {
-					containers = append(containers, list...)
-				}
-				for _, container := range containers {
-					image, found := container.(map[string]interface{})["image"]
-					if found {
-						fmt.Printf("%s/%s\n", obj.GetName(), image)
-					}
-				}
-			}
-			for name, fn := range Phases {
-				if err := fn(p); err != nil {
-					log.Errorf("Failed to dry-run deploy %s: %v", name, err)
-				}
-			}
-
-			fmt.Println(strings.Join(images, "\n"))
+			})
 		},
 	})
 
@@ -64,3 +38,52 @@ func init() {
 		Run:   func(cmd *cobra.Command, args []string) {},
 	})
 }
+
+// dryRunImages performs a dry-run deployment of all phases and calls fn with the name of each
+// workload and the images of its containers, images declared using an image annotation have no name
+func dryRunImages(p *platform.Platform, fn func(name, image string)) {
+	// in order to list all images we perform an dry-run deployment
+	// with an ApplyHook
+	p.DryRun = true
+	p.ApplyDryRun = true
+	p.TerminationProtection = true
+	p.ApplyHook = func(ns string, obj unstructured.Unstructured) {
+		containers := []interface{}{}
+		if image, found := obj.GetAnnotations()["image"]; found {
+			fn("", image)
+		}
+		list, found, _ := unstructured.NestedSlice(obj.UnstructuredContent(), "spec", "template", "spec", "containers")
+		if found {
+			containers = append(containers, list...)
+		}
+		list, found, _ = unstructured.NestedSlice(obj.UnstructuredContent(), "spec", "template", "spec", "initContainers")
+		if found {
+			containers = append(containers, list...)
+		}
+		for _, container := range containers {
+			image, found := container.(map[string]interface{})["image"]
+			if found {
+				fn(obj.GetName(), fmt.Sprintf("%v", image))
+			}
+		}
+	}
+	for name, fn := range Phases {
+		if err := fn(p); err != nil {
+			log.Errorf("Failed to dry-run deploy %s: %v", name, err)
+		}
+	}
+}
+
+// getImages returns the unique images used by the platform
+func getImages(p *platform.Platform) []string {
+	seen := make(map[string]bool)
+	images := []string{}
+	dryRunImages(p, func(name, image string) {
+		if !seen[image] {
+			seen[image] = true
+			images = append(images, image)
+		}
+	})
+	sort.Strings(images)
+	return images
+}
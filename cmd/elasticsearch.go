@@ -0,0 +1,89 @@
+package cmd
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/flanksource/karina/pkg/phases/elasticsearch"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var Elasticsearch = &cobra.Command{
+	Use:   "elasticsearch",
+	Short: "Manage snapshots of the in-cluster elasticsearch",
+}
+
+func init() {
+	snapshot := &cobra.Command{
+		Use:   "snapshot [name]",
+		Short: "Create a snapshot in the S3 snapshot repository",
+		Args:  cobra.MaximumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			indices, _ := cmd.Flags().GetStringSlice("indices")
+			wait, _ := cmd.Flags().GetBool("wait")
+			name := fmt.Sprintf("karina-%s", time.Now().UTC().Format("2006.01.02-150405"))
+			if len(args) > 0 {
+				name = args[0]
+			}
+			client, err := elasticsearch.NewClient(getPlatform(cmd))
+			if err != nil {
+				log.Fatalf("Failed to connect to elasticsearch: %v", err)
+			}
+			if _, err := elasticsearch.Snapshot(client, name, indices, wait); err != nil {
+				log.Fatalf("Failed to create snapshot: %v", err)
+			}
+			if wait {
+				log.Infof("Created snapshot %s", name)
+			} else {
+				log.Infof("Started snapshot %s", name)
+			}
+		},
+	}
+	snapshot.Flags().StringSlice("indices", nil, "Index patterns to snapshot, defaults to all indices")
+	snapshot.Flags().Bool("wait", true, "Wait for the snapshot to complete")
+
+	restore := &cobra.Command{
+		Use:   "restore <snapshot>",
+		Short: "Restore indices from a snapshot",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			opts := elasticsearch.RestoreOptions{}
+			opts.Indices, _ = cmd.Flags().GetStringSlice("indices")
+			opts.Prefix, _ = cmd.Flags().GetString("prefix")
+			opts.Close, _ = cmd.Flags().GetBool("close")
+			opts.Wait, _ = cmd.Flags().GetBool("wait")
+			client, err := elasticsearch.NewClient(getPlatform(cmd))
+			if err != nil {
+				log.Fatalf("Failed to connect to elasticsearch: %v", err)
+			}
+			if err := elasticsearch.Restore(client, args[0], opts); err != nil {
+				log.Fatalf("Failed to restore: %v", err)
+			}
+			log.Infof("Restored %s", args[0])
+		},
+	}
+	restore.Flags().StringSlice("indices", nil, "Index patterns to restore, defaults to all indices in the snapshot")
+	restore.Flags().String("prefix", "", "Restore indices with a prefix e.g. restored-, instead of restoring over existing indices")
+	restore.Flags().Bool("close", false, "Close existing indices before restoring over them")
+	restore.Flags().Bool("wait", true, "Wait for the restore to complete")
+
+	list := &cobra.Command{
+		Use:   "list",
+		Short: "List snapshots in the S3 snapshot repository",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			client, err := elasticsearch.NewClient(getPlatform(cmd))
+			if err != nil {
+				log.Fatalf("Failed to connect to elasticsearch: %v", err)
+			}
+			snapshots, err := elasticsearch.ListSnapshots(client)
+			if err != nil {
+				log.Fatalf("%v", err)
+			}
+			elasticsearch.PrintSnapshots(nil, snapshots)
+		},
+	}
+
+	Elasticsearch.AddCommand(snapshot, restore, list)
+}
@@ -36,6 +36,45 @@ func init() {
 		},
 	})
 
+	Harbor.AddCommand(&cobra.Command{
+		Use:   "sync",
+		Short: "Reconcile harbor projects, members, robot accounts, registries and replication policies",
+		Args:  cobra.MinimumNArgs(0),
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := harbor.Sync(getPlatform(cmd)); err != nil {
+				log.Fatalf("Error syncing harbor %s\n", err)
+			}
+		},
+	})
+
+	scanReport := &cobra.Command{
+		Use:   "scan-report",
+		Short: "Summarise the critical vulnerabilities found by scans per project and repository",
+		Args:  cobra.MinimumNArgs(0),
+		Run: func(cmd *cobra.Command, args []string) {
+			opts := harbor.ScanReportOptions{}
+			opts.Projects, _ = cmd.Flags().GetStringSlice("project")
+			opts.All, _ = cmd.Flags().GetBool("all")
+			if err := harbor.ScanReport(getPlatform(cmd), opts); err != nil {
+				log.Fatalf("Error getting scan report %s\n", err)
+			}
+		},
+	}
+	scanReport.Flags().StringSlice("project", nil, "Only report on these projects")
+	scanReport.Flags().Bool("all", false, "Include repositories without critical vulnerabilities")
+	Harbor.AddCommand(scanReport)
+
+	Harbor.AddCommand(&cobra.Command{
+		Use:   "rotate-secrets",
+		Short: "Rotate the harbor component secrets, secretKey and admin and database passwords",
+		Args:  cobra.MinimumNArgs(0),
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := harbor.RotateSecrets(getPlatform(cmd)); err != nil {
+				log.Fatalf("Error rotating harbor secrets %s\n", err)
+			}
+		},
+	})
+
 	Harbor.AddCommand(&cobra.Command{
 		Use:   "replicate-all",
 		Short: "Trigger a manual replication for all enabled jobs",
@@ -1,36 +1,58 @@
 package cmd
 
 import (
-	"github.com/flanksource/karina/pkg/elastic"
+	"time"
+
+	"github.com/flanksource/karina/pkg/logs"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 )
 
 var Logs = &cobra.Command{
 	Use:   "logs",
-	Short: "Retrieve and export logs from ElasticSearch",
+	Short: "Retrieve and export logs from ElasticSearch or Loki",
 	Args:  cobra.MinimumNArgs(0),
 	Run: func(cmd *cobra.Command, args []string) {
 		name, _ := cmd.Flags().GetString("name")
 		kql, _ := cmd.Flags().GetString("query")
 		pod, _ := cmd.Flags().GetString("pod")
+		container, _ := cmd.Flags().GetString("container")
+		host, _ := cmd.Flags().GetString("host")
+		level, _ := cmd.Flags().GetString("level")
 		count, _ := cmd.Flags().GetInt("count")
 		namespace, _ := cmd.Flags().GetString("namespace")
 		cluster, _ := cmd.Flags().GetString("cluster")
 		since, _ := cmd.Flags().GetString("since")
 		from, _ := cmd.Flags().GetString("from")
 		to, _ := cmd.Flags().GetString("to")
+		index, _ := cmd.Flags().GetString("index")
 		timestamps, _ := cmd.Flags().GetBool("timestamps")
-		if err := elastic.ExportLogs(getPlatform(cmd), name, elastic.Query{
-			Pod:        pod,
-			Count:      count,
-			Cluster:    cluster,
-			Namespace:  namespace,
-			Since:      since,
-			Query:      kql,
-			From:       from,
+		follow, _ := cmd.Flags().GetBool("follow")
+		interval, _ := cmd.Flags().GetDuration("interval")
+		output, _ := cmd.Flags().GetString("output")
+
+		backend, err := logs.GetBackend(getPlatform(cmd), name)
+		if err != nil {
+			log.Fatalf("Failed to export logs, %s", err)
+		}
+		if err := logs.Export(backend, logs.Query{
+			Pod:       pod,
+			Container: container,
+			Host:      host,
+			Level:     level,
+			Count:     count,
+			Cluster:   cluster,
+			Namespace: namespace,
+			Since:     since,
+			Query:     kql,
+			From:      from,
+			To:        to,
+			Index:     index,
+		}, logs.Options{
+			Format:     output,
 			Timestamps: timestamps,
-			To:         to,
+			Follow:     follow,
+			Interval:   interval,
 		}); err != nil {
 			log.Fatalf("Failed to export logs, %s", err)
 		}
@@ -42,10 +64,17 @@ func init() {
 	Logs.Flags().String("from", "", "Logs since")
 	Logs.Flags().String("to", "", "Logs to")
 	Logs.Flags().String("since", "1d", "Logs since")
-	Logs.Flags().StringP("query", "q", "", "KQL query")
+	Logs.Flags().StringP("query", "q", "", "KQL query, or a LogQL pipeline for loki e.g. |= \"error\"")
 	Logs.Flags().String("cluster", "", "The kubernetes cluster to search in")
 	Logs.Flags().Int("count", 100000, "Number of log entries to return")
 	Logs.Flags().StringP("pod", "p", "", "Restrict to pod")
 	Logs.Flags().StringP("namespace", "n", "", "Restruct to namespace")
+	Logs.Flags().StringP("container", "c", "", "Restrict to container")
+	Logs.Flags().String("host", "", "Restrict to host")
+	Logs.Flags().String("level", "", "Restrict to log level")
+	Logs.Flags().String("index", "", "Elasticsearch index pattern, defaults to <filebeat index>-* or filebeat-*")
 	Logs.Flags().Bool("timestamps", false, "export timestamps per entry")
+	Logs.Flags().BoolP("follow", "f", false, "Poll for new log entries")
+	Logs.Flags().Duration("interval", 2*time.Second, "Interval between polls when following")
+	Logs.Flags().StringP("output", "o", "text", "Output format, one of text, json, ndjson or go-template=<template> e.g. go-template='{{.Pod}}: {{.Message}}'")
 }
@@ -0,0 +1,47 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+
+	"github.com/flanksource/karina/pkg/platform"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var Manifests = &cobra.Command{
+	Use:   "manifests",
+	Short: "Commands for working with the embedded manifests",
+}
+
+func init() {
+	export := &cobra.Command{
+		Use:   "export [dir]",
+		Short: "Export the embedded manifests and templates as a starting point for manifestOverlays",
+		Long:  "Export the embedded manifests and templates to dir along with a SHA256SUMS file used to detect when an overlaid file changes upstream",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			dir := args[0]
+			if update, _ := cmd.Flags().GetBool("update-checksums"); update {
+				if err := platform.UpdateOverlayChecksums(dir); err != nil {
+					log.Fatalf("Failed to update checksums: %v", err)
+				}
+				log.Infof("Updated %s/%s", dir, platform.OverlayChecksums)
+				return
+			}
+			force, _ := cmd.Flags().GetBool("force")
+			if files, err := ioutil.ReadDir(dir); err == nil && len(files) > 0 && !force {
+				log.Fatalf("%s is not empty, use --force to overwrite", dir)
+			} else if err != nil && !os.IsNotExist(err) {
+				log.Fatalf("Failed to read %s: %v", dir, err)
+			}
+			if err := platform.ExportManifests(dir); err != nil {
+				log.Fatalf("Failed to export manifests: %v", err)
+			}
+			log.Infof("Exported manifests to %s", dir)
+		},
+	}
+	export.Flags().Bool("force", false, "Overwrite existing files in dir")
+	export.Flags().Bool("update-checksums", false, "Record the current embedded versions of the files in an existing overlay dir, after merging upstream changes")
+	Manifests.AddCommand(export)
+}
@@ -1,6 +1,11 @@
 package cmd
 
 import (
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/flanksource/commons/console"
 	"github.com/flanksource/karina/pkg/phases/opa"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
@@ -11,14 +16,111 @@ var Opa = &cobra.Command{
 }
 
 func init() {
-	Opa.AddCommand(&cobra.Command{
-		Use:   "bundle",
+	bundle := &cobra.Command{
+		Use:   "bundle [name]",
 		Short: "deploy opa bundle",
-		Args:  cobra.MinimumNArgs(0),
+		Long:  "Upload a bundle to the opa.bundlePrefix bucket, if --bundle is not specified a bundle is built from opa.policies",
+		Args:  cobra.ExactArgs(1),
 		Run: func(cmd *cobra.Command, args []string) {
-			if err := opa.DeployBundle(getPlatform(cmd), args[0]); err != nil {
+			bundlePath, _ := cmd.Flags().GetString("bundle")
+			if err := opa.DeployBundle(getPlatform(cmd), args[0], bundlePath); err != nil {
 				log.Fatalf("Error deploying  opa bundles: %s", err)
 			}
 		},
-	})
+	}
+	bundle.Flags().String("bundle", "", "Path to a pre-built bundle to upload")
+
+	build := &cobra.Command{
+		Use:   "build",
+		Short: "Build a bundle from a directory of policies",
+		Args:  cobra.MinimumNArgs(0),
+		Run: func(cmd *cobra.Command, args []string) {
+			p := getPlatform(cmd)
+			policies, _ := cmd.Flags().GetString("policies")
+			output, _ := cmd.Flags().GetString("output")
+			revision, _ := cmd.Flags().GetString("revision")
+			signingKey, _ := cmd.Flags().GetString("signing-key")
+			if policies == "" && p.OPA != nil {
+				policies = p.OPA.Policies
+			}
+			if signingKey == "" && p.OPA != nil {
+				signingKey = p.OPA.BundleSigningKey
+			}
+			if policies == "" {
+				log.Fatalf("Must specify --policies or opa.policies")
+			}
+			if err := opa.Build(p, policies, output, revision, signingKey); err != nil {
+				log.Fatalf("Failed to build bundle: %v", err)
+			}
+		},
+	}
+	build.Flags().String("policies", "", "Directory containing the policies, defaults to opa.policies")
+	build.Flags().StringP("output", "o", "bundle.tar.gz", "Path to write the bundle to")
+	build.Flags().String("revision", "", "Revision to set in the bundle manifest, defaults to the git commit of the policies")
+	build.Flags().String("signing-key", "", "Path to a PEM encoded private key to sign the bundle with, defaults to opa.bundleSigningKey")
+
+	test := &cobra.Command{
+		Use:   "test",
+		Short: "Run the rego unit tests and evaluate the e2e fixtures locally",
+		Args:  cobra.MinimumNArgs(0),
+		Run: func(cmd *cobra.Command, args []string) {
+			p := getPlatform(cmd)
+			policies, _ := cmd.Flags().GetString("policies")
+			fixtures, _ := cmd.Flags().GetString("fixtures")
+			junitPath, _ := cmd.Flags().GetString("junit-path")
+			if p.OPA != nil {
+				if policies == "" {
+					policies = p.OPA.Policies
+				}
+				if fixtures == "" {
+					fixtures = p.OPA.E2E.Fixtures
+				}
+			}
+			if policies == "" {
+				log.Fatalf("Must specify --policies or opa.policies")
+			}
+
+			test := &console.TestResults{Writer: os.Stdout}
+			opa.TestPolicies(p, test, policies)
+			if fixtures != "" {
+				opa.TestFixtures(p, test, policies, fixtures)
+			}
+			test.Done()
+
+			if junitPath != "" {
+				test.SuiteName(p.Name + "-opa")
+				xml, _ := test.ToXML()
+				os.MkdirAll(path.Dir(junitPath), 0755)         // nolint: errcheck
+				ioutil.WriteFile(junitPath, []byte(xml), 0644) // nolint: errcheck
+			}
+			if test.FailCount > 0 {
+				os.Exit(1)
+			}
+		},
+	}
+	test.Flags().String("policies", "", "Directory containing the policies, defaults to opa.policies")
+	test.Flags().String("fixtures", "", "Directory containing accepted, rejected and resources fixtures, defaults to opa.e2e.fixtures")
+	test.Flags().String("junit-path", "", "Path to export JUnit formatted test results")
+
+	auditOpts := opa.AuditOptions{}
+	audit := &cobra.Command{
+		Use:   "audit",
+		Short: "Report existing objects that violate the admission policies",
+		Long:  "Evaluate the deployed policies against all live objects, or a directory of specs, and report the violations per namespace",
+		Args:  cobra.MinimumNArgs(0),
+		Run: func(cmd *cobra.Command, args []string) {
+			violations, err := opa.Audit(getPlatform(cmd), auditOpts)
+			if err != nil {
+				log.Fatalf("Failed to audit: %v", err)
+			}
+			if err := opa.WriteViolations(os.Stdout, violations, auditOpts.Format); err != nil {
+				log.Fatalf("Failed to write report: %v", err)
+			}
+		},
+	}
+	audit.Flags().StringVar(&auditOpts.Path, "input", "", "Path to input directory of specs, defaults to the live objects in the cluster")
+	audit.Flags().StringVar(&auditOpts.Policies, "policies", "", "Directory containing the policies, defaults to the policies deployed to opa")
+	audit.Flags().StringVar(&auditOpts.Format, "format", "table", "Format of the report, can be one of table,csv,json")
+
+	Opa.AddCommand(bundle, build, test, audit)
 }
@@ -2,10 +2,12 @@ package cmd
 
 import (
 	"strings"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 
+	"github.com/flanksource/karina/pkg/constants"
 	"github.com/flanksource/karina/pkg/provision"
 	"github.com/flanksource/karina/pkg/provision/vmware"
 )
@@ -85,8 +87,26 @@ var vm = &cobra.Command{
 	},
 }
 
+var controller = &cobra.Command{
+	Use:   "controller",
+	Short: "Run a controller that reconciles Machine and MachineDeployment resources with vSphere",
+	Args:  cobra.MinimumNArgs(0),
+	Run: func(cmd *cobra.Command, args []string) {
+		namespace, _ := cmd.Flags().GetString("namespace")
+		concurrency, _ := cmd.Flags().GetInt("concurrency")
+		syncPeriod, _ := cmd.Flags().GetDuration("sync-period")
+		opts := provision.ControllerOptions{Namespace: namespace, Concurrency: concurrency, SyncPeriod: syncPeriod}
+		if err := provision.Controller(getPlatform(cmd), opts); err != nil {
+			log.Fatalf("Failed to run controller, %s", err)
+		}
+	},
+}
+
 func init() {
-	Provision.AddCommand(vsphereCluster, kindCluster, vm)
+	Provision.AddCommand(vsphereCluster, kindCluster, vm, controller)
+	controller.Flags().String("namespace", constants.PlatformSystem, "Namespace to watch for machines and machine deployments")
+	controller.Flags().Int("concurrency", 3, "Number of machines to provision or terminate concurrently")
+	controller.Flags().Duration("sync-period", 5*time.Minute, "How often to resync machines with vSphere")
 	vm.Flags().String("name", "", "Name of vm")
 	vm.Flags().String("dns", "", "DNS entry to add")
 	vm.Flags().String("template", "", "template to use")
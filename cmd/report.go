@@ -1,8 +1,14 @@
 package cmd
 
 import (
+	"fmt"
+	"strings"
+
+	"github.com/flanksource/karina/pkg/k8s"
 	"github.com/flanksource/karina/pkg/reports"
 	"github.com/spf13/cobra"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
 )
 
 var Report = &cobra.Command{
@@ -12,13 +18,76 @@ var Report = &cobra.Command{
 var reportOpts = reports.ReportOptions{}
 
 func init() {
-	Report.PersistentFlags().StringVar(&reportOpts.Path, "input", "", "Path to input directory of specs")
+	Report.PersistentFlags().StringVar(&reportOpts.Path, "input", "", "Path to input directory of specs, reports are generated from the cluster if empty")
 	Report.PersistentFlags().StringArrayVar(&reportOpts.Annotations, "col", nil, "Annotations to include in the report")
-	Report.PersistentFlags().StringVar(&reportOpts.Format, "format", "table", "Format of the report, can be one of table,csv")
-	Report.AddCommand(&cobra.Command{
-		Use: "quotas",
+	Report.PersistentFlags().StringVar(&reportOpts.Format, "format", "table", "Format of the report, can be one of "+strings.Join(reports.Formats, ","))
+	quotas := &cobra.Command{
+		Use:   "quotas",
+		Short: "Report the hard limits and usage of ResourceQuotas and ClusterResourceQuotas",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var specs k8s.Specs
+			var err error
+			if reportOpts.Path != "" {
+				specs, err = k8s.Walk(reportOpts.Path)
+			} else {
+				client, e := getPlatform(cmd).GetDynamicClient()
+				if e != nil {
+					return e
+				}
+				specs, err = reports.LiveSpecs(client)
+			}
+			if err != nil {
+				return err
+			}
+			return reports.Quotas(specs, reportOpts)
+		},
+	}
+	quotas.Flags().StringSliceVar(&reportOpts.Resources, "resource", nil, "Resources to report on e.g. limits.memory,requests.storage, defaults to all resources")
+
+	capacityOpts := reports.CapacityOptions{}
+	capacity := &cobra.Command{
+		Use:   "capacity",
+		Short: "Report the capacity, cost and headroom of each pool, or the allocation of pool costs to namespaces",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			p := getPlatform(cmd)
+			client, err := p.GetClientset()
+			if err != nil {
+				return err
+			}
+			cpu, _ := cmd.Flags().GetString("request-cpu")
+			memory, _ := cmd.Flags().GetString("request-memory")
+			capacityOpts.Request = v1.ResourceList{}
+			for name, value := range map[v1.ResourceName]string{v1.ResourceCPU: cpu, v1.ResourceMemory: memory} {
+				if value == "" {
+					continue
+				}
+				quantity, err := resource.ParseQuantity(value)
+				if err != nil {
+					return fmt.Errorf("invalid --request-%s: %v", name, err)
+				}
+				capacityOpts.Request[name] = quantity
+			}
+			capacityOpts.ReportOptions = reportOpts
+			return reports.Capacity(client, p.PlatformConfig, capacityOpts)
+		},
+	}
+	capacity.Flags().Float64Var(&capacityOpts.CPU, "cpu-price", 0, "Monthly price per CPU core")
+	capacity.Flags().Float64Var(&capacityOpts.Memory, "memory-price", 0, "Monthly price per GB of memory")
+	capacity.Flags().Float64Var(&capacityOpts.Disk, "disk-price", 0, "Monthly price per GB of disk")
+	capacity.Flags().BoolVar(&capacityOpts.ByNamespace, "by-namespace", false, "Report the allocation of pool costs to namespaces by their requests")
+	capacity.Flags().String("request-cpu", "1", "The CPU request of a replica, used to forecast the headroom of each pool")
+	capacity.Flags().String("request-memory", "1Gi", "The memory request of a replica, used to forecast the headroom of each pool")
+
+	Report.AddCommand(quotas, capacity, &cobra.Command{
+		Use:   "utilisation",
+		Short: "Report the requests of pods vs the allocatable capacity of nodes for each pool",
 		RunE: func(cmd *cobra.Command, args []string) error {
-			return reports.Quotas(reportOpts)
+			p := getPlatform(cmd)
+			client, err := p.GetClientset()
+			if err != nil {
+				return err
+			}
+			return reports.Utilisation(client, p.PlatformConfig, reportOpts)
 		},
 	})
 }
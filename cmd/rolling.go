@@ -40,8 +40,8 @@ func init() {
 	RollingUpdate.Flags().DurationVar(&rollingOpts.MinAge, "min-age", time.Hour*24*7, "Minimum age of nodes to roll")
 	Rolling.PersistentFlags().DurationVar(&rollingOpts.Timeout, "timeout", time.Minute*5, "timeout between actions")
 	Rolling.PersistentFlags().IntVar(&rollingOpts.Max, "max", 100, "Max number of nodes to roll")
-	Rolling.PersistentFlags().BoolVar(&rollingOpts.MigrateLocalVolumes, "migrate-local-volumes", true, "Delete and recreate local PVC's")
-	Rolling.PersistentFlags().BoolVar(&rollingOpts.Force, "force", false, "ignore errors and continue with the rolling action regardless of health")
+	Rolling.PersistentFlags().BoolVar(&rollingOpts.MigrateLocalVolumes, "migrate-local-volumes", true, "Copy the data of local volumes to a new volume on another node, when disabled nodes with local volumes are only replaced with --force")
+	Rolling.PersistentFlags().BoolVar(&rollingOpts.Force, "force", false, "ignore errors and continue with the rolling action regardless of health, discarding the data of local volumes that cannot be migrated")
 	Rolling.PersistentFlags().BoolVar(&rollingOpts.Masters, "masters", true, "include master nodes")
 	Rolling.PersistentFlags().BoolVar(&rollingOpts.Workers, "workers", true, "include worker nodes")
 	Rolling.AddCommand(RollingRestart, RollingUpdate)
@@ -0,0 +1,115 @@
+package cmd
+
+import (
+	"io/ioutil"
+
+	"github.com/flanksource/karina/pkg/phases/tenant"
+	"github.com/flanksource/karina/pkg/types"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	yaml "gopkg.in/flanksource/yaml.v3"
+)
+
+var Tenant = &cobra.Command{
+	Use:   "tenant",
+	Short: "Onboard tenants with their own namespaces, quotas, RBAC, network policies, harbor project and gitops",
+}
+
+func init() {
+	apply := &cobra.Command{
+		Use:   "apply [name...]",
+		Short: "Apply the tenants declared in the config and in tenant files, or only the named tenants",
+		Run: func(cmd *cobra.Command, args []string) {
+			p := getPlatform(cmd)
+			tenants := getTenants(cmd, p.Tenants)
+			names := make(map[string]bool)
+			for _, name := range args {
+				names[name] = true
+			}
+			for _, t := range tenants {
+				if len(names) > 0 && !names[t.Name] {
+					continue
+				}
+				delete(names, t.Name)
+				if err := tenant.Apply(p, t, true); err != nil {
+					log.Fatalf("Failed to apply tenant %s: %v", t.Name, err)
+				}
+			}
+			for name := range names {
+				log.Fatalf("Tenant %s not found", name)
+			}
+			if prune, _ := cmd.Flags().GetBool("prune"); prune && len(args) == 0 {
+				client, err := p.GetClientset()
+				if err != nil {
+					log.Fatalf("Failed to get clientset: %v", err)
+				}
+				if err := tenant.PruneRemoved(client, p.Logger, tenants, p.DryRun); err != nil {
+					log.Fatalf("Failed to prune removed tenants: %v", err)
+				}
+			}
+		},
+	}
+	apply.Flags().StringSliceP("file", "f", nil, "A YAML file containing a list of tenants")
+	apply.Flags().Bool("prune", false, "Delete the quotas, role bindings and network policies of tenants that are no longer declared, ignored when tenants are named")
+
+	create := &cobra.Command{
+		Use:   "create <name>",
+		Short: "Create or update a tenant that is not declared in the config or tenant files from flags",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			p := getPlatform(cmd)
+			for _, declared := range getTenants(cmd, p.Tenants) {
+				if declared.Name == args[0] {
+					log.Fatalf("Tenant %s is declared in the config or a tenant file, use karina tenant apply instead", args[0])
+				}
+			}
+			t := types.Tenant{Name: args[0]}
+			t.Namespaces, _ = cmd.Flags().GetStringSlice("namespace")
+			t.Labels, _ = cmd.Flags().GetStringToString("label")
+			t.Roles, _ = cmd.Flags().GetStringToString("role")
+			t.Quota, _ = cmd.Flags().GetStringToString("quota")
+			t.DisableNetworkPolicies, _ = cmd.Flags().GetBool("disable-network-policies")
+			if enabled, _ := cmd.Flags().GetBool("harbor"); enabled {
+				t.Harbor = &types.TenantHarbor{}
+			}
+			if url, _ := cmd.Flags().GetString("git-url"); url != "" {
+				t.GitOps = &types.GitOps{GitURL: url}
+				t.GitOps.GitBranch, _ = cmd.Flags().GetString("git-branch")
+				t.GitOps.GitPath, _ = cmd.Flags().GetString("git-path")
+			}
+			// objects are not pruned as the flags may only describe part of the tenant
+			if err := tenant.Apply(p, t, false); err != nil {
+				log.Fatalf("Failed to create tenant %s: %v", t.Name, err)
+			}
+		},
+	}
+	create.Flags().StringSliceP("file", "f", nil, "A YAML file containing a list of tenants that must not include the tenant")
+	create.Flags().StringSlice("namespace", nil, "Namespaces of the tenant, defaults to the tenant name")
+	create.Flags().StringToString("label", nil, "Labels added to the tenant namespaces")
+	create.Flags().StringToString("role", nil, "ClusterRoles bound to LDAP groups e.g. --role developers=edit")
+	create.Flags().StringToString("quota", nil, "ResourceQuota hard limits e.g. --quota requests.cpu=4,limits.memory=16Gi")
+	create.Flags().Bool("disable-network-policies", false, "Do not create network policies that deny ingress from outside the tenant")
+	create.Flags().Bool("harbor", false, "Create a harbor project and pull secret for the tenant")
+	create.Flags().String("git-url", "", "Deploy flux to sync the tenant namespaces from a git repository")
+	create.Flags().String("git-branch", "", "The git branch to sync")
+	create.Flags().String("git-path", "", "The path within the git repository to sync")
+
+	Tenant.AddCommand(apply, create)
+}
+
+// getTenants returns tenants together with the tenants in the files given by the --file flag
+func getTenants(cmd *cobra.Command, tenants []types.Tenant) []types.Tenant {
+	files, _ := cmd.Flags().GetStringSlice("file")
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			log.Fatalf("Failed to read %s: %v", file, err)
+		}
+		var list []types.Tenant
+		if err := yaml.Unmarshal(data, &list); err != nil {
+			log.Fatalf("Failed to parse %s: %v", file, err)
+		}
+		tenants = append(tenants, list...)
+	}
+	return tenants
+}
@@ -13,6 +13,7 @@ import (
 	"github.com/flanksource/karina/pkg/phases/base"
 	"github.com/flanksource/karina/pkg/phases/configmapreloader"
 	"github.com/flanksource/karina/pkg/phases/consul"
+	"github.com/flanksource/karina/pkg/phases/custom"
 	"github.com/flanksource/karina/pkg/phases/dex"
 	"github.com/flanksource/karina/pkg/phases/eck"
 	"github.com/flanksource/karina/pkg/phases/elasticsearch"
@@ -27,10 +28,13 @@ import (
 	"github.com/flanksource/karina/pkg/phases/quack"
 	"github.com/flanksource/karina/pkg/phases/registrycreds"
 	"github.com/flanksource/karina/pkg/phases/sealedsecrets"
+	"github.com/flanksource/karina/pkg/phases/storage"
 	"github.com/flanksource/karina/pkg/phases/stubs"
 	"github.com/flanksource/karina/pkg/phases/vault"
 	"github.com/flanksource/karina/pkg/phases/velero"
 	"github.com/flanksource/karina/pkg/platform"
+	"github.com/flanksource/karina/pkg/types"
+	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	mpb "github.com/vbauerster/mpb/v5"
 )
@@ -41,6 +45,7 @@ var (
 	waitInterval          int
 	junitPath, suiteName  string
 	p                     *platform.Platform
+	newPlatform           func() *platform.Platform
 	progress              *mpb.Progress
 	test                  *console.TestResults
 	testE2E, showProgress bool
@@ -51,7 +56,37 @@ var (
 )
 
 var Test = &cobra.Command{
-	Use: "test",
+	Use:   "test [custom phase]",
+	Short: "Test a built-in phase, or a phase declared under customPhases",
+	Args:  cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) == 0 {
+			cmd.Help() // nolint: errcheck
+			return
+		}
+		phase := custom.Get(p, args[0])
+		if phase == nil {
+			log.Fatalf("Unknown phase %s", args[0])
+		}
+		queue(phase.Name, customTest(*phase), wg, ch)
+	},
+}
+
+func customTest(phase types.CustomPhase) TestFn {
+	return func(p *platform.Platform, test *console.TestResults) {
+		custom.Test(p, test, phase)
+	}
+}
+
+// testHarbor runs the harbor tests and if harbor.scanPlatformImages is set, checks the platform
+// images for critical vulnerabilities
+func testHarbor(p *platform.Platform, test *console.TestResults) {
+	harbor.Test(p, test)
+	if p.Harbor == nil || p.Harbor.Disabled || !p.Harbor.ScanPlatformImages {
+		return
+	}
+	// listing images requires a dry-run deployment, which must not affect the platform used by other tests
+	harbor.TestImages(p, test, getImages(newPlatform()))
 }
 
 func end(test *console.TestResults) {
@@ -108,6 +143,7 @@ func init() {
 	Test.PersistentPreRun = func(cmd *cobra.Command, args []string) {
 		GlobalPreRun(cmd, args)
 		p = getPlatform(cmd)
+		newPlatform = func() *platform.Platform { return getPlatform(cmd) }
 		wg = &sync.WaitGroup{}
 		ch = make(chan int, concurrency)
 		progress = mpb.New(mpb.WithWaitGroup(wg), mpb.WithWidth(40))
@@ -133,7 +169,7 @@ func init() {
 		"encryption":         kubeadm.TestEncryption,
 		"fluentd":            fluentdoperator.Test,
 		"gitops":             flux.Test,
-		"harbor":             harbor.Test,
+		"harbor":             testHarbor,
 		"monitoring":         monitoring.Test,
 		"nsx":                nsx.Test,
 		"opa":                opa.Test,
@@ -142,6 +178,7 @@ func init() {
 		"quack":              quack.Test,
 		"registry-creds":     registrycreds.Test,
 		"sealed-secrets":     sealedsecrets.Test,
+		"storage":            storage.Test,
 		"stubs":              stubs.Test,
 		"thanos":             monitoring.TestThanos,
 		"vault":              vault.Test,
@@ -184,12 +221,19 @@ func init() {
 		Args:  cobra.MinimumNArgs(0),
 		Run: func(cmd *cobra.Command, args []string) {
 			for name, fn := range tests {
-				if Containts(p.Test.Exclude, name) {
+				if Contains(p.Test.Exclude, name) {
 					test.Skipf(name, name)
 					continue
 				}
 				queue(name, fn, wg, ch)
 			}
+			for _, phase := range p.CustomPhases {
+				if Contains(p.Test.Exclude, phase.Name) {
+					test.Skipf(phase.Name, phase.Name)
+					continue
+				}
+				queue(phase.Name, customTest(phase), wg, ch)
+			}
 		},
 	}
 	Test.PersistentFlags().IntVar(&wait, "wait", 0, "Time in seconds to wait for tests to pass")
@@ -24,5 +24,31 @@ func init() {
 		},
 	}
 
-	Vault.AddCommand(init)
+	unseal := &cobra.Command{
+		Use:   "unseal [keys...]",
+		Short: "Unseal all vault pods",
+		Long:  "Unseal all vault pods using the specified keys, or the keys stored in the vault-unseal-keys secret if none are specified",
+		Args:  cobra.MinimumNArgs(0),
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := vault.Unseal(getPlatform(cmd), args...); err != nil {
+				log.Fatalf("Failed to unseal vault %v", err)
+			}
+		},
+	}
+
+	apply := &cobra.Command{
+		Use:   "apply",
+		Short: "Reconcile vault policies, secret engines, auth methods and roles",
+		Long:  "Reconcile vault policies, secret engines, auth methods, roles and group mappings with the configuration.\nThe changes are printed before they are applied, use --dry-run to only print them.",
+		Args:  cobra.MinimumNArgs(0),
+		Run: func(cmd *cobra.Command, args []string) {
+			prune, _ := cmd.Flags().GetBool("prune")
+			if err := vault.Apply(getPlatform(cmd), prune); err != nil {
+				log.Fatalf("Failed to apply vault configuration %v", err)
+			}
+		},
+	}
+	apply.Flags().Bool("prune", false, "Delete policies, roles and group mappings and unmount secret engines and auth methods that are no longer declared")
+
+	Vault.AddCommand(init, unseal, apply)
 }
@@ -37,12 +37,14 @@ func main() {
 		cmd.DB,
 		cmd.Deploy,
 		cmd.DNS,
+		cmd.Elasticsearch,
 		cmd.Exec,
 		cmd.ExecNode,
 		cmd.Harbor,
 		cmd.Images,
 		cmd.Logs,
 		cmd.MachineImages,
+		cmd.Manifests,
 		cmd.NSX,
 		cmd.Opa,
 		cmd.Provision,
@@ -51,6 +53,7 @@ func main() {
 		cmd.Rolling,
 		cmd.Snapshot,
 		cmd.Status,
+		cmd.Tenant,
 		cmd.Test,
 		cmd.TerminateNodes,
 		cmd.TerminateOrphans,
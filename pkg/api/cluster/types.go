@@ -0,0 +1,127 @@
+// Package cluster contains the Cluster API style Machine and MachineDeployment resources that are
+// reconciled by karina provision controller
+// +kubebuilder:object:generate=true
+// +groupName=cluster.flanksource.com
+package cluster
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"sigs.k8s.io/controller-runtime/pkg/scheme"
+)
+
+var (
+	// GroupName is the group name use in this package
+	GroupName = "cluster.flanksource.com"
+
+	// GroupVersion is group version used to register these objects
+	GroupVersion = schema.GroupVersion{Group: GroupName, Version: "v1alpha1"}
+
+	// SchemeBuilder is used to add go types to the GroupVersionKind scheme
+	SchemeBuilder = &scheme.Builder{GroupVersion: GroupVersion}
+
+	// AddToScheme adds the types in this group-version to the given scheme.
+	AddToScheme = SchemeBuilder.AddToScheme
+)
+
+const (
+	// DeploymentLabel is set on machines to the name of the MachineDeployment that owns them
+	DeploymentLabel = "cluster.flanksource.com/deployment"
+	// MachineFinalizer prevents machines from being deleted before their VM is terminated
+	MachineFinalizer = "machine.cluster.flanksource.com"
+)
+
+const (
+	MachinePending      = "Pending"
+	MachineProvisioning = "Provisioning"
+	// MachineProvisioned is the phase of a machine whose VM has been created, but has not joined the cluster yet
+	MachineProvisioned = "Provisioned"
+	MachineRunning     = "Running"
+	MachineDeleting    = "Deleting"
+	MachineFailed      = "Failed"
+)
+
+type MachineSpec struct {
+	// The pool under workers that the machine is provisioned from
+	Pool string `json:"pool"`
+	// The VM template to clone, defaults to the template of the pool
+	Template string `json:"template,omitempty"`
+	// The name of the VM, set once it has been provisioned
+	ProviderID string `json:"providerID,omitempty"`
+}
+
+type MachineStatus struct {
+	Phase string `json:"phase,omitempty"`
+	// The name of the node once the VM has joined the cluster
+	NodeName       string `json:"nodeName,omitempty"`
+	IP             string `json:"ip,omitempty"`
+	FailureMessage string `json:"failureMessage,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+
+// Machine is a single worker VM
+type Machine struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   MachineSpec   `json:"spec,omitempty"`
+	Status MachineStatus `json:"status,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// MachineList contains a list of Machine
+type MachineList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []Machine `json:"items"`
+}
+
+type MachineDeploymentSpec struct {
+	// The pool under workers that machines are provisioned from
+	Pool string `json:"pool"`
+	// The number of machines, defaults to the count of the pool
+	Replicas *int32 `json:"replicas,omitempty"`
+	// The VM template to clone, defaults to the template of the pool. Machines using a different
+	// template are replaced one at a time.
+	Template string `json:"template,omitempty"`
+	// Adopt existing VMs of the pool that do not belong to a machine as machines of the deployment,
+	// adopted VMs are terminated when the deployment scales down or replaces them
+	Adopt bool `json:"adopt,omitempty"`
+}
+
+type MachineDeploymentStatus struct {
+	Replicas int32 `json:"replicas"`
+	// The number of machines whose node has joined the cluster
+	ReadyReplicas int32 `json:"readyReplicas"`
+	// The number of machines using the template of the deployment
+	UpdatedReplicas int32 `json:"updatedReplicas"`
+}
+
+// +kubebuilder:object:root=true
+// +kubebuilder:subresource:status
+// +kubebuilder:subresource:scale:specpath=.spec.replicas,statuspath=.status.replicas
+
+// MachineDeployment maintains a number of machines from a pool, adopting the existing VMs of the pool
+type MachineDeployment struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   MachineDeploymentSpec   `json:"spec,omitempty"`
+	Status MachineDeploymentStatus `json:"status,omitempty"`
+}
+
+// +kubebuilder:object:root=true
+
+// MachineDeploymentList contains a list of MachineDeployment
+type MachineDeploymentList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []MachineDeployment `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&Machine{}, &MachineList{}, &MachineDeployment{}, &MachineDeploymentList{})
+}
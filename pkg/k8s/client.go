@@ -34,8 +34,8 @@ import (
 	"k8s.io/apimachinery/pkg/fields"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/intstr"
-	"k8s.io/apimachinery/pkg/util/wait"
 	cliresource "k8s.io/cli-runtime/pkg/resource"
 	"k8s.io/client-go/discovery/cached/disk"
 	"k8s.io/client-go/dynamic"
@@ -61,6 +61,7 @@ type Client struct {
 	restConfig          *rest.Config
 	etcdClientGenerator *etcd.EtcdClientGenerator
 	kustomizeManager    *kustomize.Manager
+	tracker             *applyTracker
 	restMapper          meta.RESTMapper
 }
 
@@ -154,22 +155,33 @@ func (c *Client) GetPodReplicas(pod v1.Pod) (int, error) {
 	return 1, nil
 }
 
-func (c *Client) Drain(nodeName string, timeout time.Duration) error {
+// Drain cordons a node and evicts its pods, local volumes used by the pods are migrated to
+// other nodes, unless opts.RetainLocalVolumes is set. Nothing is evicted if any of the local
+// volumes cannot be migrated, unless opts.Force is set.
+func (c *Client) Drain(nodeName string, opts DrainOptions) error {
 	c.Infof("[%s] draining", nodeName)
+	volumes := make(map[string]LocalVolume)
+	if !opts.RetainLocalVolumes {
+		var err error
+		if volumes, err = c.GetLocalVolumes(nodeName); err != nil {
+			return fmt.Errorf("error finding local volumes on %s: %v", nodeName, err)
+		}
+		if err := c.checkLocalVolumes(volumes, opts); err != nil {
+			return err
+		}
+	}
 	if err := c.Cordon(nodeName); err != nil {
 		return fmt.Errorf("error cordoning %s: %v", nodeName, err)
 	}
-	return c.EvictNode(nodeName)
+	return c.EvictNode(nodeName, volumes, opts)
 }
 
-func (c *Client) EvictPod(pod v1.Pod) error {
+// EvictPod evicts a pod and then migrates or recreates the local volumes it used once no other
+// pods on the node use them
+func (c *Client) EvictPod(pod v1.Pod, volumes map[string]LocalVolume, opts DrainOptions) error {
 	if IsPodDaemonSet(pod) || IsPodFinished(pod) || IsDeleted(&pod) {
 		return nil
 	}
-	client, err := c.GetClientset()
-	if err != nil {
-		return err
-	}
 	drainer, err := c.getDrainHelper()
 	if err != nil {
 		return err
@@ -201,40 +213,41 @@ func (c *Client) EvictPod(pod v1.Pod) error {
 		return err
 	}
 
-	pvcs := client.CoreV1().PersistentVolumeClaims(pod.Namespace)
 	for _, vol := range pod.Spec.Volumes {
-		if vol.PersistentVolumeClaim != nil {
-			pvc, err := pvcs.Get(vol.PersistentVolumeClaim.ClaimName, metav1.GetOptions{})
-			if err != nil {
-				return err
-			}
-			if pvc != nil && pvc.Spec.StorageClassName == nil || strings.Contains(*pvc.Spec.StorageClassName, "local") {
-				c.Infof("[%s] deleting", pvc.Name)
-				if err := pvcs.Delete(pvc.Name, &metav1.DeleteOptions{}); err != nil {
-					return err
-				}
-				//nolint: errcheck
-				wait.PollImmediate(1*time.Second, 2*time.Minute, func() (bool, error) {
-					_, err := pvcs.Get(pvc.Name, metav1.GetOptions{})
-					return errors.IsNotFound(err), nil
-				})
-				pvc.ObjectMeta.SetAnnotations(nil)
-				pvc.SetFinalizers([]string{})
-				pvc.SetSelfLink("")
-				pvc.SetResourceVersion("")
-				pvc.Spec.VolumeName = ""
-				new, err := pvcs.Create(pvc)
-				if err != nil {
-					return err
-				}
-				c.Infof("Created new PVC %s -> %s", pvc.UID, new.UID)
-			}
+		if vol.PersistentVolumeClaim == nil {
+			continue
+		}
+		key := pod.Namespace + "/" + vol.PersistentVolumeClaim.ClaimName
+		volume, ok := volumes[key]
+		if !ok {
+			continue
+		}
+		// volumes shared by multiple pods are only handled once the last of them is evicted
+		volume.Pods = remove(volume.Pods, pod.Name)
+		if len(volume.Pods) > 0 {
+			volumes[key] = volume
+			continue
+		}
+		delete(volumes, key)
+		if err := c.releaseVolume(key, volume, pod.Spec.NodeName, opts); err != nil {
+			return err
 		}
 	}
 	return nil
 }
 
-func (c *Client) EvictNode(nodeName string) error {
+// releaseVolume migrates a local volume to another node, or recreates its claim if it cannot be migrated
+func (c *Client) releaseVolume(key string, volume LocalVolume, nodeName string, opts DrainOptions) error {
+	if volume.Reason == "" && opts.MigrateLocalVolumes {
+		if err := c.MigrateVolume(volume, nodeName, opts.Timeout); err != nil {
+			return fmt.Errorf("failed to migrate %s: %v", key, err)
+		}
+		return nil
+	}
+	return c.recreateClaim(volume.Claim, opts.Timeout)
+}
+
+func (c *Client) EvictNode(nodeName string, volumes map[string]LocalVolume, opts DrainOptions) error {
 	client, err := c.GetClientset()
 	if err != nil {
 		return nil
@@ -249,7 +262,14 @@ func (c *Client) EvictNode(nodeName string) error {
 	}
 
 	for _, pod := range pods.Items {
-		if err := c.EvictPod(pod); err != nil {
+		if err := c.EvictPod(pod, volumes, opts); err != nil {
+			return err
+		}
+	}
+	// volumes whose remaining pods finished or were deleted before they could be evicted
+	for key, volume := range volumes {
+		delete(volumes, key)
+		if err := c.releaseVolume(key, volume, nodeName, opts); err != nil {
 			return err
 		}
 	}
@@ -538,6 +558,7 @@ func (c *Client) ApplyUnstructured(namespace string, objects ...*unstructured.Un
 		if c.ApplyHook != nil {
 			c.ApplyHook(namespace, *unstructuredObj)
 		}
+		c.track(namespace, *unstructuredObj)
 		if c.ApplyDryRun {
 			c.Debugf("[dry-run] %s/%s/%s created/configured", client.Resource, unstructuredObj, unstructuredObj.GetName())
 		} else {
@@ -605,6 +626,7 @@ func (c *Client) Apply(namespace string, objects ...runtime.Object) error {
 		if c.ApplyHook != nil {
 			c.ApplyHook(namespace, *unstructuredObj)
 		}
+		c.track(namespace, *unstructuredObj)
 		if c.ApplyDryRun {
 			c.trace("apply", unstructuredObj)
 			c.Debugf("[dry-run] %s/%s created/configured", resource.Resource, unstructuredObj.GetName())
@@ -1307,6 +1329,18 @@ func (c *Client) GetMasterNode() (string, error) {
 	return "", fmt.Errorf("no master nodes found")
 }
 
+// RestartDeployment performs a rolling restart of a deployment by updating an annotation of its pod
+// template, in the same way as kubectl rollout restart
+func (c *Client) RestartDeployment(namespace, name string) error {
+	client, err := c.GetClientset()
+	if err != nil {
+		return fmt.Errorf("RestartDeployment: failed to get clientset: %v", err)
+	}
+	patch := fmt.Sprintf(`{"spec":{"template":{"metadata":{"annotations":{"kubectl.kubernetes.io/restartedAt":"%s"}}}}}`, time.Now().Format(time.RFC3339))
+	_, err = client.AppsV1().Deployments(namespace).Patch(name, types.StrategicMergePatchType, []byte(patch))
+	return err
+}
+
 // GetMasterNode returns a list of all master nodes
 func (c *Client) GetMasterNodes() ([]string, error) {
 	client, err := c.GetClientset()
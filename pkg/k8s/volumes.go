@@ -0,0 +1,477 @@
+package k8s
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	utils "github.com/flanksource/commons/utils"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+)
+
+const migrateImage = "docker.io/library/busybox:1.28.0-glibc"
+
+// DrainOptions controls how pods using local persistent volumes are handled when draining a node
+type DrainOptions struct {
+	Timeout time.Duration
+	// Copy the data of local volumes to a new volume on another node before the workload is rebound
+	MigrateLocalVolumes bool
+	// Recreate local volumes that cannot be migrated empty, discarding their data
+	Force bool
+	// The node will come back with its data intact e.g. for a restart, so local volumes are left in place
+	RetainLocalVolumes bool
+}
+
+// LocalVolume is a claim used by a pod on a node that is bound to a volume that only exists on that node
+type LocalVolume struct {
+	Claim  v1.PersistentVolumeClaim
+	Volume v1.PersistentVolume
+	// The pods on the node that use the claim
+	Pods []string
+	// Why the volume cannot be migrated, empty if it can be
+	Reason string
+}
+
+// GetLocalVolumes returns the local volumes used by pods on a node, keyed by namespace/claim
+func (c *Client) GetLocalVolumes(nodeName string) (map[string]LocalVolume, error) {
+	client, err := c.GetClientset()
+	if err != nil {
+		return nil, err
+	}
+	return getLocalVolumes(client, nodeName)
+}
+
+func getLocalVolumes(client kubernetes.Interface, nodeName string) (map[string]LocalVolume, error) {
+	pods, err := client.CoreV1().Pods(metav1.NamespaceAll).List(metav1.ListOptions{
+		FieldSelector: fields.SelectorFromSet(fields.Set{"spec.nodeName": nodeName}).String(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	volumes := make(map[string]LocalVolume)
+	for _, pod := range pods.Items {
+		if IsPodDaemonSet(pod) || IsPodFinished(pod) || IsDeleted(&pod) {
+			continue
+		}
+		for _, vol := range pod.Spec.Volumes {
+			if vol.PersistentVolumeClaim == nil {
+				continue
+			}
+			key := pod.Namespace + "/" + vol.PersistentVolumeClaim.ClaimName
+			if local, ok := volumes[key]; ok {
+				local.Pods = append(local.Pods, pod.Name)
+				volumes[key] = local
+				continue
+			}
+			pvc, err := client.CoreV1().PersistentVolumeClaims(pod.Namespace).Get(vol.PersistentVolumeClaim.ClaimName, metav1.GetOptions{})
+			if err != nil {
+				return nil, err
+			}
+			if pvc.Spec.VolumeName == "" {
+				continue
+			}
+			pv, err := client.CoreV1().PersistentVolumes().Get(pvc.Spec.VolumeName, metav1.GetOptions{})
+			if err != nil {
+				return nil, err
+			}
+			if !isLocalVolume(pv, nodeName) {
+				continue
+			}
+			local := LocalVolume{Claim: *pvc, Volume: *pv, Pods: []string{pod.Name}}
+			if pvc.Spec.StorageClassName == nil || *pvc.Spec.StorageClassName == "" {
+				local.Reason = "it has no storage class to provision a new volume with"
+			} else if _, err := client.StorageV1().StorageClasses().Get(*pvc.Spec.StorageClassName, metav1.GetOptions{}); err != nil {
+				local.Reason = fmt.Sprintf("storage class %s: %v", *pvc.Spec.StorageClassName, err)
+			}
+			volumes[key] = local
+		}
+	}
+	return volumes, nil
+}
+
+// remove returns list without item
+func remove(list []string, item string) []string {
+	var out []string
+	for _, i := range list {
+		if i != item {
+			out = append(out, i)
+		}
+	}
+	return out
+}
+
+// isLocalVolume returns true if the volume is a local or hostPath volume, or can only be
+// attached to the node
+func isLocalVolume(pv *v1.PersistentVolume, nodeName string) bool {
+	if pv.Spec.Local != nil || pv.Spec.HostPath != nil {
+		return true
+	}
+	if pv.Spec.NodeAffinity == nil || pv.Spec.NodeAffinity.Required == nil {
+		return false
+	}
+	for _, term := range pv.Spec.NodeAffinity.Required.NodeSelectorTerms {
+		for _, expr := range term.MatchExpressions {
+			if expr.Key == "kubernetes.io/hostname" && expr.Operator == v1.NodeSelectorOpIn &&
+				len(expr.Values) == 1 && expr.Values[0] == nodeName {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// checkLocalVolumes returns an error listing the volumes that cannot be migrated, unless opts.Force is set
+func (c *Client) checkLocalVolumes(volumes map[string]LocalVolume, opts DrainOptions) error {
+	var problems []string
+	for name, volume := range volumes {
+		reason := volume.Reason
+		if reason == "" && !opts.MigrateLocalVolumes {
+			reason = "--migrate-local-volumes is disabled"
+		}
+		if reason == "" {
+			continue
+		}
+		if opts.Force {
+			c.Warnf("[%s] data will be discarded as the volume cannot be migrated: %s", name, reason)
+			continue
+		}
+		problems = append(problems, fmt.Sprintf("%s: %s", name, reason))
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	sort.Strings(problems)
+	return fmt.Errorf("cannot migrate local volumes, use --force to discard their data: %s", strings.Join(problems, ", "))
+}
+
+// MigrateVolume copies the data of a local volume to a new volume on another node, and then rebinds
+// the claim to the new volume. The pods using the claim must already have been evicted, the original
+// volume is only deleted once the data has been copied.
+func (c *Client) MigrateVolume(volume LocalVolume, nodeName string, timeout time.Duration) error {
+	client, err := c.GetClientset()
+	if err != nil {
+		return err
+	}
+	claim := volume.Claim
+	namespace := claim.Namespace
+	pvcs := client.CoreV1().PersistentVolumeClaims(namespace)
+	pvs := client.CoreV1().PersistentVolumes()
+	name := fmt.Sprintf("migrate-%s", utils.RandomString(8))
+	// the data is only copied once nothing can write to the volume anymore
+	err = wait.PollImmediate(2*time.Second, timeout, func() (bool, error) {
+		pods, err := podsUsingClaim(client, namespace, claim.Name, nodeName)
+		return err == nil && len(pods) == 0, nil
+	})
+	if err != nil {
+		return fmt.Errorf("pods using %s were not evicted: %v", claim.Name, err)
+	}
+	c.Infof("[%s/%s] migrating %s from %s", namespace, claim.Name, volume.Volume.Name, nodeName)
+
+	target := &v1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+		Spec: v1.PersistentVolumeClaimSpec{
+			AccessModes:      claim.Spec.AccessModes,
+			Resources:        claim.Spec.Resources,
+			StorageClassName: claim.Spec.StorageClassName,
+			VolumeMode:       claim.Spec.VolumeMode,
+		},
+	}
+	if _, err := pvcs.Create(target); err != nil {
+		return fmt.Errorf("failed to create %s: %v", name, err)
+	}
+	copied := false
+	defer func() {
+		if !copied {
+			pvcs.Delete(name, nil) // nolint: errcheck
+		}
+	}()
+
+	if err := c.copyVolume(namespace, name, claim.Name, nodeName, timeout); err != nil {
+		return err
+	}
+
+	target, err = pvcs.Get(name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	newVolume := target.Spec.VolumeName
+	// retain the new volume while it is moved from the temporary claim to the original claim
+	if err := c.updateVolume(newVolume, func(pv *v1.PersistentVolume) {
+		pv.Spec.PersistentVolumeReclaimPolicy = v1.PersistentVolumeReclaimRetain
+	}); err != nil {
+		return err
+	}
+	copied = true
+	if err := c.deleteClaim(namespace, name, timeout); err != nil {
+		return err
+	}
+	if err := c.deleteClaim(namespace, claim.Name, timeout); err != nil {
+		return err
+	}
+	// pre-bind the new volume to the recreated claim so that no other claim can bind to it
+	if err := c.updateVolume(newVolume, func(pv *v1.PersistentVolume) {
+		pv.Spec.ClaimRef = &v1.ObjectReference{
+			Kind:       "PersistentVolumeClaim",
+			APIVersion: "v1",
+			Namespace:  namespace,
+			Name:       claim.Name,
+		}
+	}); err != nil {
+		return err
+	}
+
+	claim.Spec.VolumeName = newVolume
+	if _, err := pvcs.Create(newClaim(claim)); err != nil {
+		return fmt.Errorf("failed to recreate %s bound to %s: %v", claim.Name, newVolume, err)
+	}
+	err = wait.PollImmediate(2*time.Second, timeout, func() (bool, error) {
+		pvc, err := pvcs.Get(claim.Name, metav1.GetOptions{})
+		return err == nil && pvc.Status.Phase == v1.ClaimBound, nil
+	})
+	if err != nil {
+		return fmt.Errorf("%s did not bind to %s: %v", claim.Name, newVolume, err)
+	}
+	if err := c.updateVolume(newVolume, func(pv *v1.PersistentVolume) {
+		pv.Spec.PersistentVolumeReclaimPolicy = volume.Volume.Spec.PersistentVolumeReclaimPolicy
+	}); err != nil {
+		return err
+	}
+	pv, _ := pvs.Get(newVolume, metav1.GetOptions{})
+	c.Infof("[%s/%s] migrated to %s on %s", namespace, claim.Name, newVolume, describeNodeAffinity(pv))
+	return nil
+}
+
+// podsUsingClaim returns the pods on a node that use a claim and have not finished
+func podsUsingClaim(client kubernetes.Interface, namespace, claim, nodeName string) ([]string, error) {
+	pods, err := client.CoreV1().Pods(namespace).List(metav1.ListOptions{
+		FieldSelector: fields.SelectorFromSet(fields.Set{"spec.nodeName": nodeName}).String(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, pod := range pods.Items {
+		if IsPodFinished(pod) {
+			continue
+		}
+		for _, vol := range pod.Spec.Volumes {
+			if vol.PersistentVolumeClaim != nil && vol.PersistentVolumeClaim.ClaimName == claim {
+				names = append(names, pod.Name)
+			}
+		}
+	}
+	return names, nil
+}
+
+// copyVolume streams a tar of the source claim from a pod on the node to a pod mounting the
+// target claim on another node
+func (c *Client) copyVolume(namespace, target, source, nodeName string, timeout time.Duration) error {
+	client, err := c.GetClientset()
+	if err != nil {
+		return err
+	}
+	pods := client.CoreV1().Pods(namespace)
+	receiver := newCopyPod(target+"-receive", namespace, target, "nc -l -p 8080 | tar xf - -C /data && sync")
+	receiver.Spec.Affinity = &v1.Affinity{
+		NodeAffinity: &v1.NodeAffinity{
+			RequiredDuringSchedulingIgnoredDuringExecution: &v1.NodeSelector{
+				NodeSelectorTerms: []v1.NodeSelectorTerm{{
+					MatchExpressions: []v1.NodeSelectorRequirement{{
+						Key:      "kubernetes.io/hostname",
+						Operator: v1.NodeSelectorOpNotIn,
+						Values:   []string{nodeName},
+					}},
+				}},
+			},
+		},
+	}
+	if _, err := pods.Create(receiver); err != nil {
+		return err
+	}
+	defer pods.Delete(receiver.Name, nil) // nolint: errcheck
+	if err := c.WaitForPod(namespace, receiver.Name, timeout, v1.PodRunning); err != nil {
+		return err
+	}
+	running, err := pods.Get(receiver.Name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	if running.Status.Phase != v1.PodRunning || running.Status.PodIP == "" {
+		return fmt.Errorf("%s is %s", receiver.Name, running.Status.Phase)
+	}
+
+	// retry until the receiver is listening
+	sender := newCopyPod(target+"-send", namespace, source, fmt.Sprintf(
+		"for i in $(seq 1 30); do tar cf - -C /data . | nc %s 8080 && exit 0; sleep 2; done; exit 1", running.Status.PodIP))
+	sender.Spec.NodeName = nodeName
+	sender.Spec.Tolerations = []v1.Toleration{{Operator: v1.TolerationOpExists}}
+	sender.Spec.Volumes[0].PersistentVolumeClaim.ReadOnly = true
+	if _, err := pods.Create(sender); err != nil {
+		return err
+	}
+	defer pods.Delete(sender.Name, nil) // nolint: errcheck
+
+	for _, name := range []string{sender.Name, receiver.Name} {
+		if err := c.waitForPodSucceeded(namespace, name, timeout); err != nil {
+			return fmt.Errorf("failed to copy %s: %v", source, err)
+		}
+	}
+	return nil
+}
+
+func newCopyPod(name, namespace, claim, command string) *v1.Pod {
+	var grace int64
+	return &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+		Spec: v1.PodSpec{
+			RestartPolicy:                 v1.RestartPolicyNever,
+			TerminationGracePeriodSeconds: &grace,
+			Containers: []v1.Container{{
+				Name:         "copy",
+				Image:        migrateImage,
+				Command:      []string{"sh", "-c", command},
+				VolumeMounts: []v1.VolumeMount{{Name: "data", MountPath: "/data"}},
+			}},
+			Volumes: []v1.Volume{{
+				Name: "data",
+				VolumeSource: v1.VolumeSource{
+					PersistentVolumeClaim: &v1.PersistentVolumeClaimVolumeSource{ClaimName: claim},
+				},
+			}},
+		},
+	}
+}
+
+func (c *Client) waitForPodSucceeded(namespace, name string, timeout time.Duration) error {
+	client, err := c.GetClientset()
+	if err != nil {
+		return err
+	}
+	return wait.PollImmediate(2*time.Second, timeout, func() (bool, error) {
+		pod, err := client.CoreV1().Pods(namespace).Get(name, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		switch pod.Status.Phase {
+		case v1.PodSucceeded:
+			return true, nil
+		case v1.PodFailed:
+			return false, fmt.Errorf("pod %s failed", name)
+		}
+		return false, nil
+	})
+}
+
+func (c *Client) updateVolume(name string, fn func(pv *v1.PersistentVolume)) error {
+	client, err := c.GetClientset()
+	if err != nil {
+		return err
+	}
+	pv, err := client.CoreV1().PersistentVolumes().Get(name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	fn(pv)
+	_, err = client.CoreV1().PersistentVolumes().Update(pv)
+	return err
+}
+
+// deleteClaim deletes a claim and waits for it to be removed, deleting any pods that
+// are still waiting to use it, e.g. replacements for evicted pods that cannot be scheduled
+func (c *Client) deleteClaim(namespace, name string, timeout time.Duration) error {
+	client, err := c.GetClientset()
+	if err != nil {
+		return err
+	}
+	pvcs := client.CoreV1().PersistentVolumeClaims(namespace)
+	if err := pvcs.Delete(name, nil); err != nil && !errors.IsNotFound(err) {
+		return err
+	}
+	err = wait.PollImmediate(2*time.Second, timeout, func() (bool, error) {
+		if _, err := pvcs.Get(name, metav1.GetOptions{}); errors.IsNotFound(err) {
+			return true, nil
+		}
+		pods, err := client.CoreV1().Pods(namespace).List(metav1.ListOptions{})
+		if err != nil {
+			return false, nil
+		}
+		for _, pod := range pods.Items {
+			for _, vol := range pod.Spec.Volumes {
+				if vol.PersistentVolumeClaim != nil && vol.PersistentVolumeClaim.ClaimName == name {
+					c.Debugf("[%s/%s] deleting pod waiting for %s", namespace, pod.Name, name)
+					client.CoreV1().Pods(namespace).Delete(pod.Name, nil) // nolint: errcheck
+				}
+			}
+		}
+		return false, nil
+	})
+	if err != nil {
+		return fmt.Errorf("%s was not deleted: %v", name, err)
+	}
+	return nil
+}
+
+// newClaim returns a copy of a claim that can be created, without any server-set or binding fields
+func newClaim(claim v1.PersistentVolumeClaim) *v1.PersistentVolumeClaim {
+	annotations := make(map[string]string)
+	for k, v := range claim.Annotations {
+		if strings.HasPrefix(k, "pv.kubernetes.io/") || strings.HasPrefix(k, "volume.beta.kubernetes.io/storage-provisioner") || k == "volume.kubernetes.io/selected-node" {
+			continue
+		}
+		annotations[k] = v
+	}
+	return &v1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        claim.Name,
+			Namespace:   claim.Namespace,
+			Labels:      claim.Labels,
+			Annotations: annotations,
+		},
+		Spec: v1.PersistentVolumeClaimSpec{
+			AccessModes:      claim.Spec.AccessModes,
+			Resources:        claim.Spec.Resources,
+			StorageClassName: claim.Spec.StorageClassName,
+			VolumeMode:       claim.Spec.VolumeMode,
+			VolumeName:       claim.Spec.VolumeName,
+		},
+	}
+}
+
+// recreateClaim deletes a claim and recreates it empty, discarding the data on the volume
+func (c *Client) recreateClaim(claim v1.PersistentVolumeClaim, timeout time.Duration) error {
+	client, err := c.GetClientset()
+	if err != nil {
+		return err
+	}
+	c.Warnf("[%s/%s] recreating empty", claim.Namespace, claim.Name)
+	if err := c.deleteClaim(claim.Namespace, claim.Name, timeout); err != nil {
+		return err
+	}
+	claim.Spec.VolumeName = ""
+	created, err := client.CoreV1().PersistentVolumeClaims(claim.Namespace).Create(newClaim(claim))
+	if err != nil {
+		return err
+	}
+	c.Infof("Created new PVC %s -> %s", claim.UID, created.UID)
+	return nil
+}
+
+func describeNodeAffinity(pv *v1.PersistentVolume) string {
+	if pv == nil || pv.Spec.NodeAffinity == nil || pv.Spec.NodeAffinity.Required == nil {
+		return "any node"
+	}
+	for _, term := range pv.Spec.NodeAffinity.Required.NodeSelectorTerms {
+		for _, expr := range term.MatchExpressions {
+			if expr.Key == "kubernetes.io/hostname" {
+				return strings.Join(expr.Values, ",")
+			}
+		}
+	}
+	return "any node"
+}
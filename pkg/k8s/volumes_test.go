@@ -0,0 +1,183 @@
+package k8s
+
+import (
+	"testing"
+
+	"github.com/flanksource/commons/logger"
+	. "github.com/onsi/gomega"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func hostnameAffinity(operator v1.NodeSelectorOperator, nodes ...string) *v1.VolumeNodeAffinity {
+	return &v1.VolumeNodeAffinity{Required: &v1.NodeSelector{NodeSelectorTerms: []v1.NodeSelectorTerm{{
+		MatchExpressions: []v1.NodeSelectorRequirement{{Key: "kubernetes.io/hostname", Operator: operator, Values: nodes}},
+	}}}}
+}
+
+func TestIsLocalVolume(t *testing.T) {
+	tests := []struct {
+		name  string
+		spec  v1.PersistentVolumeSpec
+		local bool
+	}{
+		{"local", v1.PersistentVolumeSpec{PersistentVolumeSource: v1.PersistentVolumeSource{Local: &v1.LocalVolumeSource{Path: "/data"}}}, true},
+		{"host path", v1.PersistentVolumeSpec{PersistentVolumeSource: v1.PersistentVolumeSource{HostPath: &v1.HostPathVolumeSource{Path: "/data"}}}, true},
+		{"pinned to node", v1.PersistentVolumeSpec{NodeAffinity: hostnameAffinity(v1.NodeSelectorOpIn, "node-a")}, true},
+		{"pinned to other node", v1.PersistentVolumeSpec{NodeAffinity: hostnameAffinity(v1.NodeSelectorOpIn, "node-b")}, false},
+		{"multiple nodes", v1.PersistentVolumeSpec{NodeAffinity: hostnameAffinity(v1.NodeSelectorOpIn, "node-a", "node-b")}, false},
+		{"excluded node", v1.PersistentVolumeSpec{NodeAffinity: hostnameAffinity(v1.NodeSelectorOpNotIn, "node-a")}, false},
+		{"network", v1.PersistentVolumeSpec{PersistentVolumeSource: v1.PersistentVolumeSource{NFS: &v1.NFSVolumeSource{Server: "nfs"}}}, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			g := NewWithT(t)
+			g.Expect(isLocalVolume(&v1.PersistentVolume{Spec: test.spec}, "node-a")).To(Equal(test.local))
+		})
+	}
+}
+
+func TestCheckLocalVolumes(t *testing.T) {
+	volumes := map[string]LocalVolume{
+		"default/data": {},
+		"default/logs": {Reason: "it has no storage class to provision a new volume with"},
+	}
+	tests := []struct {
+		name  string
+		opts  DrainOptions
+		error string
+	}{
+		{"migrate", DrainOptions{MigrateLocalVolumes: true}, "default/logs: it has no storage class"},
+		{"migrate disabled", DrainOptions{}, "default/data: --migrate-local-volumes is disabled, default/logs"},
+		{"force", DrainOptions{Force: true}, ""},
+		{"force and migrate", DrainOptions{Force: true, MigrateLocalVolumes: true}, ""},
+	}
+	c := &Client{Logger: logger.StandardLogger()}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			g := NewWithT(t)
+			err := c.checkLocalVolumes(volumes, test.opts)
+			if test.error == "" {
+				g.Expect(err).ToNot(HaveOccurred())
+			} else {
+				g.Expect(err).To(MatchError(ContainSubstring(test.error)))
+			}
+		})
+	}
+	g := NewWithT(t)
+	g.Expect(c.checkLocalVolumes(map[string]LocalVolume{"default/data": {}}, DrainOptions{MigrateLocalVolumes: true})).To(Succeed())
+}
+
+func TestNewClaim(t *testing.T) {
+	g := NewWithT(t)
+	class := "local-path"
+	claim := v1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            "data",
+			Namespace:       "default",
+			UID:             "1234",
+			ResourceVersion: "10",
+			Labels:          map[string]string{"app": "db"},
+			Annotations: map[string]string{
+				"pv.kubernetes.io/bind-completed":               "yes",
+				"volume.beta.kubernetes.io/storage-provisioner": "rancher.io/local-path",
+				"volume.kubernetes.io/selected-node":            "node-a",
+				"backup":                                        "true",
+			},
+			Finalizers: []string{"kubernetes.io/pvc-protection"},
+		},
+		Spec: v1.PersistentVolumeClaimSpec{
+			AccessModes:      []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce},
+			Resources:        v1.ResourceRequirements{Requests: v1.ResourceList{v1.ResourceStorage: resource.MustParse("10Gi")}},
+			StorageClassName: &class,
+			VolumeName:       "pvc-1234",
+		},
+		Status: v1.PersistentVolumeClaimStatus{Phase: v1.ClaimBound},
+	}
+
+	created := newClaim(claim)
+	g.Expect(created.Name).To(Equal("data"))
+	g.Expect(created.UID).To(BeEmpty())
+	g.Expect(created.ResourceVersion).To(BeEmpty())
+	g.Expect(created.Finalizers).To(BeEmpty())
+	g.Expect(created.Labels).To(Equal(claim.Labels))
+	g.Expect(created.Annotations).To(Equal(map[string]string{"backup": "true"}))
+	g.Expect(created.Spec.StorageClassName).To(Equal(&class))
+	g.Expect(created.Spec.VolumeName).To(Equal("pvc-1234"))
+	g.Expect(created.Spec.Resources).To(Equal(claim.Spec.Resources))
+	g.Expect(created.Status.Phase).To(BeEmpty())
+	// the original annotations are left untouched
+	g.Expect(claim.Annotations).To(HaveLen(4))
+}
+
+func TestGetLocalVolumes(t *testing.T) {
+	g := NewWithT(t)
+	class, missing := "local-path", "missing"
+	claim := func(name, volume string, class *string) *v1.PersistentVolumeClaim {
+		return &v1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+			Spec:       v1.PersistentVolumeClaimSpec{VolumeName: volume, StorageClassName: class},
+		}
+	}
+	volume := func(name string, spec v1.PersistentVolumeSpec) *v1.PersistentVolume {
+		return &v1.PersistentVolume{ObjectMeta: metav1.ObjectMeta{Name: name}, Spec: spec}
+	}
+	local := v1.PersistentVolumeSpec{PersistentVolumeSource: v1.PersistentVolumeSource{Local: &v1.LocalVolumeSource{Path: "/data"}}}
+	pod := func(name string, claims ...string) *v1.Pod {
+		pod := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"}, Spec: v1.PodSpec{NodeName: "node-a"}}
+		for _, claim := range claims {
+			pod.Spec.Volumes = append(pod.Spec.Volumes, v1.Volume{Name: claim, VolumeSource: v1.VolumeSource{
+				PersistentVolumeClaim: &v1.PersistentVolumeClaimVolumeSource{ClaimName: claim},
+			}})
+		}
+		return pod
+	}
+	client := fake.NewSimpleClientset(
+		&storagev1.StorageClass{ObjectMeta: metav1.ObjectMeta{Name: class}},
+		claim("data", "pv-data", &class), volume("pv-data", local),
+		claim("logs", "pv-logs", nil), volume("pv-logs", local),
+		claim("cache", "pv-cache", &missing), volume("pv-cache", local),
+		claim("shared", "pv-shared", &class), volume("pv-shared", v1.PersistentVolumeSpec{}),
+		claim("pending", "", &class),
+		pod("db", "data", "logs"),
+		pod("db-replica", "data", "cache"),
+		pod("web", "shared", "pending"),
+	)
+
+	volumes, err := getLocalVolumes(client, "node-a")
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(volumes).To(HaveLen(3))
+	g.Expect(volumes["default/data"].Reason).To(BeEmpty())
+	g.Expect(volumes["default/data"].Volume.Name).To(Equal("pv-data"))
+	g.Expect(volumes["default/data"].Pods).To(Equal([]string{"db", "db-replica"}))
+	g.Expect(volumes["default/logs"].Reason).To(ContainSubstring("no storage class"))
+	g.Expect(volumes["default/cache"].Reason).To(ContainSubstring("storage class missing"))
+}
+
+func TestPodsUsingClaim(t *testing.T) {
+	g := NewWithT(t)
+	pod := func(name string, phase v1.PodPhase, claim string) *v1.Pod {
+		return &v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+			Spec: v1.PodSpec{NodeName: "node-a", Volumes: []v1.Volume{{Name: claim, VolumeSource: v1.VolumeSource{
+				PersistentVolumeClaim: &v1.PersistentVolumeClaimVolumeSource{ClaimName: claim},
+			}}}},
+			Status: v1.PodStatus{Phase: phase},
+		}
+	}
+	client := fake.NewSimpleClientset(
+		pod("db", v1.PodRunning, "data"),
+		pod("backup", v1.PodSucceeded, "data"),
+		pod("web", v1.PodRunning, "logs"),
+	)
+
+	pods, err := podsUsingClaim(client, "default", "data", "node-a")
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(pods).To(Equal([]string{"db"}))
+	pods, err = podsUsingClaim(client, "default", "cache", "node-a")
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(pods).To(BeEmpty())
+}
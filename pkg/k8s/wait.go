@@ -0,0 +1,173 @@
+package k8s
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+type applyTracker struct {
+	sync.Mutex
+	objects []unstructured.Unstructured
+}
+
+// TrackApplied starts recording the objects that are applied, until Applied is called
+func (c *Client) TrackApplied() {
+	c.tracker = &applyTracker{}
+}
+
+// Applied returns the objects applied since TrackApplied was called and stops recording
+func (c *Client) Applied() []unstructured.Unstructured {
+	if c.tracker == nil {
+		return nil
+	}
+	objects := c.tracker.objects
+	c.tracker = nil
+	return objects
+}
+
+func (c *Client) track(namespace string, obj unstructured.Unstructured) {
+	if c.tracker == nil {
+		return
+	}
+	if obj.GetNamespace() == "" {
+		obj.SetNamespace(namespace)
+	}
+	c.tracker.Lock()
+	defer c.tracker.Unlock()
+	c.tracker.objects = append(c.tracker.objects, obj)
+}
+
+// WaitForReady waits until the Deployments, StatefulSets and DaemonSets are ready, the Jobs
+// have completed and the CRDs are established, other kinds of objects are ignored. Objects
+// without a namespace are looked up in namespace. On timeout the objects that are not ready
+// are returned in the error.
+func (c *Client) WaitForReady(namespace string, timeout time.Duration, objects ...unstructured.Unstructured) error {
+	if c.ApplyDryRun {
+		return nil
+	}
+	var pending []unstructured.Unstructured
+	seen := make(map[string]bool)
+	for _, obj := range objects {
+		key := strings.Join([]string{obj.GetKind(), obj.GetNamespace(), obj.GetName()}, "/")
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		switch obj.GetKind() {
+		case "Deployment", "StatefulSet", "DaemonSet", "Job":
+			if obj.GetNamespace() == "" {
+				obj.SetNamespace(namespace)
+			}
+			pending = append(pending, obj)
+		case "CustomResourceDefinition":
+			pending = append(pending, obj)
+		}
+	}
+
+	start := time.Now()
+	for {
+		var notReady []string
+		for i := range pending {
+			obj := &pending[i]
+			name := strings.Join([]string{obj.GetKind(), obj.GetNamespace(), obj.GetName()}, "/")
+			name = strings.Replace(name, "//", "/", 1)
+			client, _, _, err := c.GetDynamicClientFor(obj.GetNamespace(), obj)
+			if err != nil {
+				return err
+			}
+			current, err := client.Get(obj.GetName(), metav1.GetOptions{})
+			if err != nil {
+				notReady = append(notReady, fmt.Sprintf("%s: %v", name, err))
+				continue
+			}
+			ready, msg, err := isReady(current)
+			if err != nil {
+				return fmt.Errorf("%s: %v", name, err)
+			}
+			if !ready {
+				notReady = append(notReady, fmt.Sprintf("%s: %s", name, msg))
+			}
+		}
+		if len(notReady) == 0 {
+			return nil
+		}
+		if time.Since(start) > timeout {
+			return fmt.Errorf("timed out after %v waiting for %s", timeout, strings.Join(notReady, ", "))
+		}
+		c.Debugf("Waiting for %s", strings.Join(notReady, ", "))
+		time.Sleep(5 * time.Second)
+	}
+}
+
+// isReady returns whether the object is ready and if not a message describing why, an error is
+// returned for objects that will never become ready e.g. failed jobs
+func isReady(obj *unstructured.Unstructured) (bool, string, error) {
+	status := func(field string) int64 {
+		value, _, _ := unstructured.NestedInt64(obj.Object, "status", field)
+		return value
+	}
+	spec := func(field string, defaultValue int64) int64 {
+		value, found, _ := unstructured.NestedInt64(obj.Object, "spec", field)
+		if !found {
+			return defaultValue
+		}
+		return value
+	}
+	if observed := status("observedGeneration"); observed != 0 && observed < obj.GetGeneration() {
+		return false, "waiting for the controller to observe the latest generation", nil
+	}
+
+	switch obj.GetKind() {
+	case "Deployment":
+		replicas := spec("replicas", 1)
+		if updated := status("updatedReplicas"); updated < replicas {
+			return false, fmt.Sprintf("%d of %d replicas updated", updated, replicas), nil
+		}
+		if available := status("availableReplicas"); available < replicas {
+			return false, fmt.Sprintf("%d of %d replicas available", available, replicas), nil
+		}
+	case "StatefulSet":
+		replicas := spec("replicas", 1)
+		if ready := status("readyReplicas"); ready < replicas {
+			return false, fmt.Sprintf("%d of %d replicas ready", ready, replicas), nil
+		}
+	case "DaemonSet":
+		desired := status("desiredNumberScheduled")
+		if ready := status("numberReady"); ready < desired {
+			return false, fmt.Sprintf("%d of %d pods ready", ready, desired), nil
+		}
+	case "CustomResourceDefinition":
+		if !hasCondition(obj, "Established") {
+			return false, "not established", nil
+		}
+	case "Job":
+		conditions, _, _ := unstructured.NestedSlice(obj.Object, "status", "conditions")
+		for _, c := range conditions {
+			condition, _ := c.(map[string]interface{})
+			if condition["type"] == "Failed" && condition["status"] == "True" {
+				return false, "", fmt.Errorf("job failed: %v", condition["message"])
+			}
+		}
+		completions := spec("completions", 1)
+		if succeeded := status("succeeded"); succeeded < completions {
+			return false, fmt.Sprintf("%d of %d completions", succeeded, completions), nil
+		}
+	}
+	return true, "", nil
+}
+
+func hasCondition(obj *unstructured.Unstructured, conditionType string) bool {
+	conditions, _, _ := unstructured.NestedSlice(obj.Object, "status", "conditions")
+	for _, c := range conditions {
+		condition, _ := c.(map[string]interface{})
+		if condition["type"] == conditionType && condition["status"] == "True" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,178 @@
+package logs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/flanksource/commons/logger"
+	"github.com/flanksource/karina/pkg/types"
+	elastic "github.com/olivere/elastic/v7"
+)
+
+// document is a log entry indexed by filebeat
+type document struct {
+	Kubernetes struct {
+		Namespace string `json:"namespace"`
+		Pod       Name   `json:"pod"`
+		Container Name   `json:"container"`
+	} `json:"kubernetes"`
+	Host   Name `json:"host"`
+	Fields struct {
+		Cluster string `json:"cluster"`
+	} `json:"fields"`
+	Log struct {
+		Level string `json:"level"`
+	} `json:"log"`
+	Timestamp time.Time `json:"@timestamp"`
+	Message   string    `json:"message"`
+}
+
+type Name struct {
+	Name string
+}
+
+func (n Name) String() string {
+	return n.Name
+}
+
+type elasticBackend struct {
+	client *elastic.Client
+	index  string
+}
+
+// NewElastic returns a backend that searches the filebeat indices matching index
+func NewElastic(conn types.Connection, index string) (Backend, error) {
+	client, err := elastic.NewSimpleClient(
+		elastic.SetBasicAuth(conn.User, conn.Password),
+		elastic.SetURL(conn.GetURL()),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &elasticBackend{client: client, index: index}, nil
+}
+
+func (query Query) ToQuery() *elastic.BoolQuery {
+	q := elastic.NewBoolQuery()
+	if query.Namespace != "" {
+		q.Must(elastic.NewMatchPhraseQuery("kubernetes.namespace", query.Namespace))
+	}
+	if query.Pod != "" {
+		q.Must(elastic.NewMatchPhraseQuery("kubernetes.pod.name", query.Pod))
+	}
+	if query.Container != "" {
+		q.Must(elastic.NewMatchPhraseQuery("kubernetes.container.name", query.Container))
+	}
+	if query.Host != "" {
+		q.Must(elastic.NewMatchPhraseQuery("host.name", query.Host))
+	}
+	if query.Level != "" {
+		q.Must(elastic.NewMatchPhraseQuery("log.level", query.Level))
+	}
+	if query.Cluster != "" {
+		q.Must(elastic.NewMatchPhraseQuery("fields.cluster", query.Cluster))
+	}
+	if query.Query != "" {
+		q.Must(elastic.NewQueryStringQuery(query.Query))
+	}
+
+	if query.From != "" {
+		q.Must(elastic.NewRangeQuery("@timestamp").From(query.From).To(query.To))
+	} else if query.Since != "" {
+		q.Must(elastic.NewRangeQuery("@timestamp").From("now-" + query.Since).To("now"))
+	}
+	return q
+}
+
+func (e *elasticBackend) indexFor(query Query) string {
+	if query.Index != "" {
+		return query.Index
+	}
+	return e.index
+}
+
+func (e *elasticBackend) Export(query Query, fn func(Message) error) error {
+	size := pageSize
+	if query.Count < size {
+		size = query.Count
+	}
+	scroll := e.client.Scroll(e.indexFor(query)).
+		Size(size).
+		Sort("@timestamp", false).
+		Query(query.ToQuery())
+	defer scroll.Clear(context.Background()) // nolint: errcheck
+
+	count := 0
+	for count < query.Count {
+		result, err := scroll.Do(context.Background())
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			logger.Infof("Retrying %s", err)
+			time.Sleep(5 * time.Second)
+			if result, err = scroll.Do(context.Background()); errors.Is(err, io.EOF) {
+				break
+			} else if err != nil {
+				return err
+			}
+		}
+		for _, hit := range result.Hits.Hits {
+			msg, err := toMessage(hit)
+			if err != nil {
+				return err
+			}
+			if err := fn(msg); err != nil {
+				return err
+			}
+			count++
+			if count >= query.Count {
+				break
+			}
+		}
+		logger.Debugf("Exported %d results of %d total", count, result.TotalHits())
+	}
+	return nil
+}
+
+func (e *elasticBackend) After(query Query, since time.Time) ([]Message, error) {
+	q := query.ToQuery().Must(elastic.NewRangeQuery("@timestamp").Gte(since.Format(time.RFC3339Nano)))
+	result, err := e.client.Search(e.indexFor(query)).
+		Size(pageSize).
+		Sort("@timestamp", true).
+		Query(q).
+		Do(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	var messages []Message
+	for _, hit := range result.Hits.Hits {
+		msg, err := toMessage(hit)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, msg)
+	}
+	return messages, nil
+}
+
+func toMessage(hit *elastic.SearchHit) (Message, error) {
+	doc := document{}
+	if err := json.Unmarshal(hit.Source, &doc); err != nil {
+		return Message{}, err
+	}
+	return Message{
+		ID:        hit.Id,
+		Timestamp: doc.Timestamp,
+		Cluster:   doc.Fields.Cluster,
+		Namespace: doc.Kubernetes.Namespace,
+		Pod:       doc.Kubernetes.Pod.Name,
+		Container: doc.Kubernetes.Container.Name,
+		Host:      doc.Host.Name,
+		Level:     doc.Log.Level,
+		Message:   doc.Message,
+	}, nil
+}
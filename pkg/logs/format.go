@@ -0,0 +1,108 @@
+package logs
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+)
+
+type formatter interface {
+	Write(Message) error
+	Close() error
+}
+
+func newFormatter(opts Options) (formatter, error) {
+	w := opts.Writer
+	if w == nil {
+		w = os.Stdout
+	}
+	switch {
+	case opts.Format == "" || opts.Format == "text":
+		return &textFormatter{w: w, timestamps: opts.Timestamps}, nil
+	case opts.Format == "json":
+		if opts.Follow {
+			return nil, fmt.Errorf("-o json cannot be used with --follow, use -o ndjson instead")
+		}
+		return &jsonFormatter{w: w}, nil
+	case opts.Format == "ndjson":
+		return &ndjsonFormatter{encoder: json.NewEncoder(w)}, nil
+	case strings.HasPrefix(opts.Format, "go-template="):
+		tpl, err := template.New("logs").Parse(strings.TrimPrefix(opts.Format, "go-template="))
+		if err != nil {
+			return nil, fmt.Errorf("invalid template: %v", err)
+		}
+		return &templateFormatter{w: w, template: tpl}, nil
+	}
+	return nil, fmt.Errorf("unknown output format %s, must be one of text, json, ndjson or go-template=<template>", opts.Format)
+}
+
+type textFormatter struct {
+	w          io.Writer
+	timestamps bool
+}
+
+func (f *textFormatter) Write(msg Message) error {
+	var err error
+	if f.timestamps {
+		_, err = fmt.Fprintf(f.w, "%s [%s/%s/%s] %s\n", msg.Timestamp.Format(time.RFC3339Nano), msg.Cluster, msg.Pod, msg.Container, msg.Message)
+	} else {
+		_, err = fmt.Fprintf(f.w, "[%s/%s/%s] %s\n", msg.Cluster, msg.Pod, msg.Container, msg.Message)
+	}
+	return err
+}
+
+func (f *textFormatter) Close() error { return nil }
+
+// jsonFormatter writes a single JSON array
+type jsonFormatter struct {
+	w        io.Writer
+	messages []Message
+}
+
+func (f *jsonFormatter) Write(msg Message) error {
+	f.messages = append(f.messages, msg)
+	return nil
+}
+
+func (f *jsonFormatter) Close() error {
+	if f.messages == nil {
+		f.messages = []Message{}
+	}
+	data, err := json.MarshalIndent(f.messages, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(f.w, string(data))
+	return err
+}
+
+// ndjsonFormatter writes one JSON object per line
+type ndjsonFormatter struct {
+	encoder *json.Encoder
+}
+
+func (f *ndjsonFormatter) Write(msg Message) error {
+	return f.encoder.Encode(msg)
+}
+
+func (f *ndjsonFormatter) Close() error { return nil }
+
+// templateFormatter executes a go template per message followed by a newline
+type templateFormatter struct {
+	w        io.Writer
+	template *template.Template
+}
+
+func (f *templateFormatter) Write(msg Message) error {
+	if err := f.template.Execute(f.w, msg); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintln(f.w)
+	return err
+}
+
+func (f *templateFormatter) Close() error { return nil }
@@ -0,0 +1,169 @@
+package logs
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/flanksource/karina/pkg/platform"
+	"github.com/flanksource/karina/pkg/types"
+)
+
+// the maximum number of messages retrieved per request
+var pageSize = 5000
+
+type Query struct {
+	Namespace string
+	Cluster   string
+	Pod       string
+	Container string
+	Host      string
+	Level     string
+	Count     int
+	// A KQL query for elasticsearch, or a LogQL pipeline e.g. |= "error" for loki
+	Query    string
+	Since    string
+	From, To string
+	// The elasticsearch index pattern, defaults to <filebeat.index>-* or filebeat-*
+	Index string
+}
+
+// Message is a log entry returned by any of the backends
+type Message struct {
+	// ID uniquely identifies the message and is used to de-duplicate messages when following
+	ID        string            `json:"-"`
+	Timestamp time.Time         `json:"timestamp"`
+	Cluster   string            `json:"cluster,omitempty"`
+	Namespace string            `json:"namespace,omitempty"`
+	Pod       string            `json:"pod,omitempty"`
+	Container string            `json:"container,omitempty"`
+	Host      string            `json:"host,omitempty"`
+	Level     string            `json:"level,omitempty"`
+	Message   string            `json:"message"`
+	Labels    map[string]string `json:"labels,omitempty"`
+}
+
+// Backend retrieves logs from a log store
+type Backend interface {
+	// Export calls fn with up to query.Count messages matching the query, newest first
+	Export(query Query, fn func(Message) error) error
+	// After returns up to pageSize messages matching the query at or after since, oldest first
+	After(query Query, since time.Time) ([]Message, error)
+}
+
+type Options struct {
+	// One of text, json, ndjson or go-template=<template>
+	Format     string
+	Timestamps bool
+	// Keep polling for new messages until Done is closed
+	Follow   bool
+	Interval time.Duration
+	Done     <-chan struct{}
+	Writer   io.Writer
+}
+
+// GetBackend returns the backend configured for the filebeat entry, loki is used if a loki connection
+// is configured, otherwise elasticsearch
+func GetBackend(p *platform.Platform, filebeatName string) (Backend, error) {
+	var filebeat *types.Filebeat
+	for i := range p.Filebeat {
+		if p.Filebeat[i].Name == filebeatName {
+			filebeat = &p.Filebeat[i]
+		}
+	}
+	if filebeat == nil {
+		return nil, fmt.Errorf("failed to find filebeat with name %s", filebeatName)
+	}
+	if filebeat.Loki != nil {
+		p.Infof("Exporting logs from %s@%s", filebeat.Loki.User, filebeat.Loki.GetURL())
+		return NewLoki(*filebeat.Loki), nil
+	}
+	if filebeat.Elasticsearch == nil {
+		return nil, fmt.Errorf("filebeat %s has no elasticsearch or loki connection to query", filebeatName)
+	}
+	p.Infof("Exporting logs from %s@%s", filebeat.Elasticsearch.User, filebeat.Elasticsearch.GetURL())
+	index := "filebeat-*"
+	if filebeat.Index != "" {
+		index = filebeat.Index + "-*"
+	}
+	return NewElastic(*filebeat.Elasticsearch, index)
+}
+
+// Export writes the messages matching the query, when following the most recent messages are
+// written oldest first and then new messages are polled for until opts.Done is closed
+func Export(backend Backend, query Query, opts Options) error {
+	formatter, err := newFormatter(opts)
+	if err != nil {
+		return err
+	}
+	if !opts.Follow {
+		if err := backend.Export(query, formatter.Write); err != nil {
+			return err
+		}
+		return formatter.Close()
+	}
+
+	var recent []Message
+	if err := backend.Export(query, func(msg Message) error {
+		recent = append(recent, msg)
+		return nil
+	}); err != nil {
+		return err
+	}
+	last := time.Now()
+	// the IDs of the messages with the last timestamp, as polling includes messages at that timestamp
+	seen := make(map[string]bool)
+	write := func(msg Message) error {
+		if !msg.Timestamp.Equal(last) {
+			last = msg.Timestamp
+			seen = make(map[string]bool)
+		}
+		seen[msg.ID] = true
+		return formatter.Write(msg)
+	}
+	for i := len(recent) - 1; i >= 0; i-- {
+		if err := write(recent[i]); err != nil {
+			return err
+		}
+	}
+
+	interval := opts.Interval
+	if interval == 0 {
+		interval = 2 * time.Second
+	}
+	for {
+		select {
+		case <-opts.Done:
+			return formatter.Close()
+		case <-time.After(interval):
+		}
+		messages, err := backend.After(query, last)
+		if err != nil {
+			return err
+		}
+		for _, msg := range messages {
+			if msg.Timestamp.Equal(last) && seen[msg.ID] {
+				continue
+			}
+			if err := write(msg); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// parseSince parses durations such as 30m, 12h, 1d or 2w
+func parseSince(since string) (time.Duration, error) {
+	for suffix, unit := range map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour} {
+		if strings.HasSuffix(since, suffix) {
+			n, err := strconv.Atoi(strings.TrimSuffix(since, suffix))
+			if err != nil {
+				return 0, fmt.Errorf("invalid duration %s", since)
+			}
+			return time.Duration(n) * unit, nil
+		}
+	}
+	return time.ParseDuration(since)
+}
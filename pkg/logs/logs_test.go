@@ -0,0 +1,241 @@
+package logs
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/flanksource/karina/pkg/types"
+	. "github.com/onsi/gomega"
+)
+
+var start = time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+
+// stubElastic serves the scroll and search APIs from an in-memory list of filebeat documents
+type stubElastic struct {
+	sync.Mutex
+	docs     []map[string]interface{}
+	requests []string
+	pages    [][]map[string]interface{}
+}
+
+func (s *stubElastic) add(pod, message string, offset time.Duration) {
+	s.Lock()
+	defer s.Unlock()
+	s.docs = append(s.docs, map[string]interface{}{
+		"_id":        strconv.Itoa(len(s.docs)),
+		"@timestamp": start.Add(offset).Format(time.RFC3339Nano),
+		"message":    message,
+		"kubernetes": map[string]interface{}{"namespace": "default", "pod": map[string]string{"name": pod}, "container": map[string]string{"name": "app"}},
+		"fields":     map[string]string{"cluster": "test"},
+		"log":        map[string]string{"level": "info"},
+	})
+}
+
+func (s *stubElastic) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.Lock()
+	defer s.Unlock()
+	body, _ := ioutil.ReadAll(r.Body)
+	s.requests = append(s.requests, r.Method+" "+r.URL.Path+" "+string(body))
+	sorted := append([]map[string]interface{}{}, s.docs...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i]["@timestamp"].(string) < sorted[j]["@timestamp"].(string)
+	})
+
+	var hits []map[string]interface{}
+	switch {
+	case r.Method == http.MethodDelete:
+		fmt.Fprint(w, `{"succeeded":true}`)
+		return
+	case r.URL.Path == "/_search/scroll":
+		if len(s.pages) > 0 {
+			hits, s.pages = s.pages[0], s.pages[1:]
+		}
+	case r.URL.Query().Get("scroll") != "":
+		// newest first, returned in pages of size
+		size, _ := strconv.Atoi(r.URL.Query().Get("size"))
+		s.pages = nil
+		for i := len(sorted) - 1; i >= 0; i-- {
+			if len(s.pages) == 0 || len(s.pages[len(s.pages)-1]) == size {
+				s.pages = append(s.pages, nil)
+			}
+			s.pages[len(s.pages)-1] = append(s.pages[len(s.pages)-1], sorted[i])
+		}
+		if len(s.pages) > 0 {
+			hits, s.pages = s.pages[0], s.pages[1:]
+		}
+	default:
+		gte := regexp.MustCompile(`"from":"([^"]+)","include_lower":true`).FindStringSubmatch(string(body))
+		for _, doc := range sorted {
+			if len(gte) == 0 || doc["@timestamp"].(string) >= gte[1] {
+				hits = append(hits, doc)
+			}
+		}
+	}
+
+	var result []map[string]interface{}
+	for _, doc := range hits {
+		source := make(map[string]interface{})
+		for k, v := range doc {
+			if k != "_id" {
+				source[k] = v
+			}
+		}
+		result = append(result, map[string]interface{}{"_id": doc["_id"], "_index": "filebeat-1", "_source": source})
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{ // nolint: errcheck
+		"_scroll_id": "scroll",
+		"hits":       map[string]interface{}{"total": map[string]int{"value": len(s.docs)}, "hits": result},
+	})
+}
+
+func TestElasticExport(t *testing.T) {
+	g := NewWithT(t)
+	stub := &stubElastic{}
+	for i := 0; i < 5; i++ {
+		stub.add("web", fmt.Sprintf("line %d", i), time.Duration(i)*time.Second)
+	}
+	server := httptest.NewServer(stub)
+	defer server.Close()
+
+	backend, err := NewElastic(types.Connection{URL: server.URL}, "logs-*")
+	g.Expect(err).ToNot(HaveOccurred())
+	var out bytes.Buffer
+	g.Expect(Export(backend, Query{Count: 3, Pod: "web", Container: "app", Level: "info"}, Options{Writer: &out})).To(Succeed())
+	g.Expect(out.String()).To(Equal("[test/web/app] line 4\n[test/web/app] line 3\n[test/web/app] line 2\n"))
+	g.Expect(stub.requests[0]).To(HavePrefix("POST /logs-*/_search"))
+	g.Expect(stub.requests[0]).To(ContainSubstring(`"kubernetes.container.name"`))
+	g.Expect(stub.requests[0]).To(ContainSubstring(`"log.level"`))
+
+	out.Reset()
+	g.Expect(Export(backend, Query{Count: 10, Index: "other-*"}, Options{Writer: &out, Format: "ndjson"})).To(Succeed())
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	g.Expect(lines).To(HaveLen(5))
+	msg := Message{}
+	g.Expect(json.Unmarshal([]byte(lines[0]), &msg)).To(Succeed())
+	g.Expect(msg.Message).To(Equal("line 4"))
+	g.Expect(msg.Timestamp).To(Equal(start.Add(4 * time.Second)))
+	g.Expect(stub.requests[len(stub.requests)-3]).To(HavePrefix("POST /other-*/_search"))
+}
+
+func TestElasticFollow(t *testing.T) {
+	g := NewWithT(t)
+	stub := &stubElastic{}
+	stub.add("web", "first", 0)
+	stub.add("web", "second", time.Second)
+	server := httptest.NewServer(stub)
+	defer server.Close()
+
+	backend, err := NewElastic(types.Connection{URL: server.URL}, "filebeat-*")
+	g.Expect(err).ToNot(HaveOccurred())
+	var out syncBuffer
+	done := make(chan struct{})
+	errs := make(chan error)
+	go func() {
+		errs <- Export(backend, Query{Count: 10}, Options{Writer: &out, Follow: true, Interval: 10 * time.Millisecond, Done: done, Format: "go-template={{.Pod}}: {{.Message}}"})
+	}()
+	g.Eventually(out.String).Should(Equal("web: first\nweb: second\n"))
+	// a message with the same timestamp as the last message is not skipped
+	stub.add("web", "third", time.Second)
+	stub.add("web", "fourth", 2*time.Second)
+	g.Eventually(out.String).Should(Equal("web: first\nweb: second\nweb: third\nweb: fourth\n"))
+	g.Consistently(out.String, "100ms").Should(Equal("web: first\nweb: second\nweb: third\nweb: fourth\n"))
+	close(done)
+	g.Expect(<-errs).To(Succeed())
+}
+
+type syncBuffer struct {
+	sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.Lock()
+	defer b.Unlock()
+	return b.buf.String()
+}
+
+func TestLoki(t *testing.T) {
+	g := NewWithT(t)
+	var queries []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		g.Expect(r.URL.Path).To(Equal("/loki/api/v1/query_range"))
+		queries = append(queries, r.URL.Query().Get("query"))
+		end, _ := strconv.ParseInt(r.URL.Query().Get("end"), 10, 64)
+		limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+		// two streams with interleaved messages, only the newest limit messages before end are returned
+		streams := []map[string]interface{}{
+			{"stream": map[string]string{"namespace": "default", "pod": "web", "container": "app"}, "values": [][2]string{}},
+			{"stream": map[string]string{"namespace": "default", "pod": "api", "container": "app"}, "values": [][2]string{}},
+		}
+		for i := 3; i >= 0; i-- {
+			ts := start.Add(time.Duration(i) * time.Second).UnixNano()
+			if ts < end && limit > 0 {
+				limit--
+				stream := streams[i%2]
+				stream["values"] = append(stream["values"].([][2]string), [2]string{strconv.FormatInt(ts, 10), fmt.Sprintf("line %d", i)})
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{ // nolint: errcheck
+			"status": "success",
+			"data":   map[string]interface{}{"resultType": "streams", "result": streams},
+		})
+	}))
+	defer server.Close()
+
+	backend := NewLoki(types.Connection{URL: server.URL})
+	var out bytes.Buffer
+	query := Query{Count: 10, Namespace: "default", Query: `|= "line"`, From: start.Add(-time.Hour).Format(time.RFC3339), To: start.Add(time.Hour).Format(time.RFC3339)}
+	g.Expect(Export(backend, query, Options{Writer: &out, Format: "json"})).To(Succeed())
+	var messages []Message
+	g.Expect(json.Unmarshal(out.Bytes(), &messages)).To(Succeed())
+	g.Expect(messages).To(HaveLen(4))
+	g.Expect(messages[0].Message).To(Equal("line 3"))
+	g.Expect(messages[0].Pod).To(Equal("api"))
+	g.Expect(messages[3].Message).To(Equal("line 0"))
+	g.Expect(queries[0]).To(Equal(`{namespace="default"} |= "line"`))
+
+	// paging requests older messages until the count is reached
+	defer func(size int) { pageSize = size }(pageSize)
+	pageSize = 2
+	queries = nil
+	out.Reset()
+	query.Count = 3
+	g.Expect(Export(backend, query, Options{Writer: &out})).To(Succeed())
+	g.Expect(out.String()).To(Equal("[/api/app] line 3\n[/web/app] line 2\n[/api/app] line 1\n"))
+	g.Expect(queries).To(HaveLen(2))
+}
+
+func TestFormats(t *testing.T) {
+	g := NewWithT(t)
+	_, err := newFormatter(Options{Format: "json", Follow: true})
+	g.Expect(err).To(HaveOccurred())
+	_, err = newFormatter(Options{Format: "yaml"})
+	g.Expect(err).To(HaveOccurred())
+
+	var out bytes.Buffer
+	f, err := newFormatter(Options{Writer: &out, Timestamps: true})
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(f.Write(Message{Timestamp: start, Cluster: "c", Pod: "p", Container: "app", Message: "hello"})).To(Succeed())
+	g.Expect(out.String()).To(Equal("2020-06-01T12:00:00Z [c/p/app] hello\n"))
+
+	since, err := parseSince("2d")
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(since).To(Equal(48 * time.Hour))
+}
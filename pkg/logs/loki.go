@@ -0,0 +1,213 @@
+package logs
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/flanksource/karina/pkg/types"
+)
+
+// lokiLabels maps query fields to the stream labels they are matched against
+var lokiLabels = []struct {
+	label string
+	value func(Query) string
+}{
+	{"cluster", func(q Query) string { return q.Cluster }},
+	{"namespace", func(q Query) string { return q.Namespace }},
+	{"pod", func(q Query) string { return q.Pod }},
+	{"container", func(q Query) string { return q.Container }},
+	{"host", func(q Query) string { return q.Host }},
+	{"level", func(q Query) string { return q.Level }},
+}
+
+type lokiBackend struct {
+	client *http.Client
+	conn   types.Connection
+}
+
+// NewLoki returns a backend that queries the query_range API of loki, or any API compatible with it
+func NewLoki(conn types.Connection) Backend {
+	return &lokiBackend{client: http.DefaultClient, conn: conn}
+}
+
+type lokiResponse struct {
+	Status string `json:"status"`
+	Data   struct {
+		ResultType string `json:"resultType"`
+		Result     []struct {
+			Stream map[string]string `json:"stream"`
+			Values [][2]string       `json:"values"`
+		} `json:"result"`
+	} `json:"data"`
+}
+
+// LogQL returns a LogQL query with a stream selector for the query filters, followed by query.Query
+func (query Query) LogQL() string {
+	var matchers []string
+	for _, label := range lokiLabels {
+		if value := label.value(query); value != "" {
+			matchers = append(matchers, fmt.Sprintf("%s=%q", label.label, value))
+		}
+	}
+	if len(matchers) == 0 {
+		// loki requires at least one matcher that does not match empty values
+		matchers = append(matchers, `namespace=~".+"`)
+	}
+	logql := "{" + strings.Join(matchers, ",") + "}"
+	if query.Query != "" {
+		logql += " " + query.Query
+	}
+	return logql
+}
+
+// timeRange returns the start and end of the query, from and to must be RFC3339 timestamps
+func (query Query) timeRange() (time.Time, time.Time, error) {
+	end := time.Now()
+	if query.From != "" {
+		start, err := time.Parse(time.RFC3339, query.From)
+		if err != nil {
+			return start, end, fmt.Errorf("--from must be an RFC3339 timestamp for loki: %v", err)
+		}
+		if query.To != "" {
+			if end, err = time.Parse(time.RFC3339, query.To); err != nil {
+				return start, end, fmt.Errorf("--to must be an RFC3339 timestamp for loki: %v", err)
+			}
+		}
+		return start, end, nil
+	}
+	since := 24 * time.Hour
+	if query.Since != "" {
+		var err error
+		if since, err = parseSince(query.Since); err != nil {
+			return end, end, err
+		}
+	}
+	return end.Add(-since), end, nil
+}
+
+func (l *lokiBackend) Export(query Query, fn func(Message) error) error {
+	start, end, err := query.timeRange()
+	if err != nil {
+		return err
+	}
+	count := 0
+	seen := make(map[string]bool)
+	for count < query.Count {
+		// end is exclusive, so the next page is requested up to and including the oldest message
+		// of this page, which is skipped if it has already been returned
+		messages, err := l.query(query, start, end.Add(time.Nanosecond), pageSize, "backward")
+		if err != nil {
+			return err
+		}
+		returned := 0
+		for _, msg := range messages {
+			if seen[msg.ID] {
+				continue
+			}
+			seen[msg.ID] = true
+			if err := fn(msg); err != nil {
+				return err
+			}
+			returned++
+			count++
+			end = msg.Timestamp
+			if count >= query.Count {
+				return nil
+			}
+		}
+		if returned == 0 || len(messages) < pageSize {
+			return nil
+		}
+	}
+	return nil
+}
+
+func (l *lokiBackend) After(query Query, since time.Time) ([]Message, error) {
+	return l.query(query, since, time.Now(), pageSize, "forward")
+}
+
+// query returns the messages between start and end sorted in the given direction
+func (l *lokiBackend) query(query Query, start, end time.Time, limit int, direction string) ([]Message, error) {
+	params := url.Values{}
+	params.Set("query", query.LogQL())
+	params.Set("start", strconv.FormatInt(start.UnixNano(), 10))
+	params.Set("end", strconv.FormatInt(end.UnixNano(), 10))
+	params.Set("limit", strconv.Itoa(limit))
+	params.Set("direction", direction)
+	req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(l.conn.GetURL(), "/")+"/loki/api/v1/query_range?"+params.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if l.conn.User != "" {
+		req.SetBasicAuth(l.conn.User, l.conn.Password)
+	}
+	resp, err := l.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("loki returned %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	result := lokiResponse{}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return nil, fmt.Errorf("failed to decode loki response: %v", err)
+	}
+	if result.Data.ResultType != "streams" {
+		return nil, fmt.Errorf("expected a streams result from loki, got %s", result.Data.ResultType)
+	}
+
+	var messages []Message
+	for _, stream := range result.Data.Result {
+		for _, value := range stream.Values {
+			ns, err := strconv.ParseInt(value[0], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid timestamp %s: %v", value[0], err)
+			}
+			messages = append(messages, newLokiMessage(stream.Stream, time.Unix(0, ns).UTC(), value[1]))
+		}
+	}
+	// each stream is sorted, but streams are not merged
+	sort.SliceStable(messages, func(i, j int) bool {
+		if direction == "forward" {
+			return messages[i].Timestamp.Before(messages[j].Timestamp)
+		}
+		return messages[i].Timestamp.After(messages[j].Timestamp)
+	})
+	return messages, nil
+}
+
+func newLokiMessage(labels map[string]string, timestamp time.Time, line string) Message {
+	var keys []string
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	hash := fnv.New64a()
+	fmt.Fprintf(hash, "%d", timestamp.UnixNano())
+	for _, k := range keys {
+		fmt.Fprintf(hash, "%s=%s,", k, labels[k])
+	}
+	hash.Write([]byte(line)) // nolint: errcheck
+	return Message{
+		ID:        strconv.FormatUint(hash.Sum64(), 16),
+		Timestamp: timestamp,
+		Cluster:   labels["cluster"],
+		Namespace: labels["namespace"],
+		Pod:       labels["pod"],
+		Container: labels["container"],
+		Host:      labels["host"],
+		Level:     labels["level"],
+		Message:   line,
+		Labels:    labels,
+	}
+}
@@ -2,6 +2,7 @@ package auditbeat
 
 import (
 	"github.com/flanksource/karina/pkg/constants"
+	"github.com/flanksource/karina/pkg/phases/beats"
 	"github.com/flanksource/karina/pkg/platform"
 )
 
@@ -11,5 +12,17 @@ func Deploy(p *platform.Platform) error {
 		return p.DeleteSpecs(constants.PlatformSystem, "auditbeat.yaml")
 	}
 
+	beat := beats.Beat{
+		Type:        "auditbeat",
+		BeatsOutput: beats.WithDefaultOutput(p, p.Auditbeat.BeatsOutput),
+	}
+	if !beat.HasOutput() {
+		p.Warnf("Skipping deployment of auditbeat, no output is specified and there is no infra filebeat with an elasticsearch output")
+		return nil
+	}
+	if err := beats.Deploy(p, beat); err != nil {
+		return err
+	}
+
 	return p.ApplySpecs(constants.PlatformSystem, "auditbeat.yaml")
 }
@@ -11,6 +11,7 @@ import (
 	"github.com/flanksource/karina/pkg/phases/nginx"
 	"github.com/flanksource/karina/pkg/phases/platformoperator"
 	"github.com/flanksource/karina/pkg/phases/quack"
+	"github.com/flanksource/karina/pkg/phases/storage"
 	"github.com/flanksource/karina/pkg/phases/vsphere"
 	"github.com/flanksource/karina/pkg/platform"
 )
@@ -46,26 +47,8 @@ func Install(platform *platform.Platform) error {
 		return err
 	}
 
-	if !platform.NodeLocalDNS.Disabled {
-		client, err := platform.GetClientset()
-		if err != nil {
-			return fmt.Errorf("install: Failed to get clientset: %v", err)
-		}
-
-		kubeDNS, err := client.CoreV1().Services("kube-system").Get("kube-dns", metav1.GetOptions{})
-		if err != nil {
-			return fmt.Errorf("install: Failed to get service: %v", err)
-		}
-
-		platform.NodeLocalDNS.DNSServer = kubeDNS.Spec.ClusterIP
-
-		// TODO(mazzy89): make these values configurable
-		platform.NodeLocalDNS.LocalDNS = "169.254.20.10"
-		platform.NodeLocalDNS.DNSDomain = "cluster.local"
-
-		if err := platform.ApplySpecs("", "node-local-dns.yaml"); err != nil {
-			platform.Errorf("Error deploying node-local-dns: %s", err)
-		}
+	if err := installDNS(platform); err != nil {
+		return err
 	}
 
 	if err := nginx.Install(platform); err != nil {
@@ -136,5 +119,44 @@ func Install(platform *platform.Platform) error {
 		}
 	}
 
+	// the provisioners above may have reset the default storage class
+	if err := storage.SetDefault(platform); err != nil {
+		platform.Warnf("Failed to set the default storage class: %v", err)
+	}
+
+	return nil
+}
+
+// installDNS applies the CoreDNS config and node-local-dns
+func installDNS(platform *platform.Platform) error {
+	for _, zone := range platform.CoreDNS.StubZones {
+		if zone.Zone == "" || len(zone.Servers) == 0 {
+			return fmt.Errorf("install: stub zones require a zone and at least one server")
+		}
+	}
+
+	if err := platform.ApplySpecs("", "coredns.yaml"); err != nil {
+		platform.Errorf("Error deploying coredns config: %s", err)
+	}
+
+	if platform.NodeLocalDNS.Disabled {
+		return nil
+	}
+	if platform.NodeLocalDNS.DNSServer == "" {
+		client, err := platform.GetClientset()
+		if err != nil {
+			return fmt.Errorf("install: Failed to get clientset: %v", err)
+		}
+
+		kubeDNS, err := client.CoreV1().Services("kube-system").Get("kube-dns", metav1.GetOptions{})
+		if err != nil {
+			return fmt.Errorf("install: Failed to get service: %v", err)
+		}
+		platform.NodeLocalDNS.DNSServer = kubeDNS.Spec.ClusterIP
+	}
+
+	if err := platform.ApplySpecs("", "node-local-dns.yaml"); err != nil {
+		platform.Errorf("Error deploying node-local-dns: %s", err)
+	}
 	return nil
 }
@@ -2,6 +2,8 @@ package base
 
 import (
 	"fmt"
+	"sort"
+	"strings"
 	"time"
 
 	"k8s.io/apimachinery/pkg/api/errors"
@@ -47,6 +49,8 @@ func Test(platform *platform.Platform, test *console.TestResults) {
 		k8s.TestNamespace(client, "minio", test)
 	}
 
+	TestDNS(platform, test)
+
 	if platform.E2E {
 		TestPlatformOperatorAutoDeleteNamespace(platform, test)
 		TestPlatformOperatorPodAnnotations(platform, test)
@@ -355,6 +359,68 @@ func TestPlatformOperatorClusterResourceQuota2(p *platform.Platform, test *conso
 	test.Passf("platform-operator", "cluster resource quota test 2 passed")
 }
 
+// TestDNS resolves the kubernetes service, the hosts entries and a name in each stub zone from a pod
+func TestDNS(p *platform.Platform, test *console.TestResults) {
+	client, _ := p.GetClientset()
+	namespace := "kube-system"
+	name := fmt.Sprintf("dns-test-%s", utils.RandomString(6))
+	var grace int64
+	pod := &v1.Pod{
+		TypeMeta:   metav1.TypeMeta{Kind: "Pod", APIVersion: "v1"},
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+		Spec: v1.PodSpec{
+			RestartPolicy:                 v1.RestartPolicyNever,
+			TerminationGracePeriodSeconds: &grace,
+			Containers: []v1.Container{
+				{
+					Name:    "dns",
+					Image:   "docker.io/library/busybox:1.28.0-glibc",
+					Command: []string{"sleep", "3600"},
+				},
+			},
+		},
+	}
+	if _, err := client.CoreV1().Pods(namespace).Create(pod); err != nil {
+		test.Failf("dns", "failed to create pod %s: %v", name, err)
+		return
+	}
+	defer func() {
+		client.CoreV1().Pods(namespace).Delete(name, nil) // nolint: errcheck
+	}()
+	if err := p.WaitForPod(namespace, name, 2*time.Minute, v1.PodRunning); err != nil {
+		test.Failf("dns", "pod %s did not start: %v", name, err)
+		return
+	}
+
+	lookup := func(host, expected string) {
+		stdout, stderr, err := p.ExecutePodf(namespace, name, "dns", "nslookup", host)
+		if err != nil {
+			test.Failf("dns", "failed to resolve %s: %s %s", host, stdout, stderr)
+		} else if expected != "" && !strings.Contains(stdout, expected) {
+			test.Failf("dns", "expected %s to resolve to %s, got: %s", host, expected, stdout)
+		} else {
+			test.Passf("dns", "resolved %s", host)
+		}
+	}
+
+	lookup("kubernetes.default.svc."+p.NodeLocalDNS.DNSDomain, "")
+	var hosts []string
+	for host := range p.CoreDNS.Hosts {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	for _, host := range hosts {
+		lookup(host, p.CoreDNS.Hosts[host])
+	}
+	for _, zone := range p.CoreDNS.StubZones {
+		if zone.TestName == "" {
+			test.Skipf("dns", "no testName for stub zone %s", zone.Zone)
+			continue
+		}
+		lookup(zone.TestName, "")
+	}
+}
+
 // nolint: unparam
 func newResourceQuota(name, namespace, cpu, memory string) *v1.ResourceQuota {
 	rq := &v1.ResourceQuota{
@@ -0,0 +1,141 @@
+package beats
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"strconv"
+
+	"github.com/flanksource/karina/pkg/platform"
+	"github.com/flanksource/karina/pkg/types"
+	elastic "github.com/olivere/elastic/v7"
+	"github.com/pkg/errors"
+)
+
+// templateOrder is higher than the order of the templates loaded by beats, so that settings
+// applied by karina take precedence
+const templateOrder = 10
+
+// ApplyIndexLifecycle creates or updates the ILM policy and index template of beat in its elasticsearch output,
+// and bootstraps the rollover alias if it does not exist
+func ApplyIndexLifecycle(p *platform.Platform, beat Beat) error {
+	if beat.Elasticsearch == nil || (beat.ILM == nil && beat.IndexTemplate == nil) {
+		return nil
+	}
+	alias := beat.alias()
+	if p.DryRun {
+		p.Infof("[dry-run] Would apply index lifecycle for %s", alias)
+		return nil
+	}
+	client, err := newClient(*beat.Elasticsearch)
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+
+	if beat.ILM != nil {
+		if _, err := client.XPackIlmPutLifecycle().Policy(alias).BodyJson(Policy(*beat.ILM)).Do(ctx); err != nil {
+			return errors.Wrapf(err, "failed to apply ILM policy %s", alias)
+		}
+		p.Infof("Applied ILM policy %s", alias)
+	}
+
+	if _, err := client.IndexPutTemplate(alias + "-settings").BodyJson(Template(beat)).Do(ctx); err != nil {
+		return errors.Wrapf(err, "failed to apply index template %s-settings", alias)
+	}
+	p.Infof("Applied index template %s-settings", alias)
+
+	if beat.ILM == nil {
+		return nil
+	}
+	if _, err := client.Aliases().Alias(alias).Do(ctx); err == nil {
+		return nil
+	} else if !elastic.IsNotFound(err) {
+		return errors.Wrapf(err, "failed to get alias %s", alias)
+	}
+	index := alias + "-000001"
+	p.Infof("Creating index %s with write alias %s", index, alias)
+	_, err = client.CreateIndex(index).BodyJson(map[string]interface{}{
+		"aliases": map[string]interface{}{
+			alias: map[string]interface{}{"is_write_index": true},
+		},
+	}).Do(ctx)
+	return errors.Wrapf(err, "failed to create index %s", index)
+}
+
+// Policy returns an ILM policy that rolls over indices and then optionally force merges and deletes them
+func Policy(ilm types.BeatsILM) map[string]interface{} {
+	rollover := make(map[string]interface{})
+	if ilm.MaxSize != "" {
+		rollover["max_size"] = ilm.MaxSize
+	}
+	if ilm.MaxAge != "" {
+		rollover["max_age"] = ilm.MaxAge
+	}
+	if len(rollover) == 0 {
+		// the same defaults as the policy created by beats
+		rollover["max_size"] = "50gb"
+		rollover["max_age"] = "30d"
+	}
+	phases := map[string]interface{}{
+		"hot": map[string]interface{}{
+			"actions": map[string]interface{}{"rollover": rollover},
+		},
+	}
+	if ilm.WarmAfter != "" {
+		phases["warm"] = map[string]interface{}{
+			"min_age": ilm.WarmAfter,
+			"actions": map[string]interface{}{
+				"forcemerge": map[string]interface{}{"max_num_segments": 1},
+			},
+		}
+	}
+	if ilm.DeleteAfter != "" {
+		phases["delete"] = map[string]interface{}{
+			"min_age": ilm.DeleteAfter,
+			"actions": map[string]interface{}{"delete": map[string]interface{}{}},
+		}
+	}
+	return map[string]interface{}{
+		"policy": map[string]interface{}{"phases": phases},
+	}
+}
+
+// Template returns an index template that applies the index settings and lifecycle policy of beat to its indices
+func Template(beat Beat) map[string]interface{} {
+	settings := make(map[string]interface{})
+	if t := beat.IndexTemplate; t != nil {
+		if t.Shards > 0 {
+			settings["index.number_of_shards"] = strconv.Itoa(t.Shards)
+		}
+		if t.Replicas != nil {
+			settings["index.number_of_replicas"] = strconv.Itoa(*t.Replicas)
+		}
+		if t.RefreshInterval != "" {
+			settings["index.refresh_interval"] = t.RefreshInterval
+		}
+		for k, v := range t.Settings {
+			settings[k] = v
+		}
+	}
+	if beat.ILM != nil {
+		settings["index.lifecycle.name"] = beat.alias()
+		settings["index.lifecycle.rollover_alias"] = beat.alias()
+	}
+	return map[string]interface{}{
+		"index_patterns": []string{beat.alias() + "-*"},
+		"order":          templateOrder,
+		"settings":       settings,
+	}
+}
+
+func newClient(conn types.Connection) (*elastic.Client, error) {
+	httpClient := &http.Client{Transport: &http.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: conn.Verify != "true"}, // nolint: gosec
+	}}
+	return elastic.NewSimpleClient(
+		elastic.SetURL(conn.GetURL()),
+		elastic.SetBasicAuth(conn.User, conn.Password),
+		elastic.SetHttpClient(httpClient),
+	)
+}
@@ -0,0 +1,198 @@
+package beats
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/flanksource/karina/pkg/constants"
+	"github.com/flanksource/karina/pkg/platform"
+	"github.com/flanksource/karina/pkg/types"
+	"github.com/pkg/errors"
+	"gopkg.in/flanksource/yaml.v3"
+)
+
+// Beat is a beat deployed by karina, its output configuration is stored in a secret that is passed
+// to the beat as an additional config file
+type Beat struct {
+	// The type of beat e.g. filebeat
+	Type string
+	// The name of the beat, used to name the output secret, defaults to the type
+	Name string
+	// The index events are written to, defaults to the type when an ILM policy is specified
+	Index string
+	types.BeatsOutput
+	// Additional settings merged into the output configuration e.g. setup.kibana
+	Settings map[string]interface{}
+}
+
+func (beat Beat) SecretName() string {
+	name := beat.Name
+	if name == "" {
+		name = beat.Type
+	}
+	return name + "-output"
+}
+
+// alias returns the index or rollover alias events are written to
+func (beat Beat) alias() string {
+	if beat.Index != "" {
+		return beat.Index
+	}
+	return beat.Type
+}
+
+// HasOutput returns true if the beat specifies an output, beats without an output are skipped by their phases
+func (beat Beat) HasOutput() bool {
+	return countOutputs(beat.BeatsOutput) > 0
+}
+
+func countOutputs(output types.BeatsOutput) int {
+	outputs := 0
+	for _, set := range []bool{output.Elasticsearch != nil, output.Logstash != nil, output.Kafka != nil, output.File != nil} {
+		if set {
+			outputs++
+		}
+	}
+	return outputs
+}
+
+// WithDefaultOutput returns the elasticsearch output of the infra filebeat if output does not specify one,
+// output is returned unchanged if there is no infra filebeat with an elasticsearch output
+func WithDefaultOutput(p *platform.Platform, output types.BeatsOutput) types.BeatsOutput {
+	if countOutputs(output) > 0 {
+		return output
+	}
+	for _, f := range p.Filebeat {
+		if f.Name == "infra" {
+			output.Elasticsearch = f.Elasticsearch
+		}
+	}
+	return output
+}
+
+// Deploy creates or updates the output secret of the beat and applies any index lifecycle policy and template
+func Deploy(p *platform.Platform, beat Beat) error {
+	config, err := Config(beat)
+	if err != nil {
+		return fmt.Errorf("invalid %s output: %v", beat.SecretName(), err)
+	}
+	data, err := yaml.Marshal(config)
+	if err != nil {
+		return err
+	}
+	if err := p.CreateOrUpdateSecret(beat.SecretName(), constants.PlatformSystem, map[string][]byte{
+		"output.yml": data,
+	}); err != nil {
+		return errors.Wrapf(err, "failed to create secret %s", beat.SecretName())
+	}
+	return ApplyIndexLifecycle(p, beat)
+}
+
+// Config returns the beats configuration for the output of beat
+func Config(beat Beat) (map[string]interface{}, error) {
+	outputs := countOutputs(beat.BeatsOutput)
+	if outputs == 0 {
+		return nil, fmt.Errorf("one of elasticsearch, logstash, kafka or file must be specified")
+	}
+	if outputs > 1 {
+		return nil, fmt.Errorf("only one of elasticsearch, logstash, kafka or file can be specified")
+	}
+	if (beat.ILM != nil || beat.IndexTemplate != nil) && beat.Elasticsearch == nil {
+		return nil, fmt.Errorf("ilm and indexTemplate require an elasticsearch output")
+	}
+
+	config := make(map[string]interface{})
+	for k, v := range beat.Settings {
+		config[k] = v
+	}
+	switch {
+	case beat.Elasticsearch != nil:
+		es := map[string]interface{}{
+			"hosts":                   []string{beat.Elasticsearch.GetURL()},
+			"username":                beat.Elasticsearch.User,
+			"password":                beat.Elasticsearch.Password,
+			"ssl.verification_mode":   verificationMode(*beat.Elasticsearch),
+			"ssl.supported_protocols": []string{"TLSv1.2", "TLSv1.3"},
+		}
+		if !strings.Contains(beat.Elasticsearch.GetURL(), "://") {
+			es["protocol"] = "https"
+		}
+		if beat.ILM != nil {
+			// karina manages the policy and the rollover alias, so the beat only writes to the alias
+			es["index"] = beat.alias()
+			config["setup.ilm.enabled"] = false
+			config["setup.template.name"] = beat.alias()
+			config["setup.template.pattern"] = beat.alias() + "-*"
+		} else if beat.Index != "" {
+			es["index"] = beat.Index + "-%{[agent.version]}-%{+yyyy.MM.dd}"
+			config["setup.template.name"] = beat.Index
+			config["setup.template.pattern"] = beat.Index + "-*"
+			config["setup.template.enabled"] = false
+			config["setup.ilm.rollover_alias"] = beat.Index + "-%{[agent.version]}"
+		}
+		config["output.elasticsearch"] = es
+	case beat.Logstash != nil:
+		logstash := map[string]interface{}{
+			"hosts": []string{hostPort(*beat.Logstash)},
+		}
+		if beat.Logstash.Scheme == "https" || strings.HasPrefix(beat.Logstash.URL, "https://") {
+			logstash["ssl.enabled"] = true
+			logstash["ssl.verification_mode"] = verificationMode(*beat.Logstash)
+		}
+		config["output.logstash"] = logstash
+	case beat.Kafka != nil:
+		if len(beat.Kafka.Brokers) == 0 || beat.Kafka.Topic == "" {
+			return nil, fmt.Errorf("kafka brokers and topic must be specified")
+		}
+		kafka := map[string]interface{}{
+			"hosts": beat.Kafka.Brokers,
+			"topic": beat.Kafka.Topic,
+		}
+		if beat.Kafka.User != "" {
+			kafka["username"] = beat.Kafka.User
+			kafka["password"] = beat.Kafka.Password
+		}
+		if beat.Kafka.Version != "" {
+			kafka["version"] = beat.Kafka.Version
+		}
+		if beat.Kafka.TLS {
+			kafka["ssl.enabled"] = true
+		}
+		config["output.kafka"] = kafka
+	case beat.File != nil:
+		if beat.File.Path == "" {
+			return nil, fmt.Errorf("file path must be specified")
+		}
+		file := map[string]interface{}{
+			"path":     beat.File.Path,
+			"filename": beat.Type,
+		}
+		if beat.File.Filename != "" {
+			file["filename"] = beat.File.Filename
+		}
+		if beat.File.RotateEveryKB > 0 {
+			file["rotate_every_kb"] = beat.File.RotateEveryKB
+		}
+		if beat.File.NumberOfFiles > 0 {
+			file["number_of_files"] = beat.File.NumberOfFiles
+		}
+		config["output.file"] = file
+	}
+	return config, nil
+}
+
+func verificationMode(conn types.Connection) string {
+	if conn.Verify == "true" {
+		return "full"
+	}
+	return "none"
+}
+
+// hostPort returns host:port without a scheme, as expected by the logstash output
+func hostPort(conn types.Connection) string {
+	url := conn.GetURL()
+	if i := strings.Index(url, "://"); i >= 0 {
+		url = url[i+3:]
+	}
+	return strings.TrimSuffix(url, "/")
+}
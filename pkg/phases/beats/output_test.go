@@ -0,0 +1,93 @@
+package beats
+
+import (
+	"testing"
+
+	"github.com/flanksource/karina/pkg/platform"
+	"github.com/flanksource/karina/pkg/types"
+	. "github.com/onsi/gomega"
+)
+
+func TestConfig(t *testing.T) {
+	g := NewWithT(t)
+	es := &types.Connection{URL: "logs.example.com", Port: "9200", Scheme: "https", User: "elastic", Password: "secret"}
+
+	config, err := Config(Beat{Type: "filebeat", Index: "filebeat-infra", BeatsOutput: types.BeatsOutput{Elasticsearch: es}})
+	g.Expect(err).ToNot(HaveOccurred())
+	output := config["output.elasticsearch"].(map[string]interface{})
+	g.Expect(output["hosts"]).To(Equal([]string{"https://logs.example.com:9200"}))
+	g.Expect(output["index"]).To(Equal("filebeat-infra-%{[agent.version]}-%{+yyyy.MM.dd}"))
+	g.Expect(output).ToNot(HaveKey("protocol"))
+	g.Expect(config["setup.template.enabled"]).To(Equal(false))
+
+	config, err = Config(Beat{Type: "journalbeat", BeatsOutput: types.BeatsOutput{Elasticsearch: es, ILM: &types.BeatsILM{DeleteAfter: "30d"}}})
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(config["output.elasticsearch"]).To(HaveKeyWithValue("index", "journalbeat"))
+	g.Expect(config["setup.ilm.enabled"]).To(Equal(false))
+	g.Expect(config["setup.template.pattern"]).To(Equal("journalbeat-*"))
+
+	config, err = Config(Beat{Type: "auditbeat", BeatsOutput: types.BeatsOutput{Logstash: &types.Connection{URL: "logstash", Port: "5044"}}})
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(config["output.logstash"]).To(Equal(map[string]interface{}{"hosts": []string{"logstash:5044"}}))
+
+	config, err = Config(Beat{Type: "packetbeat", BeatsOutput: types.BeatsOutput{Kafka: &types.KafkaOutput{Brokers: []string{"kafka:9092"}, Topic: "beats", TLS: true}}})
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(config["output.kafka"]).To(Equal(map[string]interface{}{"hosts": []string{"kafka:9092"}, "topic": "beats", "ssl.enabled": true}))
+
+	config, err = Config(Beat{Type: "packetbeat", BeatsOutput: types.BeatsOutput{File: &types.FileOutput{Path: "/var/log/packetbeat"}}})
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(config["output.file"]).To(Equal(map[string]interface{}{"path": "/var/log/packetbeat", "filename": "packetbeat"}))
+
+	_, err = Config(Beat{Type: "filebeat"})
+	g.Expect(err).To(HaveOccurred())
+	_, err = Config(Beat{Type: "filebeat", BeatsOutput: types.BeatsOutput{Elasticsearch: es, Logstash: es}})
+	g.Expect(err).To(HaveOccurred())
+	_, err = Config(Beat{Type: "filebeat", BeatsOutput: types.BeatsOutput{Logstash: es, ILM: &types.BeatsILM{}}})
+	g.Expect(err).To(HaveOccurred())
+}
+
+func TestDefaultOutput(t *testing.T) {
+	g := NewWithT(t)
+	p := &platform.Platform{}
+	beat := Beat{Type: "journalbeat", BeatsOutput: WithDefaultOutput(p, types.BeatsOutput{})}
+	g.Expect(beat.HasOutput()).To(BeFalse())
+
+	es := &types.Connection{URL: "logs.example.com", Port: "9200"}
+	p.Filebeat = []types.Filebeat{{Name: "infra", BeatsOutput: types.BeatsOutput{Elasticsearch: es}}}
+	beat = Beat{Type: "journalbeat", BeatsOutput: WithDefaultOutput(p, types.BeatsOutput{})}
+	g.Expect(beat.HasOutput()).To(BeTrue())
+	g.Expect(beat.Elasticsearch).To(Equal(es))
+
+	kafka := &types.KafkaOutput{Brokers: []string{"kafka:9092"}, Topic: "beats"}
+	beat = Beat{Type: "journalbeat", BeatsOutput: WithDefaultOutput(p, types.BeatsOutput{Kafka: kafka})}
+	g.Expect(beat.Elasticsearch).To(BeNil())
+	g.Expect(beat.Kafka).To(Equal(kafka))
+}
+
+func TestTemplateAndPolicy(t *testing.T) {
+	g := NewWithT(t)
+	replicas := 0
+	beat := Beat{Type: "filebeat", Index: "filebeat-infra", BeatsOutput: types.BeatsOutput{
+		ILM:           &types.BeatsILM{MaxAge: "1d", DeleteAfter: "30d"},
+		IndexTemplate: &types.BeatsIndexTemplate{Shards: 2, Replicas: &replicas, Settings: map[string]string{"index.codec": "best_compression"}},
+	}}
+	g.Expect(Template(beat)).To(Equal(map[string]interface{}{
+		"index_patterns": []string{"filebeat-infra-*"},
+		"order":          templateOrder,
+		"settings": map[string]interface{}{
+			"index.number_of_shards":         "2",
+			"index.number_of_replicas":       "0",
+			"index.codec":                    "best_compression",
+			"index.lifecycle.name":           "filebeat-infra",
+			"index.lifecycle.rollover_alias": "filebeat-infra",
+		},
+	}))
+
+	phases := Policy(*beat.ILM)["policy"].(map[string]interface{})["phases"].(map[string]interface{})
+	g.Expect(phases).To(HaveKey("hot"))
+	g.Expect(phases).ToNot(HaveKey("warm"))
+	g.Expect(phases["hot"]).To(Equal(map[string]interface{}{
+		"actions": map[string]interface{}{"rollover": map[string]interface{}{"max_age": "1d"}},
+	}))
+	g.Expect(phases["delete"]).To(HaveKeyWithValue("min_age", "30d"))
+}
@@ -0,0 +1,186 @@
+package consul
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/flanksource/commons/console"
+	"github.com/flanksource/commons/utils"
+	"github.com/flanksource/karina/pkg/k8s"
+	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// The number of restored keys that are compared against the live consul cluster
+const verifySampleSize = 10
+
+type kvPair struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// LatestBackup returns the s3:// URL of the most recent snapshot for this consul deployment
+func (b *BackupRestore) LatestBackup() (string, error) {
+	client, err := b.GetAWSS3Client()
+	if err != nil {
+		return "", err
+	}
+	bucket := b.Vault.Consul.Bucket
+	prefix := fmt.Sprintf("consul/backups/%s/%s/", b.Namespace, b.Name)
+
+	var latest *s3.Object
+	err = client.ListObjectsPages(&s3.ListObjectsInput{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(prefix),
+	}, func(page *s3.ListObjectsOutput, last bool) bool {
+		for _, obj := range page.Contents {
+			if latest == nil || aws.TimeValue(obj.LastModified).After(aws.TimeValue(latest.LastModified)) {
+				latest = obj
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return "", errors.Wrap(err, "failed to list snapshots in s3")
+	}
+	if latest == nil {
+		return "", errors.Errorf("no snapshots found in s3://%s/%s", bucket, prefix)
+	}
+	return fmt.Sprintf("s3://%s/%s", bucket, aws.StringValue(latest.Key)), nil
+}
+
+// Verify restores the latest snapshot into a scratch single-node consul instance running
+// in a temporary namespace and compares a sample of the restored keys with the live cluster,
+// sampled keys that differ fail the verification unless allowDrift is set
+func (b *BackupRestore) Verify(test *console.TestResults, allowDrift bool) {
+	if b.Vault == nil || b.Vault.Disabled {
+		test.Skipf("consul", "Consul is disabled")
+		return
+	}
+	snapshot, err := b.LatestBackup()
+	if err != nil {
+		test.Failf("consul", "failed to find latest snapshot: %v", err)
+		return
+	}
+	test.Passf("consul", "found snapshot %s", snapshot)
+
+	namespace := "consul-verify-" + utils.RandomString(6)
+	scratch := NewBackupRestore(b.Platform, "consul-verify", namespace)
+	defer func() {
+		client, err := b.GetClientset()
+		if err != nil {
+			test.Warnf("failed to get k8s client %v", err)
+			return
+		}
+		if err := client.CoreV1().Namespaces().Delete(namespace, nil); err != nil {
+			test.Warnf("failed to delete namespace %s: %v", namespace, err)
+		}
+	}()
+
+	if err := scratch.deployScratch(b.Namespace); err != nil {
+		test.Failf("consul", "failed to deploy scratch consul instance: %v", err)
+		return
+	}
+	pod := scratch.Name + "-0"
+	if err := b.WaitForPodCommand(namespace, pod, "consul", 2*time.Minute, "consul", "members"); err != nil {
+		test.Failf("consul", "scratch consul instance did not become ready: %v", err)
+		return
+	}
+	test.Passf("consul", "deployed scratch consul instance %s/%s", namespace, pod)
+
+	if err := scratch.Restore(snapshot); err != nil {
+		test.Failf("consul", "failed to restore %s: %v", snapshot, err)
+		return
+	}
+
+	stdout, _, err := b.ExecutePodf(namespace, pod, "consul", "consul", "kv", "export")
+	if err != nil {
+		test.Failf("consul", "failed to export restored keys: %v", err)
+		return
+	}
+	var pairs []kvPair
+	if err := json.Unmarshal([]byte(stdout), &pairs); err != nil {
+		test.Failf("consul", "failed to parse restored keys: %v", err)
+		return
+	}
+	if len(pairs) == 0 {
+		test.Failf("consul", "no keys were restored from %s", snapshot)
+		return
+	}
+
+	sampled := 0
+	var drift []string
+	for _, pair := range pairs {
+		if sampled >= verifySampleSize {
+			break
+		}
+		sampled++
+		value, err := base64.StdEncoding.DecodeString(pair.Value)
+		if err != nil {
+			drift = append(drift, fmt.Sprintf("failed to decode restored key %s: %v", pair.Key, err))
+			continue
+		}
+		if getConsulValue(b.Platform, b.Namespace, b.Name+"-0", "consul", pair.Key) != strings.TrimSuffix(string(value), "\n") {
+			drift = append(drift, fmt.Sprintf("key %s has changed since the snapshot was taken", pair.Key))
+		}
+	}
+	if len(drift) > 0 && !allowDrift {
+		test.Failf("consul", "%d/%d sampled keys restored from %s do not match %s/%s: %s", len(drift), sampled, snapshot, b.Namespace, b.Name, strings.Join(drift, ", "))
+		return
+	}
+	for _, msg := range drift {
+		test.Warnf("%s", msg)
+	}
+	test.Passf("consul", "restored %d keys from %s, %d/%d sampled keys match %s/%s", len(pairs), snapshot, sampled-len(drift), sampled, b.Namespace, b.Name)
+}
+
+// deployScratch deploys a single in-memory consul server that is addressable
+// at the same DNS name the backup jobs use for a consul statefulset
+func (b *BackupRestore) deployScratch(sourceNamespace string) error {
+	if err := b.CreateOrUpdateNamespace(b.Namespace, nil, nil); err != nil {
+		return err
+	}
+	secret := b.GetSecret(sourceNamespace, "consul-backup-config")
+	if secret == nil {
+		return fmt.Errorf("secret %s/consul-backup-config not found", sourceNamespace)
+	}
+	if err := b.CreateOrUpdateSecret("consul-backup-config", b.Namespace, *secret); err != nil {
+		return err
+	}
+
+	version := b.Vault.Consul.Version
+	if version == "" {
+		version = "1.7.1"
+	}
+	labels := map[string]string{
+		"app":       "consul",
+		"component": b.Name,
+	}
+	pod := k8s.Deployment(b.Name+"-0", "consul:"+version).
+		Command("consul", "agent", "-dev", "-client=0.0.0.0", "-bind=0.0.0.0").
+		Labels(labels).
+		Ports(8500).
+		AsOneShotJob()
+	pod.Namespace = b.Namespace
+	pod.Labels = labels
+	pod.Spec.Hostname = b.Name + "-0"
+	pod.Spec.Subdomain = b.Name
+	pod.Spec.Containers[0].Name = "consul"
+
+	service := &v1.Service{
+		TypeMeta:   metav1.TypeMeta{Kind: "Service", APIVersion: "v1"},
+		ObjectMeta: metav1.ObjectMeta{Name: b.Name, Namespace: b.Namespace},
+		Spec: v1.ServiceSpec{
+			ClusterIP: v1.ClusterIPNone,
+			Selector:  labels,
+			Ports:     []v1.ServicePort{{Name: "http", Port: 8500}},
+		},
+	}
+	return b.Apply(b.Namespace, service, pod)
+}
@@ -0,0 +1,308 @@
+package custom
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/flanksource/commons/console"
+	"github.com/flanksource/commons/text"
+	"github.com/flanksource/karina/pkg/k8s"
+	"github.com/flanksource/karina/pkg/phases/helm"
+	"github.com/flanksource/karina/pkg/platform"
+	"github.com/flanksource/karina/pkg/types"
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+const defaultTimeout = 5 * time.Minute
+
+// Get returns the custom phase with name, or nil if there is none
+func Get(p *platform.Platform, name string) *types.CustomPhase {
+	for i, phase := range p.CustomPhases {
+		if phase.Name == name {
+			return &p.CustomPhases[i]
+		}
+	}
+	return nil
+}
+
+// Validate returns an error if a custom phase has no name or the same name as another custom
+// phase or one of the reserved names of the built-in phases
+func Validate(p *platform.Platform, reserved ...string) error {
+	names := make(map[string]bool)
+	for _, name := range reserved {
+		names[name] = true
+	}
+	for _, phase := range p.CustomPhases {
+		if phase.Name == "" {
+			return fmt.Errorf("custom phases must specify a name")
+		}
+		if names[phase.Name] {
+			return fmt.Errorf("custom phase %s has the same name as another phase", phase.Name)
+		}
+		names[phase.Name] = true
+	}
+	return nil
+}
+
+// Order returns the enabled custom phases ordered so that each phase comes after the custom
+// phases it depends on, dependencies on built-in phases are ignored. If names are specified
+// only the named phases and the custom phases they depend on are returned.
+func Order(p *platform.Platform, names ...string) ([]types.CustomPhase, error) {
+	var ordered []types.CustomPhase
+	state := make(map[string]string)
+	var visit func(phase types.CustomPhase) error
+	visit = func(phase types.CustomPhase) error {
+		switch state[phase.Name] {
+		case "visited":
+			return nil
+		case "visiting":
+			return fmt.Errorf("custom phase %s has a circular dependency", phase.Name)
+		}
+		state[phase.Name] = "visiting"
+		for _, dependency := range phase.DependsOn {
+			if dep := Get(p, dependency); dep != nil && !dep.Disabled {
+				if err := visit(*dep); err != nil {
+					return err
+				}
+			}
+		}
+		state[phase.Name] = "visited"
+		ordered = append(ordered, phase)
+		return nil
+	}
+	for _, name := range names {
+		phase := Get(p, name)
+		if phase == nil {
+			return nil, fmt.Errorf("unknown custom phase %s", name)
+		}
+		if err := visit(*phase); err != nil {
+			return nil, err
+		}
+	}
+	if len(names) > 0 {
+		return ordered, nil
+	}
+	for _, phase := range p.CustomPhases {
+		if phase.Disabled {
+			continue
+		}
+		if err := visit(phase); err != nil {
+			return nil, err
+		}
+	}
+	return ordered, nil
+}
+
+// Deploy applies the manifests and chart of a custom phase and optionally waits for them to become ready,
+// the manifests and chart of a disabled phase are deleted
+func Deploy(p *platform.Platform, phase types.CustomPhase) error {
+	if phase.Disabled {
+		if err := Delete(p, phase); err != nil {
+			p.Warnf("failed to delete %s: %v", phase.Name, err)
+		}
+		return nil
+	}
+	if phase.Namespace == "" {
+		return fmt.Errorf("custom phase %s must specify a namespace", phase.Name)
+	}
+	specs, err := render(p, phase)
+	if err != nil {
+		return err
+	}
+	if len(specs) == 0 {
+		return fmt.Errorf("custom phase %s has no manifests or chart", phase.Name)
+	}
+	if err := p.CreateOrUpdateNamespace(phase.Namespace, nil, nil); err != nil {
+		return err
+	}
+
+	var objects []unstructured.Unstructured
+	for _, spec := range specs {
+		if err := p.ApplyText(phase.Namespace, spec); err != nil {
+			return err
+		}
+		items, err := k8s.GetUnstructuredObjects([]byte(spec))
+		if err != nil {
+			return err
+		}
+		objects = append(objects, items...)
+	}
+
+	if !phase.Wait {
+		return nil
+	}
+	timeout, err := getTimeout(phase)
+	if err != nil {
+		return err
+	}
+	p.Infof("Waiting up to %v for %s to become ready", timeout, phase.Name)
+	return p.WaitForReady(phase.Namespace, timeout, objects...)
+}
+
+// Delete deletes the objects in the manifests and chart of a custom phase
+func Delete(p *platform.Platform, phase types.CustomPhase) error {
+	if phase.Namespace == "" {
+		return fmt.Errorf("custom phase %s must specify a namespace", phase.Name)
+	}
+	specs, err := render(p, phase)
+	if err != nil {
+		return err
+	}
+	for i := len(specs) - 1; i >= 0; i-- {
+		if err := helm.DeleteText(p, phase.Namespace, specs[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// render returns the templated manifests and chart of a phase
+func render(p *platform.Platform, phase types.CustomPhase) ([]string, error) {
+	var specs []string
+	if phase.Manifests != "" {
+		err := filepath.Walk(phase.Manifests, func(path string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() {
+				return err
+			}
+			name := strings.TrimSuffix(info.Name(), ".raw")
+			if ext := filepath.Ext(name); ext != ".yaml" && ext != ".yml" && ext != ".json" {
+				return nil
+			}
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			spec := string(data)
+			if !strings.HasSuffix(info.Name(), ".raw") {
+				if spec, err = text.Template(spec, p.PlatformConfig); err != nil {
+					return errors.Wrapf(err, "failed to template %s", path)
+				}
+			}
+			specs = append(specs, spec)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if phase.Chart != nil {
+		chart := *phase.Chart
+		if chart.Name == "" {
+			chart.Name = phase.Name
+		}
+		if chart.Namespace == "" {
+			chart.Namespace = phase.Namespace
+		}
+		spec, err := helm.Template(p, chart)
+		if err != nil {
+			return nil, err
+		}
+		specs = append(specs, spec)
+	}
+	return specs, nil
+}
+
+func getTimeout(phase types.CustomPhase) (time.Duration, error) {
+	if phase.Timeout == "" {
+		return defaultTimeout, nil
+	}
+	timeout, err := time.ParseDuration(phase.Timeout)
+	if err != nil {
+		return 0, errors.Wrapf(err, "invalid timeout for %s", phase.Name)
+	}
+	return timeout, nil
+}
+
+// Test checks the pods in the namespace of a custom phase, the test urls and runs the test job
+func Test(p *platform.Platform, test *console.TestResults, phase types.CustomPhase) {
+	if phase.Disabled {
+		test.Skipf(phase.Name, "%s is disabled", phase.Name)
+		return
+	}
+	if !phase.Test.SkipPods {
+		client, err := p.GetClientset()
+		if err != nil {
+			test.Failf(phase.Name, "Failed to get clientset: %v", err)
+			return
+		}
+		k8s.TestNamespace(client, phase.Namespace, test)
+	}
+
+	client := &http.Client{
+		Timeout:   30 * time.Second,
+		Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}},
+	}
+	for _, url := range phase.Test.URLs {
+		url, err := text.Template(url, p.PlatformConfig)
+		if err != nil {
+			test.Failf(phase.Name, "Invalid url %s: %v", url, err)
+			continue
+		}
+		resp, err := client.Get(url)
+		if err != nil {
+			test.Failf(phase.Name, "GET %s failed: %v", url, err)
+			continue
+		}
+		resp.Body.Close() // nolint: errcheck
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			test.Failf(phase.Name, "GET %s returned %s", url, resp.Status)
+		} else {
+			test.Passf(phase.Name, "GET %s returned %s", url, resp.Status)
+		}
+	}
+
+	if phase.Test.Job != "" {
+		if err := runJob(p, phase); err != nil {
+			test.Failf(phase.Name, "Test job %s failed: %v", phase.Test.Job, err)
+		} else {
+			test.Passf(phase.Name, "Test job %s completed", phase.Test.Job)
+		}
+	}
+}
+
+// runJob recreates the test job and waits for it to complete
+func runJob(p *platform.Platform, phase types.CustomPhase) error {
+	data, err := ioutil.ReadFile(phase.Test.Job)
+	if err != nil {
+		return err
+	}
+	spec, err := text.Template(string(data), p.PlatformConfig)
+	if err != nil {
+		return err
+	}
+	objects, err := k8s.GetUnstructuredObjects([]byte(spec))
+	if err != nil {
+		return err
+	}
+	for i := range objects {
+		job := &objects[i]
+		if job.GetNamespace() == "" {
+			job.SetNamespace(phase.Namespace)
+		}
+		// jobs are immutable, so any previous run is deleted first
+		existing := job.DeepCopy()
+		if err := p.Get(job.GetNamespace(), job.GetName(), existing); err == nil {
+			if err := p.DeleteUnstructured(job.GetNamespace(), existing); err != nil {
+				return err
+			}
+			for i := 0; i < 12 && p.Get(job.GetNamespace(), job.GetName(), existing) == nil; i++ {
+				time.Sleep(5 * time.Second)
+			}
+		}
+		if err := p.ApplyUnstructured(job.GetNamespace(), job); err != nil {
+			return err
+		}
+	}
+	timeout, err := getTimeout(phase)
+	if err != nil {
+		return err
+	}
+	return p.WaitForReady(phase.Namespace, timeout, objects...)
+}
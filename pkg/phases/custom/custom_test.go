@@ -0,0 +1,54 @@
+package custom
+
+import (
+	"testing"
+
+	"github.com/flanksource/karina/pkg/platform"
+	"github.com/flanksource/karina/pkg/types"
+	. "github.com/onsi/gomega"
+)
+
+func phases(phases ...types.CustomPhase) *platform.Platform {
+	return &platform.Platform{PlatformConfig: types.PlatformConfig{CustomPhases: phases}}
+}
+
+func TestValidate(t *testing.T) {
+	g := NewWithT(t)
+	g.Expect(Validate(phases(types.CustomPhase{Name: "billing"}, types.CustomPhase{Name: "reports"}), "harbor")).To(Succeed())
+	g.Expect(Validate(phases(types.CustomPhase{Name: "harbor"}), "harbor")).To(MatchError(ContainSubstring("harbor")))
+	g.Expect(Validate(phases(types.CustomPhase{Name: "billing"}, types.CustomPhase{Name: "billing"}))).To(MatchError(ContainSubstring("billing")))
+	g.Expect(Validate(phases(types.CustomPhase{Namespace: "billing"}))).ToNot(Succeed())
+}
+
+func TestOrder(t *testing.T) {
+	g := NewWithT(t)
+	p := phases(
+		types.CustomPhase{Name: "billing", DependsOn: []string{"monitoring", "db"}},
+		types.CustomPhase{Name: "db", DependsOn: []string{"postgres-operator"}},
+		types.CustomPhase{Name: "reports", DependsOn: []string{"billing"}},
+		types.CustomPhase{Name: "unused"},
+		types.CustomPhase{Name: "disabled", Disabled: true},
+	)
+	names := func(phases []types.CustomPhase) []string {
+		var list []string
+		for _, phase := range phases {
+			list = append(list, phase.Name)
+		}
+		return list
+	}
+
+	ordered, err := Order(p)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(names(ordered)).To(Equal([]string{"db", "billing", "reports", "unused"}))
+
+	ordered, err = Order(p, "reports")
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(names(ordered)).To(Equal([]string{"db", "billing", "reports"}))
+
+	_, err = Order(p, "missing")
+	g.Expect(err).To(MatchError(ContainSubstring("unknown custom phase missing")))
+
+	p.CustomPhases[1].DependsOn = []string{"reports"}
+	_, err = Order(p, "reports")
+	g.Expect(err).To(MatchError(ContainSubstring("circular dependency")))
+}
@@ -26,5 +26,36 @@ func Deploy(p *platform.Platform) error {
 		p.Elasticsearch.Replicas = 3
 	}
 
-	return p.ApplySpecs(Namespace, "elasticsearch.yaml")
+	if p.Elasticsearch.Snapshots != nil {
+		if err := defaultSnapshots(p); err != nil {
+			return err
+		}
+		if err := p.GetOrCreateBucket(p.Elasticsearch.Snapshots.Bucket); err != nil {
+			return err
+		}
+		// added to the elasticsearch keystore by ECK
+		if err := p.CreateOrUpdateSecret(ClusterName+"-es-s3-credentials", Namespace, map[string][]byte{
+			"s3.client.default.access_key": []byte(p.S3.AccessKey),
+			"s3.client.default.secret_key": []byte(p.S3.SecretKey),
+		}); err != nil {
+			return err
+		}
+	}
+
+	if err := p.ApplySpecs(Namespace, "elasticsearch.yaml"); err != nil {
+		return err
+	}
+
+	if p.Elasticsearch.Snapshots == nil || p.DryRun {
+		return nil
+	}
+	client, err := NewClient(p)
+	if err == nil {
+		err = ConfigureSnapshots(client, *p.Elasticsearch.Snapshots)
+	}
+	if err != nil {
+		// elasticsearch is restarted to install the repository-s3 plugin, so it may not be available yet
+		p.Warnf("Failed to configure snapshots, they will be configured on the next deploy: %v", err)
+	}
+	return nil
 }
@@ -0,0 +1,219 @@
+package elasticsearch
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/flanksource/karina/pkg/k8s/proxy"
+	"github.com/flanksource/karina/pkg/platform"
+	"github.com/flanksource/karina/pkg/types"
+	elastic "github.com/olivere/elastic/v7"
+	"github.com/pkg/errors"
+)
+
+const (
+	ClusterName = "logs"
+	// Repository is the name of the S3 snapshot repository registered in elasticsearch
+	Repository = "s3"
+)
+
+// NewClient returns a client for the logs cluster, connected to the first elasticsearch pod as the elastic user
+func NewClient(p *platform.Platform) (*elastic.Client, error) {
+	pod, err := p.GetFirstPodByLabelSelector(Namespace, fmt.Sprintf("common.k8s.elastic.co/type=elasticsearch,elasticsearch.k8s.elastic.co/cluster-name=%s", ClusterName))
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to find elasticsearch pod")
+	}
+	dialer, err := p.GetProxyDialer(proxy.Proxy{
+		Namespace:    Namespace,
+		Kind:         "pods",
+		ResourceName: pod.Name,
+		Port:         9200,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get proxy dialer")
+	}
+	secret := p.GetSecret(Namespace, fmt.Sprintf("%s-es-elastic-user", ClusterName))
+	if secret == nil {
+		return nil, fmt.Errorf("unable to get password for elastic user")
+	}
+	httpClient := &http.Client{Transport: &http.Transport{
+		DialContext:     dialer.DialContext,
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true}, // nolint: gosec
+	}}
+	return elastic.NewSimpleClient(
+		elastic.SetURL(fmt.Sprintf("https://%s-es-http:9200", ClusterName)),
+		elastic.SetBasicAuth("elastic", string((*secret)["elastic"])),
+		elastic.SetHttpClient(httpClient),
+	)
+}
+
+// defaultSnapshots fills in the bucket, path and endpoint of the snapshot repository from the platform S3 config
+func defaultSnapshots(p *platform.Platform) error {
+	snapshots := p.Elasticsearch.Snapshots
+	if snapshots.Bucket == "" {
+		snapshots.Bucket = p.S3.Bucket
+	}
+	if snapshots.Bucket == "" {
+		return fmt.Errorf("elasticsearch.snapshots.bucket or s3.bucket must be specified")
+	}
+	if snapshots.BasePath == "" {
+		snapshots.BasePath = "elasticsearch/" + p.Name
+	}
+	if snapshots.Endpoint == "" {
+		snapshots.Endpoint = p.S3.Endpoint
+	}
+	return nil
+}
+
+// ConfigureSnapshots registers the S3 snapshot repository and creates or updates the snapshot lifecycle policies
+func ConfigureSnapshots(client *elastic.Client, snapshots types.ElasticsearchSnapshots) error {
+	ctx := context.Background()
+	if _, err := client.SnapshotCreateRepository(Repository).
+		Type("s3").
+		Settings(map[string]interface{}{
+			"bucket":    snapshots.Bucket,
+			"base_path": snapshots.BasePath,
+		}).
+		Do(ctx); err != nil {
+		return errors.Wrapf(err, "failed to register snapshot repository %s", Repository)
+	}
+	for _, policy := range snapshots.Policies {
+		if _, err := client.PerformRequest(ctx, elastic.PerformRequestOptions{
+			Method: "PUT",
+			Path:   "/_slm/policy/" + policy.Name,
+			Body:   Policy(policy),
+		}); err != nil {
+			return errors.Wrapf(err, "failed to apply snapshot policy %s", policy.Name)
+		}
+	}
+	return nil
+}
+
+// Policy returns the body of a snapshot lifecycle policy
+func Policy(policy types.ElasticsearchSnapshotPolicy) map[string]interface{} {
+	indices := policy.Indices
+	if len(indices) == 0 {
+		indices = []string{"*"}
+	}
+	body := map[string]interface{}{
+		"schedule":   policy.Schedule,
+		"name":       fmt.Sprintf("<%s-{now/d}>", policy.Name),
+		"repository": Repository,
+		"config": map[string]interface{}{
+			"indices":              indices,
+			"include_global_state": false,
+		},
+	}
+	retention := make(map[string]interface{})
+	if policy.ExpireAfter != "" {
+		retention["expire_after"] = policy.ExpireAfter
+	}
+	if policy.MinCount > 0 {
+		retention["min_count"] = policy.MinCount
+	}
+	if policy.MaxCount > 0 {
+		retention["max_count"] = policy.MaxCount
+	}
+	if len(retention) > 0 {
+		body["retention"] = retention
+	}
+	return body
+}
+
+// Snapshot creates a snapshot of indices, or of all indices if none are specified
+func Snapshot(client *elastic.Client, name string, indices []string, wait bool) (*elastic.Snapshot, error) {
+	body := map[string]interface{}{"include_global_state": false}
+	if len(indices) > 0 {
+		body["indices"] = strings.Join(indices, ",")
+	}
+	resp, err := client.SnapshotCreate(Repository, name).BodyJson(body).WaitForCompletion(wait).Do(context.Background())
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to create snapshot %s", name)
+	}
+	// the snapshot is only returned when waiting for completion
+	if resp.Snapshot != nil && resp.Snapshot.State != "SUCCESS" {
+		return resp.Snapshot, fmt.Errorf("snapshot %s is %s: %v", name, resp.Snapshot.State, resp.Snapshot.Failures)
+	}
+	return resp.Snapshot, nil
+}
+
+type RestoreOptions struct {
+	// Index patterns to restore, defaults to all indices in the snapshot
+	Indices []string
+	// Restore indices with a prefix e.g. restored-, so that they do not conflict with existing indices
+	Prefix string
+	// Close existing indices before restoring over them, open indices cannot be restored
+	Close bool
+	Wait  bool
+}
+
+// Restore restores indices from a snapshot
+func Restore(client *elastic.Client, name string, opts RestoreOptions) error {
+	ctx := context.Background()
+	if opts.Close && opts.Prefix == "" {
+		indices := opts.Indices
+		if len(indices) == 0 {
+			resp, err := client.SnapshotGet(Repository).Snapshot(name).Do(ctx)
+			if err != nil {
+				return errors.Wrapf(err, "failed to get snapshot %s", name)
+			}
+			for _, snapshot := range resp.Snapshots {
+				indices = append(indices, snapshot.Indices...)
+			}
+		}
+		if len(indices) > 0 {
+			if _, err := client.CloseIndex(strings.Join(indices, ",")).IgnoreUnavailable(true).AllowNoIndices(true).Do(ctx); err != nil {
+				return errors.Wrap(err, "failed to close indices")
+			}
+		}
+	}
+
+	restore := client.SnapshotRestore(Repository, name).
+		IncludeGlobalState(false).
+		WaitForCompletion(opts.Wait)
+	if len(opts.Indices) > 0 {
+		restore = restore.Indices(opts.Indices...)
+	}
+	if opts.Prefix != "" {
+		restore = restore.RenamePattern("(.+)").RenameReplacement(opts.Prefix + "$1")
+	}
+	if _, err := restore.Do(ctx); err != nil {
+		return errors.Wrapf(err, "failed to restore snapshot %s", name)
+	}
+	return nil
+}
+
+// ListSnapshots returns all snapshots in the repository, oldest first
+func ListSnapshots(client *elastic.Client) ([]*elastic.Snapshot, error) {
+	resp, err := client.SnapshotGet(Repository).Do(context.Background())
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list snapshots")
+	}
+	return resp.Snapshots, nil
+}
+
+// PrintSnapshots writes a table of snapshots to w, or to stdout if w is nil
+func PrintSnapshots(w io.Writer, snapshots []*elastic.Snapshot) {
+	if w == nil {
+		w = os.Stdout
+	}
+	table := tabwriter.NewWriter(w, 3, 2, 3, ' ', tabwriter.DiscardEmptyColumns)
+	fmt.Fprintln(table, "NAME\tSTATE\tSTARTED\tDURATION\tINDICES\tFAILURES")
+	for _, snapshot := range snapshots {
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%d\t%d\n",
+			snapshot.Snapshot,
+			snapshot.State,
+			snapshot.StartTime.Format(time.RFC3339),
+			time.Duration(snapshot.DurationInMillis)*time.Millisecond,
+			len(snapshot.Indices),
+			len(snapshot.Failures))
+	}
+	table.Flush()
+}
@@ -0,0 +1,104 @@
+package elasticsearch
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/flanksource/karina/pkg/types"
+	elastic "github.com/olivere/elastic/v7"
+	. "github.com/onsi/gomega"
+)
+
+type request struct {
+	method, path, query string
+	body                map[string]interface{}
+}
+
+func stubElastic(t *testing.T) (*elastic.Client, *[]request, func()) {
+	var requests []request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := make(map[string]interface{})
+		data, _ := ioutil.ReadAll(r.Body)
+		if len(data) > 0 {
+			if err := json.Unmarshal(data, &body); err != nil {
+				t.Errorf("invalid body %s: %v", data, err)
+			}
+		}
+		requests = append(requests, request{r.Method, r.URL.Path, r.URL.RawQuery, body})
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/_snapshot/s3/_all":
+			fmt.Fprint(w, `{"snapshots":[{"snapshot":"nightly-2020.06.01-abc","state":"SUCCESS","indices":["filebeat-1","filebeat-2"],"duration_in_millis":61000,"start_time":"2020-06-01T01:30:00.000Z"}]}`)
+		case r.Method == http.MethodGet && r.URL.Path == "/_snapshot/s3/nightly":
+			fmt.Fprint(w, `{"snapshots":[{"snapshot":"nightly","state":"SUCCESS","indices":["filebeat-1","filebeat-2"]}]}`)
+		case r.Method == http.MethodPut && r.URL.Path == "/_snapshot/s3/manual":
+			fmt.Fprint(w, `{"snapshot":{"snapshot":"manual","state":"PARTIAL","failures":[{"index":"filebeat-1","reason":"failed"}]}}`)
+		case r.URL.Path == "/_snapshot/s3/nightly/_restore":
+			fmt.Fprint(w, `{"snapshot":{"snapshot":"nightly","indices":["filebeat-1"]}}`)
+		default:
+			fmt.Fprint(w, `{"acknowledged":true}`)
+		}
+	}))
+	client, err := elastic.NewSimpleClient(elastic.SetURL(server.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, &requests, server.Close
+}
+
+func TestConfigureSnapshots(t *testing.T) {
+	g := NewWithT(t)
+	client, requests, close := stubElastic(t)
+	defer close()
+
+	g.Expect(ConfigureSnapshots(client, types.ElasticsearchSnapshots{
+		Bucket:   "backups",
+		BasePath: "elasticsearch/test",
+		Policies: []types.ElasticsearchSnapshotPolicy{
+			{Name: "nightly", Schedule: "0 30 1 * * ?", ExpireAfter: "30d", MinCount: 5},
+		},
+	})).To(Succeed())
+	g.Expect(*requests).To(HaveLen(2))
+	g.Expect((*requests)[0].path).To(Equal("/_snapshot/s3"))
+	g.Expect((*requests)[0].body).To(Equal(map[string]interface{}{
+		"type":     "s3",
+		"settings": map[string]interface{}{"bucket": "backups", "base_path": "elasticsearch/test"},
+	}))
+	g.Expect((*requests)[1].path).To(Equal("/_slm/policy/nightly"))
+	g.Expect((*requests)[1].body).To(HaveKeyWithValue("name", "<nightly-{now/d}>"))
+	g.Expect((*requests)[1].body).To(HaveKeyWithValue("config", map[string]interface{}{"indices": []interface{}{"*"}, "include_global_state": false}))
+	g.Expect((*requests)[1].body).To(HaveKeyWithValue("retention", map[string]interface{}{"expire_after": "30d", "min_count": float64(5)}))
+}
+
+func TestSnapshotRestoreAndList(t *testing.T) {
+	g := NewWithT(t)
+	client, requests, close := stubElastic(t)
+	defer close()
+
+	_, err := Snapshot(client, "manual", []string{"filebeat-*"}, true)
+	g.Expect(err).To(MatchError(ContainSubstring("PARTIAL")))
+	g.Expect((*requests)[0].query).To(Equal("wait_for_completion=true"))
+	g.Expect((*requests)[0].body).To(HaveKeyWithValue("indices", "filebeat-*"))
+
+	*requests = nil
+	g.Expect(Restore(client, "nightly", RestoreOptions{Close: true, Wait: true})).To(Succeed())
+	g.Expect(*requests).To(HaveLen(3))
+	g.Expect((*requests)[1].path).To(Equal("/filebeat-1,filebeat-2/_close"))
+	g.Expect((*requests)[2].body).ToNot(HaveKey("rename_pattern"))
+
+	*requests = nil
+	g.Expect(Restore(client, "nightly", RestoreOptions{Close: true, Prefix: "restored-"})).To(Succeed())
+	g.Expect(*requests).To(HaveLen(1))
+	g.Expect((*requests)[0].body).To(HaveKeyWithValue("rename_replacement", "restored-$1"))
+
+	snapshots, err := ListSnapshots(client)
+	g.Expect(err).ToNot(HaveOccurred())
+	var out bytes.Buffer
+	PrintSnapshots(&out, snapshots)
+	g.Expect(out.String()).To(Equal("NAME                     STATE     STARTED                DURATION   INDICES   FAILURES\n" +
+		"nightly-2020.06.01-abc   SUCCESS   2020-06-01T01:30:00Z   1m1s       2         0\n"))
+}
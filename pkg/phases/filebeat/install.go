@@ -1,43 +1,32 @@
 package filebeat
 
 import (
-	"fmt"
-
-	"github.com/pkg/errors"
-
 	"github.com/flanksource/karina/pkg/constants"
+	"github.com/flanksource/karina/pkg/phases/beats"
 	"github.com/flanksource/karina/pkg/platform"
 )
 
 func Deploy(p *platform.Platform) error {
-	for _, f := range p.Filebeat {
+	for i, f := range p.Filebeat {
 		if f.Disabled {
 			p.Infof("Skipping deployment of filebeat %s, it is disabled", f.Name)
 			continue
 		}
 
-		if f.Elasticsearch != nil {
-			secretName := fmt.Sprintf("elastic-%s", f.Name)
-			err := p.GetOrCreateSecret(secretName, constants.PlatformSystem, map[string][]byte{
-				"ELASTIC_URL":      []byte(f.Elasticsearch.GetURL()),
-				"ELASTIC_USERNAME": []byte(f.Elasticsearch.User),
-				"ELASTIC_PASSWORD": []byte(f.Elasticsearch.Password),
-			})
-			if err != nil {
-				return errors.Wrap(err, "failed to create secret elastic")
-			}
+		beat := beats.Beat{
+			Type:        "filebeat",
+			Name:        "filebeat-" + f.Name,
+			Index:       f.Index,
+			BeatsOutput: f.BeatsOutput,
 		}
-
-		if f.Logstash != nil {
-			secretName := fmt.Sprintf("logstash-%s", f.Name)
-			err := p.GetOrCreateSecret(secretName, constants.PlatformSystem, map[string][]byte{
-				"LOGSTASH_URL":      []byte(f.Logstash.GetURL()),
-				"LOGSTASH_USERNAME": []byte(f.Logstash.User),
-				"LOGSTASH_PASSWORD": []byte(f.Logstash.Password),
-			})
-			if err != nil {
-				return errors.Wrap(err, "Failed to create secret logstash")
-			}
+		if !beat.HasOutput() {
+			p.Warnf("Skipping deployment of filebeat %s, no output is specified", f.Name)
+			// disabled filebeats are not rendered into filebeat.yaml
+			p.Filebeat[i].Disabled = true
+			continue
+		}
+		if err := beats.Deploy(p, beat); err != nil {
+			return err
 		}
 	}
 
@@ -6,6 +6,8 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"strconv"
+	"strings"
 
 	"github.com/dghubble/sling"
 	"github.com/flanksource/commons/console"
@@ -21,6 +23,7 @@ type Client struct {
 	logger.Logger
 	sling  *sling.Sling
 	client *http.Client
+	base   string
 	url    string
 }
 
@@ -50,20 +53,47 @@ func NewClient(p *platform.Platform) (*Client, error) {
 		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
 	}
 
-	client := &http.Client{Transport: tr}
+	return newClient(p.Logger, &http.Client{Transport: tr}, "http://harbor-core", p.Harbor.URL, adminPassword(p)), nil
+}
+
+func newClient(log logger.Logger, client *http.Client, base, url, password string) *Client {
 	return &Client{
-		Logger: p.Logger,
+		Logger: log,
 		client: client,
-		url:    p.Harbor.URL,
-		sling: sling.New().Client(client).Base("http://harbor-core").
-			SetBasicAuth("admin", p.Harbor.AdminPassword).
+		base:   base,
+		url:    url,
+		sling: sling.New().Client(client).Base(base).
+			SetBasicAuth("admin", password).
 			Set("accept", "application/json").
 			Set("content-type", "application/json"),
-	}, nil
+	}
+}
+
+// do sends the request and decodes the response into out, an error is returned for non-2xx responses
+func (harbor *Client) do(s *sling.Sling, out interface{}) (*http.Response, error) {
+	req, err := s.Request()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := harbor.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp, fmt.Errorf("%s %s returned %s: %s", req.Method, req.URL.Path, resp.Status, strings.TrimSpace(string(body)))
+	}
+	if out != nil && len(body) > 0 {
+		if err := json.Unmarshal(body, out); err != nil {
+			return resp, fmt.Errorf("failed to decode %s %s: %v", req.Method, req.URL.Path, err)
+		}
+	}
+	return resp, nil
 }
 
 func (harbor *Client) GetStatus() (*Status, error) {
-	resp, err := harbor.client.Get("http://harbor-core/api/health")
+	resp, err := harbor.client.Get(harbor.base + "/api/health")
 	if err != nil {
 		return nil, err
 	}
@@ -76,14 +106,9 @@ func (harbor *Client) GetStatus() (*Status, error) {
 	return &status, nil
 }
 
-func (harbor *Client) ListReplicationPolicies() (policies []ReplicationPolicy, customErr error) {
-	resp, err := harbor.sling.New().
-		Get("api/replication/policies").
-		Receive(&policies, &customErr)
-	if err == nil {
-		err = customErr
-	}
-	defer resp.Body.Close()
+func (harbor *Client) ListReplicationPolicies() ([]ReplicationPolicy, error) {
+	var policies []ReplicationPolicy
+	_, err := harbor.do(harbor.sling.New().Get("api/replication/policies"), &policies)
 	return policies, err
 }
 
@@ -122,11 +147,359 @@ func (harbor *Client) UpdateSettings(settings types.HarborSettings) error {
 	return nil
 }
 
-func (harbor *Client) ListMembers(project string) ([]ProjectMember, error) {
+func (harbor *Client) GetProject(name string) (*Project, error) {
+	var projects []Project
+	if _, err := harbor.do(harbor.sling.New().Get("api/projects").QueryStruct(&nameQuery{Name: name}), &projects); err != nil {
+		return nil, err
+	}
+	for _, project := range projects {
+		if project.Name == name {
+			return &project, nil
+		}
+	}
 	return nil, nil
 }
 
+func (harbor *Client) CreateProject(project Project) error {
+	_, err := harbor.do(harbor.sling.New().Post("api/projects").BodyJSON(&project), nil)
+	return err
+}
+
+func (harbor *Client) UpdateProject(project Project) error {
+	_, err := harbor.do(harbor.sling.New().Put(fmt.Sprintf("api/projects/%d", project.ID)).BodyJSON(&project), nil)
+	return err
+}
+
+func (harbor *Client) GetProjectQuota(project int) (*Quota, error) {
+	var quotas []Quota
+	query := &quotaQuery{Reference: "project", ReferenceID: strconv.Itoa(project)}
+	if _, err := harbor.do(harbor.sling.New().Get("api/quotas").QueryStruct(query), &quotas); err != nil {
+		return nil, err
+	}
+	if len(quotas) == 0 {
+		return nil, nil
+	}
+	return &quotas[0], nil
+}
+
+func (harbor *Client) UpdateQuota(quota Quota) error {
+	_, err := harbor.do(harbor.sling.New().Put(fmt.Sprintf("api/quotas/%d", quota.ID)).BodyJSON(&Quota{Hard: quota.Hard}), nil)
+	return err
+}
+
+func (harbor *Client) ListMembers(project int) ([]ProjectMember, error) {
+	var members []ProjectMember
+	_, err := harbor.do(harbor.sling.New().Get(fmt.Sprintf("api/projects/%d/members", project)), &members)
+	return members, err
+}
+
+func (harbor *Client) AddMember(project int, member ProjectMemberRequest) error {
+	_, err := harbor.do(harbor.sling.New().Post(fmt.Sprintf("api/projects/%d/members", project)).BodyJSON(&member), nil)
+	return err
+}
+
+func (harbor *Client) UpdateMember(project, member, role int) error {
+	_, err := harbor.do(harbor.sling.New().Put(fmt.Sprintf("api/projects/%d/members/%d", project, member)).BodyJSON(&ProjectMemberRequest{RoleID: role}), nil)
+	return err
+}
+
+func (harbor *Client) DeleteMember(project, member int) error {
+	_, err := harbor.do(harbor.sling.New().Delete(fmt.Sprintf("api/projects/%d/members/%d", project, member)), nil)
+	return err
+}
+
+func (harbor *Client) ListRobots(project int) ([]Robot, error) {
+	var robots []Robot
+	_, err := harbor.do(harbor.sling.New().Get(fmt.Sprintf("api/projects/%d/robots", project)), &robots)
+	return robots, err
+}
+
+// CreateRobot creates a robot account and returns its token, which cannot be retrieved later
+func (harbor *Client) CreateRobot(project int, robot Robot) (*RobotToken, error) {
+	token := RobotToken{}
+	_, err := harbor.do(harbor.sling.New().Post(fmt.Sprintf("api/projects/%d/robots", project)).BodyJSON(&robot), &token)
+	return &token, err
+}
+
+func (harbor *Client) DeleteRobot(project, robot int) error {
+	_, err := harbor.do(harbor.sling.New().Delete(fmt.Sprintf("api/projects/%d/robots/%d", project, robot)), nil)
+	return err
+}
+
+func (harbor *Client) ListRegistries() ([]ReplicationRegistry, error) {
+	var registries []ReplicationRegistry
+	_, err := harbor.do(harbor.sling.New().Get("api/registries"), &registries)
+	return registries, err
+}
+
+func (harbor *Client) CreateRegistry(registry ReplicationRegistry) error {
+	_, err := harbor.do(harbor.sling.New().Post("api/registries").BodyJSON(&registry), nil)
+	return err
+}
+
+func (harbor *Client) UpdateRegistry(registry ReplicationRegistry) error {
+	_, err := harbor.do(harbor.sling.New().Put(fmt.Sprintf("api/registries/%d", registry.ID)).BodyJSON(&registry), nil)
+	return err
+}
+
+func (harbor *Client) DeleteRegistry(id int) error {
+	_, err := harbor.do(harbor.sling.New().Delete(fmt.Sprintf("api/registries/%d", id)), nil)
+	return err
+}
+
+func (harbor *Client) CreateReplicationPolicy(policy ReplicationPolicy) error {
+	_, err := harbor.do(harbor.sling.New().Post("api/replication/policies").BodyJSON(&policy), nil)
+	return err
+}
+
+func (harbor *Client) UpdateReplicationPolicy(policy ReplicationPolicy) error {
+	_, err := harbor.do(harbor.sling.New().Put(fmt.Sprintf("api/replication/policies/%d", policy.ID)).BodyJSON(&policy), nil)
+	return err
+}
+
+func (harbor *Client) DeleteReplicationPolicy(id int) error {
+	_, err := harbor.do(harbor.sling.New().Delete(fmt.Sprintf("api/replication/policies/%d", id)), nil)
+	return err
+}
+
+// GetGCSchedule returns the garbage collection schedule, or nil if none has been created
+func (harbor *Client) GetGCSchedule() (*Schedule, error) {
+	gc := AdminJob{}
+	if _, err := harbor.do(harbor.sling.New().Get("api/system/gc/schedule"), &gc); err != nil {
+		return nil, err
+	}
+	return gc.Schedule, nil
+}
+
+func (harbor *Client) CreateGCSchedule(schedule Schedule) error {
+	_, err := harbor.do(harbor.sling.New().Post("api/system/gc/schedule").BodyJSON(&AdminJob{Schedule: &schedule}), nil)
+	return err
+}
+
+func (harbor *Client) UpdateGCSchedule(schedule Schedule) error {
+	_, err := harbor.do(harbor.sling.New().Put("api/system/gc/schedule").BodyJSON(&AdminJob{Schedule: &schedule}), nil)
+	return err
+}
+
+func (harbor *Client) GetRetention(id int) (*RetentionPolicy, error) {
+	policy := RetentionPolicy{}
+	_, err := harbor.do(harbor.sling.New().Get(fmt.Sprintf("api/retentions/%d", id)), &policy)
+	return &policy, err
+}
+
+func (harbor *Client) CreateRetention(policy RetentionPolicy) error {
+	_, err := harbor.do(harbor.sling.New().Post("api/retentions").BodyJSON(&policy), nil)
+	return err
+}
+
+func (harbor *Client) UpdateRetention(policy RetentionPolicy) error {
+	_, err := harbor.do(harbor.sling.New().Put(fmt.Sprintf("api/retentions/%d", policy.ID)).BodyJSON(&policy), nil)
+	return err
+}
+
+func (harbor *Client) ListProjects() ([]Project, error) {
+	var projects []Project
+	for page := 1; ; page++ {
+		var list []Project
+		if _, err := harbor.do(harbor.sling.New().Get("api/projects").QueryStruct(&pageQuery{Page: page, PageSize: pageSize}), &list); err != nil {
+			return nil, err
+		}
+		projects = append(projects, list...)
+		if len(list) < pageSize {
+			return projects, nil
+		}
+	}
+}
+
+func (harbor *Client) ListRepositories(project int) ([]Repository, error) {
+	var repositories []Repository
+	for page := 1; ; page++ {
+		var list []Repository
+		query := &pageQuery{ProjectID: project, Page: page, PageSize: pageSize}
+		if _, err := harbor.do(harbor.sling.New().Get("api/repositories").QueryStruct(query), &list); err != nil {
+			return nil, err
+		}
+		repositories = append(repositories, list...)
+		if len(list) < pageSize {
+			return repositories, nil
+		}
+	}
+}
+
+// ListTags returns the tags of a repository e.g. library/nginx including their scan overview
+func (harbor *Client) ListTags(repository string) ([]Tag, error) {
+	var tags []Tag
+	_, err := harbor.do(harbor.sling.New().Get(fmt.Sprintf("api/repositories/%s/tags?detail=true", repository)), &tags)
+	return tags, err
+}
+
+// GetTag returns a tag including its scan overview, or nil if the repository or tag does not exist
+func (harbor *Client) GetTag(repository, tag string) (*Tag, error) {
+	result := Tag{}
+	resp, err := harbor.do(harbor.sling.New().Get(fmt.Sprintf("api/repositories/%s/tags/%s", repository, tag)), &result)
+	if resp != nil && resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// ChangePassword changes the password of a user, which requires the current password
+func (harbor *Client) ChangePassword(user int, oldPassword, newPassword string) error {
+	body := map[string]string{"old_password": oldPassword, "new_password": newPassword}
+	_, err := harbor.do(harbor.sling.New().Put(fmt.Sprintf("api/users/%d/password", user)).BodyJSON(&body), nil)
+	return err
+}
+
+const pageSize = 100
+
+// the id of the admin user created when harbor is installed
+const adminUserID = 1
+
+type pageQuery struct {
+	ProjectID int `url:"project_id,omitempty"`
+	Page      int `url:"page,omitempty"`
+	PageSize  int `url:"page_size,omitempty"`
+}
+
+type nameQuery struct {
+	Name string `url:"name,omitempty"`
+}
+
+type quotaQuery struct {
+	Reference   string `url:"reference"`
+	ReferenceID string `url:"reference_id"`
+}
+
 type Project struct {
+	ID   int    `json:"project_id,omitempty"`
+	Name string `json:"name,omitempty"`
+	// only used when creating a project
+	ProjectName  string            `json:"project_name,omitempty"`
+	StorageLimit *int64            `json:"storage_limit,omitempty"`
+	Metadata     map[string]string `json:"metadata,omitempty"`
+}
+
+type AdminJob struct {
+	Schedule *Schedule `json:"schedule"`
+}
+
+type Schedule struct {
+	// One of None, Hourly, Daily, Weekly or Custom
+	Type string `json:"type"`
+	Cron string `json:"cron,omitempty"`
+}
+
+type RetentionPolicy struct {
+	ID        int              `json:"id,omitempty"`
+	Algorithm string           `json:"algorithm"`
+	Rules     []RetentionRule  `json:"rules"`
+	Trigger   RetentionTrigger `json:"trigger"`
+	Scope     RetentionScope   `json:"scope"`
+}
+
+type RetentionRule struct {
+	Disabled       bool                           `json:"disabled"`
+	Action         string                         `json:"action"`
+	Template       string                         `json:"template"`
+	Params         map[string]int                 `json:"params"`
+	TagSelectors   []RetentionSelector            `json:"tag_selectors"`
+	ScopeSelectors map[string][]RetentionSelector `json:"scope_selectors"`
+}
+
+type RetentionSelector struct {
+	Kind       string `json:"kind"`
+	Decoration string `json:"decoration"`
+	Pattern    string `json:"pattern"`
+}
+
+type RetentionTrigger struct {
+	Kind       string            `json:"kind"`
+	References map[string]string `json:"references"`
+	Settings   map[string]string `json:"settings"`
+}
+
+type RetentionScope struct {
+	Level string `json:"level"`
+	Ref   int    `json:"ref"`
+}
+
+type Repository struct {
+	ID        int    `json:"id"`
+	Name      string `json:"name"`
+	ProjectID int    `json:"project_id"`
+	TagsCount int    `json:"tags_count"`
+}
+
+type Tag struct {
+	Name     string `json:"name"`
+	Digest   string `json:"digest"`
+	PushTime string `json:"push_time"`
+	// scan reports keyed by mime type
+	ScanOverview map[string]ScanOverview `json:"scan_overview"`
+}
+
+type ScanOverview struct {
+	ScanStatus string                `json:"scan_status"`
+	Severity   string                `json:"severity"`
+	Summary    *VulnerabilitySummary `json:"summary"`
+}
+
+type VulnerabilitySummary struct {
+	Total   int            `json:"total"`
+	Fixable int            `json:"fixable"`
+	Summary map[string]int `json:"summary"`
+}
+
+// Vulnerabilities returns the number of vulnerabilities of the given severity e.g. Critical, and
+// whether the tag has been scanned successfully
+func (tag Tag) Vulnerabilities(severity string) (int, bool) {
+	for _, overview := range tag.ScanOverview {
+		if overview.ScanStatus != "Success" {
+			continue
+		}
+		if overview.Summary == nil {
+			return 0, true
+		}
+		return overview.Summary.Summary[severity], true
+	}
+	return 0, false
+}
+
+type Quota struct {
+	ID   int              `json:"id,omitempty"`
+	Hard map[string]int64 `json:"hard"`
+}
+
+type ProjectMemberRequest struct {
+	RoleID      int          `json:"role_id"`
+	MemberGroup *MemberGroup `json:"member_group,omitempty"`
+}
+
+type MemberGroup struct {
+	GroupName   string `json:"group_name,omitempty"`
+	GroupType   int    `json:"group_type,omitempty"`
+	LdapGroupDN string `json:"ldap_group_dn,omitempty"`
+}
+
+type Robot struct {
+	ID          int           `json:"id,omitempty"`
+	Name        string        `json:"name,omitempty"`
+	Description string        `json:"description,omitempty"`
+	Disabled    bool          `json:"disabled,omitempty"`
+	Access      []RobotAccess `json:"access,omitempty"`
+}
+
+type RobotAccess struct {
+	Resource string `json:"resource"`
+	Action   string `json:"action"`
+}
+
+type RobotToken struct {
+	Name  string `json:"name"`
+	Token string `json:"token"`
 }
 
 type Replication struct {
@@ -145,35 +518,37 @@ type Replication struct {
 }
 
 type ReplicationRegistry struct {
-	ID         int    `json:"id,omitempty"`
-	URL        string `json:"url,omitempty"`
-	Name       string `json:"name,omitempty"`
-	Credential struct {
-		Type         string `json:"type,omitempty"`
-		AccessKey    string `json:"access_key,omitempty"`
-		AccessSecret string `json:"access_secret,omitempty"`
-	} `json:"credential,omitempty"`
+	ID           int                 `json:"id,omitempty"`
+	URL          string              `json:"url,omitempty"`
+	Name         string              `json:"name,omitempty"`
+	Credential   *RegistryCredential `json:"credential,omitempty"`
+	Type         string              `json:"type,omitempty"`
+	Insecure     bool                `json:"insecure,omitempty"`
+	Description  string              `json:"description,omitempty"`
+	Status       string              `json:"status,omitempty"`
+	CreationTime string              `json:"creation_time,omitempty"`
+	UpdateTime   string              `json:"update_time,omitempty"`
+}
+type RegistryCredential struct {
 	Type         string `json:"type,omitempty"`
-	Insecure     bool   `json:"insecure,omitempty"`
-	Description  string `json:"description,omitempty"`
-	Status       string `json:"status,omitempty"`
-	CreationTime string `json:"creation_time,omitempty"`
-	UpdateTime   string `json:"update_time,omitempty"`
+	AccessKey    string `json:"access_key,omitempty"`
+	AccessSecret string `json:"access_secret,omitempty"`
 }
+
 type ReplicationPolicy struct {
-	ID            int                 `json:"id,omitempty"`
-	Name          string              `json:"name,omitempty"`
-	Description   string              `json:"description,omitempty"`
-	SrcRegistry   ReplicationRegistry `json:"src_registry,omitempty"`
-	DestRegistry  ReplicationRegistry `json:"dest_registry,omitempty"`
-	DestNamespace string              `json:"dest_namespace,omitempty"`
-	Trigger       ReplicationTrigger  `json:"trigger,omitempty"`
-	Filters       []ReplicationFilter `json:"filters,omitempty"`
-	Deletion      bool                `json:"deletion,omitempty"`
-	Override      bool                `json:"override,omitempty"`
-	Enabled       bool                `json:"enabled,omitempty"`
-	CreationTime  string              `json:"creation_time,omitempty"`
-	UpdateTime    string              `json:"update_time,omitempty"`
+	ID            int                  `json:"id,omitempty"`
+	Name          string               `json:"name,omitempty"`
+	Description   string               `json:"description,omitempty"`
+	SrcRegistry   *ReplicationRegistry `json:"src_registry,omitempty"`
+	DestRegistry  *ReplicationRegistry `json:"dest_registry,omitempty"`
+	DestNamespace string               `json:"dest_namespace,omitempty"`
+	Trigger       *ReplicationTrigger  `json:"trigger,omitempty"`
+	Filters       []ReplicationFilter  `json:"filters,omitempty"`
+	Deletion      bool                 `json:"deletion,omitempty"`
+	Override      bool                 `json:"override,omitempty"`
+	Enabled       bool                 `json:"enabled,omitempty"`
+	CreationTime  string               `json:"creation_time,omitempty"`
+	UpdateTime    string               `json:"update_time,omitempty"`
 }
 
 type ReplicationTrigger struct {
@@ -0,0 +1,119 @@
+package harbor
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/flanksource/commons/logger"
+	"github.com/flanksource/karina/pkg/platform"
+	pg "github.com/go-pg/pg/v9"
+	"github.com/go-pg/pg/v9/orm"
+	"github.com/pkg/errors"
+)
+
+// encryptHeader prefixes values that harbor has encrypted with the secretKey
+const encryptHeader = "<enc-v1>"
+
+// encryptedColumn is a column in the harbor core database that contains values encrypted with the secretKey
+type encryptedColumn struct {
+	table, column string
+}
+
+var encryptedColumns = []encryptedColumn{
+	// password settings e.g. ldap_search_password and oidc_client_secret
+	{"properties", "v"},
+	// registry credentials, including registries that are not declared under harbor.registries
+	{"registry", "access_secret"},
+	// CLI secrets and tokens of OIDC users
+	{"oidc_user", "secret"},
+	{"oidc_user", "token"},
+}
+
+// encrypt encrypts a value the same way as harbor, using AES-CFB with a random IV
+func encrypt(value, key string) (string, error) {
+	block, err := aes.NewCipher([]byte(key))
+	if err != nil {
+		return "", err
+	}
+	data := make([]byte, aes.BlockSize+len(value))
+	iv := data[:aes.BlockSize]
+	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
+		return "", err
+	}
+	cipher.NewCFBEncrypter(block, iv).XORKeyStream(data[aes.BlockSize:], []byte(value))
+	return encryptHeader + base64.StdEncoding.EncodeToString(data), nil
+}
+
+// decrypt decrypts a value encrypted by harbor
+func decrypt(value, key string) (string, error) {
+	if !strings.HasPrefix(value, encryptHeader) {
+		return "", fmt.Errorf("value is not encrypted")
+	}
+	data, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, encryptHeader))
+	if err != nil {
+		return "", err
+	}
+	if len(data) < aes.BlockSize {
+		return "", fmt.Errorf("encrypted value is too short")
+	}
+	block, err := aes.NewCipher([]byte(key))
+	if err != nil {
+		return "", err
+	}
+	plain := make([]byte, len(data)-aes.BlockSize)
+	cipher.NewCFBDecrypter(block, data[:aes.BlockSize]).XORKeyStream(plain, data[aes.BlockSize:])
+	return string(plain), nil
+}
+
+// reencrypt replaces every value encrypted with oldKey by the same value encrypted with newKey, it
+// should be run in a transaction so that no values are left encrypted with the old key on failure
+func reencrypt(log logger.Logger, db orm.DB, oldKey, newKey string) error {
+	for _, col := range encryptedColumns {
+		var exists bool
+		if _, err := db.QueryOne(pg.Scan(&exists), "SELECT to_regclass(?) IS NOT NULL", col.table); err != nil {
+			return err
+		}
+		if !exists {
+			continue
+		}
+		var rows []struct {
+			ID    int64
+			Value string
+		}
+		if _, err := db.Query(&rows, "SELECT id, ? AS value FROM ? WHERE ? LIKE ?",
+			pg.Ident(col.column), pg.Ident(col.table), pg.Ident(col.column), encryptHeader+"%"); err != nil {
+			return errors.Wrapf(err, "failed to read %s.%s", col.table, col.column)
+		}
+		for _, row := range rows {
+			value, err := decrypt(row.Value, oldKey)
+			if err != nil {
+				return errors.Wrapf(err, "failed to decrypt %s.%s of %d", col.table, col.column, row.ID)
+			}
+			if value, err = encrypt(value, newKey); err != nil {
+				return err
+			}
+			if _, err := db.Exec("UPDATE ? SET ? = ? WHERE id = ?", pg.Ident(col.table), pg.Ident(col.column), value, row.ID); err != nil {
+				return errors.Wrapf(err, "failed to update %s.%s of %d", col.table, col.column, row.ID)
+			}
+		}
+		log.Infof("Re-encrypted %d values of %s.%s", len(rows), col.table, col.column)
+	}
+	return nil
+}
+
+// openDB connects to the harbor core database, using a proxy for the database managed by the postgres operator
+func openDB(p *platform.Platform, managed bool) (*pg.DB, error) {
+	if managed {
+		return p.OpenDB("postgres-operator", "postgres-"+dbCluster, dbNames[0])
+	}
+	opts, err := pg.ParseURL(p.Harbor.DB.GetConnectionURL(dbNames[0]))
+	if err != nil {
+		return nil, err
+	}
+	return pg.Connect(opts), nil
+}
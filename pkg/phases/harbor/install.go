@@ -7,7 +7,6 @@ import (
 	pgapi "github.com/flanksource/karina/pkg/api/postgres"
 	"github.com/flanksource/karina/pkg/phases/postgresoperator"
 	"github.com/flanksource/karina/pkg/platform"
-	"github.com/flanksource/konfigadm/pkg/utils"
 )
 
 func Deploy(p *platform.Platform) error {
@@ -22,16 +21,9 @@ func Deploy(p *platform.Platform) error {
 	if err := p.CreateOrUpdateNamespace(Namespace, nil, nil); err != nil {
 		return err
 	}
-	var nonce string
-	if p.HasSecret(Namespace, "harbor-secret") {
-		nonce = string((*p.GetSecret(Namespace, "harbor-secret"))["secret"])
-	} else {
-		nonce = utils.RandomString(16)
-		if err := p.CreateOrUpdateSecret("harbor-secret", Namespace, map[string][]byte{
-			"secret": []byte(nonce),
-		}); err != nil {
-			return err
-		}
+	secrets, err := getSecrets(p)
+	if err != nil {
+		return fmt.Errorf("deploy: failed to get secrets: %v", err)
 	}
 
 	if p.Harbor.DB == nil {
@@ -43,37 +35,7 @@ func Deploy(p *platform.Platform) error {
 		p.Harbor.DB = db
 	}
 
-	if err := p.CreateOrUpdateSecret("harbor-chartmuseum", Namespace, map[string][]byte{
-		"CACHE_REDIS_PASSWORD":  []byte{},
-		"AWS_SECRET_ACCESS_KEY": []byte(p.S3.SecretKey),
-	}); err != nil {
-		return err
-	}
-
-	if err := p.CreateOrUpdateSecret("harbor-clair", Namespace, map[string][]byte{
-		"config.yaml": []byte(getClairConfig(p)),
-		"database":    []byte(p.Harbor.DB.GetConnectionURL("clair")),
-		"redis":       []byte("redis://harbor-redis:6379/4"),
-	}); err != nil {
-		return err
-	}
-
-	coreCert, err := p.CreateIngressCertificate("harbor-core")
-	if err != nil {
-		return err
-	}
-	tls := coreCert.AsTLSSecret()
-
-	if err := p.CreateOrUpdateSecret("harbor-core", Namespace, map[string][]byte{
-		"HARBOR_ADMIN_PASSWORD": []byte(p.Harbor.AdminPassword),
-		"POSTGRESQL_PASSWORD":   []byte(p.Harbor.DB.Password),
-		"CLAIR_DB_PASSWORD":     []byte(p.Harbor.DB.Password),
-		"tls.key":               tls["tls.key"],
-		"tls.crt":               tls["tls.crt"],
-		"ca.crt":                tls["tls.crt"],
-		"secretKey":             []byte("not-a-secure-key"),
-		"secret":                []byte(nonce),
-	}); err != nil {
+	if err := applySecrets(p, secrets); err != nil {
 		return err
 	}
 
@@ -81,21 +43,6 @@ func Deploy(p *platform.Platform) error {
 		return err
 	}
 
-	if err := p.CreateOrUpdateSecret("harbor-registry", Namespace, map[string][]byte{
-		"REGISTRY_HTTP_SECRET":          []byte(nonce),
-		"REGISTRY_REDIS_PASSWORD":       []byte(""),
-		"REGISTRY_STORAGE_S3_ACCESSKEY": []byte(p.S3.AccessKey),
-		"REGISTRY_STORAGE_S3_SECRETKEY": []byte(p.S3.SecretKey),
-	}); err != nil {
-		return err
-	}
-
-	if err := p.CreateOrUpdateSecret("harbor-jobservice", Namespace, map[string][]byte{
-		"secret": []byte(nonce),
-	}); err != nil {
-		return err
-	}
-
 	if err := p.ApplySpecs(Namespace, "harbor.yaml"); err != nil {
 		return err
 	}
@@ -108,7 +55,10 @@ func Deploy(p *platform.Platform) error {
 	if err != nil {
 		return err
 	}
-	return client.UpdateSettings(*p.Harbor.Settings)
+	if err := client.UpdateSettings(*p.Harbor.Settings); err != nil {
+		return err
+	}
+	return reconcile(p.Logger, client, p, p.Harbor, p.DryRun)
 }
 
 func getClairConfig(p *platform.Platform) string {
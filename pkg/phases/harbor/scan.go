@@ -0,0 +1,166 @@
+package harbor
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/flanksource/commons/console"
+	"github.com/flanksource/karina/pkg/platform"
+)
+
+type ScanReportOptions struct {
+	// Only report on these projects
+	Projects []string
+	// Include repositories without critical vulnerabilities
+	All bool
+}
+
+// RepositoryScan summarises the scan results of all the tags in a repository
+type RepositoryScan struct {
+	Project    string
+	Repository string
+	Tags       int
+	NotScanned int
+	// the number of tags with at least one critical vulnerability
+	VulnerableTags int
+	// the highest number of critical and high vulnerabilities found in a single tag
+	Critical, High int
+}
+
+// ScanReport prints the number of critical vulnerabilities per project and repository
+func ScanReport(p *platform.Platform, opts ScanReportOptions) error {
+	client, err := NewClient(p)
+	if err != nil {
+		return err
+	}
+	scans, err := client.scanReport(opts.Projects)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 3, 2, 3, ' ', 0)
+	fmt.Fprintln(w, "PROJECT\tREPOSITORY\tTAGS\tNOT SCANNED\tVULNERABLE TAGS\tCRITICAL\tHIGH\t")
+	for _, scan := range scans {
+		if !opts.All && scan.Critical == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%d\t%d\t%d\t\n", scan.Project, scan.Repository, scan.Tags, scan.NotScanned, scan.VulnerableTags, scan.Critical, scan.High)
+	}
+	return w.Flush()
+}
+
+func (harbor *Client) scanReport(filter []string) ([]RepositoryScan, error) {
+	projects, err := harbor.ListProjects()
+	if err != nil {
+		return nil, err
+	}
+	var scans []RepositoryScan
+	for _, project := range projects {
+		if len(filter) > 0 && !contains(filter, project.Name) {
+			continue
+		}
+		repositories, err := harbor.ListRepositories(project.ID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list repositories of %s: %v", project.Name, err)
+		}
+		for _, repository := range repositories {
+			tags, err := harbor.ListTags(repository.Name)
+			if err != nil {
+				return nil, fmt.Errorf("failed to list tags of %s: %v", repository.Name, err)
+			}
+			scan := RepositoryScan{Project: project.Name, Repository: repository.Name, Tags: len(tags)}
+			for _, tag := range tags {
+				critical, scanned := tag.Vulnerabilities("Critical")
+				if !scanned {
+					scan.NotScanned++
+					continue
+				}
+				high, _ := tag.Vulnerabilities("High")
+				if critical > 0 {
+					scan.VulnerableTags++
+				}
+				if critical > scan.Critical {
+					scan.Critical = critical
+				}
+				if high > scan.High {
+					scan.High = high
+				}
+			}
+			scans = append(scans, scan)
+		}
+	}
+	sort.Slice(scans, func(i, j int) bool {
+		if scans[i].Critical != scans[j].Critical {
+			return scans[i].Critical > scans[j].Critical
+		}
+		return scans[i].Repository < scans[j].Repository
+	})
+	return scans, nil
+}
+
+// TestImages fails for every image stored in harbor that has critical vulnerabilities, images are
+// looked up by their repository path regardless of registry, so that images replicated into
+// harbor are found e.g. docker.io/library/nginx:1.17 is looked up as library/nginx:1.17
+func TestImages(p *platform.Platform, test *console.TestResults, images []string) {
+	client, err := NewClient(p)
+	if err != nil {
+		test.Failf("Harbor", "failed to get harbor client: %v", err)
+		return
+	}
+	checked := 0
+	for _, image := range images {
+		repository, tag := parseImage(image)
+		result, err := client.GetTag(repository, tag)
+		if err != nil {
+			test.Failf("Harbor", "failed to get scan results for %s: %v", image, err)
+			continue
+		}
+		if result == nil {
+			p.Debugf("%s is not stored in harbor", image)
+			continue
+		}
+		checked++
+		critical, scanned := result.Vulnerabilities("Critical")
+		if !scanned {
+			test.Skipf("Harbor", "%s has not been scanned", image)
+		} else if critical > 0 {
+			test.Failf("Harbor", "%s has %d critical vulnerabilities", image, critical)
+		} else {
+			test.Passf("Harbor", "%s has no critical vulnerabilities", image)
+		}
+	}
+	if checked == 0 {
+		test.Skipf("Harbor", "none of the %d images are stored in harbor", len(images))
+	}
+}
+
+// parseImage returns the repository and tag of an image without the registry host, e.g. nginx
+// returns library/nginx and latest
+func parseImage(image string) (string, string) {
+	host := "docker.io"
+	parts := strings.SplitN(image, "/", 2)
+	if len(parts) == 2 && (strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost") {
+		host, image = parts[0], parts[1]
+	}
+	tag := "latest"
+	if i := strings.Index(image, "@"); i > 0 {
+		image, tag = image[:i], image[i+1:]
+	} else if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		image, tag = image[:i], image[i+1:]
+	}
+	if host == "docker.io" && !strings.Contains(image, "/") {
+		image = "library/" + image
+	}
+	return image, tag
+}
+
+func contains(list []string, item string) bool {
+	for _, i := range list {
+		if i == item {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,358 @@
+package harbor
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/flanksource/commons/logger"
+	pgapi "github.com/flanksource/karina/pkg/api/postgres"
+	"github.com/flanksource/karina/pkg/phases/postgresoperator"
+	"github.com/flanksource/karina/pkg/platform"
+	"github.com/flanksource/konfigadm/pkg/utils"
+	pg "github.com/go-pg/pg/v9"
+	"github.com/pkg/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// the keys of the harbor-secret secret in which the generated secrets are persisted
+const (
+	secretName = "harbor-secret"
+	// the nonce used by versions that shared a single secret between components
+	legacyNonceKey   = "secret"
+	coreSecretKey    = "coreSecret"
+	jobserviceKey    = "jobserviceSecret"
+	registryKey      = "registrySecret"
+	encryptionKey    = "secretKey"
+	adminPasswordKey = "adminPassword"
+	// the key used to encrypt data in the database before it was generated per installation
+	legacySecretKey = "not-a-secure-key"
+	// rotationSecret holds new and previous values while secrets are rotated, so that they can be
+	// recovered if rotate-secrets fails after changing them but before they are persisted
+	rotationSecret      = "harbor-secret-rotation"
+	previousKey         = "previousSecretKey"
+	databasePasswordKey = "databasePassword"
+)
+
+// harborComponents are restarted when secrets are rotated
+var harborComponents = []string{"harbor-core", "harbor-jobservice", "harbor-registry", "harbor-chartmuseum", "harbor-clair", "harbor-exporter"}
+
+// getSecrets returns the persisted secrets, generating and persisting any that are missing. Existing
+// installations keep using their shared nonce, the legacy secretKey and the initial admin password
+// until they are rotated, as the secretKey and admin password cannot be changed without migration.
+func getSecrets(p *platform.Platform) (map[string]string, error) {
+	data := make(map[string][]byte)
+	if secret := p.GetSecret(Namespace, secretName); secret != nil {
+		data = *secret
+	}
+	secrets, changed := generateSecrets(p.Logger, data, p.Harbor.AdminPassword)
+	if changed {
+		if err := persistSecrets(p, secrets); err != nil {
+			return nil, err
+		}
+	}
+	return secrets, nil
+}
+
+// generateSecrets returns the persisted secrets with any missing secrets generated, and whether any were generated
+func generateSecrets(log logger.Logger, data map[string][]byte, adminPassword string) (map[string]string, bool) {
+	secrets := make(map[string]string)
+	for k, v := range data {
+		secrets[k] = string(v)
+	}
+	nonce, existing := secrets[legacyNonceKey]
+	changed := false
+	generate := func(key, value string) {
+		if secrets[key] == "" {
+			secrets[key] = value
+			changed = true
+		}
+	}
+	if existing {
+		generate(coreSecretKey, nonce)
+		generate(jobserviceKey, nonce)
+		generate(registryKey, nonce)
+		generate(adminPasswordKey, adminPassword)
+		if secrets[encryptionKey] == "" {
+			log.Warnf("Harbor is using the insecure default secretKey, run karina harbor rotate-secrets to replace it")
+		}
+		generate(encryptionKey, legacySecretKey)
+	} else {
+		generate(coreSecretKey, utils.RandomString(16))
+		generate(jobserviceKey, utils.RandomString(16))
+		generate(registryKey, utils.RandomString(16))
+		generate(adminPasswordKey, randomPassword())
+		// harbor requires the secretKey to be exactly 16 characters
+		generate(encryptionKey, utils.RandomString(16))
+		// the nonce marks the installation as existing for previous versions of karina
+		generate(legacyNonceKey, utils.RandomString(16))
+	}
+	return secrets, changed
+}
+
+func persistSecrets(p *platform.Platform, secrets map[string]string) error {
+	data := make(map[string][]byte)
+	for k, v := range secrets {
+		data[k] = []byte(v)
+	}
+	return p.CreateOrUpdateSecret(secretName, Namespace, data)
+}
+
+// adminPassword returns the persisted admin password, falling back to the configured default for
+// installations that have not been deployed by this version yet
+func adminPassword(p *platform.Platform) string {
+	if secret := p.GetSecret(Namespace, secretName); secret != nil {
+		if password := string((*secret)[adminPasswordKey]); password != "" {
+			return password
+		}
+	}
+	return p.Harbor.AdminPassword
+}
+
+// randomPassword returns a password that meets harbor's requirement of at least 8 characters
+// including an uppercase letter, a lowercase letter and a number
+func randomPassword() string {
+	for {
+		password := utils.RandomString(20)
+		if strings.ContainsAny(password, "0123456789") && strings.ContainsAny(password, "abcdefghijklmnopqrstuvwxyz") {
+			return "H" + password
+		}
+	}
+}
+
+// applySecrets creates the secrets consumed by the harbor components
+func applySecrets(p *platform.Platform, secrets map[string]string) error {
+	if err := p.CreateOrUpdateSecret("harbor-chartmuseum", Namespace, map[string][]byte{
+		"CACHE_REDIS_PASSWORD":  []byte{},
+		"AWS_SECRET_ACCESS_KEY": []byte(p.S3.SecretKey),
+	}); err != nil {
+		return err
+	}
+
+	if err := p.CreateOrUpdateSecret("harbor-clair", Namespace, map[string][]byte{
+		"config.yaml": []byte(getClairConfig(p)),
+		"database":    []byte(p.Harbor.DB.GetConnectionURL("clair")),
+		"redis":       []byte("redis://harbor-redis:6379/4"),
+	}); err != nil {
+		return err
+	}
+
+	coreCert, err := p.CreateIngressCertificate("harbor-core")
+	if err != nil {
+		return err
+	}
+	tls := coreCert.AsTLSSecret()
+
+	if err := p.CreateOrUpdateSecret("harbor-core", Namespace, map[string][]byte{
+		"HARBOR_ADMIN_PASSWORD": []byte(secrets[adminPasswordKey]),
+		"POSTGRESQL_PASSWORD":   []byte(p.Harbor.DB.Password),
+		"CLAIR_DB_PASSWORD":     []byte(p.Harbor.DB.Password),
+		"tls.key":               tls["tls.key"],
+		"tls.crt":               tls["tls.crt"],
+		"ca.crt":                tls["tls.crt"],
+		"secretKey":             []byte(secrets[encryptionKey]),
+		"secret":                []byte(secrets[coreSecretKey]),
+	}); err != nil {
+		return err
+	}
+
+	if err := p.CreateOrUpdateSecret("harbor-registry", Namespace, map[string][]byte{
+		"REGISTRY_HTTP_SECRET":          []byte(secrets[registryKey]),
+		"REGISTRY_REDIS_PASSWORD":       []byte(""),
+		"REGISTRY_STORAGE_S3_ACCESSKEY": []byte(p.S3.AccessKey),
+		"REGISTRY_STORAGE_S3_SECRETKEY": []byte(p.S3.SecretKey),
+	}); err != nil {
+		return err
+	}
+
+	return p.CreateOrUpdateSecret("harbor-jobservice", Namespace, map[string][]byte{
+		"secret": []byte(secrets[jobserviceKey]),
+	})
+}
+
+// RotateSecrets replaces the component secrets, the secretKey, the admin password and the password of
+// the database managed by the postgres operator, and then restarts the harbor components. Values in
+// the database encrypted with the previous secretKey are decrypted and re-encrypted with the new
+// secretKey before it is swapped.
+func RotateSecrets(p *platform.Platform) error {
+	if p.Harbor == nil || p.Harbor.Disabled {
+		return fmt.Errorf("harbor is not enabled")
+	}
+	if p.DryRun {
+		p.Infof("[dry-run] Would rotate the harbor secrets and admin and database passwords")
+		return nil
+	}
+	secrets, err := getSecrets(p)
+	if err != nil {
+		return errors.Wrap(err, "failed to get secrets")
+	}
+	client, err := NewClient(p)
+	if err != nil {
+		return err
+	}
+
+	if p.GetSecret(Namespace, rotationSecret) != nil {
+		return fmt.Errorf("a previous rotation did not complete, recover any values needed from %s/%s and delete it", Namespace, rotationSecret)
+	}
+	rotation := map[string]string{}
+	password := randomPassword()
+	rotation[adminPasswordKey] = password
+	if err := saveRotation(p, rotation); err != nil {
+		return err
+	}
+	p.Infof("Rotating the harbor admin password")
+	if err := client.ChangePassword(adminUserID, secrets[adminPasswordKey], password); err != nil {
+		return errors.Wrap(err, "failed to change the admin password")
+	}
+	secrets[adminPasswordKey] = password
+	if err := persistSecrets(p, secrets); err != nil {
+		return errors.Wrapf(err, "failed to persist the new admin password, read it from %s/%s", Namespace, rotationSecret)
+	}
+
+	if secrets[encryptionKey] == legacySecretKey {
+		p.Infof("Replacing the insecure default secretKey")
+	}
+	oldKey := secrets[encryptionKey]
+	rotation[previousKey] = oldKey
+	if err := saveRotation(p, rotation); err != nil {
+		return err
+	}
+	secrets[encryptionKey] = utils.RandomString(16)
+	secrets[coreSecretKey] = utils.RandomString(16)
+	secrets[jobserviceKey] = utils.RandomString(16)
+	secrets[registryKey] = utils.RandomString(16)
+	managed := p.Harbor.DB == nil
+	if err := rotateEncryptionKey(p, managed, secrets, oldKey); err != nil {
+		return err
+	}
+
+	// the database password is rotated last and applied to harbor-core straight away, as harbor
+	// cannot connect to the database between changing the password and applying it
+	if managed {
+		rotation[databasePasswordKey] = utils.RandomString(32)
+		if err := saveRotation(p, rotation); err != nil {
+			return err
+		}
+		if err := rotateDBPassword(p, rotation[databasePasswordKey]); err != nil {
+			return errors.Wrap(err, "failed to rotate the database password")
+		}
+		db, err := postgresoperator.GetOrCreateDB(p, pgapi.NewClusterConfig(dbCluster, dbNames...))
+		if err != nil {
+			return err
+		}
+		p.Harbor.DB = db
+	} else {
+		p.Warnf("Not rotating the password of the externally managed harbor database")
+	}
+	if err := applySecrets(p, secrets); err != nil {
+		return err
+	}
+	if err := deleteRotation(p); err != nil {
+		p.Warnf("Failed to delete %s/%s: %v", Namespace, rotationSecret, err)
+	}
+	return restartComponents(p)
+}
+
+// saveRotation persists the values that are about to be changed in the rotation secret
+func saveRotation(p *platform.Platform, rotation map[string]string) error {
+	data := make(map[string][]byte)
+	for k, v := range rotation {
+		data[k] = []byte(v)
+	}
+	if err := p.CreateOrUpdateSecret(rotationSecret, Namespace, data); err != nil {
+		return errors.Wrapf(err, "failed to save %s/%s, no secrets have been changed", Namespace, rotationSecret)
+	}
+	return nil
+}
+
+func deleteRotation(p *platform.Platform) error {
+	clientset, err := p.GetClientset()
+	if err != nil {
+		return err
+	}
+	return clientset.CoreV1().Secrets(Namespace).Delete(rotationSecret, nil)
+}
+
+// rotateEncryptionKey re-encrypts the values in the database with the new secretKey in a transaction that
+// is only committed once the new secrets are persisted, the previous secrets are restored if it cannot be committed
+func rotateEncryptionKey(p *platform.Platform, managed bool, secrets map[string]string, oldKey string) error {
+	db, err := openDB(p, managed)
+	if err != nil {
+		return errors.Wrap(err, "failed to connect to the harbor database")
+	}
+	defer db.Close()
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // nolint: errcheck
+	p.Infof("Re-encrypting harbor data with the new secretKey")
+	if err := reencrypt(p.Logger, tx, oldKey, secrets[encryptionKey]); err != nil {
+		return errors.Wrap(err, "failed to re-encrypt harbor data, the secretKey has not been changed")
+	}
+	if err := persistSecrets(p, secrets); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		previous := make(map[string]string)
+		for k, v := range secrets {
+			previous[k] = v
+		}
+		previous[encryptionKey] = oldKey
+		if err := persistSecrets(p, previous); err != nil {
+			return errors.Wrapf(err, "failed to restore the secretKey, read the previous secretKey from %s/%s", Namespace, rotationSecret)
+		}
+		return errors.Wrap(err, "failed to commit the re-encrypted harbor data, the secretKey has not been changed")
+	}
+	return nil
+}
+
+// rotateDBPassword changes the password of the harbor database user and updates the credentials
+// secret of the postgres operator to match
+func rotateDBPassword(p *platform.Platform, password string) error {
+	cluster := "postgres-" + dbCluster
+	namespace := "postgres-operator"
+	name := fmt.Sprintf("app.%s.credentials", cluster)
+	clientset, err := p.GetClientset()
+	if err != nil {
+		return err
+	}
+	secret, err := clientset.CoreV1().Secrets(namespace).Get(name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	db, err := p.OpenDB(namespace, cluster, dbNames[0])
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	username := string(secret.Data["username"])
+	p.Infof("Rotating the password of database user %s", username)
+	if _, err := db.Exec("ALTER ROLE ? PASSWORD ?", pg.Ident(username), password); err != nil {
+		return err
+	}
+	secret.Data["password"] = []byte(password)
+	if _, err := clientset.CoreV1().Secrets(namespace).Update(secret); err != nil {
+		return errors.Wrapf(err, "failed to update %s, read the new database password from %s/%s", name, Namespace, rotationSecret)
+	}
+	return nil
+}
+
+// restartComponents performs a rolling restart of the harbor components and waits for them to be ready
+func restartComponents(p *platform.Platform) error {
+	var objects []unstructured.Unstructured
+	for _, name := range harborComponents {
+		p.Infof("Restarting %s", name)
+		if err := p.RestartDeployment(Namespace, name); err != nil {
+			return errors.Wrapf(err, "failed to restart %s", name)
+		}
+		obj := unstructured.Unstructured{}
+		obj.SetAPIVersion("apps/v1")
+		obj.SetKind("Deployment")
+		obj.SetNamespace(Namespace)
+		obj.SetName(name)
+		objects = append(objects, obj)
+	}
+	return p.WaitForReady(Namespace, 10*time.Minute, objects...)
+}
@@ -0,0 +1,74 @@
+package harbor
+
+import (
+	"testing"
+
+	"github.com/flanksource/commons/logger"
+	. "github.com/onsi/gomega"
+)
+
+func TestGenerateSecretsNewInstall(t *testing.T) {
+	g := NewWithT(t)
+	secrets, changed := generateSecrets(logger.StandardLogger(), map[string][]byte{}, "Harbor12345")
+	g.Expect(changed).To(BeTrue())
+	for _, key := range []string{coreSecretKey, jobserviceKey, registryKey, legacyNonceKey} {
+		g.Expect(secrets[key]).To(HaveLen(16), key)
+	}
+	g.Expect(secrets[coreSecretKey]).ToNot(Equal(secrets[jobserviceKey]))
+	g.Expect(secrets[encryptionKey]).To(HaveLen(16))
+	g.Expect(secrets[encryptionKey]).ToNot(Equal(legacySecretKey))
+	g.Expect(secrets[adminPasswordKey]).ToNot(Equal("Harbor12345"))
+	g.Expect(secrets[adminPasswordKey]).To(MatchRegexp("[A-Z].*[0-9]|[0-9].*[A-Z]"))
+
+	// the persisted secrets are reused as is
+	data := make(map[string][]byte)
+	for k, v := range secrets {
+		data[k] = []byte(v)
+	}
+	again, changed := generateSecrets(logger.StandardLogger(), data, "Harbor12345")
+	g.Expect(changed).To(BeFalse())
+	g.Expect(again).To(Equal(secrets))
+}
+
+func TestGenerateSecretsLegacy(t *testing.T) {
+	g := NewWithT(t)
+	secrets, changed := generateSecrets(logger.StandardLogger(), map[string][]byte{legacyNonceKey: []byte("shared-nonce")}, "Harbor12345")
+	g.Expect(changed).To(BeTrue())
+	g.Expect(secrets[coreSecretKey]).To(Equal("shared-nonce"))
+	g.Expect(secrets[jobserviceKey]).To(Equal("shared-nonce"))
+	g.Expect(secrets[registryKey]).To(Equal("shared-nonce"))
+	g.Expect(secrets[encryptionKey]).To(Equal(legacySecretKey))
+	g.Expect(secrets[adminPasswordKey]).To(Equal("Harbor12345"))
+
+	// rotated secrets of a legacy installation are kept
+	secrets, changed = generateSecrets(logger.StandardLogger(), map[string][]byte{
+		legacyNonceKey:   []byte("shared-nonce"),
+		coreSecretKey:    []byte("core"),
+		jobserviceKey:    []byte("jobservice"),
+		registryKey:      []byte("registry"),
+		encryptionKey:    []byte("0123456789abcdef"),
+		adminPasswordKey: []byte("Rotated1"),
+	}, "Harbor12345")
+	g.Expect(changed).To(BeFalse())
+	g.Expect(secrets[coreSecretKey]).To(Equal("core"))
+	g.Expect(secrets[encryptionKey]).To(Equal("0123456789abcdef"))
+	g.Expect(secrets[adminPasswordKey]).To(Equal("Rotated1"))
+}
+
+func TestEncryption(t *testing.T) {
+	g := NewWithT(t)
+	encrypted, err := encrypt("registry-password", legacySecretKey)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(encrypted).To(HavePrefix(encryptHeader))
+	again, _ := encrypt("registry-password", legacySecretKey)
+	g.Expect(again).ToNot(Equal(encrypted))
+
+	g.Expect(decrypt(encrypted, legacySecretKey)).To(Equal("registry-password"))
+	g.Expect(decrypt(encrypted, "0123456789abcdef")).ToNot(Equal("registry-password"))
+	_, err = decrypt("cmVnaXN0cnktcGFzc3dvcmQ=", legacySecretKey)
+	g.Expect(err).To(MatchError("value is not encrypted"))
+	_, err = decrypt(encryptHeader+"c2hvcnQ=", legacySecretKey)
+	g.Expect(err).To(MatchError("encrypted value is too short"))
+	_, err = encrypt("registry-password", "too-short")
+	g.Expect(err).To(HaveOccurred())
+}
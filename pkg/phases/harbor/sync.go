@@ -0,0 +1,635 @@
+package harbor
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/flanksource/commons/logger"
+	"github.com/flanksource/karina/pkg/platform"
+	"github.com/flanksource/karina/pkg/types"
+	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// ManagedDescription is set on the robot accounts, registries and replication policies created by
+// karina, so that they can be deleted once they are removed from the config
+const ManagedDescription = "Managed by karina"
+
+var roles = map[string]int{
+	"projectAdmin": 1,
+	"developer":    2,
+	"guest":        3,
+	"maintainer":   4,
+	"limitedGuest": 5,
+}
+
+// secretStore is the subset of the kubernetes client used to persist robot tokens and pull secrets
+type secretStore interface {
+	GetSecret(namespace, name string) *map[string][]byte
+	Apply(namespace string, objects ...runtime.Object) error
+}
+
+type syncer struct {
+	logger.Logger
+	client  *Client
+	secrets secretStore
+	harbor  *types.Harbor
+	dryRun  bool
+}
+
+// Sync reconciles the projects, members, robot accounts, registries and replication policies
+// declared in the config with harbor
+func Sync(p *platform.Platform) error {
+	if p.Harbor == nil || p.Harbor.Disabled {
+		return nil
+	}
+	client, err := NewClient(p)
+	if err != nil {
+		return err
+	}
+	return reconcile(p.Logger, client, p, p.Harbor, p.DryRun)
+}
+
+// SyncProjects reconciles projects that are declared outside of harbor.projects e.g. by tenants
+func SyncProjects(p *platform.Platform, projects ...types.HarborProject) error {
+	if p.Harbor == nil || p.Harbor.Disabled {
+		return fmt.Errorf("harbor is not enabled")
+	}
+	client, err := NewClient(p)
+	if err != nil {
+		return err
+	}
+	s := &syncer{Logger: p.Logger, client: client, secrets: p, harbor: p.Harbor, dryRun: p.DryRun}
+	for _, project := range projects {
+		if err := s.syncProject(project); err != nil {
+			return errors.Wrapf(err, "failed to sync project %s", project.Name)
+		}
+	}
+	return nil
+}
+
+func reconcile(log logger.Logger, client *Client, secrets secretStore, harbor *types.Harbor, dryRun bool) error {
+	s := &syncer{Logger: log, client: client, secrets: secrets, harbor: harbor, dryRun: dryRun}
+	if err := s.syncGC(); err != nil {
+		return errors.Wrap(err, "failed to sync the garbage collection schedule")
+	}
+	var names []string
+	for name := range harbor.Projects {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		project := harbor.Projects[name]
+		if project.Name == "" {
+			project.Name = name
+		}
+		if err := s.syncProject(project); err != nil {
+			return errors.Wrapf(err, "failed to sync project %s", project.Name)
+		}
+	}
+	return s.syncReplication()
+}
+
+// change logs the change and applies it, unless running in dry-run mode
+func (s *syncer) change(fn func() error, msg string, args ...interface{}) error {
+	if s.dryRun {
+		s.Infof("[dry-run] Would "+msg, args...)
+		return nil
+	}
+	s.Infof(strings.ToUpper(msg[:1])+msg[1:], args...)
+	return fn()
+}
+
+func (s *syncer) syncProject(config types.HarborProject) error {
+	var limit int64 = -1
+	if config.StorageLimit != "" {
+		quantity, err := resource.ParseQuantity(config.StorageLimit)
+		if err != nil {
+			return fmt.Errorf("invalid storageLimit %s: %v", config.StorageLimit, err)
+		}
+		limit = quantity.Value()
+	}
+	metadata := map[string]string{"public": fmt.Sprintf("%t", config.Public)}
+
+	project, err := s.client.GetProject(config.Name)
+	if err != nil {
+		return err
+	}
+	if project == nil {
+		err := s.change(func() error {
+			return s.client.CreateProject(Project{ProjectName: config.Name, Metadata: metadata, StorageLimit: &limit})
+		}, "create project %s", config.Name)
+		if err != nil || s.dryRun {
+			return err
+		}
+		if project, err = s.client.GetProject(config.Name); err != nil {
+			return err
+		} else if project == nil {
+			return fmt.Errorf("project not found after creation")
+		}
+	} else if project.Metadata["public"] != metadata["public"] {
+		project.Metadata = metadata
+		if err := s.change(func() error { return s.client.UpdateProject(*project) },
+			"set public=%t on project %s", config.Public, config.Name); err != nil {
+			return err
+		}
+	}
+
+	quota, err := s.client.GetProjectQuota(project.ID)
+	if err != nil {
+		return err
+	}
+	if quota != nil && quota.Hard["storage"] != limit {
+		quota.Hard = map[string]int64{"storage": limit}
+		if err := s.change(func() error { return s.client.UpdateQuota(*quota) },
+			"set the storage quota of project %s to %d bytes", config.Name, limit); err != nil {
+			return err
+		}
+	}
+
+	if err := s.syncRetention(*project, config); err != nil {
+		return errors.Wrap(err, "failed to sync the retention policy")
+	}
+	if err := s.syncMembers(project.ID, config); err != nil {
+		return err
+	}
+	return s.syncRobots(project.ID, config)
+}
+
+func (s *syncer) syncGC() error {
+	if s.harbor.GC == nil {
+		return nil
+	}
+	schedule := Schedule{Type: "Custom", Cron: s.harbor.GC.Schedule}
+	if schedule.Cron == "" {
+		schedule = Schedule{Type: "None"}
+	}
+	existing, err := s.client.GetGCSchedule()
+	if err != nil {
+		return err
+	}
+	if existing == nil {
+		return s.change(func() error { return s.client.CreateGCSchedule(schedule) },
+			"create the garbage collection schedule %s", schedule.Cron)
+	}
+	if existing.Type == schedule.Type && existing.Cron == schedule.Cron {
+		return nil
+	}
+	return s.change(func() error { return s.client.UpdateGCSchedule(schedule) },
+		"change the garbage collection schedule from %s to %s", existing.Cron, schedule.Cron)
+}
+
+// syncRetention creates or updates the retention policy of a project, harbor creates a policy
+// for every project so that the policy is normally updated
+func (s *syncer) syncRetention(project Project, config types.HarborProject) error {
+	if config.Retention == nil {
+		return nil
+	}
+	policy, err := newRetentionPolicy(project.ID, *config.Retention)
+	if err != nil {
+		return err
+	}
+	id, _ := strconv.Atoi(project.Metadata["retention_id"])
+	if id == 0 {
+		return s.change(func() error { return s.client.CreateRetention(policy) },
+			"create the retention policy of project %s", config.Name)
+	}
+	existing, err := s.client.GetRetention(id)
+	if err != nil {
+		return err
+	}
+	policy.ID = id
+	if reflect.DeepEqual(existing.Rules, policy.Rules) && reflect.DeepEqual(existing.Trigger.Settings, policy.Trigger.Settings) {
+		return nil
+	}
+	return s.change(func() error { return s.client.UpdateRetention(policy) },
+		"update the retention policy of project %s", config.Name)
+}
+
+func newRetentionPolicy(project int, config types.HarborRetention) (RetentionPolicy, error) {
+	// harbor deletes every tag that is not retained by a rule, so a policy without rules deletes everything
+	if len(config.Rules) == 0 {
+		return RetentionPolicy{}, fmt.Errorf("retention policies must have at least one rule")
+	}
+	policy := RetentionPolicy{
+		Algorithm: "or",
+		Rules:     []RetentionRule{},
+		Trigger: RetentionTrigger{
+			Kind:       "Schedule",
+			References: map[string]string{},
+			Settings:   map[string]string{"cron": config.Schedule},
+		},
+		Scope: RetentionScope{Level: "project", Ref: project},
+	}
+	for i, rule := range config.Rules {
+		templates := map[string]int{}
+		if rule.LatestPushed > 0 {
+			templates["latestPushedK"] = rule.LatestPushed
+		}
+		if rule.LatestPulled > 0 {
+			templates["latestPulledN"] = rule.LatestPulled
+		}
+		if rule.DaysSinceLastPush > 0 {
+			templates["nDaysSinceLastPush"] = rule.DaysSinceLastPush
+		}
+		if rule.DaysSinceLastPull > 0 {
+			templates["nDaysSinceLastPull"] = rule.DaysSinceLastPull
+		}
+		if rule.Always {
+			templates["always"] = 0
+		}
+		if len(templates) != 1 {
+			return policy, fmt.Errorf("retention rule %d must set exactly one of latestPushed, latestPulled, daysSinceLastPush, daysSinceLastPull or always", i+1)
+		}
+		repositories, tags := rule.Repositories, rule.Tags
+		if repositories == "" {
+			repositories = "**"
+		}
+		if tags == "" {
+			tags = "**"
+		}
+		for template, value := range templates {
+			params := map[string]int{}
+			if template != "always" {
+				params[template] = value
+			}
+			policy.Rules = append(policy.Rules, RetentionRule{
+				Action:       "retain",
+				Template:     template,
+				Params:       params,
+				TagSelectors: []RetentionSelector{{Kind: "doublestar", Decoration: "matches", Pattern: tags}},
+				ScopeSelectors: map[string][]RetentionSelector{
+					"repository": {{Kind: "doublestar", Decoration: "repoMatches", Pattern: repositories}},
+				},
+			})
+		}
+	}
+	return policy, nil
+}
+
+// syncMembers assigns the declared roles to groups, groups that are not declared are removed when
+// any roles are declared, user members are never removed
+func (s *syncer) syncMembers(project int, config types.HarborProject) error {
+	if len(config.Roles) == 0 {
+		return nil
+	}
+	members, err := s.client.ListMembers(project)
+	if err != nil {
+		return err
+	}
+	existing := make(map[string]ProjectMember)
+	for _, member := range members {
+		if member.EntityType == "g" {
+			existing[member.EntityName] = member
+		}
+	}
+
+	declared := make(map[string]bool)
+	var groups []string
+	for group := range config.Roles {
+		groups = append(groups, group)
+	}
+	sort.Strings(groups)
+	for _, group := range groups {
+		role, ok := roles[config.Roles[group]]
+		if !ok {
+			return fmt.Errorf("invalid role %s for %s", config.Roles[group], group)
+		}
+		name := groupName(group)
+		declared[name] = true
+		member, ok := existing[name]
+		if !ok {
+			request := ProjectMemberRequest{RoleID: role, MemberGroup: s.memberGroup(group)}
+			if err := s.change(func() error { return s.client.AddMember(project, request) },
+				"add group %s to project %s as %s", group, config.Name, config.Roles[group]); err != nil {
+				return err
+			}
+		} else if member.RoleID != role {
+			if err := s.change(func() error { return s.client.UpdateMember(project, member.ID, role) },
+				"change the role of group %s in project %s to %s", group, config.Name, config.Roles[group]); err != nil {
+				return err
+			}
+		}
+	}
+
+	for name, member := range existing {
+		if declared[name] {
+			continue
+		}
+		id := member.ID
+		if err := s.change(func() error { return s.client.DeleteMember(project, id) },
+			"remove group %s from project %s", name, config.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *syncer) memberGroup(group string) *MemberGroup {
+	authMode := ""
+	if s.harbor.Settings != nil {
+		authMode = s.harbor.Settings.AuthMode
+	}
+	switch authMode {
+	case "oidc_auth":
+		return &MemberGroup{GroupName: group, GroupType: 3}
+	case "http_auth":
+		return &MemberGroup{GroupName: group, GroupType: 2}
+	default:
+		return &MemberGroup{GroupName: groupName(group), GroupType: 1, LdapGroupDN: group}
+	}
+}
+
+// groupName returns the value of the first RDN for LDAP DNs e.g. cn=admins,ou=groups returns admins
+func groupName(group string) string {
+	if !strings.Contains(group, "=") {
+		return group
+	}
+	rdn := strings.Split(group, ",")[0]
+	return strings.TrimSpace(rdn[strings.Index(rdn, "=")+1:])
+}
+
+// syncRobots creates the declared robot accounts and stores their tokens, as the token is only
+// returned on creation, robots without a stored token are recreated
+func (s *syncer) syncRobots(project int, config types.HarborProject) error {
+	robots, err := s.client.ListRobots(project)
+	if err != nil {
+		return err
+	}
+	existing := make(map[string]Robot)
+	for _, robot := range robots {
+		existing[strings.TrimPrefix(robot.Name, "robot$")] = robot
+	}
+
+	declared := make(map[string]bool)
+	for _, config := range config.Robots {
+		declared[config.Name] = true
+	}
+	for name, robot := range existing {
+		if declared[name] || robot.Description != ManagedDescription {
+			continue
+		}
+		id := robot.ID
+		if err := s.change(func() error { return s.client.DeleteRobot(project, id) },
+			"delete robot %s from project %s", name, config.Name); err != nil {
+			return err
+		}
+	}
+
+	for _, robot := range config.Robots {
+		if err := s.syncRobot(project, config.Name, robot, existing); err != nil {
+			return errors.Wrapf(err, "failed to sync robot %s", robot.Name)
+		}
+	}
+	return nil
+}
+
+func (s *syncer) syncRobot(project int, projectName string, config types.HarborRobot, existing map[string]Robot) error {
+	tokenSecret := fmt.Sprintf("robot-%s-%s", projectName, config.Name)
+	var username, token string
+	if secret := s.secrets.GetSecret(Namespace, tokenSecret); secret != nil {
+		username = string((*secret)["username"])
+		token = string((*secret)["token"])
+	}
+
+	robot, exists := existing[config.Name]
+	if exists && (token == "" || robot.Disabled) {
+		id := robot.ID
+		if err := s.change(func() error { return s.client.DeleteRobot(project, id) },
+			"delete robot %s from project %s as its token is not stored", config.Name, projectName); err != nil {
+			return err
+		}
+		exists = false
+	}
+	if !exists {
+		access := []RobotAccess{{Resource: fmt.Sprintf("/project/%d/repository", project), Action: "pull"}}
+		if config.Push {
+			access = append(access, RobotAccess{Resource: access[0].Resource, Action: "push"})
+		}
+		request := Robot{Name: config.Name, Description: ManagedDescription, Access: access}
+		err := s.change(func() error {
+			created, err := s.client.CreateRobot(project, request)
+			if err != nil {
+				return err
+			}
+			username, token = created.Name, created.Token
+			return s.secrets.Apply(Namespace, newSecret(Namespace, tokenSecret, v1.SecretTypeOpaque, map[string][]byte{
+				"username": []byte(username),
+				"token":    []byte(token),
+			}))
+		}, "create robot %s in project %s", config.Name, projectName)
+		if err != nil || s.dryRun {
+			return err
+		}
+	}
+
+	if len(config.Namespaces) == 0 {
+		return nil
+	}
+	dockerConfig, err := s.dockerConfig(username, token)
+	if err != nil {
+		return err
+	}
+	name := config.SecretName
+	if name == "" {
+		name = fmt.Sprintf("harbor-%s-%s", projectName, config.Name)
+	}
+	for _, namespace := range config.Namespaces {
+		if s.dryRun {
+			s.Infof("[dry-run] Would apply pull secret %s/%s", namespace, name)
+			continue
+		}
+		s.Debugf("Applying pull secret %s/%s", namespace, name)
+		if err := s.secrets.Apply(namespace, newSecret(namespace, name, v1.SecretTypeDockerConfigJson, map[string][]byte{
+			v1.DockerConfigJsonKey: dockerConfig,
+		})); err != nil {
+			return errors.Wrapf(err, "failed to apply pull secret %s/%s", namespace, name)
+		}
+	}
+	return nil
+}
+
+func (s *syncer) dockerConfig(username, token string) ([]byte, error) {
+	host := s.harbor.URL
+	if u, err := url.Parse(s.harbor.URL); err == nil && u.Host != "" {
+		host = u.Host
+	}
+	return json.Marshal(map[string]interface{}{
+		"auths": map[string]interface{}{
+			host: map[string]string{
+				"username": username,
+				"password": token,
+				"auth":     base64.StdEncoding.EncodeToString([]byte(username + ":" + token)),
+			},
+		},
+	})
+}
+
+func newSecret(namespace, name string, secretType v1.SecretType, data map[string][]byte) *v1.Secret {
+	return &v1.Secret{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Secret"},
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+		Type:       secretType,
+		Data:       data,
+	}
+}
+
+// syncReplication reconciles registries and replication policies, policies are deleted before
+// registries as harbor refuses to delete registries that are still in use
+func (s *syncer) syncReplication() error {
+	registries, err := s.client.ListRegistries()
+	if err != nil {
+		return err
+	}
+	existingRegistries := make(map[string]ReplicationRegistry)
+	for _, registry := range registries {
+		existingRegistries[registry.Name] = registry
+	}
+	policies, err := s.client.ListReplicationPolicies()
+	if err != nil {
+		return err
+	}
+	existingPolicies := make(map[string]ReplicationPolicy)
+	for _, policy := range policies {
+		existingPolicies[policy.Name] = policy
+	}
+
+	declaredRegistries := make(map[string]bool)
+	for _, registry := range s.harbor.Registries {
+		declaredRegistries[registry.Name] = true
+	}
+	declaredPolicies := make(map[string]bool)
+	for _, replication := range s.harbor.Replication {
+		if !declaredRegistries[replication.Registry] {
+			return fmt.Errorf("replication %s references undeclared registry %s", replication.Name, replication.Registry)
+		}
+		declaredPolicies[replication.Name] = true
+	}
+
+	for name, policy := range existingPolicies {
+		if declaredPolicies[name] || policy.Description != ManagedDescription {
+			continue
+		}
+		id := policy.ID
+		if err := s.change(func() error { return s.client.DeleteReplicationPolicy(id) },
+			"delete replication policy %s", name); err != nil {
+			return err
+		}
+	}
+	for name, registry := range existingRegistries {
+		if declaredRegistries[name] || registry.Description != ManagedDescription {
+			continue
+		}
+		id := registry.ID
+		if err := s.change(func() error { return s.client.DeleteRegistry(id) },
+			"delete registry %s", name); err != nil {
+			return err
+		}
+	}
+
+	for _, config := range s.harbor.Registries {
+		registry := newRegistry(config)
+		if existing, ok := existingRegistries[config.Name]; ok {
+			registry.ID = existing.ID
+			if err := s.change(func() error { return s.client.UpdateRegistry(registry) },
+				"update registry %s", config.Name); err != nil {
+				return err
+			}
+		} else if err := s.change(func() error { return s.client.CreateRegistry(registry) },
+			"create registry %s", config.Name); err != nil {
+			return err
+		}
+	}
+	if s.dryRun || len(s.harbor.Replication) == 0 {
+		return nil
+	}
+
+	// registry ids are needed by the policies, including those of newly created registries
+	if registries, err = s.client.ListRegistries(); err != nil {
+		return err
+	}
+	for _, registry := range registries {
+		existingRegistries[registry.Name] = registry
+	}
+	for _, config := range s.harbor.Replication {
+		registry := existingRegistries[config.Registry]
+		policy, err := newReplicationPolicy(config, &ReplicationRegistry{ID: registry.ID})
+		if err != nil {
+			return errors.Wrapf(err, "invalid replication %s", config.Name)
+		}
+		if existing, ok := existingPolicies[config.Name]; ok {
+			policy.ID = existing.ID
+			if err := s.change(func() error { return s.client.UpdateReplicationPolicy(policy) },
+				"update replication policy %s", config.Name); err != nil {
+				return err
+			}
+		} else if err := s.change(func() error { return s.client.CreateReplicationPolicy(policy) },
+			"create replication policy %s", config.Name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func newRegistry(config types.HarborRegistry) ReplicationRegistry {
+	registry := ReplicationRegistry{
+		Name:        config.Name,
+		URL:         config.URL,
+		Type:        config.Type,
+		Insecure:    config.Insecure,
+		Description: ManagedDescription,
+	}
+	if registry.Type == "" {
+		registry.Type = "harbor"
+	}
+	if config.Username != "" {
+		registry.Credential = &RegistryCredential{
+			Type:         "basic",
+			AccessKey:    config.Username,
+			AccessSecret: config.Password,
+		}
+	}
+	return registry
+}
+
+func newReplicationPolicy(config types.HarborReplication, registry *ReplicationRegistry) (ReplicationPolicy, error) {
+	policy := ReplicationPolicy{
+		Name:          config.Name,
+		Description:   ManagedDescription,
+		DestNamespace: config.DestNamespace,
+		Override:      config.Override,
+		Deletion:      config.Deletion,
+		Enabled:       !config.Disabled,
+		Trigger:       &ReplicationTrigger{},
+	}
+	switch config.Direction {
+	case "", "pull":
+		policy.SrcRegistry = registry
+		policy.Trigger.Type = "manual"
+	case "push":
+		policy.DestRegistry = registry
+		policy.Trigger.Type = "event_based"
+	default:
+		return policy, fmt.Errorf("direction must be pull or push, not %s", config.Direction)
+	}
+	if config.Schedule != "" {
+		policy.Trigger.Type = "scheduled"
+		policy.Trigger.TriggerSettings.Cron = config.Schedule
+	}
+	if config.Repositories != "" {
+		policy.Filters = append(policy.Filters, ReplicationFilter{Type: "name", Value: config.Repositories})
+	}
+	if config.Tags != "" {
+		policy.Filters = append(policy.Filters, ReplicationFilter{Type: "tag", Value: config.Tags})
+	}
+	return policy, nil
+}
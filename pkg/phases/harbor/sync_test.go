@@ -0,0 +1,370 @@
+package harbor
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/flanksource/commons/logger"
+	"github.com/flanksource/karina/pkg/types"
+	. "github.com/onsi/gomega"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// stubHarbor is an in-memory implementation of the parts of the harbor API used by sync
+type stubHarbor struct {
+	sync.Mutex
+	nextID     int
+	projects   map[int]*Project
+	quotas     map[int]*Quota
+	members    map[int]map[int]*ProjectMember
+	robots     map[int]map[int]*Robot
+	registries map[int]*ReplicationRegistry
+	policies   map[int]*ReplicationPolicy
+	retentions map[int]*RetentionPolicy
+	gc         *Schedule
+	// the number of POST and DELETE requests received
+	changes int
+}
+
+func newStubHarbor() *stubHarbor {
+	return &stubHarbor{
+		projects:   make(map[int]*Project),
+		quotas:     make(map[int]*Quota),
+		members:    make(map[int]map[int]*ProjectMember),
+		robots:     make(map[int]map[int]*Robot),
+		registries: make(map[int]*ReplicationRegistry),
+		policies:   make(map[int]*ReplicationPolicy),
+		retentions: make(map[int]*RetentionPolicy),
+	}
+}
+
+func (h *stubHarbor) id() int {
+	h.nextID++
+	return h.nextID
+}
+
+func (h *stubHarbor) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.Lock()
+	defer h.Unlock()
+	if r.Method == http.MethodPost || r.Method == http.MethodDelete {
+		h.changes++
+	}
+	path := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/"), "/"), "/")
+	id := func(i int) int {
+		n, _ := strconv.Atoi(path[i])
+		return n
+	}
+	decode := func(out interface{}) {
+		json.NewDecoder(r.Body).Decode(out) // nolint: errcheck
+	}
+	reply := func(out interface{}) {
+		json.NewEncoder(w).Encode(out) // nolint: errcheck
+	}
+	// numeric segments are replaced with "id" e.g. DELETE projects/id/members/id
+	var segments []string
+	for _, segment := range path {
+		if _, err := strconv.Atoi(segment); err == nil {
+			segment = "id"
+		}
+		segments = append(segments, segment)
+	}
+	route := r.Method + " " + strings.Join(segments, "/")
+
+	switch route {
+	case "GET projects":
+		var list []Project
+		for _, p := range h.projects {
+			if p.Name == r.URL.Query().Get("name") {
+				list = append(list, *p)
+			}
+		}
+		reply(list)
+	case "POST projects":
+		var p Project
+		decode(&p)
+		p.ID, p.Name, p.ProjectName = h.id(), p.ProjectName, ""
+		h.projects[p.ID] = &p
+		h.quotas[p.ID] = &Quota{ID: p.ID, Hard: map[string]int64{"storage": *p.StorageLimit}}
+		p.StorageLimit = nil
+		w.WriteHeader(http.StatusCreated)
+	case "PUT projects/id":
+		decode(h.projects[id(1)])
+	case "GET quotas":
+		projectID, _ := strconv.Atoi(r.URL.Query().Get("reference_id"))
+		reply([]Quota{*h.quotas[projectID]})
+	case "PUT quotas/id":
+		decode(h.quotas[id(1)])
+	case "GET projects/id/members":
+		list := []ProjectMember{}
+		for _, m := range h.members[id(1)] {
+			list = append(list, *m)
+		}
+		reply(list)
+	case "POST projects/id/members":
+		var req ProjectMemberRequest
+		decode(&req)
+		if h.members[id(1)] == nil {
+			h.members[id(1)] = make(map[int]*ProjectMember)
+		}
+		m := &ProjectMember{ID: h.id(), EntityName: req.MemberGroup.GroupName, EntityType: "g", RoleID: req.RoleID}
+		h.members[id(1)][m.ID] = m
+		w.WriteHeader(http.StatusCreated)
+	case "PUT projects/id/members/id":
+		var req ProjectMemberRequest
+		decode(&req)
+		h.members[id(1)][id(3)].RoleID = req.RoleID
+	case "DELETE projects/id/members/id":
+		delete(h.members[id(1)], id(3))
+	case "GET projects/id/robots":
+		list := []Robot{}
+		for _, robot := range h.robots[id(1)] {
+			list = append(list, *robot)
+		}
+		reply(list)
+	case "POST projects/id/robots":
+		var robot Robot
+		decode(&robot)
+		if h.robots[id(1)] == nil {
+			h.robots[id(1)] = make(map[int]*Robot)
+		}
+		robot.ID, robot.Name = h.id(), "robot$"+robot.Name
+		h.robots[id(1)][robot.ID] = &robot
+		w.WriteHeader(http.StatusCreated)
+		reply(RobotToken{Name: robot.Name, Token: "token-" + strconv.Itoa(robot.ID)})
+	case "DELETE projects/id/robots/id":
+		delete(h.robots[id(1)], id(3))
+	case "GET registries":
+		list := []ReplicationRegistry{}
+		for _, registry := range h.registries {
+			list = append(list, *registry)
+		}
+		reply(list)
+	case "POST registries":
+		var registry ReplicationRegistry
+		decode(&registry)
+		registry.ID = h.id()
+		h.registries[registry.ID] = &registry
+		w.WriteHeader(http.StatusCreated)
+	case "PUT registries/id":
+		decode(h.registries[id(1)])
+	case "DELETE registries/id":
+		for _, policy := range h.policies {
+			if policy.SrcRegistry != nil && policy.SrcRegistry.ID == id(1) {
+				http.Error(w, "registry in use", http.StatusPreconditionFailed)
+				return
+			}
+		}
+		delete(h.registries, id(1))
+	case "GET replication/policies":
+		list := []ReplicationPolicy{}
+		for _, policy := range h.policies {
+			list = append(list, *policy)
+		}
+		reply(list)
+	case "POST replication/policies":
+		var policy ReplicationPolicy
+		decode(&policy)
+		policy.ID = h.id()
+		h.policies[policy.ID] = &policy
+		w.WriteHeader(http.StatusCreated)
+	case "PUT replication/policies/id":
+		decode(h.policies[id(2)])
+	case "DELETE replication/policies/id":
+		delete(h.policies, id(2))
+	case "GET system/gc/schedule":
+		reply(AdminJob{Schedule: h.gc})
+	case "POST system/gc/schedule", "PUT system/gc/schedule":
+		job := AdminJob{}
+		decode(&job)
+		h.gc = job.Schedule
+	case "GET retentions/id":
+		reply(h.retentions[id(1)])
+	case "POST retentions":
+		var policy RetentionPolicy
+		decode(&policy)
+		policy.ID = h.id()
+		h.retentions[policy.ID] = &policy
+		h.projects[policy.Scope.Ref].Metadata["retention_id"] = strconv.Itoa(policy.ID)
+		w.WriteHeader(http.StatusCreated)
+	case "PUT retentions/id":
+		decode(h.retentions[id(1)])
+	default:
+		http.Error(w, route+" not found", http.StatusNotFound)
+	}
+}
+
+type stubSecrets map[string]*v1.Secret
+
+func (s stubSecrets) GetSecret(namespace, name string) *map[string][]byte {
+	if secret, ok := s[namespace+"/"+name]; ok {
+		return &secret.Data
+	}
+	return nil
+}
+
+func (s stubSecrets) Apply(namespace string, objects ...runtime.Object) error {
+	for _, obj := range objects {
+		secret := obj.(*v1.Secret)
+		s[namespace+"/"+secret.Name] = secret
+	}
+	return nil
+}
+
+func newStubClient(stub *stubHarbor) (*Client, func()) {
+	server := httptest.NewServer(stub)
+	return newClient(logger.StandardLogger(), server.Client(), server.URL, "https://harbor.example.com", "password"), server.Close
+}
+
+func TestSync(t *testing.T) {
+	g := NewWithT(t)
+	stub := newStubHarbor()
+	client, stop := newStubClient(stub)
+	defer stop()
+	secrets := stubSecrets{}
+
+	config := &types.Harbor{
+		URL: "https://harbor.example.com",
+		Projects: map[string]types.HarborProject{
+			"apps": {
+				Public:       true,
+				StorageLimit: "1Gi",
+				Roles: map[string]string{
+					"cn=developers,ou=groups,dc=example,dc=com": "developer",
+					"cn=admins,ou=groups,dc=example,dc=com":     "projectAdmin",
+				},
+				Robots: []types.HarborRobot{{Name: "ci", Push: true, Namespaces: []string{"ci", "apps"}}},
+			},
+		},
+		Registries: []types.HarborRegistry{{Name: "hub", URL: "https://hub.docker.com", Type: "docker-hub"}},
+		Replication: []types.HarborReplication{
+			{Name: "library", Registry: "hub", Repositories: "library/**", Schedule: "0 0 2 * * *"},
+		},
+	}
+	g.Expect(reconcile(logger.StandardLogger(), client, secrets, config, false)).To(Succeed())
+
+	g.Expect(stub.projects).To(HaveLen(1))
+	project := stub.projects[1]
+	g.Expect(project.Name).To(Equal("apps"))
+	g.Expect(project.Metadata["public"]).To(Equal("true"))
+	g.Expect(stub.quotas[project.ID].Hard["storage"]).To(Equal(int64(1 << 30)))
+	g.Expect(stub.members[project.ID]).To(HaveLen(2))
+	g.Expect(stub.robots[project.ID]).To(HaveLen(1))
+	g.Expect(secrets).To(HaveKey("harbor/robot-apps-ci"))
+	g.Expect(secrets).To(HaveKey("ci/harbor-apps-ci"))
+	pullSecret := secrets["apps/harbor-apps-ci"]
+	g.Expect(pullSecret.Type).To(Equal(v1.SecretTypeDockerConfigJson))
+	g.Expect(string(pullSecret.Data[v1.DockerConfigJsonKey])).To(ContainSubstring(`"harbor.example.com"`))
+	g.Expect(stub.registries).To(HaveLen(1))
+	g.Expect(stub.policies).To(HaveLen(1))
+	for _, policy := range stub.policies {
+		g.Expect(policy.SrcRegistry).ToNot(BeNil())
+		g.Expect(policy.Trigger.Type).To(Equal("scheduled"))
+	}
+
+	// a second run does not create or delete anything
+	stub.changes = 0
+	g.Expect(reconcile(logger.StandardLogger(), client, secrets, config, false)).To(Succeed())
+	g.Expect(stub.changes).To(Equal(0))
+
+	// roles, robots, policies and registries that are removed from the config are pruned
+	apps := config.Projects["apps"]
+	apps.Public = false
+	apps.Roles = map[string]string{"cn=developers,ou=groups,dc=example,dc=com": "maintainer"}
+	apps.Robots = nil
+	config.Projects["apps"] = apps
+	config.Registries = nil
+	config.Replication = nil
+	g.Expect(reconcile(logger.StandardLogger(), client, secrets, config, false)).To(Succeed())
+	g.Expect(project.Metadata["public"]).To(Equal("false"))
+	g.Expect(stub.members[project.ID]).To(HaveLen(1))
+	for _, member := range stub.members[project.ID] {
+		g.Expect(member.EntityName).To(Equal("developers"))
+		g.Expect(member.RoleID).To(Equal(roles["maintainer"]))
+	}
+	g.Expect(stub.robots[project.ID]).To(BeEmpty())
+	g.Expect(stub.policies).To(BeEmpty())
+	g.Expect(stub.registries).To(BeEmpty())
+}
+
+func TestSyncRecreatesRobotsWithoutToken(t *testing.T) {
+	g := NewWithT(t)
+	stub := newStubHarbor()
+	client, stop := newStubClient(stub)
+	defer stop()
+
+	config := &types.Harbor{
+		Projects: map[string]types.HarborProject{
+			"apps": {Robots: []types.HarborRobot{{Name: "ci"}}},
+		},
+	}
+	g.Expect(reconcile(logger.StandardLogger(), client, stubSecrets{}, config, false)).To(Succeed())
+	// the token secret is lost, so the robot must be recreated to obtain a new token
+	secrets := stubSecrets{}
+	g.Expect(reconcile(logger.StandardLogger(), client, secrets, config, false)).To(Succeed())
+	g.Expect(stub.robots[1]).To(HaveLen(1))
+	g.Expect(string(secrets["harbor/robot-apps-ci"].Data["token"])).ToNot(BeEmpty())
+}
+
+func TestSyncRetentionAndGC(t *testing.T) {
+	g := NewWithT(t)
+	stub := newStubHarbor()
+	client, stop := newStubClient(stub)
+	defer stop()
+
+	config := &types.Harbor{
+		GC: &types.HarborGC{Schedule: "0 0 2 * * 6"},
+		Projects: map[string]types.HarborProject{
+			"apps": {
+				Retention: &types.HarborRetention{
+					Schedule: "0 0 3 * * *",
+					Rules:    []types.HarborRetentionRule{{Repositories: "apps/**", LatestPushed: 10}},
+				},
+			},
+		},
+	}
+	g.Expect(reconcile(logger.StandardLogger(), client, stubSecrets{}, config, false)).To(Succeed())
+	g.Expect(stub.gc).To(Equal(&Schedule{Type: "Custom", Cron: "0 0 2 * * 6"}))
+	g.Expect(stub.retentions).To(HaveLen(1))
+	policy := stub.retentions[2]
+	g.Expect(policy.Rules).To(HaveLen(1))
+	g.Expect(policy.Rules[0].Template).To(Equal("latestPushedK"))
+	g.Expect(policy.Rules[0].Params).To(Equal(map[string]int{"latestPushedK": 10}))
+	g.Expect(policy.Trigger.Settings["cron"]).To(Equal("0 0 3 * * *"))
+
+	stub.changes = 0
+	g.Expect(reconcile(logger.StandardLogger(), client, stubSecrets{}, config, false)).To(Succeed())
+	g.Expect(stub.changes).To(Equal(0))
+
+	config.Projects["apps"].Retention.Rules[0].LatestPushed = 5
+	config.GC.Schedule = ""
+	g.Expect(reconcile(logger.StandardLogger(), client, stubSecrets{}, config, false)).To(Succeed())
+	g.Expect(stub.retentions).To(HaveLen(1))
+	g.Expect(policy.Rules[0].Params).To(Equal(map[string]int{"latestPushedK": 5}))
+	g.Expect(stub.gc.Type).To(Equal("None"))
+
+	config.Projects["apps"].Retention.Rules[0].Always = true
+	g.Expect(reconcile(logger.StandardLogger(), client, stubSecrets{}, config, false)).ToNot(Succeed())
+
+	config.Projects["apps"].Retention.Rules = []types.HarborRetentionRule{}
+	g.Expect(reconcile(logger.StandardLogger(), client, stubSecrets{}, config, false)).To(MatchError(ContainSubstring("at least one rule")))
+}
+
+func TestParseImage(t *testing.T) {
+	g := NewWithT(t)
+	for image, expected := range map[string][2]string{
+		"nginx":                                  {"library/nginx", "latest"},
+		"docker.io/flanksource/karina:v0.1":      {"flanksource/karina", "v0.1"},
+		"quay.io/coreos/etcd:v3.4":               {"coreos/etcd", "v3.4"},
+		"localhost:5000/app@sha256:abc":          {"app", "sha256:abc"},
+		"harbor.example.com/library/busybox:1.2": {"library/busybox", "1.2"},
+	} {
+		repository, tag := parseImage(image)
+		g.Expect([2]string{repository, tag}).To(Equal(expected), image)
+	}
+}
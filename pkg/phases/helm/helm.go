@@ -0,0 +1,152 @@
+package helm
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/flanksource/commons/text"
+	"github.com/flanksource/karina/pkg/k8s"
+	"github.com/flanksource/karina/pkg/platform"
+	"github.com/flanksource/karina/pkg/types"
+	"github.com/pkg/errors"
+)
+
+// Phase returns a deploy function that applies the chart
+func Phase(chart types.HelmChart) func(p *platform.Platform) error {
+	return func(p *platform.Platform) error {
+		return Apply(p, chart)
+	}
+}
+
+// Apply renders the chart and applies the resulting specs, the specs go through the same
+// kustomize patches, apply hooks and dry-run handling as ApplySpecs
+func Apply(p *platform.Platform, chart types.HelmChart) error {
+	specs, err := Template(p, chart)
+	if err != nil {
+		return err
+	}
+	if err := p.CreateOrUpdateNamespace(chart.Namespace, nil, nil); err != nil {
+		return err
+	}
+	p.Infof("Applying chart %s to %s", chart.Name, chart.Namespace)
+	return p.ApplyText(chart.Namespace, specs)
+}
+
+// Delete renders the chart and deletes the resulting objects in reverse order
+func Delete(p *platform.Platform, chart types.HelmChart) error {
+	specs, err := Template(p, chart)
+	if err != nil {
+		return err
+	}
+	return DeleteText(p, chart.Namespace, specs)
+}
+
+// DeleteText deletes the objects in specs that exist in reverse order, so that e.g. namespaces
+// and CRDs are deleted after the objects in them
+func DeleteText(p *platform.Platform, namespace, specs string) error {
+	if p.TerminationProtection {
+		p.Debugf("Skipping deletion of resources when termination protection is enabled ")
+		return nil
+	}
+	objects, err := k8s.GetUnstructuredObjects([]byte(specs))
+	if err != nil {
+		return err
+	}
+	for i := len(objects) - 1; i >= 0; i-- {
+		object := objects[i]
+		if object.GetNamespace() == "" {
+			object.SetNamespace(namespace)
+		}
+		if err := p.Get(object.GetNamespace(), object.GetName(), &object); err != nil {
+			continue
+		}
+		if err := p.DeleteUnstructured(object.GetNamespace(), &object); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Template renders the chart using helm template, the chart must be available locally
+// or embedded so that no network access is required
+func Template(p *platform.Platform, chart types.HelmChart) (string, error) {
+	if chart.Name == "" || chart.Namespace == "" || chart.Chart == "" {
+		return "", fmt.Errorf("helm charts require a name, namespace and chart")
+	}
+	dir, err := ioutil.TempDir("", "helm-"+chart.Name)
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+
+	path, err := getChart(p, chart.Chart, dir)
+	if err != nil {
+		return "", err
+	}
+
+	version := p.Versions["helm"]
+	if version == "" {
+		version = platform.Dependencies["helm"].Version
+	}
+	helm, err := p.GetBinaryPath("helm", version)
+	if err != nil {
+		return "", err
+	}
+	v3 := strings.HasPrefix(strings.TrimPrefix(version, "v"), "3")
+	var args []string
+	if v3 {
+		args = []string{"template", chart.Name, path, "--namespace", chart.Namespace, "--include-crds"}
+	} else {
+		args = []string{"template", path, "--name", chart.Name, "--namespace", chart.Namespace}
+	}
+	if chart.Values != "" {
+		values, err := getValues(p, chart.Values)
+		if err != nil {
+			return "", errors.Wrapf(err, "failed to template values for %s", chart.Name)
+		}
+		file := filepath.Join(dir, "values.yaml")
+		if err := ioutil.WriteFile(file, []byte(values), 0644); err != nil {
+			return "", err
+		}
+		args = append(args, "--values", file)
+	}
+
+	p.Debugf("helm %s", strings.Join(args, " "))
+	cmd := exec.Command(helm, args...)
+	// helm 2 requires a home directory even though template does not use it
+	cmd.Env = append(os.Environ(), "HELM_HOME="+filepath.Join(dir, ".helm"))
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to render %s: %v %s", chart.Name, err, stderr.String())
+	}
+	p.Tracef("Rendered %s:\n%s", chart.Name, string(out))
+	return string(out), nil
+}
+
+// getChart returns a local path to the chart, copying embedded tarballs into dir
+func getChart(p *platform.Platform, chart, dir string) (string, error) {
+	if _, err := os.Stat(chart); err == nil {
+		return chart, nil
+	}
+	data, err := p.GetResourceByName(chart, "manifests")
+	if err != nil {
+		return "", fmt.Errorf("chart %s not found locally or in the embedded manifests", chart)
+	}
+	path := filepath.Join(dir, filepath.Base(chart))
+	return path, ioutil.WriteFile(path, []byte(data), 0644)
+}
+
+// getValues returns the templated values file, read locally or from the embedded manifests
+func getValues(p *platform.Platform, values string) (string, error) {
+	if data, err := ioutil.ReadFile(values); err == nil {
+		return text.Template(string(data), p.PlatformConfig)
+	}
+	return p.Template(values, "manifests")
+}
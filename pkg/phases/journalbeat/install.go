@@ -2,6 +2,7 @@ package journalbeat
 
 import (
 	"github.com/flanksource/karina/pkg/constants"
+	"github.com/flanksource/karina/pkg/phases/beats"
 	"github.com/flanksource/karina/pkg/platform"
 )
 
@@ -11,5 +12,17 @@ func Deploy(p *platform.Platform) error {
 		return p.DeleteSpecs(constants.PlatformSystem, "journalbeat.yaml")
 	}
 
+	beat := beats.Beat{
+		Type:        "journalbeat",
+		BeatsOutput: beats.WithDefaultOutput(p, p.Journalbeat.BeatsOutput),
+	}
+	if !beat.HasOutput() {
+		p.Warnf("Skipping deployment of journalbeat, no output is specified and there is no infra filebeat with an elasticsearch output")
+		return nil
+	}
+	if err := beats.Deploy(p, beat); err != nil {
+		return err
+	}
+
 	return p.ApplySpecs(constants.PlatformSystem, "journalbeat.yaml")
 }
@@ -35,7 +35,11 @@ func NewClusterConfig(cfg *platform.Platform) api.ClusterConfiguration {
 		ImageRepository:      "k8s.gcr.io",
 		ControlPlaneEndpoint: cfg.JoinEndpoint,
 	}
-	cluster.Networking.DNSDomain = "cluster.local"
+	// the kubelet cluster domain is defaulted from the kubeadm DNS domain, it must match the zone served by CoreDNS
+	cluster.Networking.DNSDomain = cfg.NodeLocalDNS.DNSDomain
+	if cluster.Networking.DNSDomain == "" {
+		cluster.Networking.DNSDomain = "cluster.local"
+	}
 	cluster.Networking.ServiceSubnet = cfg.ServiceSubnet
 	cluster.Networking.PodSubnet = cfg.PodSubnet
 	cluster.DNS.Type = "CoreDNS"
@@ -0,0 +1,434 @@
+package monitoring
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/flanksource/commons/console"
+	"github.com/flanksource/karina/pkg/k8s/proxy"
+	"github.com/flanksource/karina/pkg/platform"
+	"github.com/flanksource/karina/pkg/types"
+	"github.com/pkg/errors"
+	"gopkg.in/flanksource/yaml.v3"
+	v1 "k8s.io/api/core/v1"
+)
+
+const (
+	alertmanagerPod = "alertmanager-main-0"
+	silenceCreator  = "karina"
+)
+
+type receiverConfig struct {
+	Name             string            `yaml:"name"`
+	EmailConfigs     []emailConfig     `yaml:"email_configs,omitempty"`
+	SlackConfigs     []slackConfig     `yaml:"slack_configs,omitempty"`
+	WebhookConfigs   []webhookConfig   `yaml:"webhook_configs,omitempty"`
+	PagerdutyConfigs []pagerdutyConfig `yaml:"pagerduty_configs,omitempty"`
+}
+
+type emailConfig struct {
+	To           string `yaml:"to"`
+	SendResolved bool   `yaml:"send_resolved"`
+	RequireTLS   bool   `yaml:"require_tls"`
+}
+
+type slackConfig struct {
+	APIURL       string `yaml:"api_url"`
+	Channel      string `yaml:"channel,omitempty"`
+	SendResolved bool   `yaml:"send_resolved"`
+}
+
+type webhookConfig struct {
+	URL          string `yaml:"url"`
+	SendResolved bool   `yaml:"send_resolved"`
+}
+
+type pagerdutyConfig struct {
+	RoutingKey   string `yaml:"routing_key"`
+	URL          string `yaml:"url,omitempty"`
+	SendResolved bool   `yaml:"send_resolved"`
+}
+
+type routeConfig struct {
+	Receiver       string            `yaml:"receiver"`
+	Match          map[string]string `yaml:"match,omitempty"`
+	MatchRe        map[string]string `yaml:"match_re,omitempty"`
+	GroupBy        []string          `yaml:"group_by,omitempty"`
+	Continue       bool              `yaml:"continue,omitempty"`
+	RepeatInterval string            `yaml:"repeat_interval,omitempty"`
+	Routes         []routeConfig     `yaml:"routes,omitempty"`
+}
+
+// alertmanagerConfig renders monitoring/alertmanager.yaml and adds the receivers and routes
+// declared under monitoring.alertmanager
+func alertmanagerConfig(p *platform.Platform) (string, error) {
+	data, err := p.Template("monitoring/alertmanager.yaml", "manifests")
+	if err != nil {
+		return "", err
+	}
+	am := p.Monitoring.AlertManager
+	if len(am.Receivers) == 0 && len(am.Routes) == 0 {
+		return data, nil
+	}
+
+	config := make(map[string]interface{})
+	if err := yaml.Unmarshal([]byte(data), &config); err != nil {
+		return "", errors.Wrap(err, "invalid alertmanager.yaml")
+	}
+
+	names := map[string]bool{}
+	var receivers []interface{}
+	for _, receiver := range am.Receivers {
+		if receiver.Name == "" {
+			return "", fmt.Errorf("alertmanager receivers must have a name")
+		}
+		if names[receiver.Name] {
+			return "", fmt.Errorf("duplicate alertmanager receiver %s", receiver.Name)
+		}
+		names[receiver.Name] = true
+		if len(receiver.Email) > 0 && p.SMTP.Server == "" {
+			return "", fmt.Errorf("alertmanager receiver %s sends email but smtp is not configured", receiver.Name)
+		}
+		receivers = append(receivers, newReceiverConfig(p, receiver))
+	}
+	// the default receiver is kept unless it is overridden
+	if !names["default"] {
+		names["default"] = true
+		if existing, ok := config["receivers"].([]interface{}); ok {
+			receivers = append(existing, receivers...)
+		}
+	}
+	config["receivers"] = receivers
+
+	routes, err := newRouteConfigs(am.Routes, names)
+	if err != nil {
+		return "", err
+	}
+	route, ok := config["route"].(map[string]interface{})
+	if !ok {
+		return "", fmt.Errorf("alertmanager.yaml does not contain a route")
+	}
+	route["routes"] = routes
+
+	out, err := yaml.Marshal(config)
+	if err != nil {
+		return "", err
+	}
+	return string(out), nil
+}
+
+func newReceiverConfig(p *platform.Platform, receiver types.AlertReceiver) receiverConfig {
+	config := receiverConfig{Name: receiver.Name}
+	for _, to := range receiver.Email {
+		// go refuses to send credentials over an unencrypted connection
+		config.EmailConfigs = append(config.EmailConfigs, emailConfig{To: to, SendResolved: receiver.SendResolved, RequireTLS: p.SMTP.Username != ""})
+	}
+	for _, slack := range receiver.Slack {
+		config.SlackConfigs = append(config.SlackConfigs, slackConfig{APIURL: slack.URL, Channel: slack.Channel, SendResolved: receiver.SendResolved})
+	}
+	for _, url := range receiver.Webhook {
+		config.WebhookConfigs = append(config.WebhookConfigs, webhookConfig{URL: url, SendResolved: receiver.SendResolved})
+	}
+	for _, pd := range receiver.PagerDuty {
+		config.PagerdutyConfigs = append(config.PagerdutyConfigs, pagerdutyConfig{RoutingKey: pd.RoutingKey, URL: pd.URL, SendResolved: receiver.SendResolved})
+	}
+	return config
+}
+
+func newRouteConfigs(routes []types.AlertRoute, receivers map[string]bool) ([]routeConfig, error) {
+	var configs []routeConfig
+	for _, route := range routes {
+		if !receivers[route.Receiver] {
+			return nil, fmt.Errorf("alertmanager route references unknown receiver '%s'", route.Receiver)
+		}
+		children, err := newRouteConfigs(route.Routes, receivers)
+		if err != nil {
+			return nil, err
+		}
+		configs = append(configs, routeConfig{
+			Receiver:       route.Receiver,
+			Match:          route.Match,
+			MatchRe:        route.MatchRe,
+			GroupBy:        route.GroupBy,
+			Continue:       route.Continue,
+			RepeatInterval: route.RepeatInterval,
+			Routes:         children,
+		})
+	}
+	return configs, nil
+}
+
+type silenceMatcher struct {
+	Name    string `json:"name"`
+	Value   string `json:"value"`
+	IsRegex bool   `json:"isRegex"`
+}
+
+type silence struct {
+	ID        string           `json:"id,omitempty"`
+	Matchers  []silenceMatcher `json:"matchers"`
+	StartsAt  time.Time        `json:"startsAt"`
+	EndsAt    time.Time        `json:"endsAt"`
+	CreatedBy string           `json:"createdBy"`
+	Comment   string           `json:"comment"`
+	Status    *struct {
+		State string `json:"state"`
+	} `json:"status,omitempty"`
+}
+
+// alertmanagerClient returns an http client that connects to the first alertmanager pod
+func alertmanagerClient(p *platform.Platform) (*http.Client, string, error) {
+	dialer, err := p.GetProxyDialer(proxy.Proxy{
+		Namespace:    Namespace,
+		Kind:         "pods",
+		ResourceName: alertmanagerPod,
+		Port:         9093,
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	client := &http.Client{Transport: &http.Transport{DialContext: dialer.DialContext}}
+	return client, "http://alertmanager-main:9093", nil
+}
+
+func getSilences(client *http.Client, url string) ([]silence, error) {
+	resp, err := client.Get(url + "/api/v2/silences")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close() // nolint: errcheck
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET /api/v2/silences returned %s", resp.Status)
+	}
+	var silences []silence
+	if err := json.NewDecoder(resp.Body).Decode(&silences); err != nil {
+		return nil, err
+	}
+	return silences, nil
+}
+
+// createSilences creates the silences declared under monitoring.alertmanager.silences
+// that do not already have an active (or pending) silence created by karina
+func createSilences(p *platform.Platform) error {
+	if len(p.Monitoring.AlertManager.Silences) == 0 {
+		return nil
+	}
+	if err := p.WaitForPod(Namespace, alertmanagerPod, 2*time.Minute, v1.PodRunning); err != nil {
+		return err
+	}
+	client, url, err := alertmanagerClient(p)
+	if err != nil {
+		return err
+	}
+	existing, err := getSilences(client, url)
+	if err != nil {
+		return err
+	}
+
+	for _, declared := range p.Monitoring.AlertManager.Silences {
+		s, err := newSilence(declared)
+		if err != nil {
+			return err
+		}
+		if s.EndsAt.Before(time.Now()) {
+			p.Debugf("Silence '%s' has expired", s.Comment)
+			continue
+		}
+		if findSilence(existing, s) != nil {
+			p.Debugf("Silence '%s' already exists", s.Comment)
+			continue
+		}
+		if p.DryRun {
+			p.Infof("[dry-run] Would create silence '%s' until %s", s.Comment, s.EndsAt.Format(time.RFC3339))
+			continue
+		}
+		body, err := json.Marshal(s)
+		if err != nil {
+			return err
+		}
+		resp, err := client.Post(url+"/api/v2/silences", "application/json", bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		resp.Body.Close() // nolint: errcheck
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("failed to create silence '%s': %s", s.Comment, resp.Status)
+		}
+		p.Infof("Created silence '%s' until %s", s.Comment, s.EndsAt.Format(time.RFC3339))
+	}
+	return nil
+}
+
+func newSilence(declared types.AlertSilence) (silence, error) {
+	if len(declared.Matchers) == 0 {
+		return silence{}, fmt.Errorf("silence '%s' must have at least one matcher", declared.Comment)
+	}
+	s := silence{
+		StartsAt:  time.Now().UTC(),
+		CreatedBy: silenceCreator,
+		Comment:   declared.Comment,
+	}
+	// a fixed end time is required as a silence relative to the time it was created would be
+	// recreated on every deploy and never end
+	if declared.EndsAt == "" {
+		return s, fmt.Errorf("silence '%s' must specify endsAt", declared.Comment)
+	}
+	endsAt, err := time.Parse(time.RFC3339, declared.EndsAt)
+	if err != nil {
+		return s, errors.Wrapf(err, "invalid endsAt for silence '%s'", declared.Comment)
+	}
+	s.EndsAt = endsAt.UTC()
+
+	var names []string
+	for name := range declared.Matchers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		value := declared.Matchers[name]
+		s.Matchers = append(s.Matchers, silenceMatcher{
+			Name:    name,
+			Value:   strings.TrimPrefix(value, "~"),
+			IsRegex: strings.HasPrefix(value, "~"),
+		})
+	}
+	return s, nil
+}
+
+// findSilence returns the active or pending silence created by karina with the same comment and matchers
+func findSilence(silences []silence, s silence) *silence {
+	for i, existing := range silences {
+		if existing.CreatedBy != silenceCreator || existing.Comment != s.Comment {
+			continue
+		}
+		if existing.Status != nil && existing.Status.State == "expired" {
+			continue
+		}
+		matchers := append([]silenceMatcher{}, existing.Matchers...)
+		sort.Slice(matchers, func(i, j int) bool { return matchers[i].Name < matchers[j].Name })
+		if reflect.DeepEqual(matchers, s.Matchers) {
+			return &silences[i]
+		}
+	}
+	return nil
+}
+
+type loadedConfig struct {
+	Receivers []struct {
+		Name string `yaml:"name"`
+	} `yaml:"receivers"`
+	Route routeConfig `yaml:"route"`
+}
+
+// TestAlertManager verifies that alertmanager has loaded the receivers and routes that karina
+// rendered, and that the declared silences are active
+func TestAlertManager(p *platform.Platform, test *console.TestResults) {
+	if p.Monitoring == nil || p.Monitoring.Disabled || p.Monitoring.AlertManager.Disabled {
+		test.Skipf("alertmanager", "alertmanager is not configured or enabled")
+		return
+	}
+	data, err := alertmanagerConfig(p)
+	if err != nil {
+		test.Failf("alertmanager", "Failed to render config: %v", err)
+		return
+	}
+	expected := loadedConfig{}
+	if err := yaml.Unmarshal([]byte(data), &expected); err != nil {
+		test.Failf("alertmanager", "Failed to parse rendered config: %v", err)
+		return
+	}
+
+	client, url, err := alertmanagerClient(p)
+	if err != nil {
+		test.Failf("alertmanager", "Failed to connect to alertmanager: %v", err)
+		return
+	}
+	resp, err := client.Get(url + "/api/v2/status")
+	if err != nil {
+		test.Failf("alertmanager", "Failed to get status: %v", err)
+		return
+	}
+	defer resp.Body.Close() // nolint: errcheck
+	status := struct {
+		Config struct {
+			Original string `json:"original"`
+		} `json:"config"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		test.Failf("alertmanager", "Failed to decode status: %v", err)
+		return
+	}
+	loaded := loadedConfig{}
+	if err := yaml.Unmarshal([]byte(status.Config.Original), &loaded); err != nil {
+		test.Failf("alertmanager", "Failed to parse loaded config: %v", err)
+		return
+	}
+
+	if expected, loaded := receiverNames(expected), receiverNames(loaded); !reflect.DeepEqual(expected, loaded) {
+		test.Failf("alertmanager", "Loaded receivers %v do not match the configured receivers %v", loaded, expected)
+	} else {
+		test.Passf("alertmanager", "Loaded receivers %v", loaded)
+	}
+	if expected, loaded := describeRoutes(expected.Route, ""), describeRoutes(loaded.Route, ""); !reflect.DeepEqual(expected, loaded) {
+		test.Failf("alertmanager", "Loaded routes %v do not match the configured routes %v", loaded, expected)
+	} else {
+		test.Passf("alertmanager", "Loaded %d routes", len(loaded))
+	}
+
+	if len(p.Monitoring.AlertManager.Silences) == 0 {
+		return
+	}
+	silences, err := getSilences(client, url)
+	if err != nil {
+		test.Failf("alertmanager", "Failed to list silences: %v", err)
+		return
+	}
+	for _, declared := range p.Monitoring.AlertManager.Silences {
+		s, err := newSilence(declared)
+		if err != nil {
+			test.Failf("alertmanager", "Invalid silence: %v", err)
+			continue
+		}
+		if s.EndsAt.Before(time.Now()) {
+			continue
+		}
+		if findSilence(silences, s) == nil {
+			test.Failf("alertmanager", "Silence '%s' not found", s.Comment)
+		} else {
+			test.Passf("alertmanager", "Silence '%s' is active", s.Comment)
+		}
+	}
+}
+
+func receiverNames(config loadedConfig) []string {
+	var names []string
+	for _, receiver := range config.Receivers {
+		names = append(names, receiver.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// describeRoutes flattens a routing tree into a list of receivers and matchers
+func describeRoutes(route routeConfig, parent string) []string {
+	var labels []string
+	for k, v := range route.Match {
+		labels = append(labels, k+"="+v)
+	}
+	for k, v := range route.MatchRe {
+		labels = append(labels, k+"=~"+v)
+	}
+	sort.Strings(labels)
+	name := fmt.Sprintf("%s/%s{%s}", parent, route.Receiver, strings.Join(labels, ","))
+	routes := []string{name}
+	for _, child := range route.Routes {
+		routes = append(routes, describeRoutes(child, name)...)
+	}
+	return routes
+}
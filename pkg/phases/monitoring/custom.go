@@ -0,0 +1,342 @@
+package monitoring
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/flanksource/commons/text"
+	"github.com/flanksource/karina/pkg/k8s"
+	"github.com/flanksource/karina/pkg/platform"
+	"github.com/pkg/errors"
+	"gopkg.in/flanksource/yaml.v3"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+)
+
+// SourceLabel is added to dashboards and rules deployed from monitoring.dashboards and monitoring.rules
+// so that they can be pruned when they are removed from the source
+const SourceLabel = "monitoring.flanksource.com/source"
+
+var (
+	dashboardResource = schema.GroupVersionResource{Group: "integreatly.org", Version: "v1alpha1", Resource: "grafanadashboards"}
+	ruleResource      = schema.GroupVersionResource{Group: "monitoring.coreos.com", Version: "v1", Resource: "prometheusrules"}
+	invalidName       = regexp.MustCompile("[^a-z0-9.-]+")
+)
+
+// deployCustom applies the dashboards and rules from monitoring.dashboards and monitoring.rules,
+// and deletes any previously deployed by karina that no longer exist
+func deployCustom(p *platform.Platform) error {
+	dashboards, err := readSources(p, p.Monitoring.Dashboards, ".json")
+	if err != nil {
+		return errors.Wrap(err, "failed to read dashboards")
+	}
+	rules, err := readSources(p, p.Monitoring.Rules, ".yaml", ".yml")
+	if err != nil {
+		return errors.Wrap(err, "failed to read rules")
+	}
+
+	var ruleSpecs []k8s.CRD
+	for name, data := range rules {
+		specs, err := newPrometheusRules(name, data)
+		if err != nil {
+			return errors.Wrap(err, name)
+		}
+		ruleSpecs = append(ruleSpecs, specs...)
+	}
+	if len(ruleSpecs) > 0 {
+		if err := validateRules(p, ruleSpecs); err != nil {
+			return err
+		}
+	}
+
+	client, err := p.GetDynamicClient()
+	if err != nil {
+		return err
+	}
+	for name := range dashboards {
+		if err := checkBuiltin(client, dashboardResource, name); err != nil {
+			return err
+		}
+	}
+	for _, spec := range ruleSpecs {
+		if err := checkBuiltin(client, ruleResource, spec.Metadata.Name); err != nil {
+			return err
+		}
+	}
+
+	deployed := map[string]bool{}
+	for name, data := range dashboards {
+		spec := k8s.CRD{
+			APIVersion: "integreatly.org/v1alpha1",
+			Kind:       "GrafanaDashboard",
+			Metadata: k8s.Metadata{
+				Name:      name,
+				Namespace: Namespace,
+				Labels: map[string]string{
+					"app":       "grafana",
+					SourceLabel: "config",
+				},
+			},
+			Spec: map[string]interface{}{
+				"name": name + ".json",
+				"json": data,
+			},
+		}
+		if err := p.ApplyCRD(Namespace, spec); err != nil {
+			return err
+		}
+		deployed["GrafanaDashboard/"+name] = true
+	}
+	for _, spec := range ruleSpecs {
+		if deployed["PrometheusRule/"+spec.Metadata.Name] {
+			return fmt.Errorf("prometheus rule %s is defined more than once", spec.Metadata.Name)
+		}
+		if err := p.ApplyCRD(Namespace, spec); err != nil {
+			return err
+		}
+		deployed["PrometheusRule/"+spec.Metadata.Name] = true
+	}
+
+	return prune(p, deployed)
+}
+
+// checkBuiltin returns an error if name is used by a dashboard or rule that was not deployed from
+// the monitoring sources, so that the built-in dashboards and rules are never overwritten
+func checkBuiltin(client dynamic.Interface, resource schema.GroupVersionResource, name string) error {
+	existing, err := client.Resource(resource).Namespace(Namespace).Get(name, metav1.GetOptions{})
+	if kerrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to get %s %s", resource.Resource, name)
+	}
+	if _, ok := existing.GetLabels()[SourceLabel]; !ok {
+		return fmt.Errorf("%s %s is built-in, rename the file or the object in the monitoring sources", resource.Resource, name)
+	}
+	return nil
+}
+
+func prune(p *platform.Platform, deployed map[string]bool) error {
+	client, err := p.GetDynamicClient()
+	if err != nil {
+		return err
+	}
+	for _, resource := range []schema.GroupVersionResource{dashboardResource, ruleResource} {
+		list, err := client.Resource(resource).Namespace(Namespace).List(metav1.ListOptions{LabelSelector: SourceLabel})
+		if err != nil {
+			p.Warnf("Failed to list %s: %v", resource.Resource, err)
+			continue
+		}
+		for i := range list.Items {
+			item := &list.Items[i]
+			if deployed[item.GetKind()+"/"+item.GetName()] {
+				continue
+			}
+			p.Infof("Deleting %s/%s which is no longer in the monitoring sources", item.GetKind(), item.GetName())
+			if err := p.DeleteUnstructured(Namespace, item); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// readSources returns the templated contents of the files with one of the extensions (optionally
+// followed by .raw) from each source, keyed by a name derived from the file name
+func readSources(p *platform.Platform, sources []string, extensions ...string) (map[string]string, error) {
+	out := make(map[string]string)
+	for _, source := range sources {
+		dir, cleanup, err := fetchSource(p, source)
+		if err != nil {
+			return nil, err
+		}
+		err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() {
+				if info.Name() == ".git" {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			file := info.Name()
+			raw := strings.HasSuffix(file, ".raw")
+			file = strings.TrimSuffix(file, ".raw")
+			ext := filepath.Ext(file)
+			if !hasExtension(ext, extensions) {
+				return nil
+			}
+			name := invalidName.ReplaceAllString(strings.ToLower(strings.TrimSuffix(file, ext)), "-")
+			if _, ok := out[name]; ok {
+				return fmt.Errorf("%s is defined in more than one file", name)
+			}
+			data, err := ioutil.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			if raw {
+				out[name] = string(data)
+				return nil
+			}
+			if out[name], err = text.Template(string(data), p.PlatformConfig); err != nil {
+				return errors.Wrapf(err, "failed to template %s", path)
+			}
+			return nil
+		})
+		cleanup()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+func hasExtension(ext string, extensions []string) bool {
+	for _, e := range extensions {
+		if ext == e {
+			return true
+		}
+	}
+	return false
+}
+
+// fetchSource returns a local directory for a source, cloning it first if it is a git repository
+// in the form of [git::]<url>.git[//<subdir>][?ref=<branch or tag>]
+func fetchSource(p *platform.Platform, source string) (string, func(), error) {
+	noop := func() {}
+	if !strings.HasPrefix(source, "git::") && !strings.Contains(source, ".git") {
+		if _, err := os.Stat(source); err != nil {
+			return "", noop, err
+		}
+		return source, noop, nil
+	}
+
+	url := strings.TrimPrefix(source, "git::")
+	ref := ""
+	if i := strings.Index(url, "?ref="); i > 0 {
+		url, ref = url[:i], url[i+len("?ref="):]
+	}
+	subdir := ""
+	start := 0
+	if i := strings.Index(url, "://"); i > 0 {
+		start = i + 3
+	}
+	if i := strings.Index(url[start:], "//"); i >= 0 {
+		url, subdir = url[:start+i], url[start+i+2:]
+	}
+
+	dir, err := ioutil.TempDir("", "karina-source")
+	if err != nil {
+		return "", noop, err
+	}
+	cleanup := func() { os.RemoveAll(dir) } // nolint: errcheck
+	args := []string{"clone", "--depth", "1"}
+	if ref != "" {
+		args = append(args, "--branch", ref)
+	}
+	args = append(args, url, dir)
+	p.Infof("Cloning %s", source)
+	cmd := exec.Command("git", args...)
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		cleanup()
+		return "", noop, errors.Wrapf(err, "failed to clone %s", url)
+	}
+	return filepath.Join(dir, subdir), cleanup, nil
+}
+
+// newPrometheusRules converts a file containing PrometheusRule objects, or a prometheus rule file
+// with top-level groups, into PrometheusRule specs that match the prometheus ruleSelector
+func newPrometheusRules(name, data string) ([]k8s.CRD, error) {
+	var specs []k8s.CRD
+	decoder := yaml.NewDecoder(strings.NewReader(data))
+	for i := 0; ; i++ {
+		doc := make(map[string]interface{})
+		if err := decoder.Decode(&doc); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		if len(doc) == 0 {
+			continue
+		}
+		spec := k8s.CRD{
+			APIVersion: "monitoring.coreos.com/v1",
+			Kind:       "PrometheusRule",
+			Metadata: k8s.Metadata{
+				Name:      name,
+				Namespace: Namespace,
+			},
+		}
+		if i > 0 {
+			spec.Metadata.Name = fmt.Sprintf("%s-%d", name, i)
+		}
+		if kind, ok := doc["kind"]; ok {
+			if kind != "PrometheusRule" {
+				return nil, fmt.Errorf("expected a PrometheusRule, got %v", kind)
+			}
+			if metadata, ok := doc["metadata"].(map[string]interface{}); ok {
+				if name, ok := metadata["name"].(string); ok {
+					spec.Metadata.Name = name
+				}
+			}
+			spec.Spec, _ = doc["spec"].(map[string]interface{})
+		} else if _, ok := doc["groups"]; ok {
+			spec.Spec = doc
+		} else {
+			return nil, fmt.Errorf("expected a PrometheusRule or a rule file with groups")
+		}
+		spec.Metadata.Labels = map[string]string{
+			"prometheus": "k8s",
+			"role":       "alert-rules",
+			SourceLabel:  "config",
+		}
+		specs = append(specs, spec)
+	}
+	return specs, nil
+}
+
+// validateRules checks the rule groups using promtool before they are applied, as the
+// prometheus operator only validates the structure of the rules and not the expressions
+func validateRules(p *platform.Platform, specs []k8s.CRD) error {
+	// promtool is released with prometheus, so the version matching the deployed prometheus is used
+	promtool, err := p.GetBinaryPath("promtool", p.Monitoring.Prometheus.Version)
+	if err != nil {
+		return err
+	}
+	dir, err := ioutil.TempDir("", "prometheus-rules")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+
+	var files []string
+	for _, spec := range specs {
+		data, err := yaml.Marshal(spec.Spec)
+		if err != nil {
+			return err
+		}
+		file := filepath.Join(dir, spec.Metadata.Name+".yaml")
+		if err := ioutil.WriteFile(file, data, 0644); err != nil {
+			return err
+		}
+		files = append(files, file)
+	}
+	cmd := exec.Command(promtool, append([]string{"check", "rules"}, files...)...)
+	out, err := cmd.CombinedOutput()
+	p.Tracef("promtool: %s", string(out))
+	if err != nil {
+		return fmt.Errorf("invalid prometheus rules: %s", strings.ReplaceAll(string(out), dir+"/", ""))
+	}
+	p.Infof("Validated %d rule files", len(files))
+	return nil
+}
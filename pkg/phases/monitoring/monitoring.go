@@ -66,7 +66,7 @@ func Install(p *platform.Platform) error {
 		p.Warnf("Failed to deploy prometheus operator %v", err)
 	}
 
-	data, err := p.Template("monitoring/alertmanager.yaml", "manifests")
+	data, err := alertmanagerConfig(p)
 	if err != nil {
 		return fmt.Errorf("install: failed to template alertmanager manifests: %v", err)
 	}
@@ -82,6 +82,10 @@ func Install(p *platform.Platform) error {
 		}
 	}
 
+	if err := createSilences(p); err != nil {
+		p.Warnf("Failed to create alertmanager silences: %v", err)
+	}
+
 	dashboards, err := p.GetResourcesByDir("/monitoring/dashboards", "manifests")
 	if err != nil {
 		return fmt.Errorf("unable to find dashboards: %v", err)
@@ -110,6 +114,10 @@ func Install(p *platform.Platform) error {
 		}
 	}
 
+	if err := deployCustom(p); err != nil {
+		return fmt.Errorf("install: failed to deploy custom dashboards and rules: %v", err)
+	}
+
 	return deployThanos(p)
 }
 
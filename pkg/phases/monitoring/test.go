@@ -28,6 +28,7 @@ const (
 func Test(p *platform.Platform, test *console.TestResults) {
 	client, _ := p.GetClientset()
 	k8s.TestNamespace(client, "monitoring", test)
+	TestAlertManager(p, test)
 }
 
 func TestThanos(p *platform.Platform, test *console.TestResults) {
@@ -0,0 +1,281 @@
+package opa
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/flanksource/karina/pkg/k8s"
+	"github.com/flanksource/karina/pkg/k8s/proxy"
+	"github.com/flanksource/karina/pkg/platform"
+	"github.com/pkg/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+type AuditOptions struct {
+	// Path to a directory of specs to audit, live objects are audited if empty
+	Path string
+	// Path to a directory of policies, the policies deployed to opa are used if empty
+	Policies string
+	// Format of the report, one of table, csv or json
+	Format string
+}
+
+type Violation struct {
+	Namespace string `json:"namespace,omitempty"`
+	Kind      string `json:"kind"`
+	Name      string `json:"name"`
+	Message   string `json:"message"`
+}
+
+// Audit evaluates the admission policies against existing objects, which opa only evaluates on
+// creation, and returns the objects that would be denied if they were created now
+func Audit(p *platform.Platform, opts AuditOptions) ([]Violation, error) {
+	var objects []unstructured.Unstructured
+	if opts.Path != "" {
+		specs, err := k8s.Walk(opts.Path)
+		if err != nil {
+			return nil, err
+		}
+		for _, spec := range specs {
+			objects = append(objects, spec.Items...)
+		}
+	} else {
+		var err error
+		if objects, err = listObjects(p); err != nil {
+			return nil, err
+		}
+	}
+
+	policies := opts.Policies
+	if policies == "" {
+		dir, err := ioutil.TempDir("", "opa-policies")
+		if err != nil {
+			return nil, err
+		}
+		defer os.RemoveAll(dir) // nolint: errcheck
+		if err := downloadPolicies(p, dir); err != nil {
+			return nil, errors.Wrap(err, "failed to download deployed policies")
+		}
+		policies = dir
+	}
+
+	p.Infof("Auditing %d objects against %s", len(objects), policies)
+	denied, err := evaluate(p, policies, objects, objects)
+	if err != nil {
+		return nil, err
+	}
+	var violations []Violation
+	for i, msgs := range denied {
+		for _, msg := range msgs {
+			violations = append(violations, Violation{
+				Namespace: objects[i].GetNamespace(),
+				Kind:      objects[i].GetKind(),
+				Name:      objects[i].GetName(),
+				Message:   msg,
+			})
+		}
+	}
+	sort.SliceStable(violations, func(i, j int) bool {
+		a, b := violations[i], violations[j]
+		if a.Namespace != b.Namespace {
+			return a.Namespace < b.Namespace
+		}
+		if a.Kind != b.Kind {
+			return a.Kind < b.Kind
+		}
+		return a.Name < b.Name
+	})
+	return violations, nil
+}
+
+// WriteViolations writes the violations grouped by namespace as a table, csv or json
+func WriteViolations(w io.Writer, violations []Violation, format string) error {
+	switch format {
+	case "json":
+		namespaces := make(map[string][]Violation)
+		for _, v := range violations {
+			namespaces[v.Namespace] = append(namespaces[v.Namespace], v)
+		}
+		data, err := json.MarshalIndent(namespaces, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(w, string(data))
+		return err
+	case "csv":
+		writer := csv.NewWriter(w)
+		writer.Write([]string{"namespace", "kind", "name", "violation"}) // nolint: errcheck
+		for _, v := range violations {
+			writer.Write([]string{v.Namespace, v.Kind, v.Name, v.Message}) // nolint: errcheck
+		}
+		writer.Flush()
+		return writer.Error()
+	case "table", "":
+		tw := tabwriter.NewWriter(w, 3, 2, 3, ' ', 0)
+		fmt.Fprintf(tw, "NAMESPACE\tKIND\tNAME\tVIOLATION\n")
+		for _, v := range violations {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", v.Namespace, v.Kind, v.Name, v.Message)
+		}
+		return tw.Flush()
+	}
+	return fmt.Errorf("unknown format %s, must be one of table, csv or json", format)
+}
+
+// listObjects returns all objects in the cluster that can be listed, excluding events, the
+// data of secrets is removed so that it is never written to disk or passed to opa
+func listObjects(p *platform.Platform) ([]unstructured.Unstructured, error) {
+	clientset, err := p.GetClientset()
+	if err != nil {
+		return nil, err
+	}
+	client, err := p.GetDynamicClient()
+	if err != nil {
+		return nil, err
+	}
+	lists, err := clientset.Discovery().ServerPreferredResources()
+	if err != nil && len(lists) == 0 {
+		return nil, errors.Wrap(err, "failed to discover resources")
+	}
+
+	var objects []unstructured.Unstructured
+	for _, list := range lists {
+		gv, err := schema.ParseGroupVersion(list.GroupVersion)
+		if err != nil {
+			continue
+		}
+		for _, resource := range list.APIResources {
+			if strings.Contains(resource.Name, "/") || resource.Name == "events" || !hasVerb(resource.Verbs, "list") {
+				continue
+			}
+			items, err := client.Resource(gv.WithResource(resource.Name)).List(metav1.ListOptions{})
+			if err != nil {
+				p.Warnf("Failed to list %s: %v", resource.Name, err)
+				continue
+			}
+			for _, item := range items.Items {
+				if item.GetKind() == "" {
+					item.SetGroupVersionKind(gv.WithKind(resource.Kind))
+				}
+				if item.GetKind() == "Secret" {
+					unstructured.RemoveNestedField(item.Object, "data")
+					unstructured.RemoveNestedField(item.Object, "stringData")
+				}
+				objects = append(objects, item)
+			}
+		}
+	}
+	return objects, nil
+}
+
+func hasVerb(verbs metav1.Verbs, verb string) bool {
+	for _, v := range verbs {
+		if v == verb {
+			return true
+		}
+	}
+	return false
+}
+
+type policyList struct {
+	Result []struct {
+		ID  string `json:"id"`
+		Raw string `json:"raw"`
+	} `json:"result"`
+}
+
+type bundleManifest struct {
+	Result struct {
+		Roots []string `json:"roots"`
+	} `json:"result"`
+}
+
+// downloadPolicies writes the policies and bundle data loaded into opa to dir
+func downloadPolicies(p *platform.Platform, dir string) error {
+	pod, err := p.GetFirstPodByLabelSelector(Namespace, "app=opa")
+	if err != nil {
+		return err
+	}
+	dialer, err := p.GetProxyDialer(proxy.Proxy{
+		Namespace:    Namespace,
+		Kind:         "pods",
+		ResourceName: pod.Name,
+		Port:         8181,
+	})
+	if err != nil {
+		return err
+	}
+	client := &http.Client{Transport: &http.Transport{DialContext: dialer.DialContext}}
+	get := func(path string, v interface{}) error {
+		resp, err := client.Get("http://opa:8181" + path)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close() // nolint: errcheck
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("GET %s returned %s", path, resp.Status)
+		}
+		return json.NewDecoder(resp.Body).Decode(v)
+	}
+
+	policies := policyList{}
+	if err := get("/v1/policies", &policies); err != nil {
+		return err
+	}
+	var packages []string
+	for i, policy := range policies.Result {
+		if pkg, err := packageRoot([]byte(policy.Raw)); err == nil {
+			packages = append(packages, pkg)
+		}
+		if err := ioutil.WriteFile(fmt.Sprintf("%s/%d.rego", dir, i), []byte(policy.Raw), 0644); err != nil {
+			return err
+		}
+	}
+
+	// bundle data is not replicated from the cluster, so it is downloaded for each bundle root
+	// that does not contain policies, which would otherwise conflict with the policies
+	manifest := bundleManifest{}
+	if err := get("/v1/data/system/bundle/manifest", &manifest); err != nil {
+		p.Debugf("No bundle manifest found: %v", err)
+	}
+	for _, root := range manifest.Result.Roots {
+		if overlaps(root, packages) {
+			continue
+		}
+		var data struct {
+			Result interface{} `json:"result"`
+		}
+		if err := get("/v1/data/"+root, &data); err != nil {
+			return err
+		}
+		if data.Result == nil {
+			continue
+		}
+		// data.json files are loaded at the path of their directory
+		if err := os.MkdirAll(dir+"/"+root, 0755); err != nil {
+			return err
+		}
+		if err := writeJSON(dir+"/"+root+"/data.json", data.Result); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func overlaps(root string, packages []string) bool {
+	for _, pkg := range packages {
+		if root == "" || pkg == root || strings.HasPrefix(pkg, root+"/") || strings.HasPrefix(root, pkg+"/") {
+			return true
+		}
+	}
+	return false
+}
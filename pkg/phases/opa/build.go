@@ -0,0 +1,274 @@
+package opa
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/flanksource/karina/pkg/platform"
+	"github.com/pkg/errors"
+	jose "gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// KeyID is the id of the key used to sign and verify bundles
+const KeyID = "karina"
+
+// Manifest is the .manifest file of a bundle
+type Manifest struct {
+	Revision string   `json:"revision"`
+	Roots    []string `json:"roots"`
+}
+
+type bundleFile struct {
+	Name string
+	Data []byte
+}
+
+type signedFile struct {
+	Name      string `json:"name"`
+	Hash      string `json:"hash"`
+	Algorithm string `json:"algorithm"`
+}
+
+// Build creates a gzipped bundle from the .rego (excluding *_test.rego) and data.json files in
+// policies, with a manifest containing the revision and the roots declared by the packages.
+// If signingKey is specified a .signatures.json is added that opa can verify the bundle with.
+func Build(p *platform.Platform, policies, output, revision, signingKey string) error {
+	var files []bundleFile
+	roots := make(map[string]bool)
+	err := filepath.Walk(policies, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		name, _ := filepath.Rel(policies, path)
+		name = filepath.ToSlash(name)
+		if strings.HasSuffix(name, "_test.rego") || (!strings.HasSuffix(name, ".rego") && filepath.Base(name) != "data.json") {
+			return nil
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if strings.HasSuffix(name, ".rego") {
+			root, err := packageRoot(data)
+			if err != nil {
+				return errors.Wrap(err, path)
+			}
+			roots[root] = true
+		} else if dir := filepath.Dir(name); dir != "." {
+			roots[dir] = true
+		} else {
+			doc := make(map[string]interface{})
+			if err := json.Unmarshal(data, &doc); err != nil {
+				return errors.Wrap(err, path)
+			}
+			for key := range doc {
+				roots[key] = true
+			}
+		}
+		files = append(files, bundleFile{Name: name, Data: data})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("no policies or data found in %s", policies)
+	}
+
+	if revision == "" {
+		revision = getRevision(policies)
+	}
+	manifest := Manifest{Revision: revision, Roots: uniqueRoots(roots)}
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	files = append([]bundleFile{{Name: ".manifest", Data: data}}, files...)
+
+	if signingKey != "" {
+		signatures, err := sign(files, signingKey)
+		if err != nil {
+			return errors.Wrap(err, "failed to sign bundle")
+		}
+		files = append(files, bundleFile{Name: ".signatures.json", Data: signatures})
+	}
+
+	if err := writeBundle(output, files); err != nil {
+		return err
+	}
+	p.Infof("Built %s with revision %s and roots %v", output, manifest.Revision, manifest.Roots)
+	return nil
+}
+
+// packageRoot returns the bundle root for the package declared in a rego file, e.g. kubernetes/admission
+func packageRoot(rego []byte) (string, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(rego))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "package ") {
+			pkg := strings.TrimSpace(strings.TrimPrefix(line, "package "))
+			return strings.ReplaceAll(pkg, ".", "/"), nil
+		}
+	}
+	return "", fmt.Errorf("no package declaration found")
+}
+
+// uniqueRoots removes roots that are nested under another root, opa rejects overlapping roots
+func uniqueRoots(roots map[string]bool) []string {
+	var unique []string
+	for root := range roots {
+		nested := false
+		for other := range roots {
+			if other != root && strings.HasPrefix(root, other+"/") {
+				nested = true
+			}
+		}
+		if !nested {
+			unique = append(unique, root)
+		}
+	}
+	sort.Strings(unique)
+	return unique
+}
+
+// getRevision returns the git commit of the policies directory, or a timestamp if it is not a git repository
+func getRevision(policies string) string {
+	cmd := exec.Command("git", "rev-parse", "--short", "HEAD")
+	cmd.Dir = policies
+	if out, err := cmd.Output(); err == nil {
+		return strings.TrimSpace(string(out))
+	}
+	return time.Now().UTC().Format("20060102150405")
+}
+
+// sign returns the .signatures.json for the bundle files as specified by
+// https://www.openpolicyagent.org/docs/latest/management/#signing
+func sign(files []bundleFile, signingKey string) ([]byte, error) {
+	data, err := ioutil.ReadFile(signingKey)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s is not PEM encoded", signingKey)
+	}
+	key, err := parsePrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	algorithm := jose.RS256
+	if _, ok := key.(*ecdsa.PrivateKey); ok {
+		algorithm = jose.ES256
+	}
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: algorithm, Key: key},
+		(&jose.SignerOptions{}).WithType("JWT").WithHeader("kid", KeyID))
+	if err != nil {
+		return nil, err
+	}
+
+	var signed []signedFile
+	for _, file := range files {
+		hash, err := hashFile(file)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to hash %s", file.Name)
+		}
+		signed = append(signed, signedFile{Name: file.Name, Hash: hash, Algorithm: "SHA-256"})
+	}
+	token, err := jwt.Signed(signer).Claims(map[string]interface{}{
+		"files": signed,
+		"keyid": KeyID,
+	}).CompactSerialize()
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(map[string][]string{"signatures": {token}})
+}
+
+func parsePrivateKey(der []byte) (interface{}, error) {
+	if key, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(der); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("unsupported private key, must be RSA or ECDSA")
+	}
+	switch key.(type) {
+	case *rsa.PrivateKey, *ecdsa.PrivateKey:
+		return key, nil
+	}
+	return nil, fmt.Errorf("unsupported private key, must be RSA or ECDSA")
+}
+
+// hashFile returns the SHA-256 of a bundle file, json files are hashed in their
+// canonical form (sorted keys, no whitespace) as opa does when verifying
+func hashFile(file bundleFile) (string, error) {
+	data := file.Data
+	if file.Name == ".manifest" || strings.HasSuffix(file.Name, ".json") {
+		var doc interface{}
+		if err := json.Unmarshal(data, &doc); err != nil {
+			return "", err
+		}
+		buf := &bytes.Buffer{}
+		encoder := json.NewEncoder(buf)
+		encoder.SetEscapeHTML(false)
+		if err := encoder.Encode(doc); err != nil {
+			return "", err
+		}
+		data = bytes.TrimSuffix(buf.Bytes(), []byte("\n"))
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func writeBundle(output string, files []bundleFile) error {
+	if dir := filepath.Dir(output); dir != "." {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+	f, err := os.Create(output)
+	if err != nil {
+		return err
+	}
+	defer f.Close() // nolint: errcheck
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	for _, file := range files {
+		if err := tw.WriteHeader(&tar.Header{
+			Name:    "/" + file.Name,
+			Mode:    0644,
+			Size:    int64(len(file.Data)),
+			ModTime: time.Now(),
+		}); err != nil {
+			return err
+		}
+		if _, err := tw.Write(file.Data); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
@@ -2,14 +2,33 @@ package opa
 
 import (
 	"fmt"
+	"io/ioutil"
+	"os"
 
 	"github.com/flanksource/karina/pkg/platform"
 	minio "github.com/minio/minio-go/v6"
 )
 
-func DeployBundle(p *platform.Platform, bundleName string) error {
+// DeployBundle uploads a bundle to the opa.bundlePrefix bucket, if bundlePath is empty a bundle
+// is built from opa.policies and signed using opa.bundleSigningKey if specified.
+// The bucket is kept private, opa authenticates using the S3 credentials to download bundles.
+func DeployBundle(p *platform.Platform, bundleName, bundlePath string) error {
+	if bundlePath == "" {
+		if p.OPA == nil || p.OPA.Policies == "" {
+			return fmt.Errorf("no bundle specified and opa.policies is empty")
+		}
+		dir, err := ioutil.TempDir("", "opa-bundle")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir) // nolint: errcheck
+		bundlePath = dir + "/" + bundleName + ".tar.gz"
+		if err := Build(p, p.OPA.Policies, bundlePath, "", p.OPA.BundleSigningKey); err != nil {
+			return err
+		}
+	}
+
 	objectName := fmt.Sprintf("%s.tar.gz", bundleName)
-	objectPath := fmt.Sprintf("test/opa/bundles/%s", objectName)
 	s3Client, err := p.GetS3Client()
 	if err != nil {
 		return err
@@ -25,14 +44,14 @@ func DeployBundle(p *platform.Platform, bundleName string) error {
 		}
 	}
 
-	contentType := "application/x-tar"
-	tarSize, err := s3Client.FPutObject(p.OPA.BundlePrefix, objectName, objectPath, minio.PutObjectOptions{ContentType: contentType})
+	contentType := "application/gzip"
+	tarSize, err := s3Client.FPutObject(p.OPA.BundlePrefix, objectName, bundlePath, minio.PutObjectOptions{ContentType: contentType})
 
 	if err != nil {
 		return err
 	}
-	p.Debugf("Successfully uploaded %s of size %d\n", objectName, tarSize)
+	p.Infof("Uploaded %s to %s/%s (%d bytes)", bundlePath, p.OPA.BundlePrefix, objectName, tarSize)
 
-	policy := `{"Version": "2012-10-17","Statement": [{"Action": ["s3:GetObject"],"Effect": "Allow","Principal": {"AWS": ["*"]},"Resource": ["arn:aws:s3:::bundles/*"],"Sid": ""}]}`
-	return s3Client.SetBucketPolicy(p.OPA.BundlePrefix, policy)
+	// remove any public-read policy set by previous versions
+	return s3Client.SetBucketPolicy(p.OPA.BundlePrefix, "")
 }
@@ -0,0 +1,26 @@
+package opa
+
+import (
+	"os"
+	"os/exec"
+
+	"github.com/flanksource/karina/pkg/platform"
+)
+
+// runOPA runs the opa cli and returns its stdout, opa exits with a non-zero exit code
+// when tests fail, in which case stdout is still returned with the error
+func runOPA(p *platform.Platform, args ...string) ([]byte, error) {
+	// the cli version matches the version of the deployed opa, so that policies are tested with the same builtins
+	version := ""
+	if p.OPA != nil {
+		version = p.OPA.Version
+	}
+	bin, err := p.GetBinaryPath("opa", version)
+	if err != nil {
+		return nil, err
+	}
+	p.Debugf("%s %v", bin, args)
+	cmd := exec.Command(bin, args...)
+	cmd.Stderr = os.Stderr
+	return cmd.Output()
+}
@@ -0,0 +1,160 @@
+package opa
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/flanksource/karina/pkg/platform"
+	"github.com/pkg/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// denyQuery evaluates every admission review in input.reviews against the admission policies,
+// the same policies that are evaluated by the opa-default-system-main policy in the cluster
+const denyQuery = `{i: msgs | review := input.reviews[i]; msgs := data.kubernetes.admission.deny with input as review}`
+
+type evalResult struct {
+	Result []struct {
+		Expressions []struct {
+			Value map[string][]string `json:"value"`
+		} `json:"expressions"`
+	} `json:"result"`
+}
+
+// admissionReview returns the AdmissionReview opa receives from the api server when obj is created
+func admissionReview(obj unstructured.Unstructured) map[string]interface{} {
+	return map[string]interface{}{
+		"kind":       "AdmissionReview",
+		"apiVersion": "admission.k8s.io/v1beta1",
+		"request": map[string]interface{}{
+			"kind": map[string]interface{}{
+				"group":   obj.GroupVersionKind().Group,
+				"version": obj.GroupVersionKind().Version,
+				"kind":    obj.GetKind(),
+			},
+			"namespace": obj.GetNamespace(),
+			"name":      obj.GetName(),
+			"operation": "CREATE",
+			"object":    obj.Object,
+		},
+	}
+}
+
+// resourceNames returns the plural resource names that kube-mgmt uses when replicating each kind,
+// as reported by discovery
+func resourceNames(p *platform.Platform) map[string]string {
+	names := make(map[string]string)
+	clientset, err := p.GetClientset()
+	if err != nil {
+		p.Debugf("Failed to get clientset, resource names are derived from kinds: %v", err)
+		return names
+	}
+	lists, err := clientset.Discovery().ServerPreferredResources()
+	if err != nil && len(lists) == 0 {
+		p.Debugf("Failed to discover resources, resource names are derived from kinds: %v", err)
+		return names
+	}
+	for _, list := range lists {
+		for _, resource := range list.APIResources {
+			if !strings.Contains(resource.Name, "/") {
+				names[resource.Kind] = resource.Name
+			}
+		}
+	}
+	return names
+}
+
+// resourceName returns a plural resource name for kinds that are not known to discovery,
+// e.g. the kinds of CRDs in fixtures that are not installed in the cluster
+func resourceName(kind string) string {
+	kind = strings.ToLower(kind)
+	switch {
+	case strings.HasSuffix(kind, "s"):
+		return kind + "es"
+	case strings.HasSuffix(kind, "y"):
+		return strings.TrimSuffix(kind, "y") + "ies"
+	}
+	return kind + "s"
+}
+
+// replicatedData returns the data document kube-mgmt would create when replicating resources
+// i.e. data.kubernetes.<resource>[<namespace>][<name>] or data.kubernetes.<resource>[<name>] for cluster scoped resources
+func replicatedData(resources []unstructured.Unstructured, names map[string]string) map[string]interface{} {
+	kubernetes := make(map[string]interface{})
+	for _, obj := range resources {
+		resource, ok := names[obj.GetKind()]
+		if !ok {
+			resource = resourceName(obj.GetKind())
+		}
+		if _, ok := kubernetes[resource]; !ok {
+			kubernetes[resource] = make(map[string]interface{})
+		}
+		objects := kubernetes[resource].(map[string]interface{})
+		if obj.GetNamespace() == "" {
+			objects[obj.GetName()] = obj.Object
+			continue
+		}
+		if _, ok := objects[obj.GetNamespace()]; !ok {
+			objects[obj.GetNamespace()] = make(map[string]interface{})
+		}
+		objects[obj.GetNamespace()].(map[string]interface{})[obj.GetName()] = obj.Object
+	}
+	return map[string]interface{}{"kubernetes": kubernetes}
+}
+
+// evaluate evaluates the admission policies in the policies directory against each object using
+// resources as the replicated data and returns the deny messages for each object
+func evaluate(p *platform.Platform, policies string, resources []unstructured.Unstructured, objects []unstructured.Unstructured) ([][]string, error) {
+	var reviews []map[string]interface{}
+	for _, obj := range objects {
+		reviews = append(reviews, admissionReview(obj))
+	}
+
+	dir, err := ioutil.TempDir("", "opa")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+	input := dir + "/input.json"
+	data := dir + "/data.json"
+	if err := writeJSON(input, map[string]interface{}{"reviews": reviews}); err != nil {
+		return nil, err
+	}
+	if err := writeJSON(data, replicatedData(resources, resourceNames(p))); err != nil {
+		return nil, err
+	}
+
+	stdout, err := runOPA(p, "eval", "--format", "json", "--data", policies, "--data", data, "--input", input, denyQuery)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to evaluate policies in %s", policies)
+	}
+	result := evalResult{}
+	if err := json.Unmarshal(stdout, &result); err != nil {
+		return nil, errors.Wrap(err, "failed to parse opa eval output")
+	}
+	if len(result.Result) == 0 || len(result.Result[0].Expressions) == 0 {
+		return nil, fmt.Errorf("no results returned by opa eval, is the kubernetes.admission package defined")
+	}
+
+	denied := make([][]string, len(objects))
+	for i, msgs := range result.Result[0].Expressions[0].Value {
+		index, err := strconv.Atoi(i)
+		if err != nil || index >= len(objects) {
+			return nil, fmt.Errorf("unexpected result index %s", i)
+		}
+		denied[index] = msgs
+	}
+	return denied, nil
+}
+
+func writeJSON(path string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0644)
+}
@@ -47,6 +47,17 @@ func Install(platform *platform.Platform) error {
 		return fmt.Errorf("install: failed to create secret opa-server: %v", err)
 	}
 
+	if platform.OPA.BundleURL != "" {
+		// credentials used by opa to download bundles from the private bundle bucket
+		if err := platform.CreateOrUpdateSecret("opa-bundle-credentials", Namespace, map[string][]byte{
+			"AWS_ACCESS_KEY_ID":     []byte(platform.S3.AccessKey),
+			"AWS_SECRET_ACCESS_KEY": []byte(platform.S3.SecretKey),
+			"AWS_REGION":            []byte(platform.S3.Region),
+		}); err != nil {
+			return fmt.Errorf("install: failed to create secret opa-bundle-credentials: %v", err)
+		}
+	}
+
 	if err := platform.ApplySpecs(Namespace, "opa.yaml"); err != nil {
 		return err
 	}
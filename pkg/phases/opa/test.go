@@ -1,11 +1,16 @@
 package opa
 
 import (
+	"encoding/json"
 	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 
 	"github.com/flanksource/commons/console"
 	"github.com/flanksource/karina/pkg/k8s"
 	"github.com/flanksource/karina/pkg/platform"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 )
 
 func Test(p *platform.Platform, test *console.TestResults) {
@@ -80,3 +85,108 @@ func testE2E(p *platform.Platform, test *console.TestResults) {
 		}
 	}
 }
+
+type unitTest struct {
+	Package string      `json:"package"`
+	Name    string      `json:"name"`
+	Fail    bool        `json:"fail"`
+	Error   interface{} `json:"error"`
+}
+
+// findUnitTests returns the *_test.rego files in the policies directory and its subdirectories
+func findUnitTests(policies string) ([]string, error) {
+	var tests []string
+	err := filepath.Walk(policies, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() && strings.HasSuffix(info.Name(), "_test.rego") {
+			tests = append(tests, path)
+		}
+		return nil
+	})
+	return tests, err
+}
+
+// TestPolicies runs the rego unit tests (*_test.rego files) in the policies directory
+func TestPolicies(p *platform.Platform, test *console.TestResults, policies string) {
+	tests, err := findUnitTests(policies)
+	if err != nil {
+		test.Failf("opa", "Failed to read %s: %v", policies, err)
+		return
+	}
+	if len(tests) == 0 {
+		test.Skipf("opa", "No *_test.rego files found in %s", policies)
+		return
+	}
+	stdout, err := runOPA(p, "test", "--format", "json", policies)
+	var results []unitTest
+	if jsonErr := json.Unmarshal(stdout, &results); jsonErr != nil {
+		test.Failf("opa", "Failed to run unit tests in %s: %v %v", policies, err, jsonErr)
+		return
+	}
+	for _, result := range results {
+		name := strings.TrimPrefix(result.Package, "data.") + "." + result.Name
+		if result.Error != nil {
+			test.Failf(name, "%s errored: %v", name, result.Error)
+		} else if result.Fail {
+			test.Failf(name, "%s failed", name)
+		} else {
+			test.Passf(name, "%s passed", name)
+		}
+	}
+}
+
+// TestFixtures evaluates the accepted and rejected fixtures against the policies locally,
+// using the fixtures in resources as the data replicated by kube-mgmt
+func TestFixtures(p *platform.Platform, test *console.TestResults, policies, fixtures string) {
+	specs, err := k8s.Walk(fixtures + "/resources")
+	if err != nil {
+		test.Failf("opa", "Failed to read fixture resources: %v", err)
+		return
+	}
+	var resources []unstructured.Unstructured
+	for _, spec := range specs {
+		resources = append(resources, spec.Items...)
+	}
+
+	for _, dir := range []string{"accepted", "rejected"} {
+		specs, err := k8s.Walk(fixtures + "/" + dir)
+		if err != nil {
+			test.Failf("opa", "Failed to read %s fixtures: %v", dir, err)
+			return
+		}
+		var objects []unstructured.Unstructured
+		for _, spec := range specs {
+			objects = append(objects, spec.Items...)
+		}
+		if len(objects) == 0 {
+			continue
+		}
+		denied, err := evaluate(p, policies, resources, objects)
+		if err != nil {
+			test.Failf("opa", "Failed to evaluate %s fixtures: %v", dir, err)
+			return
+		}
+
+		i := 0
+		for _, spec := range specs {
+			var msgs []string
+			for range spec.Items {
+				msgs = append(msgs, denied[i]...)
+				i++
+			}
+			name := filepath.Base(spec.Path)
+			switch {
+			case dir == "rejected" && len(msgs) > 0:
+				test.Passf(name, "%s rejected as expected: %s", name, strings.Join(msgs, ", "))
+			case dir == "rejected":
+				test.Failf(name, "%s accepted as not expected", name)
+			case len(msgs) > 0:
+				test.Failf(name, "%s rejected as not expected: %s", name, strings.Join(msgs, ", "))
+			default:
+				test.Passf(name, "%s accepted as expected", name)
+			}
+		}
+	}
+}
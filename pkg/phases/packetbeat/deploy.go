@@ -2,6 +2,7 @@ package packetbeat
 
 import (
 	"github.com/flanksource/karina/pkg/constants"
+	"github.com/flanksource/karina/pkg/phases/beats"
 	"github.com/flanksource/karina/pkg/platform"
 )
 
@@ -11,5 +12,34 @@ func Deploy(p *platform.Platform) error {
 		return p.DeleteSpecs(constants.PlatformSystem, "packetbeat.yaml")
 	}
 
+	beat := beats.Beat{
+		Type:        "packetbeat",
+		BeatsOutput: beats.WithDefaultOutput(p, p.Packetbeat.BeatsOutput),
+	}
+	if !beat.HasOutput() {
+		p.Warnf("Skipping deployment of packetbeat, no output is specified and there is no infra filebeat with an elasticsearch output")
+		return nil
+	}
+	if kibana := p.Packetbeat.Kibana; kibana != nil {
+		// dashboards are loaded into kibana using the elasticsearch credentials unless kibana has its own
+		user, password := kibana.User, kibana.Password
+		if user == "" && beat.Elasticsearch != nil {
+			user, password = beat.Elasticsearch.User, beat.Elasticsearch.Password
+		}
+		beat.Settings = map[string]interface{}{
+			"setup.kibana": map[string]interface{}{
+				"host":                    kibana.URL + ":" + kibana.Port,
+				"username":                user,
+				"password":                password,
+				"protocol":                "https",
+				"ssl.verification_mode":   "none",
+				"ssl.supported_protocols": []string{"TLSv1.2", "TLSv1.3"},
+			},
+		}
+	}
+	if err := beats.Deploy(p, beat); err != nil {
+		return err
+	}
+
 	return p.ApplySpecs(constants.PlatformSystem, "packetbeat.yaml")
 }
@@ -0,0 +1,160 @@
+package postgresoperator
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/flanksource/commons/console"
+	"github.com/flanksource/commons/utils"
+	pgapi "github.com/flanksource/karina/pkg/api/postgres"
+	"github.com/flanksource/karina/pkg/platform"
+	pg "github.com/go-pg/pg/v9"
+	"github.com/pkg/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+type table struct {
+	TableSchema string
+	TableName   string
+}
+
+func (t table) String() string {
+	return t.TableSchema + "." + t.TableName
+}
+
+// ListClusters returns all postgres clusters managed by the operator that archive their WAL to S3
+func ListClusters(p *platform.Platform) ([]pgapi.Postgresql, error) {
+	client, _, _, err := p.GetDynamicClientFor(Namespace, pgapi.NewPostgresql(""))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get dynamic client for postgresql")
+	}
+	list, err := client.List(metav1.ListOptions{})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list postgresql clusters")
+	}
+	var clusters []pgapi.Postgresql
+	for _, item := range list.Items {
+		db := pgapi.Postgresql{}
+		if err := p.Get(Namespace, item.GetName(), &db); err != nil {
+			return nil, errors.Wrapf(err, "failed to get postgresql %s", item.GetName())
+		}
+		if db.Spec.Parameters["archive_mode"] != "on" {
+			continue
+		}
+		clusters = append(clusters, db)
+	}
+	return clusters, nil
+}
+
+// Verify clones each cluster from its WAL backups into a scratch cluster and compares
+// the row counts of every table in every database with the source cluster, tables whose
+// row counts differ fail the verification unless allowDrift is set
+func Verify(p *platform.Platform, test *console.TestResults, allowDrift bool, names ...string) {
+	if p.PostgresOperator == nil || p.PostgresOperator.Disabled {
+		test.Skipf("postgres", "Postgres operator is disabled")
+		return
+	}
+	if len(names) == 0 {
+		clusters, err := ListClusters(p)
+		if err != nil {
+			test.Failf("postgres", "Failed to list clusters: %v", err)
+			return
+		}
+		for _, cluster := range clusters {
+			names = append(names, cluster.Name)
+		}
+	}
+	if len(names) == 0 {
+		test.Skipf("postgres", "No postgres clusters with WAL archiving found")
+		return
+	}
+	for _, name := range names {
+		verifyCluster(p, test, allowDrift, name)
+	}
+}
+
+func verifyCluster(p *platform.Platform, test *console.TestResults, allowDrift bool, clusterName string) {
+	source := &pgapi.Postgresql{}
+	if err := p.Get(Namespace, clusterName, source); err != nil {
+		test.Failf("postgres", "Failed to get cluster %s: %v", clusterName, err)
+		return
+	}
+	var databases []string
+	for db := range source.Spec.Databases {
+		databases = append(databases, db)
+	}
+
+	config := pgapi.NewClusterConfig(strings.TrimPrefix(clusterName, "postgres-")+"-verify-"+utils.RandomString(4), databases...)
+	config.EnableWalArchiving = false
+	config.Clone = &pgapi.CloneConfig{
+		ClusterName: clusterName,
+		Timestamp:   time.Now().UTC().Format("2006-01-02 15:04:05 UTC"),
+	}
+	cloneName := "postgres-" + config.Name
+	defer removeE2ECluster(p, config, test)
+	if _, err := GetOrCreateDB(p, config); err != nil {
+		test.Failf("postgres", "Failed to restore %s into %s: %v", clusterName, cloneName, err)
+		return
+	}
+	test.Passf("postgres", "Restored %s into %s", clusterName, cloneName)
+
+	for _, database := range databases {
+		if err := compareRowCounts(p, test, allowDrift, clusterName, cloneName, database); err != nil {
+			test.Failf("postgres", "Failed to verify %s/%s: %v", cloneName, database, err)
+		}
+	}
+}
+
+func compareRowCounts(p *platform.Platform, test *console.TestResults, allowDrift bool, sourceName, cloneName, database string) error {
+	source, err := p.OpenDB(Namespace, sourceName, database)
+	if err != nil {
+		return errors.Wrapf(err, "failed to connect to %s", sourceName)
+	}
+	defer source.Close()
+	clone, err := p.OpenDB(Namespace, cloneName, database)
+	if err != nil {
+		return errors.Wrapf(err, "failed to connect to %s", cloneName)
+	}
+	defer clone.Close()
+
+	var tables []table
+	if _, err := source.Query(&tables, `SELECT table_schema, table_name FROM information_schema.tables
+		WHERE table_type = 'BASE TABLE' AND table_schema NOT IN ('pg_catalog', 'information_schema')`); err != nil {
+		return errors.Wrap(err, "failed to list tables")
+	}
+
+	rows := 0
+	var drift []string
+	for _, t := range tables {
+		expected, err := countRows(source, t)
+		if err != nil {
+			return err
+		}
+		actual, err := countRows(clone, t)
+		if err != nil {
+			return fmt.Errorf("table %s is missing from the restored database: %v", t, err)
+		}
+		if actual != expected {
+			drift = append(drift, fmt.Sprintf("table %s has %d rows, restored %d", t, expected, actual))
+		}
+		rows += actual
+	}
+	if len(drift) > 0 && !allowDrift {
+		test.Failf("postgres", "%d tables restored into %s/%s do not match %s: %s", len(drift), cloneName, database, sourceName, strings.Join(drift, ", "))
+		return nil
+	}
+	for _, msg := range drift {
+		test.Warnf("%s/%s: %s", sourceName, database, msg)
+	}
+	test.Passf("postgres", "Restored %d tables with %d rows into %s/%s", len(tables), rows, cloneName, database)
+	return nil
+}
+
+func countRows(db *pg.DB, t table) (int, error) {
+	var count int
+	if _, err := db.QueryOne(pg.Scan(&count), "SELECT count(*) FROM ?.?", pg.Ident(t.TableSchema), pg.Ident(t.TableName)); err != nil {
+		return 0, errors.Wrapf(err, "failed to count rows in %s", t)
+	}
+	return count, nil
+}
@@ -0,0 +1,227 @@
+package storage
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/flanksource/karina/pkg/platform"
+	"github.com/flanksource/karina/pkg/types"
+	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	storageclient "k8s.io/client-go/kubernetes/typed/storage/v1"
+)
+
+const (
+	// ManagedLabel is added to the storage classes declared under storage.classes, so that they
+	// are deleted when they are removed from the config
+	ManagedLabel = "storage.flanksource.com/managed"
+	// DefaultAnnotation marks the default storage class
+	DefaultAnnotation     = "storageclass.kubernetes.io/is-default-class"
+	betaDefaultAnnotation = "storageclass.beta.kubernetes.io/is-default-class"
+)
+
+// Install creates or updates the declared storage classes, deletes previously declared classes that
+// have been removed and ensures that only the declared default class is marked as the default
+func Install(p *platform.Platform) error {
+	var classes []types.StorageClass
+	if p.Storage != nil {
+		classes = p.Storage.Classes
+	}
+	if err := validate(classes); err != nil {
+		return err
+	}
+	client, err := p.GetClientset()
+	if err != nil {
+		return errors.Wrap(err, "failed to get clientset")
+	}
+	api := client.StorageV1().StorageClasses()
+
+	declared := make(map[string]bool)
+	for _, class := range classes {
+		declared[class.Name] = true
+		if err := apply(p, api, class); err != nil {
+			return errors.Wrapf(err, "failed to apply storage class %s", class.Name)
+		}
+	}
+
+	list, err := api.List(metav1.ListOptions{LabelSelector: ManagedLabel})
+	if err != nil {
+		return errors.Wrap(err, "failed to list storage classes")
+	}
+	for _, existing := range list.Items {
+		if declared[existing.Name] {
+			continue
+		}
+		if p.DryRun {
+			p.Infof("[dry-run] Would delete storage class %s", existing.Name)
+			continue
+		}
+		p.Infof("Deleting storage class %s which is no longer declared", existing.Name)
+		if err := api.Delete(existing.Name, nil); err != nil && !kerrors.IsNotFound(err) {
+			return errors.Wrapf(err, "failed to delete storage class %s", existing.Name)
+		}
+	}
+	return SetDefault(p)
+}
+
+func validate(classes []types.StorageClass) error {
+	defaults := 0
+	for _, class := range classes {
+		if class.Name == "" || class.Provisioner == "" {
+			return fmt.Errorf("storage classes require a name and provisioner")
+		}
+		if class.Default {
+			defaults++
+		}
+	}
+	if defaults > 1 {
+		return fmt.Errorf("only one storage class can be the default, found %d", defaults)
+	}
+	return nil
+}
+
+// apply creates or updates a storage class, classes are recreated if any of their immutable
+// fields have changed, which does not affect volumes that have already been provisioned
+func apply(p *platform.Platform, api storageclient.StorageClassInterface, class types.StorageClass) error {
+	desired := newStorageClass(class)
+	existing, err := api.Get(class.Name, metav1.GetOptions{})
+	if kerrors.IsNotFound(err) {
+		if p.DryRun {
+			p.Infof("[dry-run] Would create storage class %s", class.Name)
+			return nil
+		}
+		p.Infof("Creating storage class %s", class.Name)
+		_, err = api.Create(desired)
+		return err
+	} else if err != nil {
+		return err
+	}
+
+	if !immutableEqual(existing, desired) {
+		if p.DryRun {
+			p.Infof("[dry-run] Would recreate storage class %s", class.Name)
+			return nil
+		}
+		p.Warnf("Recreating storage class %s as its provisioner, parameters, reclaim policy or binding mode have changed, existing volumes are not affected", class.Name)
+		if err := api.Delete(class.Name, nil); err != nil {
+			return err
+		}
+		_, err = api.Create(desired)
+		return err
+	}
+
+	if existing.Labels == nil {
+		existing.Labels = make(map[string]string)
+	}
+	existing.Labels[ManagedLabel] = "karina"
+	existing.AllowVolumeExpansion = desired.AllowVolumeExpansion
+	existing.MountOptions = desired.MountOptions
+	if p.DryRun {
+		p.Infof("[dry-run] Would update storage class %s", class.Name)
+		return nil
+	}
+	p.Debugf("Updating storage class %s", class.Name)
+	_, err = api.Update(existing)
+	return err
+}
+
+func newStorageClass(class types.StorageClass) *storagev1.StorageClass {
+	reclaimPolicy := v1.PersistentVolumeReclaimDelete
+	if class.ReclaimPolicy != "" {
+		reclaimPolicy = v1.PersistentVolumeReclaimPolicy(class.ReclaimPolicy)
+	}
+	bindingMode := storagev1.VolumeBindingImmediate
+	if class.VolumeBindingMode != "" {
+		bindingMode = storagev1.VolumeBindingMode(class.VolumeBindingMode)
+	}
+	allowExpansion := class.AllowVolumeExpansion
+	sc := &storagev1.StorageClass{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   class.Name,
+			Labels: map[string]string{ManagedLabel: "karina"},
+		},
+		Provisioner:          class.Provisioner,
+		Parameters:           class.Parameters,
+		ReclaimPolicy:        &reclaimPolicy,
+		VolumeBindingMode:    &bindingMode,
+		AllowVolumeExpansion: &allowExpansion,
+		MountOptions:         class.MountOptions,
+	}
+	if class.Default {
+		sc.Annotations = map[string]string{DefaultAnnotation: "true"}
+	}
+	return sc
+}
+
+func immutableEqual(existing, desired *storagev1.StorageClass) bool {
+	if existing.Provisioner != desired.Provisioner {
+		return false
+	}
+	if len(existing.Parameters) != 0 || len(desired.Parameters) != 0 {
+		if !reflect.DeepEqual(existing.Parameters, desired.Parameters) {
+			return false
+		}
+	}
+	if existing.ReclaimPolicy != nil && *existing.ReclaimPolicy != *desired.ReclaimPolicy {
+		return false
+	}
+	if existing.VolumeBindingMode != nil && *existing.VolumeBindingMode != *desired.VolumeBindingMode {
+		return false
+	}
+	return true
+}
+
+// SetDefault marks the declared default storage class as the default and removes the flag from all
+// other classes, including those deployed by other phases. Nothing is changed if no default is declared.
+func SetDefault(p *platform.Platform) error {
+	if p.Storage == nil {
+		return nil
+	}
+	var name string
+	for _, class := range p.Storage.Classes {
+		if class.Default {
+			name = class.Name
+		}
+	}
+	if name == "" {
+		return nil
+	}
+	client, err := p.GetClientset()
+	if err != nil {
+		return errors.Wrap(err, "failed to get clientset")
+	}
+	api := client.StorageV1().StorageClasses()
+	list, err := api.List(metav1.ListOptions{})
+	if err != nil {
+		return errors.Wrap(err, "failed to list storage classes")
+	}
+	for i := range list.Items {
+		sc := &list.Items[i]
+		isDefault := sc.Name == name
+		_, beta := sc.Annotations[betaDefaultAnnotation]
+		if !beta && (sc.Annotations[DefaultAnnotation] == "true") == isDefault {
+			continue
+		}
+		if p.DryRun {
+			p.Infof("[dry-run] Would set %s=%t on storage class %s", DefaultAnnotation, isDefault, sc.Name)
+			continue
+		}
+		if sc.Annotations == nil {
+			sc.Annotations = make(map[string]string)
+		}
+		delete(sc.Annotations, betaDefaultAnnotation)
+		if isDefault {
+			p.Infof("Setting %s as the default storage class", sc.Name)
+			sc.Annotations[DefaultAnnotation] = "true"
+		} else {
+			delete(sc.Annotations, DefaultAnnotation)
+		}
+		if _, err := api.Update(sc); err != nil {
+			return errors.Wrapf(err, "failed to update storage class %s", sc.Name)
+		}
+	}
+	return nil
+}
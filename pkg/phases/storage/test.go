@@ -0,0 +1,127 @@
+package storage
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/flanksource/commons/console"
+	"github.com/flanksource/commons/utils"
+	"github.com/flanksource/karina/pkg/platform"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const testTimeout = 5 * time.Minute
+
+// Test provisions a volume for each declared storage class, writes to it from one pod and reads it
+// back from a second pod
+func Test(p *platform.Platform, test *console.TestResults) {
+	if p.Storage == nil || len(p.Storage.Classes) == 0 {
+		test.Skipf("storage", "No storage classes declared")
+		return
+	}
+	size := p.Storage.TestSize
+	if size == "" {
+		size = "1Gi"
+	}
+	quantity, err := resource.ParseQuantity(size)
+	if err != nil {
+		test.Failf("storage", "Invalid testSize %s: %v", size, err)
+		return
+	}
+	client, err := p.GetClientset()
+	if err != nil {
+		test.Failf("storage", "Failed to get clientset: %v", err)
+		return
+	}
+
+	namespace := fmt.Sprintf("storage-test-%s", utils.RandomString(6))
+	if err := p.CreateOrUpdateNamespace(namespace, nil, nil); err != nil {
+		test.Failf("storage", "Failed to create namespace %s: %v", namespace, err)
+		return
+	}
+	defer func() {
+		client.CoreV1().Namespaces().Delete(namespace, nil) // nolint: errcheck
+	}()
+
+	for _, class := range p.Storage.Classes {
+		if class.SkipTest {
+			test.Skipf("storage", "Skipping storage class %s", class.Name)
+			continue
+		}
+		if err := testClass(p, client, namespace, class.Name, quantity); err != nil {
+			test.Failf("storage", "Storage class %s: %v", class.Name, err)
+		} else {
+			test.Passf("storage", "Storage class %s provisioned a volume that was written and read back", class.Name)
+		}
+	}
+}
+
+func testClass(p *platform.Platform, client kubernetes.Interface, namespace, class string, size resource.Quantity) error {
+	pvc := &v1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{Name: class, Namespace: namespace},
+		Spec: v1.PersistentVolumeClaimSpec{
+			AccessModes:      []v1.PersistentVolumeAccessMode{v1.ReadWriteOnce},
+			StorageClassName: &class,
+			Resources: v1.ResourceRequirements{
+				Requests: v1.ResourceList{v1.ResourceStorage: size},
+			},
+		},
+	}
+	if _, err := client.CoreV1().PersistentVolumeClaims(namespace).Create(pvc); err != nil {
+		return fmt.Errorf("failed to create pvc: %v", err)
+	}
+	token := utils.RandomString(10)
+	if err := runPod(p, client, namespace, class+"-write", class, fmt.Sprintf("echo %s > /data/test && sync", token)); err != nil {
+		return fmt.Errorf("failed to write: %v", err)
+	}
+	if err := runPod(p, client, namespace, class+"-read", class, fmt.Sprintf("grep -q %s /data/test", token)); err != nil {
+		return fmt.Errorf("failed to read: %v", err)
+	}
+	return nil
+}
+
+// runPod runs a shell command in a pod with the claim mounted at /data and waits for it to succeed
+func runPod(p *platform.Platform, client kubernetes.Interface, namespace, name, claim, command string) error {
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+		Spec: v1.PodSpec{
+			RestartPolicy: v1.RestartPolicyNever,
+			Containers: []v1.Container{
+				{
+					Name:         "test",
+					Image:        "docker.io/library/busybox:1.28.0-glibc",
+					Command:      []string{"sh", "-c", command},
+					VolumeMounts: []v1.VolumeMount{{Name: "data", MountPath: "/data"}},
+				},
+			},
+			Volumes: []v1.Volume{
+				{
+					Name: "data",
+					VolumeSource: v1.VolumeSource{
+						PersistentVolumeClaim: &v1.PersistentVolumeClaimVolumeSource{ClaimName: claim},
+					},
+				},
+			},
+		},
+	}
+	pods := client.CoreV1().Pods(namespace)
+	if _, err := pods.Create(pod); err != nil {
+		return err
+	}
+	// the pod is deleted so that ReadWriteOnce volumes can be attached to the next pod
+	defer pods.Delete(name, nil) // nolint: errcheck
+	if err := p.WaitForPod(namespace, name, testTimeout, v1.PodSucceeded); err != nil {
+		return err
+	}
+	pod, err := pods.Get(name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	if pod.Status.Phase != v1.PodSucceeded {
+		return fmt.Errorf("pod %s is %s", name, pod.Status.Phase)
+	}
+	return nil
+}
@@ -0,0 +1,398 @@
+package tenant
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/flanksource/commons/logger"
+	"github.com/flanksource/karina/pkg/phases/flux"
+	"github.com/flanksource/karina/pkg/phases/harbor"
+	"github.com/flanksource/karina/pkg/phases/monitoring"
+	"github.com/flanksource/karina/pkg/phases/nginx"
+	"github.com/flanksource/karina/pkg/platform"
+	"github.com/flanksource/karina/pkg/types"
+	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// Label is set to the tenant name on each of the tenant's namespaces
+	Label = "tenant.flanksource.com/name"
+	// NamespaceLabel is set to the namespace name on namespaces that tenants allow ingress from
+	NamespaceLabel = "tenant.flanksource.com/namespace"
+)
+
+// harborRoles maps the ClusterRoles of tenant groups to the roles they are given in the tenant's harbor project
+var harborRoles = map[string]string{
+	"admin": "maintainer",
+	"edit":  "developer",
+	"view":  "guest",
+}
+
+// Deploy applies all tenants declared in the config
+func Deploy(p *platform.Platform) error {
+	for _, tenant := range p.Tenants {
+		if err := Apply(p, tenant, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Apply creates or updates the namespaces of a tenant together with their quotas, role bindings and
+// network policies, and then the tenant's harbor project and gitops deployment. If prune is set the
+// objects of the tenant that are no longer generated are deleted.
+func Apply(p *platform.Platform, tenant types.Tenant, prune bool) error {
+	if tenant.Name == "" {
+		return fmt.Errorf("tenant name must be specified")
+	}
+	Defaults(&tenant)
+	p.Infof("Applying tenant %s with namespaces %v", tenant.Name, tenant.Namespaces)
+
+	if !tenant.DisableNetworkPolicies {
+		if err := labelAllowedNamespaces(p, tenant.AllowIngressFrom); err != nil {
+			return err
+		}
+	}
+
+	keep := make(map[string]bool)
+	for _, ns := range tenant.Namespaces {
+		labels := map[string]string{Label: tenant.Name, NamespaceLabel: ns}
+		for k, v := range tenant.Labels {
+			labels[k] = v
+		}
+		annotations := make(map[string]string)
+		for k, v := range tenant.Annotations {
+			annotations[k] = v
+		}
+		if err := p.CreateOrUpdateWorkloadNamespace(ns, labels, annotations); err != nil {
+			return errors.Wrapf(err, "failed to create namespace %s", ns)
+		}
+		objects, err := Objects(tenant, ns)
+		if err != nil {
+			return errors.Wrapf(err, "invalid tenant %s", tenant.Name)
+		}
+		if err := p.Apply(ns, objects...); err != nil {
+			return errors.Wrapf(err, "failed to apply tenant %s to namespace %s", tenant.Name, ns)
+		}
+		for _, obj := range objects {
+			keep[key(obj.GetObjectKind().GroupVersionKind().Kind, ns, obj.(metav1.Object).GetName())] = true
+		}
+	}
+
+	if prune {
+		client, err := p.GetClientset()
+		if err != nil {
+			return err
+		}
+		if err := Prune(client, p.Logger, tenant, keep, p.DryRun); err != nil {
+			return errors.Wrapf(err, "failed to prune tenant %s", tenant.Name)
+		}
+	}
+
+	if tenant.Harbor != nil {
+		if err := harbor.SyncProjects(p, HarborProject(tenant)); err != nil {
+			return errors.Wrapf(err, "failed to sync the harbor project of tenant %s", tenant.Name)
+		}
+	}
+
+	if tenant.GitOps != nil {
+		gitops := *tenant.GitOps
+		if gitops.Namespace == "" {
+			gitops.Namespace = tenant.Namespaces[0]
+		}
+		if err := p.Apply(gitops.Namespace, flux.NewFluxDeployment(&gitops)...); err != nil {
+			return errors.Wrapf(err, "failed to deploy gitops for tenant %s", tenant.Name)
+		}
+	}
+	return nil
+}
+
+// Defaults fills in the namespaces and allowed ingress namespaces of a tenant
+func Defaults(tenant *types.Tenant) {
+	if len(tenant.Namespaces) == 0 {
+		tenant.Namespaces = []string{tenant.Name}
+	}
+	if len(tenant.AllowIngressFrom) == 0 {
+		tenant.AllowIngressFrom = []string{nginx.Namespace, monitoring.Namespace}
+	}
+}
+
+// labelAllowedNamespaces labels existing namespaces so that they can be selected by the network policies of tenants
+func labelAllowedNamespaces(p *platform.Platform, namespaces []string) error {
+	client, err := p.GetClientset()
+	if err != nil {
+		return err
+	}
+	for _, ns := range namespaces {
+		if _, err := client.CoreV1().Namespaces().Get(ns, metav1.GetOptions{}); err != nil {
+			p.Warnf("Not allowing ingress from namespace %s: %v", ns, err)
+			continue
+		}
+		// annotations must not be nil, or the existing annotations are removed
+		if err := p.CreateOrUpdateWorkloadNamespace(ns, map[string]string{NamespaceLabel: ns}, map[string]string{}); err != nil {
+			return errors.Wrapf(err, "failed to label namespace %s", ns)
+		}
+	}
+	return nil
+}
+
+// Objects returns the ResourceQuota, LimitRange, RoleBindings and NetworkPolicy of a tenant namespace
+func Objects(tenant types.Tenant, namespace string) ([]runtime.Object, error) {
+	var objects []runtime.Object
+	meta := func(name string) metav1.ObjectMeta {
+		return metav1.ObjectMeta{Name: name, Namespace: namespace, Labels: map[string]string{Label: tenant.Name}}
+	}
+
+	if len(tenant.Quota) > 0 {
+		hard, err := resourceList(tenant.Quota)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid quota")
+		}
+		objects = append(objects, &v1.ResourceQuota{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "ResourceQuota"},
+			ObjectMeta: meta("tenant-quota"),
+			Spec:       v1.ResourceQuotaSpec{Hard: hard},
+		})
+	}
+
+	if limits := tenant.LimitRange; limits != nil {
+		item := v1.LimitRangeItem{Type: v1.LimitTypeContainer}
+		var err error
+		if item.DefaultRequest, err = resourceList(limits.DefaultRequest); err != nil {
+			return nil, errors.Wrap(err, "invalid limitRange.defaultRequest")
+		}
+		if item.Default, err = resourceList(limits.Default); err != nil {
+			return nil, errors.Wrap(err, "invalid limitRange.default")
+		}
+		if item.Max, err = resourceList(limits.Max); err != nil {
+			return nil, errors.Wrap(err, "invalid limitRange.max")
+		}
+		objects = append(objects, &v1.LimitRange{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "LimitRange"},
+			ObjectMeta: meta("tenant-limits"),
+			Spec:       v1.LimitRangeSpec{Limits: []v1.LimitRangeItem{item}},
+		})
+	}
+
+	groups := make(map[string][]string)
+	for group, role := range tenant.Roles {
+		groups[role] = append(groups[role], group)
+	}
+	var roles []string
+	for role := range groups {
+		roles = append(roles, role)
+	}
+	sort.Strings(roles)
+	for _, role := range roles {
+		sort.Strings(groups[role])
+		binding := &rbacv1.RoleBinding{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "rbac.authorization.k8s.io/v1", Kind: "RoleBinding"},
+			ObjectMeta: meta("tenant-" + role),
+			RoleRef:    rbacv1.RoleRef{APIGroup: "rbac.authorization.k8s.io", Kind: "ClusterRole", Name: role},
+		}
+		for _, group := range groups[role] {
+			binding.Subjects = append(binding.Subjects, rbacv1.Subject{APIGroup: "rbac.authorization.k8s.io", Kind: "Group", Name: group})
+		}
+		objects = append(objects, binding)
+	}
+
+	if !tenant.DisableNetworkPolicies {
+		objects = append(objects, &networkingv1.NetworkPolicy{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "networking.k8s.io/v1", Kind: "NetworkPolicy"},
+			ObjectMeta: meta("tenant-isolation"),
+			Spec: networkingv1.NetworkPolicySpec{
+				PolicyTypes: []networkingv1.PolicyType{networkingv1.PolicyTypeIngress},
+				Ingress: []networkingv1.NetworkPolicyIngressRule{{
+					From: []networkingv1.NetworkPolicyPeer{
+						{NamespaceSelector: &metav1.LabelSelector{MatchLabels: map[string]string{Label: tenant.Name}}},
+						{NamespaceSelector: &metav1.LabelSelector{MatchExpressions: []metav1.LabelSelectorRequirement{{
+							Key:      NamespaceLabel,
+							Operator: metav1.LabelSelectorOpIn,
+							Values:   tenant.AllowIngressFrom,
+						}}}},
+					},
+				}},
+			},
+		})
+	}
+	return objects, nil
+}
+
+// Prune deletes the objects labelled with the tenant's name that are not in keep, e.g. the RoleBinding of a role that is
+// no longer given to any group, and the objects in namespaces that have been removed from the tenant. Removed namespaces
+// are not deleted, but they are unlabelled so that the tenant's network policies no longer allow ingress from them.
+func Prune(client kubernetes.Interface, log logger.Logger, tenant types.Tenant, keep map[string]bool, dryRun bool) error {
+	existing, kinds, err := listObjects(client, metav1.ListOptions{LabelSelector: Label + "=" + tenant.Name})
+	if err != nil {
+		return err
+	}
+
+	for i, obj := range existing {
+		kind, ns, name := kinds[i], obj.GetNamespace(), obj.GetName()
+		if keep[key(kind, ns, name)] {
+			continue
+		}
+		if dryRun {
+			log.Infof("[dry-run] Would delete %s %s/%s of tenant %s", kind, ns, name, tenant.Name)
+			continue
+		}
+		log.Infof("Deleting %s %s/%s of tenant %s", kind, ns, name, tenant.Name)
+		switch kind {
+		case "ResourceQuota":
+			err = client.CoreV1().ResourceQuotas(ns).Delete(name, nil)
+		case "LimitRange":
+			err = client.CoreV1().LimitRanges(ns).Delete(name, nil)
+		case "RoleBinding":
+			err = client.RbacV1().RoleBindings(ns).Delete(name, nil)
+		case "NetworkPolicy":
+			err = client.NetworkingV1().NetworkPolicies(ns).Delete(name, nil)
+		}
+		if err != nil && !kerrors.IsNotFound(err) {
+			return errors.Wrapf(err, "failed to delete %s %s/%s", kind, ns, name)
+		}
+	}
+
+	namespaces, err := client.CoreV1().Namespaces().List(metav1.ListOptions{LabelSelector: Label + "=" + tenant.Name})
+	if err != nil {
+		return err
+	}
+	current := make(map[string]bool)
+	for _, ns := range tenant.Namespaces {
+		current[ns] = true
+	}
+	for _, ns := range namespaces.Items {
+		if current[ns.Name] {
+			continue
+		}
+		log.Warnf("Namespace %s is no longer part of tenant %s, removing the tenant label but not deleting it", ns.Name, tenant.Name)
+		if dryRun {
+			continue
+		}
+		delete(ns.Labels, Label)
+		if _, err := client.CoreV1().Namespaces().Update(&ns); err != nil {
+			return errors.Wrapf(err, "failed to unlabel namespace %s", ns.Name)
+		}
+	}
+	return nil
+}
+
+// PruneRemoved deletes the objects of tenants that are not in tenants and unlabels their namespaces,
+// the namespaces themselves are not deleted
+func PruneRemoved(client kubernetes.Interface, log logger.Logger, tenants []types.Tenant, dryRun bool) error {
+	declared := make(map[string]bool)
+	for _, tenant := range tenants {
+		declared[tenant.Name] = true
+	}
+	objects, _, err := listObjects(client, metav1.ListOptions{LabelSelector: Label})
+	if err != nil {
+		return err
+	}
+	namespaces, err := client.CoreV1().Namespaces().List(metav1.ListOptions{LabelSelector: Label})
+	if err != nil {
+		return err
+	}
+	for i := range namespaces.Items {
+		objects = append(objects, &namespaces.Items[i])
+	}
+	removed := make(map[string]bool)
+	for _, obj := range objects {
+		if name := obj.GetLabels()[Label]; !declared[name] && !removed[name] {
+			removed[name] = true
+			log.Infof("Tenant %s is no longer declared", name)
+			if err := Prune(client, log, types.Tenant{Name: name}, nil, dryRun); err != nil {
+				return errors.Wrapf(err, "failed to prune tenant %s", name)
+			}
+		}
+	}
+	return nil
+}
+
+// listObjects returns the quotas, limit ranges, role bindings and network policies matching selector and their kinds
+func listObjects(client kubernetes.Interface, selector metav1.ListOptions) ([]metav1.Object, []string, error) {
+	var existing []metav1.Object
+	var kinds []string
+	quotas, err := client.CoreV1().ResourceQuotas(v1.NamespaceAll).List(selector)
+	if err != nil {
+		return nil, nil, err
+	}
+	for i := range quotas.Items {
+		existing, kinds = append(existing, &quotas.Items[i]), append(kinds, "ResourceQuota")
+	}
+	limits, err := client.CoreV1().LimitRanges(v1.NamespaceAll).List(selector)
+	if err != nil {
+		return nil, nil, err
+	}
+	for i := range limits.Items {
+		existing, kinds = append(existing, &limits.Items[i]), append(kinds, "LimitRange")
+	}
+	bindings, err := client.RbacV1().RoleBindings(v1.NamespaceAll).List(selector)
+	if err != nil {
+		return nil, nil, err
+	}
+	for i := range bindings.Items {
+		existing, kinds = append(existing, &bindings.Items[i]), append(kinds, "RoleBinding")
+	}
+	policies, err := client.NetworkingV1().NetworkPolicies(v1.NamespaceAll).List(selector)
+	if err != nil {
+		return nil, nil, err
+	}
+	for i := range policies.Items {
+		existing, kinds = append(existing, &policies.Items[i]), append(kinds, "NetworkPolicy")
+	}
+	return existing, kinds, nil
+}
+
+func key(kind, namespace, name string) string {
+	return kind + "/" + namespace + "/" + name
+}
+
+// HarborProject returns the harbor project of a tenant, with a robot account whose pull secret is
+// created in each of the tenant's namespaces
+func HarborProject(tenant types.Tenant) types.HarborProject {
+	config := tenant.Harbor
+	project := types.HarborProject{
+		Name:         config.Project,
+		Roles:        config.Roles,
+		StorageLimit: config.StorageLimit,
+		Robots: []types.HarborRobot{{
+			Name:       "pull",
+			Namespaces: tenant.Namespaces,
+			SecretName: config.SecretName,
+		}},
+	}
+	if project.Name == "" {
+		project.Name = tenant.Name
+	}
+	if len(project.Roles) == 0 {
+		project.Roles = make(map[string]string)
+		for group, role := range tenant.Roles {
+			if harborRole, ok := harborRoles[role]; ok {
+				project.Roles[group] = harborRole
+			}
+		}
+	}
+	return project
+}
+
+func resourceList(values map[string]string) (v1.ResourceList, error) {
+	if len(values) == 0 {
+		return nil, nil
+	}
+	list := make(v1.ResourceList)
+	for name, value := range values {
+		quantity, err := resource.ParseQuantity(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		list[v1.ResourceName(name)] = quantity
+	}
+	return list, nil
+}
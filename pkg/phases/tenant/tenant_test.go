@@ -0,0 +1,164 @@
+package tenant
+
+import (
+	"testing"
+
+	"github.com/flanksource/commons/logger"
+	"github.com/flanksource/karina/pkg/types"
+	. "github.com/onsi/gomega"
+	v1 "k8s.io/api/core/v1"
+	networkingv1 "k8s.io/api/networking/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestObjects(t *testing.T) {
+	g := NewWithT(t)
+	tenant := types.Tenant{
+		Name:       "payments",
+		Roles:      map[string]string{"payments-devs": "edit", "payments-leads": "admin", "auditors": "edit"},
+		Quota:      map[string]string{"requests.cpu": "4", "limits.memory": "16Gi"},
+		LimitRange: &types.TenantLimitRange{DefaultRequest: map[string]string{"cpu": "100m"}},
+	}
+	Defaults(&tenant)
+	g.Expect(tenant.Namespaces).To(Equal([]string{"payments"}))
+
+	objects, err := Objects(tenant, "payments")
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(objects).To(HaveLen(5))
+
+	quota := objects[0].(*v1.ResourceQuota)
+	g.Expect(quota.Namespace).To(Equal("payments"))
+	hard := quota.Spec.Hard[v1.ResourceName("limits.memory")]
+	g.Expect(hard.String()).To(Equal("16Gi"))
+
+	limits := objects[1].(*v1.LimitRange)
+	g.Expect(limits.Spec.Limits[0].DefaultRequest.Cpu().String()).To(Equal("100m"))
+	g.Expect(limits.Spec.Limits[0].Max).To(BeNil())
+
+	admin := objects[2].(*rbacv1.RoleBinding)
+	g.Expect(admin.Name).To(Equal("tenant-admin"))
+	edit := objects[3].(*rbacv1.RoleBinding)
+	g.Expect(edit.RoleRef.Name).To(Equal("edit"))
+	g.Expect(edit.Subjects).To(HaveLen(2))
+	g.Expect(edit.Subjects[0].Name).To(Equal("auditors"))
+	g.Expect(edit.Subjects[0].Kind).To(Equal("Group"))
+
+	policy := objects[4].(*networkingv1.NetworkPolicy)
+	g.Expect(policy.Spec.Ingress[0].From[0].NamespaceSelector.MatchLabels).To(Equal(map[string]string{Label: "payments"}))
+	g.Expect(policy.Spec.Ingress[0].From[1].NamespaceSelector.MatchExpressions[0].Values).To(Equal([]string{"ingress-nginx", "monitoring"}))
+
+	tenant.Quota["pods"] = "many"
+	_, err = Objects(tenant, "payments")
+	g.Expect(err).To(MatchError(ContainSubstring("pods")))
+}
+
+func TestHarborProject(t *testing.T) {
+	g := NewWithT(t)
+	tenant := types.Tenant{
+		Name:       "payments",
+		Namespaces: []string{"payments-dev", "payments-prod"},
+		Roles:      map[string]string{"payments-devs": "edit", "payments-leads": "admin", "sre": "cluster-admin"},
+		Harbor:     &types.TenantHarbor{StorageLimit: "50Gi"},
+	}
+	project := HarborProject(tenant)
+	g.Expect(project.Name).To(Equal("payments"))
+	g.Expect(project.StorageLimit).To(Equal("50Gi"))
+	g.Expect(project.Roles).To(Equal(map[string]string{"payments-devs": "developer", "payments-leads": "maintainer"}))
+	g.Expect(project.Robots).To(Equal([]types.HarborRobot{{Name: "pull", Namespaces: []string{"payments-dev", "payments-prod"}}}))
+}
+
+func TestPrune(t *testing.T) {
+	g := NewWithT(t)
+	tenant := types.Tenant{
+		Name:       "payments",
+		Namespaces: []string{"payments-dev", "payments-prod"},
+		Roles:      map[string]string{"payments-devs": "edit", "payments-leads": "admin"},
+		Quota:      map[string]string{"pods": "20"},
+	}
+	Defaults(&tenant)
+	client := fake.NewSimpleClientset()
+	// apply returns the objects of the tenant that are kept, creating them if create is set
+	apply := func(tenant types.Tenant, create bool) map[string]bool {
+		keep := make(map[string]bool)
+		for _, ns := range tenant.Namespaces {
+			objects, err := Objects(tenant, ns)
+			g.Expect(err).ToNot(HaveOccurred())
+			for _, obj := range objects {
+				if create {
+					g.Expect(client.Tracker().Add(obj)).To(Succeed())
+				}
+				keep[key(obj.GetObjectKind().GroupVersionKind().Kind, ns, obj.(metav1.Object).GetName())] = true
+			}
+		}
+		return keep
+	}
+	for _, ns := range append(tenant.Namespaces, "payments-old") {
+		g.Expect(client.Tracker().Add(&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: ns, Labels: map[string]string{Label: "payments", NamespaceLabel: ns}}})).To(Succeed())
+	}
+	apply(types.Tenant{Name: "payments", Namespaces: []string{"payments-old"}, Roles: tenant.Roles, AllowIngressFrom: tenant.AllowIngressFrom}, true)
+	apply(tenant, true)
+	// objects of other tenants are left untouched
+	g.Expect(client.Tracker().Add(&rbacv1.RoleBinding{ObjectMeta: metav1.ObjectMeta{Name: "tenant-admin", Namespace: "orders", Labels: map[string]string{Label: "orders"}}})).To(Succeed())
+
+	// revoke the admin role, remove the quota and the payments-old namespace
+	delete(tenant.Roles, "payments-leads")
+	tenant.Quota = nil
+	g.Expect(Prune(client, logger.StandardLogger(), tenant, apply(tenant, false), true)).To(Succeed())
+	bindings, err := client.RbacV1().RoleBindings(v1.NamespaceAll).List(metav1.ListOptions{})
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(bindings.Items).To(HaveLen(7), "dry-run does not delete anything")
+
+	g.Expect(Prune(client, logger.StandardLogger(), tenant, apply(tenant, false), false)).To(Succeed())
+	bindings, err = client.RbacV1().RoleBindings(v1.NamespaceAll).List(metav1.ListOptions{})
+	g.Expect(err).ToNot(HaveOccurred())
+	var names []string
+	for _, binding := range bindings.Items {
+		names = append(names, binding.Namespace+"/"+binding.Name)
+	}
+	g.Expect(names).To(ConsistOf("payments-dev/tenant-edit", "payments-prod/tenant-edit", "orders/tenant-admin"))
+
+	quotas, err := client.CoreV1().ResourceQuotas(v1.NamespaceAll).List(metav1.ListOptions{})
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(quotas.Items).To(BeEmpty())
+	policies, err := client.NetworkingV1().NetworkPolicies(v1.NamespaceAll).List(metav1.ListOptions{})
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(policies.Items).To(HaveLen(2))
+
+	old, err := client.CoreV1().Namespaces().Get("payments-old", metav1.GetOptions{})
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(old.Labels).To(Equal(map[string]string{NamespaceLabel: "payments-old"}))
+}
+
+func TestPruneRemoved(t *testing.T) {
+	g := NewWithT(t)
+	client := fake.NewSimpleClientset()
+	var tenants []types.Tenant
+	for _, name := range []string{"payments", "orders"} {
+		tenant := types.Tenant{Name: name, Roles: map[string]string{name + "-devs": "edit"}}
+		Defaults(&tenant)
+		tenants = append(tenants, tenant)
+		g.Expect(client.Tracker().Add(&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name, Labels: map[string]string{Label: name, NamespaceLabel: name}}})).To(Succeed())
+		objects, err := Objects(tenant, name)
+		g.Expect(err).ToNot(HaveOccurred())
+		for _, obj := range objects {
+			g.Expect(client.Tracker().Add(obj)).To(Succeed())
+		}
+	}
+
+	// orders has been removed from the config
+	g.Expect(PruneRemoved(client, logger.StandardLogger(), tenants[:1], false)).To(Succeed())
+	bindings, err := client.RbacV1().RoleBindings(v1.NamespaceAll).List(metav1.ListOptions{})
+	g.Expect(err).ToNot(HaveOccurred())
+	for _, binding := range bindings.Items {
+		g.Expect(binding.Namespace).To(Equal("payments"))
+	}
+	g.Expect(bindings.Items).ToNot(BeEmpty())
+	policies, err := client.NetworkingV1().NetworkPolicies("orders").List(metav1.ListOptions{})
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(policies.Items).To(BeEmpty())
+	orders, err := client.CoreV1().Namespaces().Get("orders", metav1.GetOptions{})
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(orders.Labels).ToNot(HaveKey(Label))
+}
@@ -0,0 +1,556 @@
+package vault
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/flanksource/commons/certs"
+	"github.com/flanksource/karina/pkg/platform"
+	"github.com/flanksource/karina/pkg/types"
+	"github.com/hashicorp/vault/api"
+	"github.com/pkg/errors"
+)
+
+// Mounts that are managed by vault itself and are never pruned
+var (
+	systemMounts   = []string{"sys/", "cubbyhole/", "identity/"}
+	systemAuth     = []string{"token/"}
+	systemPolicies = []string{"root", "default"}
+)
+
+// Tokens are created for each entry and stored in the vault-token-<name> secret
+var tokens = map[string][]string{
+	"signer": {"signer"},
+}
+
+type change struct {
+	// one of + (create), ~ (update) or - (delete)
+	action string
+	kind   string
+	name   string
+	diff   []string
+	apply  func() error
+}
+
+func (c change) String() string {
+	return fmt.Sprintf("%s %s %s", c.action, c.kind, c.name)
+}
+
+func getClient(p *platform.Platform) (*api.Client, error) {
+	config := &api.Config{
+		Address: "https://vault." + p.Domain + ":443",
+	}
+	_ = config.ConfigureTLS(&api.TLSConfig{
+		Insecure: true,
+	})
+
+	client, err := api.NewClient(config)
+	if err != nil {
+		return nil, err
+	}
+	client.SetToken(p.Vault.Token)
+	return client, nil
+}
+
+// Apply reconciles the policies, secret engines, auth methods, roles and group mappings in vault
+// with the configuration, printing the changes before applying them. Policies, roles and group
+// mappings that are no longer declared are deleted if prune or vault.prune is true, secret engines
+// and auth methods are only unmounted if prune is true, as unmounting deletes all of their data.
+func Apply(p *platform.Platform, prune bool) error {
+	if p.Vault == nil || p.Vault.Disabled {
+		p.Infof("Vault is not configured or disabled. Nothing to be done")
+		return nil
+	}
+	if p.Vault.Token == "" {
+		return fmt.Errorf("vault.token must be specified, run karina vault init first")
+	}
+	client, err := getClient(p)
+	if err != nil {
+		return err
+	}
+
+	changes, err := plan(p, client, prune || p.Vault.Prune, prune)
+	if err != nil {
+		return err
+	}
+	if len(changes) == 0 {
+		p.Infof("Vault configuration is up to date")
+	}
+	for _, change := range changes {
+		p.Infof("%s", change)
+		for _, line := range change.diff {
+			p.Infof("    %s", line)
+		}
+	}
+	if p.DryRun {
+		return nil
+	}
+
+	for _, change := range changes {
+		if err := change.apply(); err != nil {
+			return errors.Wrapf(err, "failed to apply %s", change)
+		}
+	}
+
+	if _, ok := secretEngines(p)["pki"]; ok {
+		if err := importCA(client, p); err != nil {
+			return err
+		}
+	}
+
+	// ExtraConfig is an escape hatch that allows writing to arbritrary vault paths
+	for path, config := range p.Vault.ExtraConfig {
+		if _, err := client.Logical().Write(path, config); err != nil {
+			return fmt.Errorf("error writing to %s: %v", path, err)
+		}
+	}
+	return nil
+}
+
+// secretEngines returns the declared secret engines including the default pki engine
+func secretEngines(p *platform.Platform) map[string]types.VaultMount {
+	engines := make(map[string]types.VaultMount)
+	for path, engine := range p.Vault.SecretEngines {
+		engines[strings.TrimSuffix(path, "/")] = engine
+	}
+	pki, ok := engines["pki"]
+	if !ok {
+		pki = types.VaultMount{
+			Type:        "pki",
+			MaxLeaseTTL: "43800h", // 5 years
+		}
+	}
+	if len(p.Vault.Roles) > 0 && pki.Roles == nil {
+		pki.Roles = make(map[string]map[string]interface{})
+	}
+	for role, config := range p.Vault.Roles {
+		if _, ok := pki.Roles[role]; !ok {
+			pki.Roles[role] = config
+		}
+	}
+	engines["pki"] = pki
+	return engines
+}
+
+// authMethods returns the declared auth methods including the ldap method if ldap is configured
+func authMethods(p *platform.Platform) map[string]types.VaultMount {
+	methods := make(map[string]types.VaultMount)
+	for path, method := range p.Vault.AuthMethods {
+		methods[strings.TrimSuffix(path, "/")] = method
+	}
+	if _, ok := methods["ldap"]; !ok && p.Ldap != nil && !p.Ldap.Disabled {
+		methods["ldap"] = types.VaultMount{
+			Type: "ldap",
+			Config: map[string]interface{}{
+				"url":          p.Ldap.GetConnectionURL(),
+				"binddn":       p.Ldap.Username,
+				"bindpass":     p.Ldap.Password,
+				"userdn":       p.Ldap.UserDN,
+				"groupdn":      p.Ldap.GroupDN,
+				"groupfilter":  fmt.Sprintf("(&(objectClass=%s)(member={{.UserDN}}))", p.Ldap.GroupObjectClass),
+				"groupattr":    p.Ldap.GroupNameAttr,
+				"userattr":     "cn",
+				"insecure_tls": "true",
+				"starttls":     "true",
+			},
+		}
+	}
+	return methods
+}
+
+func plan(p *platform.Platform, client *api.Client, prune, unmount bool) ([]change, error) {
+	var changes, deletions []change
+
+	engines := secretEngines(p)
+	mounts, err := client.Sys().ListMounts()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list secret engines")
+	}
+	for _, path := range sortedKeys(engines) {
+		engine := engines[path]
+		c, err := planMount(client, "secret engine", path, path, engine, mounts[path+"/"])
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, c...)
+	}
+
+	methods := authMethods(p)
+	auths, err := client.Sys().ListAuth()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list auth methods")
+	}
+	for _, path := range sortedKeys(methods) {
+		method := methods[path]
+		c, err := planMount(client, "auth method", path, "auth/"+path, method, auths[path+"/"])
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, c...)
+	}
+
+	for _, path := range sortedKeys(engines) {
+		c, d, err := planCollection(client, "role", path+"/roles/", engines[path].Roles, prune)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, c...)
+		deletions = append(deletions, d...)
+	}
+	for _, path := range sortedKeys(methods) {
+		c, d, err := planCollection(client, "role", "auth/"+path+"/role/", methods[path].Roles, prune)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, c...)
+		deletions = append(deletions, d...)
+	}
+
+	if _, ok := methods["ldap"]; ok {
+		groups := make(map[string]map[string]interface{})
+		for group, policies := range p.Vault.GroupMappings {
+			groups[group] = map[string]interface{}{
+				"policies": strings.Join(policies, ","),
+			}
+		}
+		c, d, err := planCollection(client, "group mapping", "auth/ldap/groups/", groups, prune)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, c...)
+		deletions = append(deletions, d...)
+	}
+
+	c, d, err := planPolicies(p, client, prune)
+	if err != nil {
+		return nil, err
+	}
+	changes = append(changes, c...)
+	deletions = append(deletions, d...)
+
+	c, err = planTokens(p, client)
+	if err != nil {
+		return nil, err
+	}
+	changes = append(changes, c...)
+
+	if unmount {
+		for _, path := range sortedKeys(mounts) {
+			if _, ok := engines[strings.TrimSuffix(path, "/")]; !ok && !contains(systemMounts, path) {
+				path := path
+				deletions = append(deletions, change{"-", "secret engine", path, nil, func() error {
+					return client.Sys().Unmount(path)
+				}})
+			}
+		}
+		for _, path := range sortedKeys(auths) {
+			if _, ok := methods[strings.TrimSuffix(path, "/")]; !ok && !contains(systemAuth, path) {
+				path := path
+				deletions = append(deletions, change{"-", "auth method", path, nil, func() error {
+					return client.Sys().DisableAuth(path)
+				}})
+			}
+		}
+	}
+	return append(changes, deletions...), nil
+}
+
+// planMount returns the changes required to mount/enable and tune a secret engine or auth method
+// and to write its config, sysPath is the path of the mount as seen by the sys/mounts/<path>/tune endpoint
+func planMount(client *api.Client, kind, path, sysPath string, mount types.VaultMount, existing *api.MountOutput) ([]change, error) {
+	var changes []change
+	configPath := sysPath + "/config"
+	if existing == nil {
+		input := &api.MountInput{
+			Type:        mount.Type,
+			Description: mount.Description,
+			Options:     mount.Options,
+			Config: api.MountConfigInput{
+				DefaultLeaseTTL: mount.DefaultLeaseTTL,
+				MaxLeaseTTL:     mount.MaxLeaseTTL,
+			},
+		}
+		changes = append(changes, change{"+", kind, path, nil, func() error {
+			if kind == "auth method" {
+				return client.Sys().EnableAuthWithOptions(path, input)
+			}
+			return client.Sys().Mount(path, input)
+		}})
+		if len(mount.Config) > 0 {
+			changes = append(changes, change{"+", kind + " config", configPath, nil, func() error {
+				_, err := client.Logical().Write(configPath, mount.Config)
+				return err
+			}})
+		}
+		return changes, nil
+	}
+
+	if existing.Type != mount.Type {
+		return nil, fmt.Errorf("%s %s is of type %s and cannot be changed to %s, delete it manually", kind, path, existing.Type, mount.Type)
+	}
+	var diff []string
+	if mount.Description != existing.Description {
+		diff = append(diff, fmt.Sprintf("description: %s -> %s", existing.Description, mount.Description))
+	}
+	if mount.DefaultLeaseTTL != "" && !equalValue(mount.DefaultLeaseTTL, existing.Config.DefaultLeaseTTL) {
+		diff = append(diff, fmt.Sprintf("defaultLeaseTTL: %ds -> %s", existing.Config.DefaultLeaseTTL, mount.DefaultLeaseTTL))
+	}
+	if mount.MaxLeaseTTL != "" && !equalValue(mount.MaxLeaseTTL, existing.Config.MaxLeaseTTL) {
+		diff = append(diff, fmt.Sprintf("maxLeaseTTL: %ds -> %s", existing.Config.MaxLeaseTTL, mount.MaxLeaseTTL))
+	}
+	if len(diff) > 0 {
+		description := mount.Description
+		changes = append(changes, change{"~", kind, path, diff, func() error {
+			return client.Sys().TuneMount(sysPath, api.MountConfigInput{
+				Description:     &description,
+				DefaultLeaseTTL: mount.DefaultLeaseTTL,
+				MaxLeaseTTL:     mount.MaxLeaseTTL,
+			})
+		}})
+	}
+
+	if len(mount.Config) > 0 {
+		c, err := planWrite(client, kind+" config", configPath, mount.Config)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, c...)
+	}
+	return changes, nil
+}
+
+// planWrite compares the desired values with the values read from path, keys that are not
+// returned by vault (e.g. passwords) cannot be compared and are ignored
+func planWrite(client *api.Client, kind, path string, desired map[string]interface{}) ([]change, error) {
+	write := func() error {
+		_, err := client.Logical().Write(path, desired)
+		return err
+	}
+	existing, err := client.Logical().Read(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read %s", path)
+	}
+	if existing == nil || existing.Data == nil {
+		return []change{{"+", kind, path, nil, write}}, nil
+	}
+	var diff []string
+	for _, key := range sortedKeys(desired) {
+		actual, ok := existing.Data[key]
+		if !ok {
+			continue
+		}
+		if !equalValue(desired[key], actual) {
+			diff = append(diff, fmt.Sprintf("%s: %v -> %v", key, actual, desired[key]))
+		}
+	}
+	if len(diff) == 0 {
+		return nil, nil
+	}
+	return []change{{"~", kind, path, diff, write}}, nil
+}
+
+// planCollection returns the changes required to reconcile all entries under prefix
+// e.g. pki/roles/ with the desired entries
+func planCollection(client *api.Client, kind, prefix string, desired map[string]map[string]interface{}, prune bool) ([]change, []change, error) {
+	var changes, deletions []change
+	for _, name := range sortedKeys(desired) {
+		c, err := planWrite(client, kind, prefix+name, desired[name])
+		if err != nil {
+			return nil, nil, err
+		}
+		changes = append(changes, c...)
+	}
+	if !prune {
+		return changes, nil, nil
+	}
+
+	list, err := client.Logical().List(prefix)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "failed to list %s", prefix)
+	}
+	if list == nil {
+		return changes, nil, nil
+	}
+	keys, _ := list.Data["keys"].([]interface{})
+	for _, key := range keys {
+		name := fmt.Sprint(key)
+		if _, ok := desired[name]; ok {
+			continue
+		}
+		path := prefix + name
+		deletions = append(deletions, change{"-", kind, path, nil, func() error {
+			_, err := client.Logical().Delete(path)
+			return err
+		}})
+	}
+	return changes, deletions, nil
+}
+
+func planPolicies(p *platform.Platform, client *api.Client, prune bool) ([]change, []change, error) {
+	var changes, deletions []change
+	for _, name := range sortedKeys(p.Vault.Policies) {
+		name := name
+		policy := p.Vault.Policies[name].String()
+		put := func() error {
+			return client.Sys().PutPolicy(name, policy)
+		}
+		existing, err := client.Sys().GetPolicy(name)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "failed to get policy %s", name)
+		}
+		if existing == "" {
+			changes = append(changes, change{"+", "policy", name, nil, put})
+		} else if diff := lineDiff(existing, policy); len(diff) > 0 {
+			changes = append(changes, change{"~", "policy", name, diff, put})
+		}
+	}
+	if !prune {
+		return changes, nil, nil
+	}
+
+	policies, err := client.Sys().ListPolicies()
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to list policies")
+	}
+	for _, name := range policies {
+		if _, ok := p.Vault.Policies[name]; ok || contains(systemPolicies, name) {
+			continue
+		}
+		name := name
+		deletions = append(deletions, change{"-", "policy", name, nil, func() error {
+			return client.Sys().DeletePolicy(name)
+		}})
+	}
+	return changes, deletions, nil
+}
+
+// planTokens creates tokens that do not exist yet, or are no longer valid and stores
+// them in a secret rather than printing them
+func planTokens(p *platform.Platform, client *api.Client) ([]change, error) {
+	var changes []change
+	for _, name := range sortedKeys(tokens) {
+		name := name
+		secretName := "vault-token-" + name
+		if secret := p.GetSecret(Namespace, secretName); secret != nil {
+			if _, err := client.Auth().Token().Lookup(string((*secret)["token"])); err == nil {
+				continue
+			}
+		}
+		changes = append(changes, change{"+", "token", name, []string{"stored in secret " + Namespace + "/" + secretName}, func() error {
+			yes := true
+			secret, err := client.Auth().Token().Create(&api.TokenCreateRequest{
+				Policies:    tokens[name],
+				DisplayName: "karina",
+				Metadata: map[string]string{
+					"value": "key",
+				},
+				Lease:     "8760h",
+				Renewable: &yes,
+				TTL:       "8760h",
+				Period:    "8760h", //1y
+			})
+			if err != nil {
+				return err
+			}
+			return p.CreateOrUpdateSecret(secretName, Namespace, map[string][]byte{
+				"token": []byte(secret.Auth.ClientToken),
+			})
+		}})
+	}
+	return changes, nil
+}
+
+func importCA(client *api.Client, p *platform.Platform) error {
+	ingress := p.GetIngressCA()
+	switch ingress := ingress.(type) {
+	case *certs.Certificate:
+		if _, err := client.Logical().Write("pki/config/ca", map[string]interface{}{
+			"pem_bundle": string(ingress.EncodedCertificate()) + "\n" + string(ingress.EncodedPrivateKey()),
+		}); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown CA type %v", ingress)
+	}
+	return nil
+}
+
+// equalValue compares a value from the configuration with a value returned by vault, which
+// returns durations in seconds and may return comma separated strings as lists
+func equalValue(desired, actual interface{}) bool {
+	if fmt.Sprint(desired) == fmt.Sprint(actual) {
+		return true
+	}
+	switch desired := desired.(type) {
+	case string:
+		if duration, err := time.ParseDuration(desired); err == nil {
+			return fmt.Sprint(int64(duration.Seconds())) == fmt.Sprint(actual)
+		}
+		if list, ok := actual.([]interface{}); ok {
+			return desired == join(list)
+		}
+	case []interface{}:
+		if s, ok := actual.(string); ok {
+			return join(desired) == s
+		}
+		if list, ok := actual.([]interface{}); ok {
+			return join(desired) == join(list)
+		}
+	}
+	return false
+}
+
+func join(list []interface{}) string {
+	var s []string
+	for _, item := range list {
+		s = append(s, fmt.Sprint(item))
+	}
+	return strings.Join(s, ",")
+}
+
+// lineDiff returns the lines removed from and added to a policy, ignoring whitespace
+func lineDiff(from, to string) []string {
+	lines := func(s string) map[string]bool {
+		m := make(map[string]bool)
+		for _, line := range strings.Split(s, "\n") {
+			if line = strings.TrimSpace(line); line != "" {
+				m[line] = true
+			}
+		}
+		return m
+	}
+	previous, next := lines(from), lines(to)
+	var diff []string
+	for _, line := range sortedKeys(previous) {
+		if !next[line] {
+			diff = append(diff, "- "+line)
+		}
+	}
+	for _, line := range sortedKeys(next) {
+		if !previous[line] {
+			diff = append(diff, "+ "+line)
+		}
+	}
+	return diff
+}
+
+func sortedKeys(m interface{}) []string {
+	var keys []string
+	for _, key := range reflect.ValueOf(m).MapKeys() {
+		keys = append(keys, key.String())
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func contains(list []string, item string) bool {
+	for _, i := range list {
+		if i == item {
+			return true
+		}
+	}
+	return false
+}
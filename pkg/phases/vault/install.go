@@ -33,12 +33,23 @@ func Deploy(p *platform.Platform) error {
 		}
 	}
 
-	if err := p.CreateOrUpdateSecret("kms", Namespace, map[string][]byte{
+	kms := map[string][]byte{
 		"AWS_REGION":               []byte(p.Vault.Region),
 		"AWS_ACCESS_KEY_ID":        []byte(p.Vault.AccessKey),
 		"AWS_SECRET_ACCESS_KEY":    []byte(p.Vault.SecretKey),
 		"VAULT_AWSKMS_SEAL_KEY_ID": []byte(p.Vault.KmsKeyID),
-	}); err != nil {
+	}
+	if p.Vault.Transit != nil {
+		if p.Vault.Transit.KeyName == "" {
+			p.Vault.Transit.KeyName = "autounseal"
+		}
+		if p.Vault.Transit.MountPath == "" {
+			p.Vault.Transit.MountPath = "transit/"
+		}
+		// the transit seal reads its token from the environment so that it is not stored in the configmap
+		kms["VAULT_TOKEN"] = []byte(p.Vault.Transit.Token)
+	}
+	if err := p.CreateOrUpdateSecret("kms", Namespace, kms); err != nil {
 		return err
 	}
 
@@ -0,0 +1,316 @@
+package vault
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/flanksource/karina/pkg/k8s/proxy"
+	"github.com/flanksource/karina/pkg/platform"
+	"github.com/hashicorp/vault/api"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/openpgp/armor"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// UnsealKeysSecret is the secret the key shares are stored in when vault.unsealKeys.sealedSecret is enabled
+const UnsealKeysSecret = "vault-unseal-keys"
+
+// RootTokenFile is the file in vault.unsealKeys.path that the root token is written to by init
+const RootTokenFile = "vault-root-token"
+
+// getPodClient returns a vault client connected directly to a single vault pod,
+// the vault service and ingress only route to pods that are unsealed
+func getPodClient(p *platform.Platform, pod string) (*api.Client, error) {
+	dialer, err := p.GetProxyDialer(proxy.Proxy{
+		Namespace:    Namespace,
+		Kind:         "pods",
+		ResourceName: pod,
+		Port:         8200,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return api.NewClient(&api.Config{
+		Address: "https://" + pod + ":8200",
+		HttpClient: &http.Client{
+			Transport: &http.Transport{
+				DialContext:     dialer.DialContext,
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+			},
+		},
+	})
+}
+
+// isAutoUnseal returns true if vault is unsealed using a KMS or transit seal,
+// in which case init generates recovery keys instead of unseal keys
+func isAutoUnseal(p *platform.Platform) bool {
+	return p.Vault.KmsKeyID != "" || p.Vault.Transit != nil
+}
+
+// initialize initializes vault, stores the unseal (or recovery) keys and returns the root token,
+// vault is unsealed using the new keys unless they are encrypted or vault is auto-unsealed
+func initialize(p *platform.Platform) (string, error) {
+	client, err := getPodClient(p, "vault-0")
+	if err != nil {
+		return "", err
+	}
+	initialized, err := client.Sys().InitStatus()
+	if err != nil {
+		return "", errors.Wrap(err, "failed to get vault init status")
+	}
+	if initialized {
+		return "", fmt.Errorf("vault is already initialized, specify the root token in vault.token")
+	}
+
+	shares := p.Vault.UnsealKeys.Shares
+	if shares == 0 {
+		shares = 5
+	}
+	threshold := p.Vault.UnsealKeys.Threshold
+	if threshold == 0 {
+		threshold = 3
+	}
+	pgpKeys, err := readPGPKeys(p.Vault.UnsealKeys.PGPKeys)
+	if err != nil {
+		return "", err
+	}
+	if len(pgpKeys) > 0 && len(pgpKeys) != shares {
+		return "", fmt.Errorf("%d pgp keys specified for %d key shares", len(pgpKeys), shares)
+	}
+	if len(pgpKeys) > 0 && p.Vault.UnsealKeys.SealedSecret {
+		return "", fmt.Errorf("vault.unsealKeys.pgpKeys and vault.unsealKeys.sealedSecret cannot be combined, encrypted keys stored in the secret cannot be used to unseal vault")
+	}
+	if !p.Vault.UnsealKeys.SealedSecret && !p.Vault.UnsealKeys.Print {
+		return "", fmt.Errorf("specify vault.unsealKeys.sealedSecret or vault.unsealKeys.print, otherwise the generated keys would be lost")
+	}
+
+	req := &api.InitRequest{}
+	if isAutoUnseal(p) {
+		req.RecoveryShares = shares
+		req.RecoveryThreshold = threshold
+		req.RecoveryPGPKeys = pgpKeys
+	} else {
+		req.SecretShares = shares
+		req.SecretThreshold = threshold
+		req.PGPKeys = pgpKeys
+	}
+
+	p.Infof("Vault is not initialized, initializing with %d key shares and a threshold of %d", shares, threshold)
+	resp, err := client.Sys().Init(req)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to initialize vault")
+	}
+
+	keys := resp.KeysB64
+	if isAutoUnseal(p) {
+		keys = resp.RecoveryKeysB64
+	}
+	tokenFile := filepath.Join(outputPath(p), RootTokenFile)
+	if err := ioutil.WriteFile(tokenFile, []byte(resp.RootToken), 0600); err != nil {
+		p.Errorf("Failed to write the root token to %s, generate a new root token using the unseal keys", tokenFile)
+	} else {
+		p.Infof("Initial root token saved to %s, store it securely and remove the file", tokenFile)
+	}
+	if err := storeUnsealKeys(p, keys, len(pgpKeys) > 0); err != nil {
+		return "", err
+	}
+	if isAutoUnseal(p) {
+		return resp.RootToken, nil
+	}
+	if len(pgpKeys) > 0 {
+		return "", fmt.Errorf("vault is sealed, decrypt the unseal keys and run: karina vault unseal <keys>")
+	}
+	return resp.RootToken, Unseal(p, keys...)
+}
+
+// readPGPKeys reads binary or ASCII armored public keys and returns them base64 encoded
+func readPGPKeys(paths []string) ([]string, error) {
+	var keys []string
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read pgp key %s", path)
+		}
+		if block, err := armor.Decode(bytes.NewReader(data)); err == nil {
+			if data, err = ioutil.ReadAll(block.Body); err != nil {
+				return nil, errors.Wrapf(err, "failed to decode pgp key %s", path)
+			}
+		} else if _, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data))); err == nil {
+			// already base64 encoded, e.g. exported using gpg --export | base64
+			keys = append(keys, strings.TrimSpace(string(data)))
+			continue
+		}
+		keys = append(keys, base64.StdEncoding.EncodeToString(data))
+	}
+	return keys, nil
+}
+
+// outputPath returns the absolute path of the directory that init writes files to
+func outputPath(p *platform.Platform) string {
+	path := p.Vault.UnsealKeys.Path
+	if path == "" {
+		path = "."
+	}
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return path
+}
+
+// storeUnsealKeys stores the keys as a sealed secret and prints them if vault.unsealKeys.print is set
+func storeUnsealKeys(p *platform.Platform, keys []string, encrypted bool) error {
+	kind := "Unseal"
+	if isAutoUnseal(p) {
+		kind = "Recovery"
+	}
+	if p.Vault.UnsealKeys.SealedSecret {
+		file, err := sealKeys(p, keys)
+		if err != nil {
+			return errors.Wrap(err, "failed to create sealed secret for unseal keys")
+		}
+		p.Infof("%s keys saved to %s and applied as %s/%s, commit the sealed secret to source control", kind, file, Namespace, UnsealKeysSecret)
+	}
+	if !p.Vault.UnsealKeys.Print {
+		return nil
+	}
+	if !encrypted {
+		p.Warnf("%s keys are not encrypted, specify vault.unsealKeys.pgpKeys or vault.unsealKeys.sealedSecret to protect them", kind)
+	}
+	for i, key := range keys {
+		p.Infof("%s Key %d: %s", kind, i+1, key)
+	}
+	return nil
+}
+
+// sealKeys encrypts the keys as a sealed secret, writes it to vault.unsealKeys.path and applies it
+func sealKeys(p *platform.Platform, keys []string) (string, error) {
+	if p.SealedSecrets == nil || p.SealedSecrets.Disabled {
+		return "", fmt.Errorf("sealed secrets are not enabled")
+	}
+	secret := v1.Secret{
+		TypeMeta: metav1.TypeMeta{
+			APIVersion: "v1",
+			Kind:       "Secret",
+		},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      UnsealKeysSecret,
+			Namespace: Namespace,
+		},
+		Data: map[string][]byte{},
+	}
+	for i, key := range keys {
+		secret.Data[fmt.Sprintf("key-%d", i)] = []byte(key)
+	}
+	data, err := json.Marshal(&secret)
+	if err != nil {
+		return "", err
+	}
+	secretFile, err := ioutil.TempFile("", "vault-unseal-keys.json")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(secretFile.Name()) // nolint: errcheck
+	if err := ioutil.WriteFile(secretFile.Name(), data, 0600); err != nil {
+		return "", err
+	}
+
+	args := "--controller-namespace sealed-secrets"
+	if p.SealedSecrets.Certificate != nil && p.SealedSecrets.Certificate.Cert != "" {
+		args = "--cert " + p.SealedSecrets.Certificate.Cert
+	}
+	sealed := filepath.Join(outputPath(p), UnsealKeysSecret+".sealed.yaml")
+	kubeseal := p.GetBinaryWithKubeConfig("kubeseal")
+	if err := kubeseal("%s --format yaml < %s > %s", args, secretFile.Name(), sealed); err != nil {
+		return "", errors.Wrap(err, "failed to run kubeseal")
+	}
+	spec, err := ioutil.ReadFile(sealed)
+	if err != nil {
+		return "", err
+	}
+	return sealed, p.ApplyText(Namespace, string(spec))
+}
+
+// Unseal submits key shares to every sealed vault pod until it is unsealed,
+// if no keys are specified the keys stored in the vault-unseal-keys secret are used unless they are encrypted
+func Unseal(p *platform.Platform, keys ...string) error {
+	if p.Vault == nil || p.Vault.Disabled {
+		p.Infof("Vault is not configured or disabled. Nothing to be done")
+		return nil
+	}
+	if len(keys) == 0 && len(p.Vault.UnsealKeys.PGPKeys) > 0 {
+		return fmt.Errorf("the unseal keys are encrypted with vault.unsealKeys.pgpKeys, decrypt them and run: karina vault unseal <keys>")
+	}
+	if len(keys) == 0 {
+		secret := p.GetSecret(Namespace, UnsealKeysSecret)
+		if secret == nil {
+			return fmt.Errorf("no unseal keys specified and secret %s/%s not found", Namespace, UnsealKeysSecret)
+		}
+		var names []string
+		for name := range *secret {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			keys = append(keys, string((*secret)[name]))
+		}
+	}
+
+	clientset, err := p.GetClientset()
+	if err != nil {
+		return err
+	}
+	pods, err := clientset.CoreV1().Pods(Namespace).List(metav1.ListOptions{
+		LabelSelector: "app.kubernetes.io/name=vault,component=server",
+	})
+	if err != nil {
+		return err
+	}
+	if len(pods.Items) == 0 {
+		return fmt.Errorf("no vault pods found")
+	}
+
+	for _, pod := range pods.Items {
+		if err := unsealPod(p, pod.Name, keys); err != nil {
+			return errors.Wrapf(err, "failed to unseal %s", pod.Name)
+		}
+	}
+	return nil
+}
+
+func unsealPod(p *platform.Platform, pod string, keys []string) error {
+	client, err := getPodClient(p, pod)
+	if err != nil {
+		return err
+	}
+	status, err := client.Sys().SealStatus()
+	if err != nil {
+		return err
+	}
+	if !status.Initialized {
+		return fmt.Errorf("vault is not initialized, run karina vault init")
+	}
+	if !status.Sealed {
+		p.Infof("%s is already unsealed", pod)
+		return nil
+	}
+	for _, key := range keys {
+		if status, err = client.Sys().Unseal(key); err != nil {
+			return err
+		}
+		if !status.Sealed {
+			p.Infof("%s unsealed", pod)
+			return nil
+		}
+	}
+	return fmt.Errorf("still sealed after %d of %d required keys", status.Progress, status.T)
+}
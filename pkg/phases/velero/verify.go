@@ -0,0 +1,231 @@
+package velero
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/flanksource/commons/console"
+	"github.com/flanksource/commons/utils"
+	"github.com/flanksource/karina/pkg/platform"
+	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+// VerifyResources are the resources restored from a backup when verifying it,
+// workloads are excluded so that a verification never starts any pods
+var VerifyResources = []string{"configmaps", "secrets"}
+
+// GetLatestBackup returns the most recently completed velero backup
+func GetLatestBackup(p *platform.Platform) (*Backup, error) {
+	client, _, _, err := p.GetDynamicClientFor(Namespace, &Backup{})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get dynamic client for backups")
+	}
+	list, err := client.List(metav1.ListOptions{})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list backups")
+	}
+	var latest *Backup
+	for _, item := range list.Items {
+		backup := Backup{}
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(item.Object, &backup); err != nil {
+			return nil, errors.Wrapf(err, "failed to decode backup %s", item.GetName())
+		}
+		if backup.Status.Phase != BackupPhaseCompleted || backup.Status.CompletionTimestamp == nil {
+			continue
+		}
+		if latest == nil || backup.Status.CompletionTimestamp.After(latest.Status.CompletionTimestamp.Time) {
+			latest = &backup
+		}
+	}
+	if latest == nil {
+		return nil, fmt.Errorf("no completed backups found")
+	}
+	return latest, nil
+}
+
+// CreateRestore restores the given namespaces from backup into new namespaces as
+// specified by mapping and waits for the restore to finish
+func CreateRestore(p *platform.Platform, backup string, mapping map[string]string, resources ...string) (*Restore, error) {
+	no := false
+	name := "restore-" + time.Now().Format("20060102-150405")
+	namespaces := []string{}
+	for ns := range mapping {
+		namespaces = append(namespaces, ns)
+	}
+	restore := &Restore{
+		Metadata: metav1.ObjectMeta{
+			Namespace: Namespace,
+			Name:      name,
+		},
+		Spec: RestoreSpec{
+			BackupName:              backup,
+			IncludedNamespaces:      namespaces,
+			IncludedResources:       resources,
+			NamespaceMapping:        mapping,
+			RestorePVs:              &no,
+			IncludeClusterResources: &no,
+		},
+	}
+	restore.APIVersion = "velero.io/v1"
+	restore.Kind = "Restore"
+	if err := p.Apply(Namespace, restore); err != nil {
+		return nil, fmt.Errorf("createRestore: failed to apply velero restore %v", err)
+	}
+	start := time.Now()
+
+	p.Infof("Waiting for %s to complete", name)
+	for {
+		restore = &Restore{}
+		if err := p.Get(Namespace, name, restore); err != nil {
+			return nil, fmt.Errorf("createRestore: failed to get velero restore %v", err)
+		}
+		if restore.Status.Phase == RestorePhaseCompleted {
+			return restore, nil
+		} else if restore.Status.Phase != "" && restore.Status.Phase != RestorePhaseInProgress && restore.Status.Phase != RestorePhaseNew {
+			return restore, fmt.Errorf("restore did not complete successfully %s: %s", restore.Status.Phase, restore.Status.FailureReason)
+		}
+
+		if time.Now().After(start.Add(5 * time.Minute)) {
+			return nil, fmt.Errorf("timeout exceeded")
+		}
+		time.Sleep(5 * time.Second)
+	}
+}
+
+// Verify restores the latest backup of each namespace into a temporary namespace
+// and compares the restored configmaps and secrets against the live namespace, objects that
+// have changed or been removed since the backup fail the verification unless allowDrift is set
+func Verify(p *platform.Platform, test *console.TestResults, allowDrift bool, namespaces ...string) {
+	if p.Velero == nil || p.Velero.Disabled {
+		test.Skipf("velero", "Velero is disabled")
+		return
+	}
+	backup, err := GetLatestBackup(p)
+	if err != nil {
+		test.Failf("velero", "Failed to find latest backup: %v", err)
+		return
+	}
+	test.Passf("velero", "Found backup %s completed at %s", backup.Metadata.Name, backup.Status.CompletionTimestamp)
+
+	mapping := make(map[string]string)
+	for _, ns := range namespaces {
+		mapping[ns] = fmt.Sprintf("%s-verify-%s", ns, utils.RandomString(6))
+	}
+	defer cleanup(p, test, mapping)
+
+	restore, err := CreateRestore(p, backup.Metadata.Name, mapping, VerifyResources...)
+	if err != nil {
+		test.Failf("velero", "Failed to restore %s: %v", backup.Metadata.Name, err)
+		return
+	}
+	defer deleteRestore(p, test, restore)
+	if restore.Status.Warnings > 0 {
+		test.Warnf("Restore %s completed with %d warnings", restore.Metadata.Name, restore.Status.Warnings)
+	}
+	test.Passf("velero", "Restore %s of %s completed", restore.Metadata.Name, backup.Metadata.Name)
+
+	for source, target := range mapping {
+		verifyNamespace(p, test, allowDrift, source, target)
+	}
+}
+
+func verifyNamespace(p *platform.Platform, test *console.TestResults, allowDrift bool, source, target string) {
+	client, err := p.GetClientset()
+	if err != nil {
+		test.Failf("velero", "Failed to get k8s client %v", err)
+		return
+	}
+	restored, err := client.CoreV1().ConfigMaps(target).List(metav1.ListOptions{})
+	if err != nil {
+		test.Failf("velero", "Failed to list restored configmaps in %s: %v", target, err)
+		return
+	}
+	secrets, err := client.CoreV1().Secrets(target).List(metav1.ListOptions{})
+	if err != nil {
+		test.Failf("velero", "Failed to list restored secrets in %s: %v", target, err)
+		return
+	}
+	if len(restored.Items)+len(secrets.Items) == 0 {
+		test.Failf("velero", "No objects from %s were restored into %s", source, target)
+		return
+	}
+
+	var drift []string
+	for _, cm := range restored.Items {
+		live, err := client.CoreV1().ConfigMaps(source).Get(cm.Name, metav1.GetOptions{})
+		if err != nil {
+			drift = append(drift, fmt.Sprintf("configmap %s/%s no longer exists", source, cm.Name))
+		} else if !reflect.DeepEqual(live.Data, cm.Data) {
+			drift = append(drift, fmt.Sprintf("configmap %s/%s has changed since the backup", source, cm.Name))
+		}
+	}
+	for _, secret := range secrets.Items {
+		// service account tokens are regenerated for the target namespace
+		if secret.Type == v1.SecretTypeServiceAccountToken {
+			continue
+		}
+		live, err := client.CoreV1().Secrets(source).Get(secret.Name, metav1.GetOptions{})
+		if err != nil {
+			drift = append(drift, fmt.Sprintf("secret %s/%s no longer exists", source, secret.Name))
+		} else if hashData(live.Data) != hashData(secret.Data) {
+			drift = append(drift, fmt.Sprintf("secret %s/%s has changed since the backup", source, secret.Name))
+		}
+	}
+	if len(drift) > 0 && !allowDrift {
+		test.Failf("velero", "%d objects restored from %s into %s do not match the live namespace: %s",
+			len(drift), source, target, strings.Join(drift, ", "))
+		return
+	}
+	for _, msg := range drift {
+		test.Warnf("%s", msg)
+	}
+	test.Passf("velero", "Restored %d configmaps and %d secrets from %s into %s, %d objects differ from the live namespace",
+		len(restored.Items), len(secrets.Items), source, target, len(drift))
+}
+
+// hashData returns a sha256 digest of the keys and values of a secret, so that a mismatch can be
+// detected without including the values in any test output
+func hashData(data map[string][]byte) string {
+	var keys []string
+	for key := range data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	hash := sha256.New()
+	for _, key := range keys {
+		fmt.Fprintf(hash, "%s=%d:", key, len(data[key]))
+		hash.Write(data[key])
+	}
+	return fmt.Sprintf("%x", hash.Sum(nil))
+}
+
+func deleteRestore(p *platform.Platform, test *console.TestResults, restore *Restore) {
+	client, _, _, err := p.GetDynamicClientFor(Namespace, restore)
+	if err != nil {
+		test.Warnf("Failed to get dynamic client: %v", err)
+		return
+	}
+	if err := client.Delete(restore.Metadata.Name, nil); err != nil {
+		test.Warnf("Failed to delete restore %s: %v", restore.Metadata.Name, err)
+	}
+}
+
+func cleanup(p *platform.Platform, test *console.TestResults, mapping map[string]string) {
+	client, err := p.GetClientset()
+	if err != nil {
+		test.Warnf("Failed to get k8s client %v", err)
+		return
+	}
+	for _, target := range mapping {
+		if err := client.CoreV1().Namespaces().Delete(target, nil); err != nil {
+			test.Warnf("Failed to delete namespace %s: %v", target, err)
+		}
+	}
+}
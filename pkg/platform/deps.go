@@ -0,0 +1,101 @@
+package platform
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"runtime"
+	"strings"
+
+	"github.com/flanksource/commons/deps"
+	"github.com/flanksource/commons/exec"
+	"github.com/flanksource/commons/files"
+	"github.com/flanksource/commons/is"
+	"github.com/flanksource/commons/net"
+	"github.com/flanksource/commons/utils"
+	"github.com/pkg/errors"
+)
+
+// Dependency is a binary that is not provided by commons/deps, URL is templated with {{.version}},
+// {{.os}} and {{.arch}}, binaries are extracted by name from archives
+type Dependency struct {
+	Version string
+	URL     string
+}
+
+// Dependencies are the binaries that can be run with GetBinary or installed with GetBinaryPath
+// in addition to the ones provided by commons/deps
+var Dependencies = map[string]Dependency{
+	"helm": {
+		Version: "2.13.0",
+		URL:     "https://get.helm.sh/helm-v{{.version}}-{{.os}}-{{.arch}}.tar.gz",
+	},
+	"opa": {
+		Version: "0.17.3",
+		URL:     "https://github.com/open-policy-agent/opa/releases/download/v{{.version}}/opa_{{.os}}_{{.arch}}",
+	},
+	"promtool": {
+		Version: "2.16.0",
+		URL:     "https://github.com/prometheus/prometheus/releases/download/v{{.version}}/prometheus-{{.version}}.{{.os}}-{{.arch}}.tar.gz",
+	},
+}
+
+// GetBinaryPath returns the path to a binary in Dependencies for the current os and architecture,
+// downloading it if necessary. The version used is the first of version, versions.<name> and the
+// default version of the dependency that is set.
+func (platform *Platform) GetBinaryPath(name, version string) (string, error) {
+	dependency, ok := Dependencies[name]
+	if !ok {
+		return "", fmt.Errorf("unknown dependency %s", name)
+	}
+	if version == "" {
+		version = platform.Versions[name]
+	}
+	if version == "" {
+		version = dependency.Version
+	}
+	version = strings.TrimPrefix(version, "v")
+	bin := fmt.Sprintf(".bin/%s-%s", name, version)
+	if is.File(bin) {
+		return bin, nil
+	}
+	if err := os.MkdirAll(".bin", 0755); err != nil {
+		return "", err
+	}
+	url := utils.Interpolate(dependency.URL, map[string]string{"version": version, "os": runtime.GOOS, "arch": runtime.GOARCH})
+	platform.Infof("Installing %s (%s) -> %s", name, version, url)
+	if !is.Archive(url) {
+		if err := net.Download(url, bin); err != nil {
+			return "", errors.Wrapf(err, "failed to download %s", name)
+		}
+		return bin, os.Chmod(bin, 0755)
+	}
+
+	tmp, err := ioutil.TempDir(".bin", name)
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(tmp) // nolint: errcheck
+	archive := path.Join(tmp, path.Base(url))
+	if err := net.Download(url, archive); err != nil {
+		return "", errors.Wrapf(err, "failed to download %s", name)
+	}
+	if err := files.UnarchiveExecutables(archive, tmp); err != nil {
+		return "", errors.Wrapf(err, "failed to extract %s", archive)
+	}
+	if !is.File(path.Join(tmp, name)) {
+		return "", fmt.Errorf("%s not found in %s", name, url)
+	}
+	return bin, os.Rename(path.Join(tmp, name), bin)
+}
+
+func (platform *Platform) getDependency(name string) deps.BinaryFunc {
+	return func(msg string, args ...interface{}) error {
+		bin, err := platform.GetBinaryPath(name, "")
+		if err != nil {
+			return err
+		}
+		return exec.Execf(bin+" "+msg, args...)
+	}
+}
@@ -0,0 +1,247 @@
+package platform
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/flanksource/karina/manifests"
+	"github.com/flanksource/karina/templates"
+)
+
+// OverlayChecksums is the file in the root of an overlay directory that records the checksums
+// of the embedded files the overlay was exported from, in sha256sum format
+const OverlayChecksums = "SHA256SUMS"
+
+var diverged sync.Map
+
+func getFS(pkg string) http.FileSystem {
+	if pkg == "manifests" {
+		return manifests.FS(false)
+	}
+	return templates.FS(false)
+}
+
+func overlayPkg(pkg string) string {
+	if pkg == "manifests" {
+		return pkg
+	}
+	return "templates"
+}
+
+// getOverlay returns the contents of file from the manifestOverlays directory, if it exists
+func (platform *Platform) getOverlay(file, pkg string) (string, bool, error) {
+	if platform.ManifestOverlays == "" {
+		return "", false, nil
+	}
+	name := overlayPkg(pkg) + file
+	data, err := ioutil.ReadFile(filepath.Join(platform.ManifestOverlays, name))
+	if os.IsNotExist(err) {
+		return "", false, nil
+	} else if err != nil {
+		return "", false, err
+	}
+	platform.Tracef("Using overlay for %s", name)
+	platform.checkDivergence(name, file, pkg)
+	return string(data), true, nil
+}
+
+// checkDivergence warns once if the embedded version of an overlaid file has changed
+// since the overlay was exported
+func (platform *Platform) checkDivergence(name, file, pkg string) {
+	if _, warned := diverged.Load(name); warned {
+		return
+	}
+	diverged.Store(name, true)
+	checksums, err := readChecksums(platform.ManifestOverlays)
+	if err != nil {
+		platform.Debugf("Unable to read overlay checksums: %v", err)
+		return
+	}
+	base, ok := checksums[name]
+	if !ok {
+		return
+	}
+	var embedded string
+	if pkg == "manifests" {
+		embedded, err = manifests.FSString(false, file)
+	} else {
+		embedded, err = templates.FSString(false, file)
+	}
+	if err != nil {
+		// the overlay adds a file instead of replacing one
+		return
+	}
+	if checksum([]byte(embedded)) != base {
+		platform.Warnf("%s has changed since the overlay was exported, export the new version using 'karina manifests export' and merge the changes, then run 'karina manifests export --update-checksums %s'", name, platform.ManifestOverlays)
+	}
+}
+
+// getOverlayDir returns the files in path from the manifestOverlays directory
+func (platform *Platform) getOverlayDir(path, pkg string) (map[string]http.File, error) {
+	out := make(map[string]http.File)
+	if platform.ManifestOverlays == "" {
+		return out, nil
+	}
+	dir := filepath.Join(platform.ManifestOverlays, overlayPkg(pkg), path)
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return out, nil
+	} else if err != nil {
+		return nil, err
+	}
+	for _, info := range files {
+		if info.IsDir() {
+			continue
+		}
+		file, err := os.Open(filepath.Join(dir, info.Name()))
+		if err != nil {
+			return nil, err
+		}
+		platform.checkDivergence(overlayPkg(pkg)+filepath.ToSlash(filepath.Join(path, info.Name())), path+"/"+info.Name(), pkg)
+		out[info.Name()] = file
+	}
+	return out, nil
+}
+
+// ExportManifests writes the embedded manifests and templates to dir along with their checksums,
+// as a starting point for a manifestOverlays directory
+func ExportManifests(dir string) error {
+	checksums := make(map[string]string)
+	for _, pkg := range []string{"manifests", "templates"} {
+		fs := getFS(pkg)
+		err := walkFS(fs, "/", func(path string) error {
+			f, err := fs.Open(path)
+			if err != nil {
+				return err
+			}
+			defer f.Close() // nolint: errcheck
+			data, err := ioutil.ReadAll(f)
+			if err != nil {
+				return err
+			}
+			name := pkg + path
+			out := filepath.Join(dir, filepath.FromSlash(name))
+			if err := os.MkdirAll(filepath.Dir(out), 0755); err != nil {
+				return err
+			}
+			checksums[name] = checksum(data)
+			return ioutil.WriteFile(out, data, 0644)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return writeChecksums(dir, checksums)
+}
+
+// UpdateOverlayChecksums records the checksums of the current embedded versions of the files in
+// an overlay directory, after the upstream changes have been merged into the overlay
+func UpdateOverlayChecksums(dir string) error {
+	checksums, err := readChecksums(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if checksums == nil {
+		checksums = make(map[string]string)
+	}
+	for _, pkg := range []string{"manifests", "templates"} {
+		fs := getFS(pkg)
+		root := filepath.Join(dir, pkg)
+		err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			if err != nil || info.IsDir() {
+				return err
+			}
+			rel, _ := filepath.Rel(root, path)
+			f, err := fs.Open("/" + filepath.ToSlash(rel))
+			if err != nil {
+				// not an embedded file
+				return nil
+			}
+			defer f.Close() // nolint: errcheck
+			data, err := ioutil.ReadAll(f)
+			if err != nil {
+				return err
+			}
+			checksums[pkg+"/"+filepath.ToSlash(rel)] = checksum(data)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return writeChecksums(dir, checksums)
+}
+
+func walkFS(fs http.FileSystem, path string, fn func(path string) error) error {
+	dir, err := fs.Open(path)
+	if err != nil {
+		return err
+	}
+	files, err := dir.Readdir(-1)
+	dir.Close() // nolint: errcheck
+	if err != nil {
+		return err
+	}
+	for _, info := range files {
+		child := strings.TrimSuffix(path, "/") + "/" + info.Name()
+		if info.IsDir() {
+			err = walkFS(fs, child, fn)
+		} else {
+			err = fn(child)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func readChecksums(dir string) (map[string]string, error) {
+	f, err := os.Open(filepath.Join(dir, OverlayChecksums))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close() // nolint: errcheck
+	checksums := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 {
+			checksums[fields[1]] = fields[0]
+		}
+	}
+	return checksums, scanner.Err()
+}
+
+func writeChecksums(dir string, checksums map[string]string) error {
+	var names []string
+	for name := range checksums {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var lines []string
+	for _, name := range names {
+		lines = append(lines, fmt.Sprintf("%s  %s", checksums[name], name))
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, OverlayChecksums), []byte(strings.Join(lines, "\n")+"\n"), 0644)
+}
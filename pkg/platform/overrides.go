@@ -0,0 +1,97 @@
+package platform
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/flanksource/karina/pkg/types"
+	"gopkg.in/flanksource/yaml.v3"
+)
+
+// getKustomizePatches returns the configured patches followed by the patches generated from componentOverrides
+func (platform *Platform) getKustomizePatches() ([]string, error) {
+	patches := append([]string{}, platform.Patches...)
+	for _, override := range platform.ComponentOverrides {
+		patch, err := newOverridePatch(override)
+		if err != nil {
+			return nil, err
+		}
+		platform.Tracef("Generated patch from componentOverrides:\n%s", patch)
+		patches = append(patches, patch)
+	}
+	return patches, nil
+}
+
+// newOverridePatch returns a strategic merge patch for the workload, containers are merged by name
+// while tolerations replace any tolerations in the original spec
+func newOverridePatch(override types.ComponentOverride) (string, error) {
+	if override.Kind == "" {
+		override.Kind = "Deployment"
+	}
+	switch override.Kind {
+	case "Deployment", "StatefulSet", "DaemonSet":
+	default:
+		return "", fmt.Errorf("componentOverrides: unsupported kind %s for %s, use patches instead", override.Kind, override.Name)
+	}
+	if override.Name == "" || override.Namespace == "" {
+		return "", fmt.Errorf("componentOverrides: name and namespace are required")
+	}
+
+	podSpec := make(map[string]interface{})
+	if len(override.NodeSelector) > 0 {
+		podSpec["nodeSelector"] = override.NodeSelector
+	}
+	if len(override.Tolerations) > 0 {
+		podSpec["tolerations"] = override.Tolerations
+	}
+	if override.PriorityClassName != "" {
+		podSpec["priorityClassName"] = override.PriorityClassName
+	}
+	if len(override.Affinity) > 0 {
+		podSpec["affinity"] = override.Affinity
+	}
+	if len(override.Resources) > 0 {
+		var names []string
+		for name := range override.Resources {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		var containers []map[string]interface{}
+		for _, name := range names {
+			containers = append(containers, map[string]interface{}{
+				"name":      name,
+				"resources": override.Resources[name],
+			})
+		}
+		podSpec["containers"] = containers
+	}
+
+	spec := make(map[string]interface{})
+	if override.Replicas != nil {
+		if override.Kind == "DaemonSet" {
+			return "", fmt.Errorf("componentOverrides: replicas cannot be set on DaemonSet %s", override.Name)
+		}
+		spec["replicas"] = *override.Replicas
+	}
+	if len(podSpec) > 0 {
+		spec["template"] = map[string]interface{}{"spec": podSpec}
+	}
+	if len(spec) == 0 {
+		return "", fmt.Errorf("componentOverrides: %s/%s does not override anything", override.Namespace, override.Name)
+	}
+
+	patch := map[string]interface{}{
+		"apiVersion": "apps/v1",
+		"kind":       override.Kind,
+		"metadata": map[string]interface{}{
+			"name":      override.Name,
+			"namespace": override.Namespace,
+		},
+		"spec": spec,
+	}
+	data, err := yaml.Marshal(patch)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
@@ -61,9 +61,7 @@ func (platform *Platform) Init() error {
 	if platform.Client.GetKubeConfigBytes == nil {
 		platform.Client.GetKubeConfigBytes = platform.GetKubeConfigBytes
 	}
-	platform.Client.GetKustomizePatches = func() ([]string, error) {
-		return platform.Patches, nil
-	}
+	platform.Client.GetKustomizePatches = platform.getKustomizePatches
 	platform.Client.ApplyDryRun = platform.DryRun
 	platform.Client.Trace = platform.PlatformConfig.Trace
 	platform.Logger = logrus.StandardLogger().WithContext(context.Background())
@@ -478,6 +476,11 @@ func (platform *Platform) GetResourceByName(file string, pkg string) (string, er
 	if !strings.HasPrefix(file, "/") {
 		file = "/" + file
 	}
+	if overlay, found, err := platform.getOverlay(file, pkg); err != nil {
+		return "", err
+	} else if found {
+		return overlay, nil
+	}
 	if pkg == "manifests" {
 		raw, err = manifests.FSString(false, file)
 	} else {
@@ -508,14 +511,16 @@ func (platform *Platform) Template(file string, pkg string) (string, error) {
 
 func (platform *Platform) GetResourcesByDir(path string, pkg string) (map[string]http.File, error) {
 	out := make(map[string]http.File)
-	var fs http.FileSystem
-	if pkg == "manifests" {
-		fs = manifests.FS(false)
-	} else {
-		fs = templates.FS(false)
+	overlays, err := platform.getOverlayDir(path, pkg)
+	if err != nil {
+		return nil, fmt.Errorf("getResourcesByDir: failed to read overlays: %v", err)
 	}
+	fs := getFS(pkg)
 	dir, err := fs.Open(path)
 	if err != nil {
+		if len(overlays) > 0 {
+			return overlays, nil
+		}
 		return nil, fmt.Errorf("getResourcesByDir: failed to open fs: %v", err)
 	}
 	files, err := dir.Readdir(-1)
@@ -530,6 +535,10 @@ func (platform *Platform) GetResourcesByDir(path string, pkg string) (map[string
 		}
 		out[info.Name()] = file
 	}
+	// files in the overlay directory replace or are added to the embedded files
+	for name, file := range overlays {
+		out[name] = file
+	}
 	return out, nil
 }
 
@@ -649,6 +658,9 @@ func (platform *Platform) GetBinary(name string) deps.BinaryFunc {
 			return nil
 		}
 	}
+	if _, ok := Dependencies[name]; ok {
+		return platform.getDependency(name)
+	}
 	os.Mkdir(".bin", 0755) //nolint: errcheck
 	return deps.Binary(name, platform.Versions[name], ".bin")
 }
@@ -0,0 +1,424 @@
+package provision
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/flanksource/karina/pkg/api/cluster"
+	"github.com/flanksource/karina/pkg/k8s"
+	"github.com/flanksource/karina/pkg/platform"
+	"github.com/flanksource/karina/pkg/types"
+	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	"sigs.k8s.io/controller-runtime/pkg/manager/signals"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+type ControllerOptions struct {
+	// The namespace that machines and machine deployments are reconciled in
+	Namespace string
+	// The number of machines that are provisioned or terminated concurrently
+	Concurrency int
+	// How often machines and machine deployments are resynced with vSphere and the cluster
+	SyncPeriod time.Duration
+}
+
+// Controller reconciles Machine and MachineDeployment resources by provisioning and terminating workers in
+// vSphere, until it is stopped by a signal
+func Controller(platform *platform.Platform, opts ControllerOptions) error {
+	if err := WithVmwareCluster(platform); err != nil {
+		return err
+	}
+	if err := platform.ApplySpecs("", "cluster-api-crd.yaml"); err != nil {
+		return errors.Wrap(err, "failed to apply machine CRDs")
+	}
+	config, err := platform.GetRESTConfig()
+	if err != nil {
+		return err
+	}
+	scheme := runtime.NewScheme()
+	if err := cluster.AddToScheme(scheme); err != nil {
+		return err
+	}
+	mgr, err := manager.New(config, manager.Options{
+		Scheme:             scheme,
+		Namespace:          opts.Namespace,
+		SyncPeriod:         &opts.SyncPeriod,
+		MetricsBindAddress: "0",
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to create controller manager")
+	}
+
+	machines := &machineReconciler{
+		Client:   mgr.GetClient(),
+		platform: platform,
+		create: func(pool, template, name string) (types.Machine, error) {
+			return createWorkerFromTemplate(platform, pool, template, name)
+		},
+		terminate: func(name string) error {
+			vm, err := platform.Cluster.GetMachine(name)
+			if err != nil {
+				return err
+			}
+			if vm == nil {
+				platform.Warnf("VM %s not found, assuming it has already been terminated", name)
+				return nil
+			}
+			return terminate(platform, vm, k8s.DrainOptions{Timeout: 5 * time.Minute, MigrateLocalVolumes: true})
+		},
+		node: func(name string) (*v1.Node, error) {
+			clientset, err := platform.GetClientset()
+			if err != nil {
+				return nil, err
+			}
+			node, err := clientset.CoreV1().Nodes().Get(name, metav1.GetOptions{})
+			if kerrors.IsNotFound(err) {
+				return nil, nil
+			}
+			return node, err
+		},
+		exists: func(name string) (bool, error) {
+			vm, err := platform.Cluster.GetMachine(name)
+			return vm != nil, err
+		},
+	}
+	if err := builder.ControllerManagedBy(mgr).
+		For(&cluster.Machine{}).
+		WithOptions(controller.Options{MaxConcurrentReconciles: opts.Concurrency}).
+		Complete(machines); err != nil {
+		return err
+	}
+
+	deployments := &deploymentReconciler{
+		Client:   mgr.GetClient(),
+		scheme:   scheme,
+		platform: platform,
+		vms: func(pool types.VM) (map[string]string, error) {
+			list, err := platform.Cluster.GetMachinesFor(&pool)
+			if err != nil {
+				return nil, err
+			}
+			// pools with prefixes such as w and wb match each other's VMs
+			prefix := fmt.Sprintf("%s-%s-%s-", platform.HostPrefix, platform.Name, pool.Prefix)
+			vms := make(map[string]string)
+			for name, vm := range list {
+				if strings.HasPrefix(name, prefix) {
+					vms[name] = vm.GetTemplate()
+				}
+			}
+			return vms, nil
+		},
+	}
+	if err := builder.ControllerManagedBy(mgr).
+		For(&cluster.MachineDeployment{}).
+		Owns(&cluster.Machine{}).
+		Complete(deployments); err != nil {
+		return err
+	}
+
+	platform.Infof("Reconciling machines and machine deployments in %s", opts.Namespace)
+	return mgr.Start(signals.SetupSignalHandler())
+}
+
+type machineReconciler struct {
+	client.Client
+	platform  *platform.Platform
+	create    func(pool, template, name string) (types.Machine, error)
+	terminate func(name string) error
+	// node returns the node of a VM, or nil if the VM has not joined the cluster
+	node func(name string) (*v1.Node, error)
+	// exists returns true if a VM exists
+	exists func(name string) (bool, error)
+}
+
+func (r *machineReconciler) Reconcile(req reconcile.Request) (reconcile.Result, error) {
+	ctx := context.Background()
+	machine := &cluster.Machine{}
+	if err := r.Get(ctx, req.NamespacedName, machine); err != nil {
+		return reconcile.Result{}, client.IgnoreNotFound(err)
+	}
+
+	if machine.DeletionTimestamp != nil {
+		if !hasFinalizer(machine) {
+			return reconcile.Result{}, nil
+		}
+		if err := r.setPhase(machine, cluster.MachineDeleting, ""); err != nil {
+			return reconcile.Result{}, err
+		}
+		if machine.Spec.ProviderID != "" {
+			r.platform.Infof("Terminating %s for machine %s", machine.Spec.ProviderID, machine.Name)
+			if err := r.terminate(machine.Spec.ProviderID); err != nil {
+				return reconcile.Result{}, errors.Wrapf(err, "failed to terminate %s", machine.Spec.ProviderID)
+			}
+		}
+		controllerutil.RemoveFinalizer(machine, cluster.MachineFinalizer)
+		return reconcile.Result{}, r.Update(ctx, machine)
+	}
+
+	if !hasFinalizer(machine) {
+		controllerutil.AddFinalizer(machine, cluster.MachineFinalizer)
+		if err := r.Update(ctx, machine); err != nil {
+			return reconcile.Result{}, err
+		}
+	}
+
+	if _, ok := r.platform.Nodes[machine.Spec.Pool]; !ok {
+		return reconcile.Result{}, r.setPhase(machine, cluster.MachineFailed, fmt.Sprintf("pool %s not found", machine.Spec.Pool))
+	}
+
+	if machine.Spec.ProviderID == "" {
+		// provisioning is not retried, failed machines are replaced by their machine deployment
+		if machine.Status.Phase == cluster.MachineFailed {
+			return reconcile.Result{}, nil
+		}
+		// the VM is named after the machine and recorded before it is created, so that it is terminated
+		// with the machine even if the machine cannot be updated afterwards
+		machine.Spec.ProviderID = fmt.Sprintf("%s-%s-%s-%s", r.platform.HostPrefix, r.platform.Name, r.platform.Nodes[machine.Spec.Pool].Prefix, machine.Name)
+		if err := r.Update(ctx, machine); err != nil {
+			return reconcile.Result{}, errors.Wrapf(err, "failed to record VM %s", machine.Spec.ProviderID)
+		}
+		if err := r.setPhase(machine, cluster.MachineProvisioning, ""); err != nil {
+			return reconcile.Result{}, err
+		}
+		r.platform.Infof("Provisioning %s in %s for machine %s", machine.Spec.ProviderID, machine.Spec.Pool, machine.Name)
+		vm, err := r.create(machine.Spec.Pool, machine.Spec.Template, machine.Spec.ProviderID)
+		if err != nil {
+			return reconcile.Result{}, r.setPhase(machine, cluster.MachineFailed, err.Error())
+		}
+		machine.Status.IP = vm.IP()
+		if err := r.setPhase(machine, cluster.MachineProvisioned, ""); err != nil {
+			return reconcile.Result{}, err
+		}
+	}
+
+	node, err := r.node(machine.Spec.ProviderID)
+	if err != nil {
+		return reconcile.Result{}, err
+	}
+	if node == nil {
+		exists, err := r.exists(machine.Spec.ProviderID)
+		if err != nil {
+			return reconcile.Result{}, err
+		}
+		if !exists {
+			return reconcile.Result{}, r.setPhase(machine, cluster.MachineFailed, fmt.Sprintf("VM %s not found", machine.Spec.ProviderID))
+		}
+		// wait for the VM to join the cluster
+		return reconcile.Result{RequeueAfter: 30 * time.Second}, r.setPhase(machine, cluster.MachineProvisioned, "")
+	}
+	machine.Status.NodeName = node.Name
+	if !nodeReady(*node) {
+		return reconcile.Result{RequeueAfter: 30 * time.Second}, r.setPhase(machine, cluster.MachineProvisioned, "")
+	}
+	return reconcile.Result{}, r.setPhase(machine, cluster.MachineRunning, "")
+}
+
+// setPhase updates the status of a machine
+func (r *machineReconciler) setPhase(machine *cluster.Machine, phase, failure string) error {
+	if phase == cluster.MachineFailed {
+		r.platform.Errorf("Machine %s failed: %s", machine.Name, failure)
+	}
+	machine.Status.Phase = phase
+	machine.Status.FailureMessage = failure
+	return r.Status().Update(context.Background(), machine)
+}
+
+type deploymentReconciler struct {
+	client.Client
+	scheme   *runtime.Scheme
+	platform *platform.Platform
+	// vms returns the names and templates of the existing VMs of a pool
+	vms func(pool types.VM) (map[string]string, error)
+}
+
+func (r *deploymentReconciler) Reconcile(req reconcile.Request) (reconcile.Result, error) {
+	ctx := context.Background()
+	deployment := &cluster.MachineDeployment{}
+	if err := r.Get(ctx, req.NamespacedName, deployment); err != nil {
+		return reconcile.Result{}, client.IgnoreNotFound(err)
+	}
+	if deployment.DeletionTimestamp != nil {
+		return reconcile.Result{}, nil
+	}
+	pool, ok := r.platform.Nodes[deployment.Spec.Pool]
+	if !ok {
+		r.platform.Errorf("Machine deployment %s: pool %s not found", deployment.Name, deployment.Spec.Pool)
+		return reconcile.Result{}, nil
+	}
+	replicas := pool.Count
+	if deployment.Spec.Replicas != nil {
+		replicas = int(*deployment.Spec.Replicas)
+	}
+	template := deployment.Spec.Template
+	if template == "" {
+		template = pool.Template
+	}
+
+	list := &cluster.MachineList{}
+	if err := r.List(ctx, list, client.InNamespace(deployment.Namespace)); err != nil {
+		return reconcile.Result{}, err
+	}
+	var machines []cluster.Machine
+	known := make(map[string]bool)
+	for _, machine := range list.Items {
+		known[machine.Spec.ProviderID] = true
+		if machine.Labels[cluster.DeploymentLabel] == deployment.Name {
+			machines = append(machines, machine)
+		}
+	}
+
+	// VMs are recorded on their machine before they are created, so any other VM of the pool is unmanaged
+	if deployment.Spec.Adopt {
+		vms, err := r.vms(pool)
+		if err != nil {
+			return reconcile.Result{}, errors.Wrapf(err, "failed to list VMs of pool %s", deployment.Spec.Pool)
+		}
+		var names []string
+		for name := range vms {
+			if !known[name] {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			machine, err := r.newMachine(deployment, vms[name])
+			if err != nil {
+				return reconcile.Result{}, err
+			}
+			machine.Spec.ProviderID = name
+			r.platform.Infof("Machine deployment %s: adopting %s", deployment.Name, name)
+			if err := r.Create(ctx, machine); err != nil {
+				return reconcile.Result{}, err
+			}
+			machines = append(machines, *machine)
+		}
+	}
+
+	create, remove := plan(replicas, template, machines)
+	for i := 0; i < create; i++ {
+		machine, err := r.newMachine(deployment, template)
+		if err != nil {
+			return reconcile.Result{}, err
+		}
+		if err := r.Create(ctx, machine); err != nil {
+			return reconcile.Result{}, err
+		}
+		r.platform.Infof("Machine deployment %s: created machine %s", deployment.Name, machine.Name)
+	}
+	for i := range remove {
+		r.platform.Infof("Machine deployment %s: deleting machine %s", deployment.Name, remove[i].Name)
+		if err := r.Delete(ctx, &remove[i]); client.IgnoreNotFound(err) != nil {
+			return reconcile.Result{}, err
+		}
+	}
+
+	deployment.Status = cluster.MachineDeploymentStatus{}
+	for _, machine := range machines {
+		if machine.DeletionTimestamp != nil {
+			continue
+		}
+		deployment.Status.Replicas++
+		if machine.Status.Phase == cluster.MachineRunning {
+			deployment.Status.ReadyReplicas++
+		}
+		if !outdated(machine, template) {
+			deployment.Status.UpdatedReplicas++
+		}
+	}
+	return reconcile.Result{}, r.Status().Update(ctx, deployment)
+}
+
+func (r *deploymentReconciler) newMachine(deployment *cluster.MachineDeployment, template string) (*cluster.Machine, error) {
+	machine := &cluster.Machine{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: deployment.Name + "-",
+			Namespace:    deployment.Namespace,
+			Labels:       map[string]string{cluster.DeploymentLabel: deployment.Name},
+		},
+		Spec: cluster.MachineSpec{Pool: deployment.Spec.Pool, Template: template},
+	}
+	if err := controllerutil.SetControllerReference(deployment, machine, r.scheme); err != nil {
+		return nil, err
+	}
+	return machine, nil
+}
+
+// plan returns the number of machines to create and the machines to delete to converge on replicas
+// machines using template. Failed machines are replaced, and machines using a different template are
+// replaced one at a time by first adding a machine, and then deleting an outdated machine once all
+// machines are running.
+func plan(replicas int, template string, machines []cluster.Machine) (int, []cluster.Machine) {
+	var remove, healthy []cluster.Machine
+	busy := false
+	for _, machine := range machines {
+		if machine.DeletionTimestamp != nil {
+			continue
+		}
+		if machine.Status.Phase == cluster.MachineFailed {
+			remove = append(remove, machine)
+			continue
+		}
+		if machine.Status.Phase != cluster.MachineRunning {
+			busy = true
+		}
+		healthy = append(healthy, machine)
+	}
+
+	switch {
+	case len(healthy) < replicas:
+		return replicas - len(healthy), remove
+	case busy:
+		// wait for new machines to join before deleting any machines
+		return 0, remove
+	case len(healthy) > replicas:
+		// delete outdated machines first, and then the oldest machines
+		sort.SliceStable(healthy, func(i, j int) bool {
+			if outdated(healthy[i], template) != outdated(healthy[j], template) {
+				return outdated(healthy[i], template)
+			}
+			return healthy[i].CreationTimestamp.Before(&healthy[j].CreationTimestamp)
+		})
+		return 0, append(remove, healthy[:len(healthy)-replicas]...)
+	}
+	for _, machine := range healthy {
+		if outdated(machine, template) {
+			return 1, remove
+		}
+	}
+	return 0, remove
+}
+
+// outdated returns true if a machine uses a different template, machines with an unknown template are never outdated
+func outdated(machine cluster.Machine, template string) bool {
+	return machine.Spec.Template != "" && template != "" && machine.Spec.Template != template
+}
+
+func hasFinalizer(machine *cluster.Machine) bool {
+	for _, finalizer := range machine.Finalizers {
+		if finalizer == cluster.MachineFinalizer {
+			return true
+		}
+	}
+	return false
+}
+
+func nodeReady(node v1.Node) bool {
+	for _, condition := range node.Status.Conditions {
+		if condition.Type == v1.NodeReady {
+			return condition.Status == v1.ConditionTrue
+		}
+	}
+	return false
+}
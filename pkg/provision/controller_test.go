@@ -0,0 +1,216 @@
+package provision
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/flanksource/commons/logger"
+	"github.com/flanksource/karina/pkg/api/cluster"
+	"github.com/flanksource/karina/pkg/platform"
+	"github.com/flanksource/karina/pkg/types"
+	. "github.com/onsi/gomega"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+func machine(name, template, phase string, age time.Duration) cluster.Machine {
+	return cluster.Machine{
+		ObjectMeta: metav1.ObjectMeta{Name: name, CreationTimestamp: metav1.NewTime(time.Now().Add(-age))},
+		Spec:       cluster.MachineSpec{Pool: "workers", Template: template},
+		Status:     cluster.MachineStatus{Phase: phase},
+	}
+}
+
+func names(machines []cluster.Machine) []string {
+	var list []string
+	for _, m := range machines {
+		list = append(list, m.Name)
+	}
+	return list
+}
+
+func TestPlan(t *testing.T) {
+	g := NewWithT(t)
+	running := []cluster.Machine{
+		machine("a", "k8s-1.17", cluster.MachineRunning, 3*time.Hour),
+		machine("b", "k8s-1.17", cluster.MachineRunning, 2*time.Hour),
+		machine("c", "", cluster.MachineRunning, time.Hour),
+	}
+
+	create, remove := plan(3, "k8s-1.17", running)
+	g.Expect(create).To(Equal(0))
+	g.Expect(remove).To(BeEmpty())
+
+	// scale up, replacing failed machines
+	create, remove = plan(4, "k8s-1.17", append(running, machine("d", "k8s-1.17", cluster.MachineFailed, 0)))
+	g.Expect(create).To(Equal(1))
+	g.Expect(names(remove)).To(Equal([]string{"d"}))
+
+	// scale down oldest first, but not while machines are being provisioned
+	create, remove = plan(2, "k8s-1.17", running)
+	g.Expect(create).To(Equal(0))
+	g.Expect(names(remove)).To(Equal([]string{"a"}))
+	_, remove = plan(2, "k8s-1.17", append(running, machine("d", "k8s-1.17", cluster.MachineProvisioning, 0)))
+	g.Expect(remove).To(BeEmpty())
+
+	// upgrade by adding a machine and then deleting an outdated machine, machines with an unknown template are kept
+	create, remove = plan(3, "k8s-1.18", running)
+	g.Expect(create).To(Equal(1))
+	g.Expect(remove).To(BeEmpty())
+	surged := append(running, machine("d", "k8s-1.18", cluster.MachineProvisioned, 0))
+	create, remove = plan(3, "k8s-1.18", surged)
+	g.Expect(create).To(Equal(0))
+	g.Expect(remove).To(BeEmpty())
+	surged[3].Status.Phase = cluster.MachineRunning
+	_, remove = plan(3, "k8s-1.18", surged)
+	g.Expect(names(remove)).To(Equal([]string{"a"}))
+
+	// machines being deleted are not counted
+	deleted := machine("a", "k8s-1.17", cluster.MachineDeleting, 3*time.Hour)
+	now := metav1.Now()
+	deleted.DeletionTimestamp = &now
+	create, _ = plan(3, "k8s-1.17", []cluster.Machine{deleted, running[1], running[2]})
+	g.Expect(create).To(Equal(1))
+}
+
+func testPlatform() *platform.Platform {
+	return &platform.Platform{
+		Logger: logger.StandardLogger(),
+		PlatformConfig: types.PlatformConfig{
+			Name:       "test",
+			HostPrefix: "k8s",
+			Nodes:      map[string]types.VM{"workers": {Prefix: "w", Count: 2, Template: "k8s-1.17"}},
+		},
+	}
+}
+
+func fakeClient(g *WithT, objects ...runtime.Object) (client.Client, *runtime.Scheme) {
+	scheme := runtime.NewScheme()
+	g.Expect(cluster.AddToScheme(scheme)).To(Succeed())
+	return fake.NewFakeClientWithScheme(scheme, objects...), scheme
+}
+
+func TestDeploymentReconciler(t *testing.T) {
+	g := NewWithT(t)
+	deployment := &cluster.MachineDeployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "workers", Namespace: "platform-system"},
+		Spec:       cluster.MachineDeploymentSpec{Pool: "workers"},
+	}
+	running := machine("workers-a", "k8s-1.17", cluster.MachineRunning, time.Hour)
+	running.Namespace = "platform-system"
+	running.Labels = map[string]string{cluster.DeploymentLabel: "workers"}
+	running.Spec.ProviderID = "k8s-test-w-workers-a"
+	vms := func(pool types.VM) (map[string]string, error) {
+		return map[string]string{"k8s-test-w-workers-a": "k8s-1.17", "k8s-test-w-123": "k8s-1.17"}, nil
+	}
+	request := reconcile.Request{NamespacedName: k8stypes.NamespacedName{Namespace: "platform-system", Name: "workers"}}
+
+	// unmanaged VMs are ignored and a machine is created to reach the count of the pool
+	c, scheme := fakeClient(g, deployment.DeepCopy(), running.DeepCopy())
+	r := &deploymentReconciler{Client: c, scheme: scheme, platform: testPlatform(), vms: vms}
+	_, err := r.Reconcile(request)
+	g.Expect(err).ToNot(HaveOccurred())
+	list := &cluster.MachineList{}
+	g.Expect(c.List(context.Background(), list)).To(Succeed())
+	g.Expect(list.Items).To(HaveLen(2))
+	for _, m := range list.Items {
+		g.Expect(m.Spec.ProviderID).ToNot(Equal("k8s-test-w-123"))
+		g.Expect(m.Labels[cluster.DeploymentLabel]).To(Equal("workers"))
+	}
+
+	// unmanaged VMs are adopted when adopt is set
+	deployment.Spec.Adopt = true
+	c, scheme = fakeClient(g, deployment.DeepCopy(), running.DeepCopy())
+	r = &deploymentReconciler{Client: c, scheme: scheme, platform: testPlatform(), vms: vms}
+	_, err = r.Reconcile(request)
+	g.Expect(err).ToNot(HaveOccurred())
+	list = &cluster.MachineList{}
+	g.Expect(c.List(context.Background(), list)).To(Succeed())
+	var providers []string
+	for _, m := range list.Items {
+		providers = append(providers, m.Spec.ProviderID)
+	}
+	g.Expect(providers).To(ConsistOf("k8s-test-w-workers-a", "k8s-test-w-123"))
+	g.Expect(c.Get(context.Background(), request.NamespacedName, deployment)).To(Succeed())
+	g.Expect(deployment.Status.Replicas).To(Equal(int32(2)))
+	g.Expect(deployment.Status.ReadyReplicas).To(Equal(int32(1)))
+}
+
+func TestMachineReconciler(t *testing.T) {
+	g := NewWithT(t)
+	m := machine("workers-a", "k8s-1.17", "", 0)
+	m.Namespace = "platform-system"
+	request := reconcile.Request{NamespacedName: k8stypes.NamespacedName{Namespace: "platform-system", Name: "workers-a"}}
+	c, _ := fakeClient(g, &m)
+	var created, terminated []string
+	var node *v1.Node
+	r := &machineReconciler{
+		Client:   c,
+		platform: testPlatform(),
+		create: func(pool, template, name string) (types.Machine, error) {
+			created = append(created, name)
+			return nil, fmt.Errorf("failed to clone %s", name)
+		},
+		terminate: func(name string) error {
+			terminated = append(terminated, name)
+			return nil
+		},
+		node:   func(name string) (*v1.Node, error) { return node, nil },
+		exists: func(name string) (bool, error) { return true, nil },
+	}
+	get := func() *cluster.Machine {
+		machine := &cluster.Machine{}
+		g.Expect(c.Get(context.Background(), request.NamespacedName, machine)).To(Succeed())
+		return machine
+	}
+
+	// the VM is named after the machine and recorded even if it fails to be created, provisioning is not retried
+	_, err := r.Reconcile(request)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(created).To(Equal([]string{"k8s-test-w-workers-a"}))
+	failed := get()
+	g.Expect(failed.Spec.ProviderID).To(Equal("k8s-test-w-workers-a"))
+	g.Expect(failed.Status.Phase).To(Equal(cluster.MachineFailed))
+	g.Expect(failed.Finalizers).To(ContainElement(cluster.MachineFinalizer))
+	_, err = r.Reconcile(request)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(created).To(HaveLen(1))
+
+	// provisioned machines are running once their node is ready
+	provisioned := get()
+	provisioned.Spec.ProviderID = ""
+	provisioned.Status.Phase = ""
+	g.Expect(c.Update(context.Background(), provisioned)).To(Succeed())
+	r.create = func(pool, template, name string) (types.Machine, error) {
+		return types.NullMachine{Hostname: name}, nil
+	}
+	result, err := r.Reconcile(request)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(result.RequeueAfter).To(Equal(30 * time.Second))
+	g.Expect(get().Status.Phase).To(Equal(cluster.MachineProvisioned))
+	node = &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "k8s-test-w-workers-a"},
+		Status:     v1.NodeStatus{Conditions: []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionTrue}}},
+	}
+	_, err = r.Reconcile(request)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(get().Status.Phase).To(Equal(cluster.MachineRunning))
+	g.Expect(get().Status.NodeName).To(Equal("k8s-test-w-workers-a"))
+
+	// deleted machines terminate their VM before the finalizer is removed
+	deleted := get()
+	now := metav1.Now()
+	deleted.DeletionTimestamp = &now
+	g.Expect(c.Update(context.Background(), deleted)).To(Succeed())
+	_, err = r.Reconcile(request)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(terminated).To(Equal([]string{"k8s-test-w-workers-a"}))
+	g.Expect(get().Finalizers).To(BeEmpty())
+}
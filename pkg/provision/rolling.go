@@ -23,6 +23,15 @@ type RollingOptions struct {
 	Masters, Workers       bool
 }
 
+// DrainOptions returns the options used to drain nodes that are being replaced
+func (opts RollingOptions) DrainOptions() k8s.DrainOptions {
+	return k8s.DrainOptions{
+		Timeout:             opts.Timeout,
+		MigrateLocalVolumes: opts.MigrateLocalVolumes,
+		Force:               opts.Force,
+	}
+}
+
 // Perform a rolling update of nodes
 func RollingUpdate(platform *platform.Platform, opts RollingOptions) error {
 	cluster, err := GetCluster(platform)
@@ -75,7 +84,9 @@ func RollingUpdate(platform *platform.Platform, opts RollingOptions) error {
 			return fmt.Errorf("[%s] replacement did not come up healthy: %v", replacement.Name(), status)
 		}
 
-		terminate(platform, machine)
+		if err := terminate(platform, machine, opts.DrainOptions()); err != nil {
+			return err
+		}
 
 		platform.Infof("Replaced %s in %s", node.Name, timer)
 		rolled++
@@ -131,7 +142,8 @@ func RollingRestart(platform *platform.Platform, opts RollingOptions) error {
 		platform.Infof("Health Before: %s", health)
 
 		timer := timer.NewTimer()
-		if err := platform.Drain(node.Name, opts.Timeout); err != nil {
+		// the node keeps its local volumes when it restarts, so they do not need to be migrated
+		if err := platform.Drain(node.Name, k8s.DrainOptions{Timeout: opts.Timeout, RetainLocalVolumes: true}); err != nil {
 			if opts.Force {
 				platform.Errorf("failed to drain %s, force restarting: %v", node.Name, err)
 			} else {
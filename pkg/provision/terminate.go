@@ -5,6 +5,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/flanksource/karina/pkg/k8s"
 	"github.com/flanksource/karina/pkg/platform"
 )
 
@@ -18,13 +19,14 @@ func TerminateOrphans(platform *platform.Platform) error {
 	for _, orphan := range cluster.Orphans {
 		time.Sleep(1 * time.Second) // sleep to allow for cancellation
 		platform.Infof("Deleting %s", orphan.Name())
-		terminate(platform, orphan)
+		// orphans have not joined the cluster, so there is nothing to drain
+		terminate(platform, orphan, k8s.DrainOptions{Force: true}) // nolint: errcheck
 	}
 	return nil
 }
 
 // TerminateNodes deletes all of the specified nodes stops and deletes all VM's for a cluster;
-func TerminateNodes(platform *platform.Platform, nodes []string) error {
+func TerminateNodes(platform *platform.Platform, nodes []string, opts k8s.DrainOptions) error {
 	cluster, err := GetCluster(platform)
 	if err != nil {
 		return err
@@ -42,10 +44,9 @@ func TerminateNodes(platform *platform.Platform, nodes []string) error {
 		node := nodeMachine.Node
 		platform.Infof("Deleting %s", node.Name)
 
-		if err := cluster.Cordon(node); err != nil {
+		if err := terminate(platform, machine, opts); err != nil {
 			return err
 		}
-		terminate(platform, machine)
 	}
 	return nil
 }
@@ -80,7 +81,7 @@ func Cleanup(platform *platform.Platform) error {
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			terminate(platform, vm)
+			terminate(platform, vm, k8s.DrainOptions{Force: true}) // nolint: errcheck
 		}()
 	}
 
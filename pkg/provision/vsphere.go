@@ -7,6 +7,7 @@ import (
 	"time"
 
 	"github.com/flanksource/commons/utils"
+	"github.com/flanksource/karina/pkg/k8s"
 	"github.com/flanksource/karina/pkg/phases"
 	"github.com/flanksource/karina/pkg/phases/kubeadm"
 	"github.com/flanksource/karina/pkg/platform"
@@ -110,7 +111,9 @@ func VsphereCluster(platform *platform.Platform) error {
 				wg.Add(1)
 				go func() {
 					defer wg.Done()
-					terminate(platform, vm)
+					if err := terminate(platform, vm, k8s.DrainOptions{Timeout: 5 * time.Minute, MigrateLocalVolumes: true}); err != nil {
+						platform.Errorf("Failed to downscale: %v", err)
+					}
 				}()
 			}
 		}
@@ -180,6 +183,12 @@ func createMaster(platform *platform.Platform) (types.Machine, error) {
 }
 
 func createWorker(platform *platform.Platform, nodeGroup string) (types.Machine, error) {
+	return createWorkerFromTemplate(platform, nodeGroup, "", "")
+}
+
+// createWorkerFromTemplate creates a worker in nodeGroup, cloned from template instead of the template of
+// the node group if it is not empty, and named name instead of a generated name if it is not empty
+func createWorkerFromTemplate(platform *platform.Platform, nodeGroup, template, name string) (types.Machine, error) {
 	if nodeGroup == "" {
 		for k := range platform.Nodes {
 			nodeGroup = k
@@ -187,11 +196,17 @@ func createWorker(platform *platform.Platform, nodeGroup string) (types.Machine,
 	}
 	worker := platform.Nodes[nodeGroup]
 	vm := worker
+	if template != "" {
+		vm.Template = template
+	}
 	config, err := phases.CreateWorker(nodeGroup, platform)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create worker %v", err)
 	}
-	vm.Name = fmt.Sprintf("%s-%s-%s-%s", platform.HostPrefix, platform.Name, vm.Prefix, utils.ShortTimestamp())
+	vm.Name = name
+	if vm.Name == "" {
+		vm.Name = fmt.Sprintf("%s-%s-%s-%s", platform.HostPrefix, platform.Name, vm.Prefix, utils.ShortTimestamp())
+	}
 	if vm.Tags == nil {
 		vm.Tags = make(map[string]string)
 	}
@@ -207,13 +222,18 @@ func createWorker(platform *platform.Platform, nodeGroup string) (types.Machine,
 	return cloned, nil
 }
 
-func terminate(platform *platform.Platform, vm types.Machine) {
+// terminate drains the node and deletes it along with the VM, the VM is not terminated if the
+// node fails to drain unless opts.Force is set
+func terminate(platform *platform.Platform, vm types.Machine, opts k8s.DrainOptions) error {
 	if err := platform.ProvisionHook.BeforeTerminate(platform, vm); err != nil {
 		platform.Warnf("%v", err)
 	}
 
 	if !platform.Terminating {
-		if err := platform.Drain(vm.Name(), 2*time.Minute); err != nil {
+		if err := platform.Drain(vm.Name(), opts); err != nil {
+			if !opts.Force {
+				return fmt.Errorf("[%s] failed to drain: %v", vm.Name(), err)
+			}
 			platform.Warnf("[%s] failed to drain: %v", vm.Name(), err)
 		}
 	}
@@ -235,4 +255,5 @@ func terminate(platform *platform.Platform, vm types.Machine) {
 	if err := vm.Terminate(); err != nil {
 		platform.Warnf("Failed to terminate %s: %v", vm.Name(), err)
 	}
+	return nil
 }
@@ -0,0 +1,266 @@
+package reports
+
+import (
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/flanksource/karina/pkg/types"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Prices are the monthly unit prices used to calculate the cost of pools
+type Prices struct {
+	// Price per CPU core
+	CPU float64
+	// Price per GB of memory
+	Memory float64
+	// Price per GB of disk
+	Disk float64
+}
+
+type CapacityOptions struct {
+	ReportOptions
+	Prices
+	// The requests of a single replica, used to forecast how many more replicas fit in each pool
+	Request v1.ResourceList
+	// Report the allocation of pool costs to namespaces rather than the capacity of each pool
+	ByNamespace bool
+}
+
+// Cost is the monthly cost of a pool, or of the share of a pool allocated to a namespace
+type Cost struct {
+	CPU, Memory, Disk float64
+}
+
+func (c Cost) Total() float64 {
+	return c.CPU + c.Memory + c.Disk
+}
+
+// PoolCapacity is the spec, live capacity, requests and cost of a pool
+type PoolCapacity struct {
+	Name string
+	// The spec of the pool from the config, nil if the nodes do not match any pool
+	Spec        *types.VM
+	Nodes       []Node
+	Allocatable v1.ResourceList
+	Requests    v1.ResourceList
+	Cost        Cost
+	// The number of replicas of CapacityOptions.Request that fit on the existing schedulable nodes
+	Headroom int
+	// The number of replicas that fit once the pool is scaled to the count in its spec
+	HeadroomAtCount int
+}
+
+// Allocation is the requests and allocated cost of a namespace in a pool
+type Allocation struct {
+	Namespace string
+	Pool      string
+	Requests  v1.ResourceList
+	Cost      Cost
+}
+
+// GetCapacity returns the capacity of each pool, combining the VM specs in config with the live usage
+func GetCapacity(usage Usage, config types.PlatformConfig, opts CapacityOptions) []PoolCapacity {
+	specs := map[string]types.VM{MasterPool: config.Master}
+	for name, vm := range config.Nodes {
+		specs[name] = vm
+	}
+	pools := make(map[string]*PoolCapacity)
+	for name := range specs {
+		spec := specs[name]
+		pools[name] = &PoolCapacity{Name: name, Spec: &spec}
+	}
+	for _, node := range usage.Nodes {
+		pool, ok := pools[node.Pool]
+		if !ok {
+			pool = &PoolCapacity{Name: node.Pool}
+			pools[node.Pool] = pool
+		}
+		pool.Nodes = append(pool.Nodes, node)
+	}
+
+	var list []PoolCapacity
+	for _, pool := range pools {
+		pool.Allocatable, pool.Requests = v1.ResourceList{}, v1.ResourceList{}
+		for _, node := range pool.Nodes {
+			add(pool.Allocatable, node.Allocatable)
+			add(pool.Requests, node.Requests)
+			cost := nodeCost(node, pool.Spec, opts.Prices)
+			pool.Cost.CPU += cost.CPU
+			pool.Cost.Memory += cost.Memory
+			pool.Cost.Disk += cost.Disk
+			if !node.Unschedulable {
+				pool.Headroom += fit(node.Allocatable, node.Requests, node.Pods, opts.Request)
+			}
+		}
+		pool.HeadroomAtCount = pool.Headroom
+		if pool.Spec != nil && pool.Spec.Count > len(pool.Nodes) {
+			pool.HeadroomAtCount += (pool.Spec.Count - len(pool.Nodes)) * fit(emptyNode(*pool), nil, 0, opts.Request)
+		}
+		list = append(list, *pool)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// GetAllocations allocates the cost of each pool to namespaces in proportion to their share of the pool's allocatable
+// CPU and memory, disk costs are allocated by the average of both shares. The unallocated cost of each pool is
+// returned with an empty namespace.
+func GetAllocations(usage Usage, pools []PoolCapacity) []Allocation {
+	requests := make(map[string]map[string]v1.ResourceList)
+	for _, pod := range usage.Pods {
+		if pod.Pool == "" {
+			continue
+		}
+		if requests[pod.Pool] == nil {
+			requests[pod.Pool] = make(map[string]v1.ResourceList)
+		}
+		if requests[pod.Pool][pod.Namespace] == nil {
+			requests[pod.Pool][pod.Namespace] = v1.ResourceList{}
+		}
+		add(requests[pod.Pool][pod.Namespace], pod.Requests)
+	}
+
+	var allocations []Allocation
+	for _, pool := range pools {
+		if len(pool.Nodes) == 0 {
+			continue
+		}
+		var namespaces []string
+		for ns := range requests[pool.Name] {
+			namespaces = append(namespaces, ns)
+		}
+		sort.Strings(namespaces)
+		idle := pool.Cost
+		for _, ns := range namespaces {
+			list := requests[pool.Name][ns]
+			cpu := ratio(*list.Cpu(), *pool.Allocatable.Cpu())
+			memory := ratio(*list.Memory(), *pool.Allocatable.Memory())
+			cost := Cost{CPU: cpu * pool.Cost.CPU, Memory: memory * pool.Cost.Memory, Disk: (cpu + memory) / 2 * pool.Cost.Disk}
+			idle.CPU -= cost.CPU
+			idle.Memory -= cost.Memory
+			idle.Disk -= cost.Disk
+			allocations = append(allocations, Allocation{Namespace: ns, Pool: pool.Name, Requests: list, Cost: cost})
+		}
+		allocations = append(allocations, Allocation{Pool: pool.Name, Requests: v1.ResourceList{}, Cost: idle})
+	}
+	return allocations
+}
+
+// CapacityTable returns a report of the spec, capacity, cost and headroom of each pool
+func CapacityTable(pools []PoolCapacity) Table {
+	table := Table{Headers: []string{"POOL", "COUNT", "NODES", "CPU", "MEMORY GB", "DISK GB",
+		"CPU REQUESTS", "CPU ALLOCATABLE", "MEMORY REQUESTS", "MEMORY ALLOCATABLE", "COST", "HEADROOM", "HEADROOM AT COUNT"}}
+	for _, pool := range pools {
+		row := []string{pool.Name}
+		if pool.Spec != nil {
+			row = append(row, fmt.Sprint(pool.Spec.Count), fmt.Sprint(len(pool.Nodes)), fmt.Sprint(pool.Spec.CPUs), fmt.Sprint(pool.Spec.MemoryGB), fmt.Sprint(pool.Spec.DiskGB))
+		} else {
+			row = append(row, "", fmt.Sprint(len(pool.Nodes)), "", "", "")
+		}
+		row = append(row,
+			FormatCPU(*pool.Requests.Cpu()), FormatCPU(*pool.Allocatable.Cpu()),
+			FormatMemory(*pool.Requests.Memory()), FormatMemory(*pool.Allocatable.Memory()),
+			fmt.Sprintf("%.2f", pool.Cost.Total()),
+			fmt.Sprint(pool.Headroom), fmt.Sprint(pool.HeadroomAtCount))
+		table.Add(row...)
+	}
+	return table
+}
+
+// AllocationTable returns a chargeback report of the requests and allocated cost of each namespace in each pool
+func AllocationTable(allocations []Allocation) Table {
+	table := Table{Headers: []string{"NAMESPACE", "POOL", "CPU REQUESTS", "MEMORY REQUESTS", "CPU COST", "MEMORY COST", "DISK COST", "COST"}}
+	for _, allocation := range allocations {
+		ns := allocation.Namespace
+		if ns == "" {
+			ns = "(unallocated)"
+		}
+		table.Add(ns, allocation.Pool,
+			FormatCPU(*allocation.Requests.Cpu()), FormatMemory(*allocation.Requests.Memory()),
+			fmt.Sprintf("%.2f", allocation.Cost.CPU),
+			fmt.Sprintf("%.2f", allocation.Cost.Memory),
+			fmt.Sprintf("%.2f", allocation.Cost.Disk),
+			fmt.Sprintf("%.2f", allocation.Cost.Total()))
+	}
+	return table
+}
+
+// Capacity writes a capacity or chargeback report to stdout
+func Capacity(client kubernetes.Interface, config types.PlatformConfig, opts CapacityOptions) error {
+	usage, err := GetUsage(client, config)
+	if err != nil {
+		return err
+	}
+	pools := GetCapacity(*usage, config, opts)
+	if opts.ByNamespace {
+		return AllocationTable(GetAllocations(*usage, pools)).Write(os.Stdout, opts.Format)
+	}
+	return CapacityTable(pools).Write(os.Stdout, opts.Format)
+}
+
+// nodeCost returns the cost of a node from the spec of its pool, or from its allocatable capacity if the spec is unknown
+// e.g. for masters that are not provisioned by karina
+func nodeCost(node Node, spec *types.VM, prices Prices) Cost {
+	if spec != nil && spec.CPUs > 0 {
+		return Cost{
+			CPU:    float64(spec.CPUs) * prices.CPU,
+			Memory: float64(spec.MemoryGB) * prices.Memory,
+			Disk:   float64(spec.DiskGB) * prices.Disk,
+		}
+	}
+	return Cost{
+		CPU:    float64(node.Allocatable.Cpu().MilliValue()) / 1000 * prices.CPU,
+		Memory: float64(node.Allocatable.Memory().Value()) / (1 << 30) * prices.Memory,
+	}
+}
+
+// emptyNode returns the allocatable capacity of a node that has not been provisioned yet, which is the average of
+// the existing nodes in the pool, or the spec of the pool if it has no nodes
+func emptyNode(pool PoolCapacity) v1.ResourceList {
+	if len(pool.Nodes) == 0 {
+		return v1.ResourceList{
+			v1.ResourceCPU:    *resource.NewQuantity(int64(pool.Spec.CPUs), resource.DecimalSI),
+			v1.ResourceMemory: *resource.NewQuantity(pool.Spec.MemoryGB<<30, resource.BinarySI),
+			v1.ResourcePods:   *resource.NewQuantity(110, resource.DecimalSI),
+		}
+	}
+	average := v1.ResourceList{}
+	for name, quantity := range pool.Allocatable {
+		average[name] = *resource.NewMilliQuantity(quantity.MilliValue()/int64(len(pool.Nodes)), quantity.Format)
+	}
+	return average
+}
+
+// fit returns how many replicas of request fit into the unrequested capacity of a node
+func fit(allocatable, requests v1.ResourceList, pods int, request v1.ResourceList) int {
+	replicas, limited := 0, false
+	if allocatable.Pods().Value() > 0 {
+		replicas, limited = int(allocatable.Pods().Value())-pods, true
+	}
+	for name, size := range request {
+		if size.IsZero() {
+			continue
+		}
+		free := allocatable[name]
+		free.Sub(requests[name])
+		n := int(free.MilliValue() / size.MilliValue())
+		if !limited || n < replicas {
+			replicas, limited = n, true
+		}
+	}
+	if replicas < 0 {
+		return 0
+	}
+	return replicas
+}
+
+func ratio(value, total resource.Quantity) float64 {
+	if total.IsZero() {
+		return 0
+	}
+	return float64(value.MilliValue()) / float64(total.MilliValue())
+}
@@ -0,0 +1,63 @@
+package reports
+
+import (
+	"testing"
+
+	"github.com/flanksource/karina/pkg/types"
+	. "github.com/onsi/gomega"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+var capacityConfig = types.PlatformConfig{
+	Name:       "test",
+	HostPrefix: "k8s",
+	Nodes: map[string]types.VM{
+		"workers":     {Prefix: "w", Count: 2, CPUs: 4, MemoryGB: 16, DiskGB: 100},
+		"workers-big": {Prefix: "wb", Count: 2, CPUs: 4, MemoryGB: 16, DiskGB: 100},
+	},
+}
+
+func capacityUsage(g *WithT) *Usage {
+	client := fake.NewSimpleClientset(
+		newNode("k8s-test-m-abc", map[string]string{"node-role.kubernetes.io/master": ""},
+			v1.Taint{Key: "node-role.kubernetes.io/master", Effect: v1.TaintEffectNoSchedule}),
+		newNode("k8s-test-w-abc", nil),
+		newNode("k8s-test-wb-abc", nil),
+		newNode("k8s-test-wb-def", nil),
+		newPod("a", "payments", "k8s-test-wb-abc", v1.PodRunning, "500m"),
+		newPod("b", "payments", "k8s-test-wb-def", v1.PodRunning, "1500m"),
+		newPod("c", "payments", "k8s-test-wb-def", v1.PodSucceeded, "2"),
+		newPod("d", "payments", "", v1.PodPending, "2"),
+		newPod("e", "orders", "k8s-test-wb-def", v1.PodRunning, "2"),
+	)
+	usage, err := GetUsage(client, capacityConfig)
+	g.Expect(err).ToNot(HaveOccurred())
+	return usage
+}
+
+func TestCapacity(t *testing.T) {
+	g := NewWithT(t)
+	usage := capacityUsage(g)
+	opts := CapacityOptions{
+		Prices:  Prices{CPU: 10, Memory: 2, Disk: 0.1},
+		Request: v1.ResourceList{v1.ResourceCPU: resource.MustParse("1"), v1.ResourceMemory: resource.MustParse("4Gi")},
+	}
+	pools := GetCapacity(*usage, capacityConfig, opts)
+	g.Expect(CapacityTable(pools).Rows).To(Equal([][]string{
+		{"masters", "0", "1", "0", "0", "0", "0.00", "4.00", "0.0Gi", "16.0Gi", "72.00", "0", "0"},
+		{"workers", "2", "1", "4", "16", "100", "0.00", "4.00", "0.0Gi", "16.0Gi", "82.00", "4", "8"},
+		// wb-abc has 3 free cores and wb-def has 0.5 free cores
+		{"workers-big", "2", "2", "4", "16", "100", "4.50", "8.00", "3.0Gi", "32.0Gi", "164.00", "3", "3"},
+	}))
+
+	allocations := GetAllocations(*usage, pools)
+	g.Expect(AllocationTable(allocations).Rows).To(Equal([][]string{
+		{"(unallocated)", "masters", "0.00", "0.0Gi", "40.00", "32.00", "0.00", "72.00"},
+		{"(unallocated)", "workers", "0.00", "0.0Gi", "40.00", "32.00", "10.00", "82.00"},
+		{"orders", "workers-big", "2.00", "1.0Gi", "20.00", "2.00", "2.81", "24.81"},
+		{"payments", "workers-big", "2.50", "2.0Gi", "25.00", "4.00", "3.75", "32.75"},
+		{"(unallocated)", "workers-big", "0.00", "0.0Gi", "35.00", "58.00", "13.44", "106.44"},
+	}))
+}
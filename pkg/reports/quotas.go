@@ -3,19 +3,43 @@ package reports
 import (
 	"fmt"
 	"os"
+	"sort"
 	"strings"
-	"text/tabwriter"
 
 	"github.com/flanksource/karina/pkg/k8s"
+	"github.com/pkg/errors"
+	kerrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
 )
 
 type ReportOptions struct {
 	Path        string
 	Annotations []string
 	Format      string
+	// Resources to report on e.g. limits.memory, defaults to all resources
+	Resources []string
 }
 
+// QuotaUsage is the hard limit and usage of a single resource in a ResourceQuota, or in a
+// ClusterResourceQuota and each of the namespaces it selects
+type QuotaUsage struct {
+	// The namespace of the quota, or dynamic for the total of a ClusterResourceQuota
+	Namespace   string
+	Kind        string
+	Name        string
+	Annotations map[string]string
+	Resource    string
+	Hard        resource.Quantity
+	// Used is nil if the quota has no status e.g. when it is read from specs
+	Used *resource.Quantity
+}
+
+var clusterResourceQuotas = schema.GroupVersionResource{Group: "quota.openshift.io", Version: "v1", Resource: "clusterresourcequotas"}
+
 func GetNamespaces(specs k8s.Specs) map[string]map[string]string {
 	namespaces := map[string]map[string]string{}
 
@@ -25,55 +49,194 @@ func GetNamespaces(specs k8s.Specs) map[string]map[string]string {
 	return namespaces
 }
 
-func Quotas(opts ReportOptions) error {
-	specs, err := k8s.Walk(opts.Path)
-	if err != nil {
-		return err
+// LiveSpecs returns the namespaces, ResourceQuotas and ClusterResourceQuotas of a cluster,
+// ClusterResourceQuotas are skipped if the CRD is not installed
+func LiveSpecs(client dynamic.Interface) (k8s.Specs, error) {
+	spec := k8s.Spec{Path: "cluster"}
+	for kind, gvr := range map[string]schema.GroupVersionResource{
+		"Namespace":            {Version: "v1", Resource: "namespaces"},
+		"ResourceQuota":        {Version: "v1", Resource: "resourcequotas"},
+		"ClusterResourceQuota": clusterResourceQuotas,
+	} {
+		list, err := client.Resource(gvr).List(metav1.ListOptions{})
+		if kerrors.IsNotFound(err) && gvr == clusterResourceQuotas {
+			continue
+		} else if err != nil {
+			return nil, errors.Wrapf(err, "failed to list %s", gvr.Resource)
+		}
+		for _, item := range list.Items {
+			if item.GetKind() == "" {
+				item.SetKind(kind)
+			}
+			spec.Items = append(spec.Items, item)
+		}
 	}
+	return k8s.Specs{spec}, nil
+}
+
+// GetQuotas returns the hard limit and usage of each resource in the ResourceQuotas and ClusterResourceQuotas in specs
+func GetQuotas(specs k8s.Specs) ([]QuotaUsage, error) {
 	namespaces := GetNamespaces(specs)
-	w := tabwriter.NewWriter(os.Stdout, 3, 2, 3, ' ', tabwriter.DiscardEmptyColumns)
-	SEP := "\t"
-	if opts.Format == "csv" {
-		SEP = ";"
-	}
-	fmt.Fprintf(w, "NAMESPACE%s", SEP)
-	for _, annotation := range opts.Annotations {
-		fmt.Fprintf(w, "%s%s", strings.ToUpper(annotation), SEP)
-	}
-	fmt.Fprintf(w, "LIMIT%s\n", SEP)
+	var quotas []QuotaUsage
+
 	for _, quota := range specs.FilterBy("ResourceQuota") {
-		limit, found, err := unstructured.NestedString(quota.Object, "spec", "hard", "limits", "memory")
+		hard, err := quantities(quota, "spec", "hard")
 		if err != nil {
-			return err
+			return nil, err
 		}
+		used, err := quantities(quota, "status", "used")
+		if err != nil {
+			return nil, err
+		}
+		quotas = append(quotas, usage(QuotaUsage{
+			Namespace:   quota.GetNamespace(),
+			Kind:        quota.GetKind(),
+			Name:        quota.GetName(),
+			Annotations: namespaces[quota.GetNamespace()],
+		}, hard, used)...)
+	}
 
-		if !found {
-			limit, _, _ = unstructured.NestedString(quota.Object, "spec", "hard", "limits.memory")
+	for _, quota := range specs.FilterBy("ClusterResourceQuota") {
+		hard, err := quantities(quota, "spec", "quota", "hard")
+		if err != nil {
+			return nil, err
+		}
+		if len(hard) == 0 {
+			if hard, err = quantities(quota, "spec", "hard"); err != nil {
+				return nil, err
+			}
 		}
+		used, err := quantities(quota, "status", "total", "used")
+		if err != nil {
+			return nil, err
+		}
+		quotas = append(quotas, usage(QuotaUsage{
+			Namespace:   "dynamic",
+			Kind:        quota.GetKind(),
+			Name:        quota.GetName(),
+			Annotations: quota.GetAnnotations(),
+		}, hard, used)...)
 
-		annotations := namespaces[quota.GetNamespace()]
-		fmt.Fprintf(w, "%s%s", quota.GetNamespace(), SEP)
-		for _, annotation := range opts.Annotations {
-			fmt.Fprintf(w, "%s%s", annotations[annotation], SEP)
+		// the usage of each namespace selected by the quota
+		slices, _, _ := unstructured.NestedSlice(quota.Object, "status", "namespaces")
+		for _, slice := range slices {
+			slice, ok := slice.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			ns, _, _ := unstructured.NestedString(slice, "namespace")
+			used, err := quantities(unstructured.Unstructured{Object: slice}, "status", "used")
+			if err != nil {
+				return nil, err
+			}
+			quotas = append(quotas, usage(QuotaUsage{
+				Namespace:   ns,
+				Kind:        quota.GetKind(),
+				Name:        quota.GetName(),
+				Annotations: namespaces[ns],
+			}, hard, used)...)
 		}
-		fmt.Fprintf(w, "%s%s\n", limit, SEP)
 	}
-	for _, quota := range specs.FilterBy("ClusterResourceQuota") {
-		limit, found, err := unstructured.NestedString(quota.Object, "spec", "hard", "limits", "memory")
-		if err != nil {
-			return err
+
+	sort.SliceStable(quotas, func(i, j int) bool {
+		if quotas[i].Namespace != quotas[j].Namespace {
+			return quotas[i].Namespace < quotas[j].Namespace
 		}
+		if quotas[i].Name != quotas[j].Name {
+			return quotas[i].Name < quotas[j].Name
+		}
+		return quotas[i].Resource < quotas[j].Resource
+	})
+	return quotas, nil
+}
 
-		if !found {
-			limit, _, _ = unstructured.NestedString(quota.Object, "spec", "hard", "limits.memory")
+// QuotaTable returns a report with a row per quota and resource, with a column for each annotation of
+// the quota's namespace in annotations
+func QuotaTable(quotas []QuotaUsage, opts ReportOptions) Table {
+	table := Table{Headers: []string{"NAMESPACE", "KIND", "NAME"}}
+	for _, annotation := range opts.Annotations {
+		table.Headers = append(table.Headers, strings.ToUpper(annotation))
+	}
+	table.Headers = append(table.Headers, "RESOURCE", "HARD", "USED", "USED %")
+
+	resources := make(map[string]bool)
+	for _, name := range opts.Resources {
+		resources[name] = true
+	}
+	for _, quota := range quotas {
+		if len(resources) > 0 && !resources[quota.Resource] {
+			continue
 		}
-		annotations := quota.GetAnnotations()
-		fmt.Fprintf(w, "dynamic%s", SEP)
+		row := []string{quota.Namespace, quota.Kind, quota.Name}
 		for _, annotation := range opts.Annotations {
-			fmt.Fprintf(w, "%s%s", annotations[annotation], SEP)
+			row = append(row, quota.Annotations[annotation])
+		}
+		row = append(row, quota.Resource, quota.Hard.String())
+		if quota.Used != nil {
+			row = append(row, quota.Used.String(), percent(*quota.Used, quota.Hard))
+		} else {
+			row = append(row, "", "")
 		}
-		fmt.Fprintf(w, "%s%s\n", limit, SEP)
+		table.Add(row...)
+	}
+	return table
+}
+
+// Quotas writes a report of the quotas in specs to stdout
+func Quotas(specs k8s.Specs, opts ReportOptions) error {
+	quotas, err := GetQuotas(specs)
+	if err != nil {
+		return err
+	}
+	return QuotaTable(quotas, opts).Write(os.Stdout, opts.Format)
+}
+
+// usage returns a QuotaUsage for each resource in hard
+func usage(quota QuotaUsage, hard, used map[string]resource.Quantity) []QuotaUsage {
+	var quotas []QuotaUsage
+	for name, limit := range hard {
+		q := quota
+		q.Resource = name
+		q.Hard = limit
+		if value, ok := used[name]; ok {
+			q.Used = &value
+		}
+		quotas = append(quotas, q)
+	}
+	return quotas
+}
+
+// quantities returns the resource quantities in a field of obj, nested fields such as limits: {memory: 1Gi}
+// are returned as limits.memory
+func quantities(obj unstructured.Unstructured, fields ...string) (map[string]resource.Quantity, error) {
+	values, _, err := unstructured.NestedMap(obj.Object, fields...)
+	if err != nil {
+		return nil, err
+	}
+	list := make(map[string]resource.Quantity)
+	var flatten func(prefix string, values map[string]interface{}) error
+	flatten = func(prefix string, values map[string]interface{}) error {
+		for name, value := range values {
+			if nested, ok := value.(map[string]interface{}); ok {
+				if err := flatten(prefix+name+".", nested); err != nil {
+					return err
+				}
+				continue
+			}
+			quantity, err := resource.ParseQuantity(fmt.Sprint(value))
+			if err != nil {
+				return errors.Wrapf(err, "invalid %s in %s/%s", prefix+name, obj.GetNamespace(), obj.GetName())
+			}
+			list[prefix+name] = quantity
+		}
+		return nil
+	}
+	return list, flatten("", values)
+}
+
+func percent(used, total resource.Quantity) string {
+	if total.IsZero() {
+		return ""
 	}
-	w.Flush()
-	return nil
+	return fmt.Sprintf("%.0f%%", 100*float64(used.MilliValue())/float64(total.MilliValue()))
 }
@@ -0,0 +1,151 @@
+package reports
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/flanksource/karina/pkg/k8s"
+	"github.com/flanksource/karina/pkg/types"
+	. "github.com/onsi/gomega"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+const quotaSpecs = `
+apiVersion: v1
+kind: Namespace
+metadata:
+  name: payments
+  annotations:
+    team: payments
+---
+apiVersion: v1
+kind: ResourceQuota
+metadata:
+  name: tenant-quota
+  namespace: payments
+spec:
+  hard:
+    limits.memory: 16Gi
+    pods: 20
+status:
+  used:
+    limits.memory: 4Gi
+    pods: "5"
+---
+apiVersion: quota.openshift.io/v1
+kind: ClusterResourceQuota
+metadata:
+  name: shared
+spec:
+  quota:
+    hard:
+      requests.cpu: "8"
+status:
+  total:
+    used:
+      requests.cpu: "6"
+  namespaces:
+    - namespace: payments
+      status:
+        used:
+          requests.cpu: 2500m
+`
+
+func TestQuotas(t *testing.T) {
+	g := NewWithT(t)
+	items, err := k8s.GetUnstructuredObjects([]byte(quotaSpecs))
+	g.Expect(err).ToNot(HaveOccurred())
+
+	quotas, err := GetQuotas(k8s.Specs{{Items: items}})
+	g.Expect(err).ToNot(HaveOccurred())
+	table := QuotaTable(quotas, ReportOptions{Annotations: []string{"team"}})
+	g.Expect(table.Headers).To(Equal([]string{"NAMESPACE", "KIND", "NAME", "TEAM", "RESOURCE", "HARD", "USED", "USED %"}))
+	g.Expect(table.Rows).To(Equal([][]string{
+		{"dynamic", "ClusterResourceQuota", "shared", "", "requests.cpu", "8", "6", "75%"},
+		{"payments", "ClusterResourceQuota", "shared", "payments", "requests.cpu", "8", "2500m", "31%"},
+		{"payments", "ResourceQuota", "tenant-quota", "payments", "limits.memory", "16Gi", "4Gi", "25%"},
+		{"payments", "ResourceQuota", "tenant-quota", "payments", "pods", "20", "5", "25%"},
+	}))
+
+	table = QuotaTable(quotas, ReportOptions{Resources: []string{"pods"}})
+	g.Expect(table.Rows).To(HaveLen(1))
+
+	var out bytes.Buffer
+	g.Expect(table.Write(&out, "markdown")).To(Succeed())
+	g.Expect(out.String()).To(Equal("| NAMESPACE | KIND | NAME | RESOURCE | HARD | USED | USED % |\n" +
+		"| --- | --- | --- | --- | --- | --- | --- |\n" +
+		"| payments | ResourceQuota | tenant-quota | pods | 20 | 5 | 25% |\n"))
+	out.Reset()
+	g.Expect(table.Write(&out, "json")).To(Succeed())
+	g.Expect(out.String()).To(ContainSubstring(`"used_%": "25%"`))
+	out.Reset()
+	g.Expect(table.Write(&out, "csv")).To(Succeed())
+	g.Expect(out.String()).To(HavePrefix("NAMESPACE;KIND;NAME;"))
+	g.Expect(table.Write(&out, "xml")).To(MatchError(ContainSubstring("unknown format")))
+}
+
+func TestUtilisation(t *testing.T) {
+	g := NewWithT(t)
+	config := types.PlatformConfig{
+		Name:       "test",
+		HostPrefix: "k8s",
+		Nodes: map[string]types.VM{
+			"workers":     {Prefix: "w"},
+			"workers-big": {Prefix: "wb"},
+		},
+	}
+	client := fake.NewSimpleClientset(
+		newNode("k8s-test-m-abc", map[string]string{"node-role.kubernetes.io/master": ""}),
+		newNode("k8s-test-w-abc", nil),
+		newNode("k8s-test-wb-abc", nil),
+		newNode("k8s-test-wb-def", nil),
+		newPod("a", "default", "k8s-test-wb-abc", v1.PodRunning, "500m"),
+		newPod("b", "default", "k8s-test-wb-def", v1.PodRunning, "1500m"),
+		newPod("c", "default", "k8s-test-wb-def", v1.PodSucceeded, "2"),
+		newPod("d", "default", "", v1.PodPending, "2"),
+	)
+
+	usage, err := GetUsage(client, config)
+	g.Expect(err).ToNot(HaveOccurred())
+	g.Expect(usage.Pods).To(HaveLen(3))
+	table := UtilisationTable(*usage)
+	g.Expect(table.Rows).To(Equal([][]string{
+		{"masters", "1", "0", "110", "0.00", "4.00", "0%", "0.0Gi", "16.0Gi", "0%"},
+		{"workers", "1", "0", "110", "0.00", "4.00", "0%", "0.0Gi", "16.0Gi", "0%"},
+		{"workers-big", "2", "2", "220", "2.50", "8.00", "31%", "2.0Gi", "32.0Gi", "6%"},
+	}))
+}
+
+// newNode returns a node with 4 CPUs, 16Gi of memory and 110 pods allocatable
+func newNode(name string, labels map[string]string, taints ...v1.Taint) *v1.Node {
+	return &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Labels: labels},
+		Spec:       v1.NodeSpec{Taints: taints},
+		Status: v1.NodeStatus{Allocatable: v1.ResourceList{
+			v1.ResourceCPU:    resource.MustParse("4"),
+			v1.ResourceMemory: resource.MustParse("16Gi"),
+			v1.ResourcePods:   resource.MustParse("110"),
+		}},
+	}
+}
+
+// newPod returns a pod requesting cpu and 1Gi of memory, with an init container requesting 1 CPU
+func newPod(name, namespace, node string, phase v1.PodPhase, cpu string) *v1.Pod {
+	return &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+		Spec: v1.PodSpec{
+			NodeName: node,
+			Containers: []v1.Container{{Resources: v1.ResourceRequirements{Requests: v1.ResourceList{
+				v1.ResourceCPU:    resource.MustParse(cpu),
+				v1.ResourceMemory: resource.MustParse("1Gi"),
+			}}}},
+			InitContainers: []v1.Container{{Resources: v1.ResourceRequirements{Requests: v1.ResourceList{
+				v1.ResourceCPU: resource.MustParse("1"),
+			}}}},
+		},
+		Status: v1.PodStatus{Phase: phase},
+	}
+}
@@ -0,0 +1,73 @@
+package reports
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+)
+
+// Formats are the output formats supported by reports
+var Formats = []string{"table", "csv", "json", "markdown"}
+
+// Table is a report with a row per item, that can be written in any of the Formats
+type Table struct {
+	Headers []string
+	Rows    [][]string
+}
+
+func (t *Table) Add(row ...string) {
+	t.Rows = append(t.Rows, row)
+}
+
+// Write writes the table to w in the given format
+func (t Table) Write(w io.Writer, format string) error {
+	switch format {
+	case "", "table":
+		table := tabwriter.NewWriter(w, 3, 2, 3, ' ', tabwriter.DiscardEmptyColumns)
+		fmt.Fprintln(table, strings.Join(t.Headers, "\t"))
+		for _, row := range t.Rows {
+			fmt.Fprintln(table, strings.Join(row, "\t"))
+		}
+		return table.Flush()
+	case "csv":
+		out := csv.NewWriter(w)
+		out.Comma = ';'
+		if err := out.Write(t.Headers); err != nil {
+			return err
+		}
+		if err := out.WriteAll(t.Rows); err != nil {
+			return err
+		}
+		return out.Error()
+	case "json":
+		items := []map[string]string{}
+		for _, row := range t.Rows {
+			item := make(map[string]string)
+			for i, header := range t.Headers {
+				item[strings.ToLower(strings.Replace(header, " ", "_", -1))] = row[i]
+			}
+			items = append(items, item)
+		}
+		data, err := json.MarshalIndent(items, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(w, string(data))
+		return err
+	case "markdown", "md":
+		fmt.Fprintf(w, "| %s |\n", strings.Join(t.Headers, " | "))
+		fmt.Fprintf(w, "|%s\n", strings.Repeat(" --- |", len(t.Headers)))
+		for _, row := range t.Rows {
+			cells := make([]string, len(row))
+			for i, cell := range row {
+				cells[i] = strings.Replace(cell, "|", "\\|", -1)
+			}
+			fmt.Fprintf(w, "| %s |\n", strings.Join(cells, " | "))
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown format %s, must be one of %s", format, strings.Join(Formats, ","))
+}
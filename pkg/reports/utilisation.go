@@ -0,0 +1,196 @@
+package reports
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/flanksource/karina/pkg/types"
+	"github.com/pkg/errors"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// MasterPool is the pool of master nodes
+const MasterPool = "masters"
+
+// Node is the allocatable capacity of a node and the requests of the pods scheduled on it
+type Node struct {
+	Name        string
+	Pool        string
+	Allocatable v1.ResourceList
+	Requests    v1.ResourceList
+	Pods        int
+	// Unschedulable is true for cordoned nodes and nodes with NoSchedule or NoExecute taints
+	Unschedulable bool
+}
+
+// Pod is the requests of a running or pending pod
+type Pod struct {
+	Namespace string
+	Name      string
+	Node      string
+	// The pool of the node the pod is scheduled on, or empty if the pod is not scheduled
+	Pool     string
+	Requests v1.ResourceList
+}
+
+type Usage struct {
+	Nodes []Node
+	Pods  []Pod
+}
+
+// GetUsage returns the nodes and pods of a cluster, with nodes assigned to the pools in config
+func GetUsage(client kubernetes.Interface, config types.PlatformConfig) (*Usage, error) {
+	nodes, err := client.CoreV1().Nodes().List(metav1.ListOptions{})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list nodes")
+	}
+	pods, err := client.CoreV1().Pods(v1.NamespaceAll).List(metav1.ListOptions{})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list pods")
+	}
+
+	usage := &Usage{}
+	index := make(map[string]int)
+	for _, node := range nodes.Items {
+		index[node.Name] = len(usage.Nodes)
+		usage.Nodes = append(usage.Nodes, Node{
+			Name:          node.Name,
+			Pool:          PoolOf(config, node),
+			Allocatable:   node.Status.Allocatable,
+			Requests:      v1.ResourceList{},
+			Unschedulable: unschedulable(node),
+		})
+	}
+	for _, pod := range pods.Items {
+		if pod.Status.Phase == v1.PodSucceeded || pod.Status.Phase == v1.PodFailed {
+			continue
+		}
+		p := Pod{Namespace: pod.Namespace, Name: pod.Name, Node: pod.Spec.NodeName, Requests: PodRequests(pod)}
+		if i, ok := index[pod.Spec.NodeName]; ok {
+			node := &usage.Nodes[i]
+			p.Pool = node.Pool
+			node.Pods++
+			add(node.Requests, p.Requests)
+		}
+		usage.Pods = append(usage.Pods, p)
+	}
+	return usage, nil
+}
+
+// PoolOf returns the name of the pool in config.Nodes that a node was provisioned from, based on the
+// <hostPrefix>-<name>-<prefix>- naming of VMs, masters for master nodes, or other if no pool matches
+func PoolOf(config types.PlatformConfig, node v1.Node) string {
+	if _, ok := node.Labels["node-role.kubernetes.io/master"]; ok {
+		return MasterPool
+	}
+	pool, longest := "other", 0
+	for name, vm := range config.Nodes {
+		prefix := fmt.Sprintf("%s-%s-%s-", config.HostPrefix, config.Name, vm.Prefix)
+		if strings.HasPrefix(node.Name, prefix) && len(prefix) > longest {
+			pool, longest = name, len(prefix)
+		}
+	}
+	return pool
+}
+
+func unschedulable(node v1.Node) bool {
+	for _, taint := range node.Spec.Taints {
+		if taint.Effect == v1.TaintEffectNoSchedule || taint.Effect == v1.TaintEffectNoExecute {
+			return true
+		}
+	}
+	return node.Spec.Unschedulable
+}
+
+// PodRequests returns the resources requested by a pod, which are the larger of the sum of its
+// containers and any of its init containers, plus the pod overhead
+func PodRequests(pod v1.Pod) v1.ResourceList {
+	requests := v1.ResourceList{}
+	for _, container := range pod.Spec.Containers {
+		add(requests, container.Resources.Requests)
+	}
+	for _, container := range pod.Spec.InitContainers {
+		for name, quantity := range container.Resources.Requests {
+			if value, ok := requests[name]; !ok || quantity.Cmp(value) > 0 {
+				requests[name] = quantity.DeepCopy()
+			}
+		}
+	}
+	add(requests, pod.Spec.Overhead)
+	return requests
+}
+
+// Pools returns the nodes in usage grouped by pool, with the allocatable capacity and requests of the nodes in
+// each pool summed up
+func (usage Usage) Pools() []Node {
+	pools := make(map[string]*Node)
+	for _, node := range usage.Nodes {
+		pool, ok := pools[node.Pool]
+		if !ok {
+			pool = &Node{Name: node.Pool, Pool: node.Pool, Allocatable: v1.ResourceList{}, Requests: v1.ResourceList{}}
+			pools[node.Pool] = pool
+		}
+		add(pool.Allocatable, node.Allocatable)
+		add(pool.Requests, node.Requests)
+		pool.Pods += node.Pods
+	}
+	var list []Node
+	for _, pool := range pools {
+		list = append(list, *pool)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Pool < list[j].Pool })
+	return list
+}
+
+// UtilisationTable returns a report of requests vs allocatable capacity for each pool
+func UtilisationTable(usage Usage) Table {
+	table := Table{Headers: []string{"POOL", "NODES", "PODS", "PODS ALLOCATABLE",
+		"CPU REQUESTS", "CPU ALLOCATABLE", "CPU %",
+		"MEMORY REQUESTS", "MEMORY ALLOCATABLE", "MEMORY %"}}
+	nodes := make(map[string]int)
+	for _, node := range usage.Nodes {
+		nodes[node.Pool]++
+	}
+	for _, pool := range usage.Pools() {
+		cpu, memory := pool.Requests[v1.ResourceCPU], pool.Requests[v1.ResourceMemory]
+		table.Add(pool.Pool,
+			fmt.Sprint(nodes[pool.Pool]),
+			fmt.Sprint(pool.Pods),
+			fmt.Sprint(pool.Allocatable.Pods().Value()),
+			FormatCPU(cpu), FormatCPU(*pool.Allocatable.Cpu()), percent(cpu, *pool.Allocatable.Cpu()),
+			FormatMemory(memory), FormatMemory(*pool.Allocatable.Memory()), percent(memory, *pool.Allocatable.Memory()))
+	}
+	return table
+}
+
+// Utilisation writes a report of requests vs allocatable capacity for each pool to stdout
+func Utilisation(client kubernetes.Interface, config types.PlatformConfig, opts ReportOptions) error {
+	usage, err := GetUsage(client, config)
+	if err != nil {
+		return err
+	}
+	return UtilisationTable(*usage).Write(os.Stdout, opts.Format)
+}
+
+// FormatCPU formats a CPU quantity as cores
+func FormatCPU(quantity resource.Quantity) string {
+	return fmt.Sprintf("%.2f", float64(quantity.MilliValue())/1000)
+}
+
+// FormatMemory formats a memory quantity in GiB
+func FormatMemory(quantity resource.Quantity) string {
+	return fmt.Sprintf("%.1fGi", float64(quantity.Value())/(1<<30))
+}
+
+func add(total, list v1.ResourceList) {
+	for name, quantity := range list {
+		value := total[name]
+		value.Add(quantity)
+		total[name] = value
+	}
+}
@@ -7,13 +7,19 @@ type PlatformConfig struct {
 	CA          *CA         `yaml:"ca"`
 	Calico      Calico      `yaml:"calico,omitempty"`
 	CertManager CertManager `yaml:"certmanager,omitempty"`
+	// Resources, replicas and node placement of platform components
+	ComponentOverrides []ComponentOverride `yaml:"componentOverrides,omitempty"`
 	// The endpoint for an externally hosted consul cluster
 	// that is used for master discovery
-	Consul         string      `yaml:"consul"`
-	Dashboard      Dashboard   `yaml:"dashboard,omitempty"`
-	Datacenter     string      `yaml:"datacenter"`
-	DNS            *DynamicDNS `yaml:"dns,omitempty"`
-	DockerRegistry string      `yaml:"dockerRegistry,omitempty"`
+	Consul string `yaml:"consul"`
+	// Stub zones, forwarders and hosts entries for CoreDNS and node-local-dns
+	CoreDNS CoreDNS `yaml:"coreDNS,omitempty"`
+	// Phases declared in config that are deployed and tested like the built-in phases
+	CustomPhases   []CustomPhase `yaml:"customPhases,omitempty"`
+	Dashboard      Dashboard     `yaml:"dashboard,omitempty"`
+	Datacenter     string        `yaml:"datacenter"`
+	DNS            *DynamicDNS   `yaml:"dns,omitempty"`
+	DockerRegistry string        `yaml:"dockerRegistry,omitempty"`
 	// The wildcard domain that cluster will be available at
 	Domain      string      `yaml:"domain"`
 	EventRouter EventRouter `yaml:"eventrouter,omitempty"`
@@ -40,7 +46,10 @@ type PlatformConfig struct {
 	PodSubnet             string            `yaml:"podSubnet"`
 	Policies              []string          `yaml:"policies,omitempty"`
 	// A list of strategic merge patches that will be applied to all resources created
-	Patches             []string             `yaml:"patches,omitempty"`
+	Patches []string `yaml:"patches,omitempty"`
+	// A directory containing manifests/ and templates/ whose files replace or are added to the
+	// embedded manifests and templates with the same path, see karina manifests export
+	ManifestOverlays    string               `yaml:"manifestOverlays,omitempty"`
 	Quack               *Enabled             `yaml:"quack,omitempty"`
 	RegistryCredentials *RegistryCredentials `yaml:"registryCredentials,omitempty"`
 	Resources           map[string]string    `yaml:"resources,omitempty"`
@@ -50,6 +59,7 @@ type PlatformConfig struct {
 	ServiceSubnet       string               `yaml:"serviceSubnet"`
 	SMTP                SMTP                 `yaml:"smtp,omitempty"`
 	Specs               []string             `yaml:"specs,omitempty"`
+	Storage             *Storage             `yaml:"storage,omitempty"`
 	TrustedCA           string               `yaml:"trustedCA,omitempty"`
 	Versions            map[string]string    `yaml:"versions,omitempty"`
 	PlatformOperator    *PlatformOperator    `yaml:"platformOperator,omitempty"`
@@ -66,6 +76,7 @@ type PlatformConfig struct {
 	ConfigMapReloader   ConfigMapReloader    `yaml:"configmapReloader,omitempty"`
 	Elasticsearch       *Elasticsearch       `yaml:"elasticsearch,omitempty"`
 	Tekton              Tekton               `yaml:"tekton,omitempty"`
+	Tenants             []Tenant             `yaml:"tenants,omitempty"`
 	Vsphere             *Vsphere             `yaml:"vsphere,omitempty"`
 	Test                Test                 `yaml:"test,omitempty"`
 	// If true, terminate operations will return an error. Used to
@@ -20,6 +20,10 @@ func DefaultPlatformConfig() PlatformConfig {
 		EventRouter: EventRouter{
 			FilebeatPrefix: "com.flanksource.infra",
 		},
+		NodeLocalDNS: NodeLocalDNS{
+			LocalDNS:  "169.254.20.10",
+			DNSDomain: "cluster.local",
+		},
 	}
 	return config
 }
@@ -3,6 +3,7 @@ package types
 import (
 	"fmt"
 	"net/url"
+	"sort"
 	"strings"
 
 	"github.com/flanksource/karina/pkg/api/calico"
@@ -98,6 +99,10 @@ type OPA struct {
 	// Log level for opa server, one of: `debug`,`info`,`error` (default: `error`)
 	LogLevel string `yaml:"logLevel,omitempty"`
 	E2E      OPAE2E `yaml:"e2e,omitempty"`
+	// Path to a PEM encoded RSA or ECDSA private key used to sign bundles built with karina opa build
+	BundleSigningKey string `yaml:"bundleSigningKey,omitempty"`
+	// PEM encoded public key used by opa to verify bundle signatures, requires opa 0.22+
+	BundleVerificationKey string `yaml:"bundleVerificationKey,omitempty"`
 }
 
 type OPAE2E struct {
@@ -120,6 +125,46 @@ type Harbor struct {
 	Replicas int                      `yaml:"replicas,omitempty"`
 	// S3 bucket for the docker registry to use
 	Bucket string `yaml:"bucket"`
+	// Remote registries used by replication policies
+	Registries []HarborRegistry `yaml:"registries,omitempty"`
+	// Replication policies, policies created by karina that are removed from the config are deleted
+	Replication []HarborReplication `yaml:"replication,omitempty"`
+	// Garbage collection of unreferenced blobs
+	GC *HarborGC `yaml:"gc,omitempty"`
+	// Fail `karina test harbor` when platform images stored in harbor have critical vulnerabilities
+	ScanPlatformImages bool `yaml:"scanPlatformImages,omitempty"`
+}
+
+type HarborGC struct {
+	// A cron schedule with seconds e.g. "0 0 2 * * 6"
+	Schedule string `yaml:"schedule"`
+}
+
+// HarborRetention is a tag retention policy, tags matched by any of the rules are retained and all
+// other tags are deleted
+type HarborRetention struct {
+	// A cron schedule with seconds e.g. "0 0 3 * * *", retention is only run manually if empty
+	Schedule string                `yaml:"schedule,omitempty"`
+	Rules    []HarborRetentionRule `yaml:"rules"`
+}
+
+// HarborRetentionRule retains tags matching repositories and tags, exactly one of the retain
+// conditions must be set
+type HarborRetentionRule struct {
+	// Repositories the rule applies to e.g. apps/**, defaults to **
+	Repositories string `yaml:"repositories,omitempty"`
+	// Tags the rule applies to e.g. v*, defaults to **
+	Tags string `yaml:"tags,omitempty"`
+	// Retain the most recently pushed tags
+	LatestPushed int `yaml:"latestPushed,omitempty"`
+	// Retain the most recently pulled tags
+	LatestPulled int `yaml:"latestPulled,omitempty"`
+	// Retain tags pushed within the last n days
+	DaysSinceLastPush int `yaml:"daysSinceLastPush,omitempty"`
+	// Retain tags pulled within the last n days
+	DaysSinceLastPull int `yaml:"daysSinceLastPull,omitempty"`
+	// Retain all matching tags
+	Always bool `yaml:"always,omitempty"`
 }
 
 type HarborSettings struct {
@@ -161,8 +206,59 @@ type HarborSettings struct {
 }
 
 type HarborProject struct {
-	Name  string            `yaml:"name,omitempty"`
-	Roles map[string]string `yaml:"roles,omitempty"`
+	// The project name, defaults to the key in harbor.projects
+	Name string `yaml:"name,omitempty"`
+	// Roles assigned to LDAP group DNs or OIDC group names, one of projectAdmin, maintainer, developer,
+	// guest or limitedGuest. Group members that are not listed are removed if any roles are specified.
+	Roles  map[string]string `yaml:"roles,omitempty"`
+	Public bool              `yaml:"public,omitempty"`
+	// Maximum storage used by the project e.g. 100Gi, unlimited if empty
+	StorageLimit string        `yaml:"storageLimit,omitempty"`
+	Robots       []HarborRobot `yaml:"robots,omitempty"`
+	// Tag retention policy, an existing policy is left unchanged if empty
+	Retention *HarborRetention `yaml:"retention,omitempty"`
+}
+
+// HarborRobot is a robot account whose token is stored as a docker pull secret
+type HarborRobot struct {
+	Name string `yaml:"name"`
+	// Allow pushing as well as pulling
+	Push bool `yaml:"push,omitempty"`
+	// Namespaces the pull secret is created in
+	Namespaces []string `yaml:"namespaces,omitempty"`
+	// The name of the pull secret, defaults to harbor-<project>-<robot>
+	SecretName string `yaml:"secretName,omitempty"`
+}
+
+type HarborRegistry struct {
+	Name string `yaml:"name"`
+	URL  string `yaml:"url"`
+	// The registry type e.g. harbor (default), docker-hub, docker-registry, google-gcr or aws-ecr
+	Type     string `yaml:"type,omitempty"`
+	Username string `yaml:"username,omitempty"`
+	Password string `yaml:"password,omitempty"`
+	Insecure bool   `yaml:"insecure,omitempty"`
+}
+
+type HarborReplication struct {
+	Name string `yaml:"name"`
+	// The name of a registry in harbor.registries
+	Registry string `yaml:"registry"`
+	// pull (default) images from the registry into harbor, or push images from harbor to the registry
+	Direction string `yaml:"direction,omitempty"`
+	// Repositories to replicate e.g. library/**
+	Repositories string `yaml:"repositories,omitempty"`
+	// Tags to replicate e.g. v*
+	Tags string `yaml:"tags,omitempty"`
+	// The namespace to replicate into, defaults to the source namespace
+	DestNamespace string `yaml:"destNamespace,omitempty"`
+	// A cron schedule with seconds e.g. "0 0 2 * * *", if empty replication is event based for
+	// push and manual for pull
+	Schedule string `yaml:"schedule,omitempty"`
+	Override bool   `yaml:"override,omitempty"`
+	// Replicate deletions
+	Deletion bool `yaml:"deletion,omitempty"`
+	Disabled bool `yaml:"disabled,omitempty"`
 }
 
 type DB struct {
@@ -364,6 +460,11 @@ type Monitoring struct {
 	AddonResizer       string        `yaml:"addonResizer,omitempty"`
 	PrometheusOperator string        `yaml:"prometheus_operator,omitempty"`
 	E2E                MonitoringE2E `yaml:"e2e,omitempty"`
+	// Directories or git repositories (e.g. https://github.com/org/repo.git//dashboards?ref=v1.0)
+	// of additional grafana dashboards, files ending in .raw are not templated
+	Dashboards []string `yaml:"dashboards,omitempty"`
+	// Directories or git repositories of additional PrometheusRule specs or prometheus rule files
+	Rules []string `yaml:"rules,omitempty"`
 }
 
 type MonitoringE2E struct {
@@ -381,6 +482,59 @@ type Prometheus struct {
 type AlertManager struct {
 	Version  string `yaml:"version,omitempty"`
 	Disabled bool   `yaml:"disabled,omitempty"`
+	// Receivers that alerts can be routed to, a receiver named default replaces the alert_email receiver
+	Receivers []AlertReceiver `yaml:"receivers,omitempty"`
+	// Routes matched in order against the labels of an alert, unmatched alerts are sent to the default receiver
+	Routes []AlertRoute `yaml:"routes,omitempty"`
+	// Silences to create after deploying alertmanager
+	Silences []AlertSilence `yaml:"silences,omitempty"`
+}
+
+type AlertReceiver struct {
+	Name string `yaml:"name"`
+	// Email addresses to send to using the smtp server
+	Email []string `yaml:"email,omitempty"`
+	// Slack or slack compatible (e.g. mattermost) incoming webhooks
+	Slack []SlackReceiver `yaml:"slack,omitempty"`
+	// URLs to post the alerts to using the alertmanager webhook format
+	Webhook []string `yaml:"webhook,omitempty"`
+	// PagerDuty or PagerDuty compatible (events API v2) integrations
+	PagerDuty []PagerDutyReceiver `yaml:"pagerduty,omitempty"`
+	// Send a notification when alerts are resolved
+	SendResolved bool `yaml:"sendResolved,omitempty"`
+}
+
+type SlackReceiver struct {
+	URL     string `yaml:"url"`
+	Channel string `yaml:"channel,omitempty"`
+}
+
+type PagerDutyReceiver struct {
+	RoutingKey string `yaml:"routingKey"`
+	// Defaults to the PagerDuty events API
+	URL string `yaml:"url,omitempty"`
+}
+
+type AlertRoute struct {
+	Receiver string `yaml:"receiver"`
+	// Labels that must match exactly e.g. severity: critical
+	Match map[string]string `yaml:"match,omitempty"`
+	// Labels that must match a regular expression e.g. namespace: team-.*
+	MatchRe map[string]string `yaml:"matchRe,omitempty"`
+	GroupBy []string          `yaml:"groupBy,omitempty"`
+	// Continue matching subsequent routes after this route matches
+	Continue       bool   `yaml:"continue,omitempty"`
+	RepeatInterval string `yaml:"repeatInterval,omitempty"`
+	// Child routes matched against alerts that match this route
+	Routes []AlertRoute `yaml:"routes,omitempty"`
+}
+
+type AlertSilence struct {
+	// Labels that must match exactly, values prefixed with ~ are regular expressions
+	Matchers map[string]string `yaml:"matchers"`
+	Comment  string            `yaml:"comment"`
+	// Time the silence ends in RFC3339 format, silences are not recreated after they end
+	EndsAt string `yaml:"endsAt"`
 }
 
 type Persistence struct {
@@ -408,6 +562,17 @@ type Brand struct {
 	Logo string `yaml:"logo,omitempty"`
 }
 
+// HelmChart is a chart rendered locally using helm template and applied like any other manifest
+type HelmChart struct {
+	// The release name
+	Name      string `yaml:"name"`
+	Namespace string `yaml:"namespace"`
+	// Path to a chart tarball or directory, paths that do not exist locally are read from the embedded manifests
+	Chart string `yaml:"chart"`
+	// Path to a values file that is templated using the platform config
+	Values string `yaml:"values,omitempty"`
+}
+
 type GitOps struct {
 	// The name of the gitops deployment, defaults to namespace name
 	Name string `yaml:"name,omitempty"`
@@ -449,6 +614,52 @@ type GitOps struct {
 	Args map[string]string `yaml:"args,omitempty"`
 }
 
+// Tenant is a team or application that is onboarded with its own namespaces, quotas, RBAC,
+// network policies, harbor project and gitops deployment
+type Tenant struct {
+	Name string `yaml:"name"`
+	// The namespaces of the tenant, defaults to the tenant name
+	Namespaces  []string          `yaml:"namespaces,omitempty"`
+	Labels      map[string]string `yaml:"labels,omitempty"`
+	Annotations map[string]string `yaml:"annotations,omitempty"`
+	// ClusterRoles e.g. admin, edit or view that are bound to LDAP groups in each namespace, keyed by group name
+	Roles map[string]string `yaml:"roles,omitempty"`
+	// The hard limits of the ResourceQuota in each namespace e.g. requests.cpu: 4, limits.memory: 16Gi, pods: 50
+	Quota map[string]string `yaml:"quota,omitempty"`
+	// The default requests and limits of containers in each namespace
+	LimitRange *TenantLimitRange `yaml:"limitRange,omitempty"`
+	// Do not create network policies that deny ingress from outside the tenant
+	DisableNetworkPolicies bool `yaml:"disableNetworkPolicies,omitempty"`
+	// Namespaces outside the tenant that are allowed ingress, defaults to ingress-nginx and monitoring
+	AllowIngressFrom []string `yaml:"allowIngressFrom,omitempty"`
+	// A harbor project with a robot account whose pull secret is created in each namespace
+	Harbor *TenantHarbor `yaml:"harbor,omitempty"`
+	// A flux deployment that syncs the tenant's git repository into its namespaces,
+	// the namespace defaults to the first tenant namespace
+	GitOps *GitOps `yaml:"gitops,omitempty"`
+}
+
+type TenantLimitRange struct {
+	// Container requests used when none are specified e.g. cpu: 100m, memory: 128Mi
+	DefaultRequest map[string]string `yaml:"defaultRequest,omitempty"`
+	// Container limits used when none are specified
+	Default map[string]string `yaml:"default,omitempty"`
+	// The maximum limits of a container
+	Max map[string]string `yaml:"max,omitempty"`
+}
+
+type TenantHarbor struct {
+	// The project name, defaults to the tenant name
+	Project string `yaml:"project,omitempty"`
+	// Harbor roles assigned to LDAP groups, defaults to maintainer, developer and guest
+	// for groups with the admin, edit and view roles in the tenant namespaces
+	Roles map[string]string `yaml:"roles,omitempty"`
+	// Maximum storage used by the project e.g. 100Gi, unlimited if empty
+	StorageLimit string `yaml:"storageLimit,omitempty"`
+	// The name of the pull secret, defaults to harbor-<project>-pull
+	SecretName string `yaml:"secretName,omitempty"`
+}
+
 type Versions struct {
 	Kubernetes       string            `yaml:"kubernetes,omitempty"`
 	ContainerRuntime string            `yaml:"containerRuntime,omitempty"`
@@ -496,29 +707,86 @@ type FluentdOperator struct {
 }
 
 type Filebeat struct {
-	Enabled       `yaml:",inline"`
-	Version       string      `yaml:"version"`
-	Name          string      `yaml:"name"`
-	Index         string      `yaml:"index"`
-	Prefix        string      `yaml:"prefix"`
-	Elasticsearch *Connection `yaml:"elasticsearch,omitempty"`
-	Logstash      *Connection `yaml:"logstash,omitempty"`
+	Enabled     `yaml:",inline"`
+	Version     string `yaml:"version"`
+	Name        string `yaml:"name"`
+	Index       string `yaml:"index"`
+	Prefix      string `yaml:"prefix"`
+	BeatsOutput `yaml:",inline"`
+	// A Loki compatible API that `karina logs` queries instead of elasticsearch, for when logs are
+	// shipped to loki by another agent
+	Loki *Connection `yaml:"loki,omitempty"`
 }
 
 type Journalbeat struct {
-	Disabled      `yaml:",inline"`
-	Elasticsearch *Connection `yaml:"elasticsearch,omitempty"`
+	Disabled    `yaml:",inline"`
+	BeatsOutput `yaml:",inline"`
 }
 
 type Auditbeat struct {
-	Disabled      `yaml:",inline"`
-	Elasticsearch *Connection `yaml:"elasticsearch,omitempty"`
+	Disabled    `yaml:",inline"`
+	BeatsOutput `yaml:",inline"`
 }
 
 type Packetbeat struct {
-	Disabled      `yaml:",inline"`
-	Elasticsearch *Connection `yaml:"elasticsearch,omitempty"`
-	Kibana        *Connection `yaml:"kibana,omitempty"`
+	Disabled    `yaml:",inline"`
+	BeatsOutput `yaml:",inline"`
+	Kibana      *Connection `yaml:"kibana,omitempty"`
+}
+
+// BeatsOutput is where a beat ships its events to, only one of elasticsearch, logstash, kafka or file can be specified.
+// Journalbeat, auditbeat and packetbeat use the elasticsearch connection of the infra filebeat if no output is specified.
+type BeatsOutput struct {
+	Elasticsearch *Connection  `yaml:"elasticsearch,omitempty"`
+	Logstash      *Connection  `yaml:"logstash,omitempty"`
+	Kafka         *KafkaOutput `yaml:"kafka,omitempty"`
+	File          *FileOutput  `yaml:"file,omitempty"`
+	// An index lifecycle policy to create in elasticsearch, events are written to a rollover alias named after the index
+	ILM *BeatsILM `yaml:"ilm,omitempty"`
+	// Index settings to apply to new indices using an index template in elasticsearch
+	IndexTemplate *BeatsIndexTemplate `yaml:"indexTemplate,omitempty"`
+}
+
+type KafkaOutput struct {
+	// A list of host:port kafka brokers
+	Brokers []string `yaml:"brokers"`
+	Topic   string   `yaml:"topic"`
+	// SASL PLAIN credentials
+	User     string `yaml:"user,omitempty"`
+	Password string `yaml:"password,omitempty"`
+	// The kafka protocol version e.g. 2.0.0
+	Version string `yaml:"version,omitempty"`
+	TLS     bool   `yaml:"tls,omitempty"`
+}
+
+type FileOutput struct {
+	// The directory on each node that events are written to
+	Path string `yaml:"path"`
+	// Defaults to the name of the beat
+	Filename string `yaml:"filename,omitempty"`
+	// The maximum size of each file before it is rotated, defaults to 10240KB
+	RotateEveryKB int `yaml:"rotateEveryKb,omitempty"`
+	// The maximum number of rotated files to keep, defaults to 7
+	NumberOfFiles int `yaml:"numberOfFiles,omitempty"`
+}
+
+type BeatsILM struct {
+	// Roll over to a new index when the current index reaches this size e.g. 50gb
+	MaxSize string `yaml:"maxSize,omitempty"`
+	// Roll over to a new index when the current index reaches this age e.g. 1d
+	MaxAge string `yaml:"maxAge,omitempty"`
+	// Force merge indices into a single segment this long after rollover e.g. 2d
+	WarmAfter string `yaml:"warmAfter,omitempty"`
+	// Delete indices this long after rollover e.g. 30d
+	DeleteAfter string `yaml:"deleteAfter,omitempty"`
+}
+
+type BeatsIndexTemplate struct {
+	Shards          int    `yaml:"shards,omitempty"`
+	Replicas        *int   `yaml:"replicas,omitempty"`
+	RefreshInterval string `yaml:"refreshInterval,omitempty"`
+	// Additional index settings e.g. index.codec: best_compression
+	Settings map[string]string `yaml:"settings,omitempty"`
 }
 
 type EventRouter struct {
@@ -542,6 +810,13 @@ type Vault struct {
 	Roles         map[string]map[string]interface{} `yaml:"roles,omitempty"`
 	Policies      map[string]VaultPolicy            `yaml:"policies,omitempty"`
 	GroupMappings map[string][]string               `yaml:"groupMappings,omitempty"`
+	// A map of secret engines to mount, keyed by path. A pki engine is mounted at pki/ if not specified
+	SecretEngines map[string]VaultMount `yaml:"secretEngines,omitempty"`
+	// A map of auth methods to enable, keyed by path. The ldap auth method is enabled at ldap/ if ldap is configured
+	AuthMethods map[string]VaultMount `yaml:"authMethods,omitempty"`
+	// Delete policies, roles and group mappings that are no longer declared, secret engines and
+	// auth methods are only unmounted by karina vault apply --prune
+	Prune bool `yaml:"prune,omitempty"`
 	// ExtraConfig is an escape hatch that allows writing to arbritrary vault paths
 	ExtraConfig map[string]map[string]interface{} `yaml:"config,omitempty"`
 	Disabled    bool                              `yaml:"disabled,omitempty"`
@@ -550,8 +825,53 @@ type Vault struct {
 	// The AWS KMS ARN Id to use to unseal vault
 	KmsKeyID string `yaml:"kmsKeyId,omitempty"`
 	Region   string `yaml:"region,omitempty"`
-	Consul   Consul `yaml:"consul,omitempty"`
+	// Auto-unseal using the transit secret engine of another vault, used when no KMS is available
+	Transit *VaultTransit `yaml:"transit,omitempty"`
+	// Controls how the unseal (or recovery) keys are generated and stored during init
+	UnsealKeys VaultUnsealKeys `yaml:"unsealKeys,omitempty"`
+	Consul     Consul          `yaml:"consul,omitempty"`
 }
+
+type VaultTransit struct {
+	// The address of the vault server providing the transit secret engine
+	Address string `yaml:"address"`
+	// A VAULT_TOKEN with permissions to encrypt/decrypt using the transit key
+	Token string `yaml:"token"`
+	// The name of the transit key, defaults to autounseal
+	KeyName string `yaml:"keyName,omitempty"`
+	// The mount path of the transit secret engine, defaults to transit/
+	MountPath     string `yaml:"mountPath,omitempty"`
+	TLSSkipVerify bool   `yaml:"tlsSkipVerify,omitempty"`
+}
+
+type VaultUnsealKeys struct {
+	// The number of key shares to split the master key into, defaults to 5
+	Shares int `yaml:"shares,omitempty"`
+	// The number of key shares required to unseal vault, defaults to 3
+	Threshold int `yaml:"threshold,omitempty"`
+	// Paths to PGP public keys used to encrypt the key shares, one per share
+	PGPKeys []string `yaml:"pgpKeys,omitempty"`
+	// Store the key shares in the vault namespace as a sealed secret, cannot be combined with pgpKeys
+	SealedSecret bool `yaml:"sealedSecret,omitempty"`
+	// Print the key shares to the console, required unless sealedSecret is set
+	Print bool `yaml:"print,omitempty"`
+	// The directory the root token and the sealed secret are written to, defaults to the current directory
+	Path string `yaml:"path,omitempty"`
+}
+type VaultMount struct {
+	Type        string `yaml:"type"`
+	Description string `yaml:"description,omitempty"`
+	// The default lease duration e.g. 768h
+	DefaultLeaseTTL string `yaml:"defaultLeaseTTL,omitempty"`
+	// The maximum lease duration e.g. 43800h
+	MaxLeaseTTL string            `yaml:"maxLeaseTTL,omitempty"`
+	Options     map[string]string `yaml:"options,omitempty"`
+	// Configuration written to <path>/config after mounting e.g. auth/kubernetes/config
+	Config map[string]interface{} `yaml:"config,omitempty"`
+	// Roles to create/update under <path>/roles for secret engines and auth/<path>/role for auth methods
+	Roles map[string]map[string]interface{} `yaml:"roles,omitempty"`
+}
+
 type VaultPolicy map[string]VaultPolicyPath
 
 type VaultPolicyPath struct {
@@ -561,8 +881,15 @@ type VaultPolicyPath struct {
 }
 
 func (vaultPolicy VaultPolicy) String() string {
+	var paths []string
+	for path := range vaultPolicy {
+		paths = append(paths, path)
+	}
+	// paths are sorted so that the policy can be compared with the policy stored in vault
+	sort.Strings(paths)
 	s := ""
-	for path, policy := range vaultPolicy {
+	for _, path := range paths {
+		policy := vaultPolicy[path]
 		s += fmt.Sprintf(`
 		path "%s" {
 			capabilities = [%s]
@@ -606,12 +933,34 @@ type ECK struct {
 }
 
 type NodeLocalDNS struct {
-	Disabled  bool   `yaml:"disabled,omitempty"`
+	Disabled bool `yaml:"disabled,omitempty"`
+	// The cluster IP of CoreDNS, defaults to the IP of the kube-dns service
 	DNSServer string `yaml:"dnsServer,omitempty"`
-	LocalDNS  string `yaml:"localDNS,omitempty"`
+	// The link-local address node-local-dns listens on, defaults to 169.254.20.10
+	LocalDNS string `yaml:"localDNS,omitempty"`
+	// The cluster domain, defaults to cluster.local
 	DNSDomain string `yaml:"dnsDomain,omitempty"`
 }
 
+// CoreDNS customises the resolution of names outside the cluster domain, the settings are
+// rendered into both the CoreDNS and node-local-dns configs
+type CoreDNS struct {
+	// Upstream servers used for names that are not in the cluster domain or a stub zone,
+	// defaults to the nameservers in /etc/resolv.conf of the node
+	Forwarders []string `yaml:"forwarders,omitempty"`
+	// Zones that are resolved using their own nameservers
+	StubZones []StubZone `yaml:"stubZones,omitempty"`
+	// Static entries of hostname to IP address
+	Hosts map[string]string `yaml:"hosts,omitempty"`
+}
+
+type StubZone struct {
+	Zone    string   `yaml:"zone"`
+	Servers []string `yaml:"servers"`
+	// A name in the zone that is resolved by karina test base
+	TestName string `yaml:"testName,omitempty"`
+}
+
 type SealedSecrets struct {
 	Enabled     `yaml:",inline"`
 	Version     string `yaml:"version,omitempty"`
@@ -741,6 +1090,32 @@ type Elasticsearch struct {
 	Replicas    int          `yaml:"replicas,omitempty"`
 	Persistence *Persistence `yaml:"persistence,omitempty"`
 	Disabled    bool         `yaml:"disabled,omitempty"`
+	// Register an S3 snapshot repository, installing the repository-s3 plugin on each node
+	Snapshots *ElasticsearchSnapshots `yaml:"snapshots,omitempty"`
+}
+
+type ElasticsearchSnapshots struct {
+	// The bucket to store snapshots in, defaults to s3.bucket
+	Bucket string `yaml:"bucket,omitempty"`
+	// The path within the bucket, defaults to elasticsearch/<platform name>
+	BasePath string `yaml:"basePath,omitempty"`
+	// The S3 endpoint used by elasticsearch, defaults to s3.endpoint
+	Endpoint string `yaml:"endpoint,omitempty"`
+	// Snapshot lifecycle policies that take snapshots on a schedule
+	Policies []ElasticsearchSnapshotPolicy `yaml:"policies,omitempty"`
+}
+
+type ElasticsearchSnapshotPolicy struct {
+	Name string `yaml:"name"`
+	// A cron expression in the elasticsearch format e.g. "0 30 1 * * ?"
+	Schedule string `yaml:"schedule"`
+	// Index patterns to include, defaults to all indices
+	Indices []string `yaml:"indices,omitempty"`
+	// Delete snapshots older than this e.g. 30d
+	ExpireAfter string `yaml:"expireAfter,omitempty"`
+	// The minimum and maximum number of snapshots to keep regardless of age
+	MinCount int `yaml:"minCount,omitempty"`
+	MaxCount int `yaml:"maxCount,omitempty"`
 }
 
 type Tekton struct {
@@ -756,6 +1131,88 @@ type Test struct {
 	Exclude []string `yaml:"exclude,omitempty"`
 }
 
+// CustomPhase is a phase declared in config that can be deployed and tested like the built-in phases
+type CustomPhase struct {
+	// The name used for karina deploy <name> and karina test <name>
+	Name      string `yaml:"name"`
+	Disabled  bool   `yaml:"disabled,omitempty"`
+	Namespace string `yaml:"namespace"`
+	// Directory of manifests to apply, files are templated using the platform config unless they end in .raw
+	Manifests string `yaml:"manifests,omitempty"`
+	// A helm chart to apply
+	Chart *HelmChart `yaml:"chart,omitempty"`
+	// Built-in or custom phases that must be deployed successfully before this phase when deploying all phases
+	DependsOn []string `yaml:"dependsOn,omitempty"`
+	// Wait for the Deployments, StatefulSets and DaemonSets to become ready and Jobs to complete
+	Wait bool `yaml:"wait,omitempty"`
+	// How long to wait for readiness, defaults to 5m
+	Timeout string          `yaml:"timeout,omitempty"`
+	Test    CustomPhaseTest `yaml:"test,omitempty"`
+}
+
+type CustomPhaseTest struct {
+	// Skip checking that all pods in the namespace are running
+	SkipPods bool `yaml:"skipPods,omitempty"`
+	// URLs that must return a 2xx response, templated using the platform config
+	URLs []string `yaml:"urls,omitempty"`
+	// Path to a Job spec that is run in the namespace and must complete successfully
+	Job string `yaml:"job,omitempty"`
+}
+
+// Storage declares the storage classes of the cluster, classes deployed by other phases
+// e.g. local-path can be redeclared here to change them or make them the default
+type Storage struct {
+	Classes []StorageClass `yaml:"classes,omitempty"`
+	// Size of the volume provisioned for each class by karina test storage, defaults to 1Gi
+	TestSize string `yaml:"testSize,omitempty"`
+}
+
+type StorageClass struct {
+	Name        string            `yaml:"name"`
+	Provisioner string            `yaml:"provisioner"`
+	Parameters  map[string]string `yaml:"parameters,omitempty"`
+	// Delete (default) or Retain
+	ReclaimPolicy string `yaml:"reclaimPolicy,omitempty"`
+	// Immediate (default) or WaitForFirstConsumer
+	VolumeBindingMode    string   `yaml:"volumeBindingMode,omitempty"`
+	AllowVolumeExpansion bool     `yaml:"allowVolumeExpansion,omitempty"`
+	MountOptions         []string `yaml:"mountOptions,omitempty"`
+	// Make this the default storage class, removing the default flag from all other classes
+	Default bool `yaml:"default,omitempty"`
+	// Do not provision a test volume using this class
+	SkipTest bool `yaml:"skipTest,omitempty"`
+}
+
+// ComponentOverride changes the sizing and placement of a Deployment, StatefulSet or DaemonSet
+// deployed by any phase, it is applied as a strategic merge patch
+type ComponentOverride struct {
+	// Deployment, StatefulSet or DaemonSet, defaults to Deployment
+	Kind      string `yaml:"kind,omitempty"`
+	Namespace string `yaml:"namespace"`
+	Name      string `yaml:"name"`
+	Replicas  *int   `yaml:"replicas,omitempty"`
+	// Resources keyed by container name, init containers are not supported
+	Resources         map[string]ContainerResources `yaml:"resources,omitempty"`
+	NodeSelector      map[string]string             `yaml:"nodeSelector,omitempty"`
+	Tolerations       []Toleration                  `yaml:"tolerations,omitempty"`
+	PriorityClassName string                        `yaml:"priorityClassName,omitempty"`
+	// A pod affinity spec, e.g. {nodeAffinity: {...}}
+	Affinity map[string]interface{} `yaml:"affinity,omitempty"`
+}
+
+type ContainerResources struct {
+	Requests map[string]string `yaml:"requests,omitempty"`
+	Limits   map[string]string `yaml:"limits,omitempty"`
+}
+
+type Toleration struct {
+	Key               string `yaml:"key,omitempty"`
+	Operator          string `yaml:"operator,omitempty"`
+	Value             string `yaml:"value,omitempty"`
+	Effect            string `yaml:"effect,omitempty"`
+	TolerationSeconds *int64 `yaml:"tolerationSeconds,omitempty"`
+}
+
 func (c Connection) GetURL() string {
 	url := c.URL
 	if c.Port != "" && !strings.Contains(url, ":") {
@@ -89,7 +89,7 @@ $BIN deploy all $PLATFORM_OPTIONS_FLAGS
 
 # deploy the opa bundles first, as they can take some time to load, this effectively
 # parallelizes this work to make the entire test complete faster
-$BIN opa bundle automobile $PLATFORM_OPTIONS_FLAGS
+$BIN opa bundle automobile --bundle test/opa/bundles/automobile.tar.gz $PLATFORM_OPTIONS_FLAGS
 # wait for up to 4 minutes, rerunning tests if they fail
 # this allows for all resources to reconcile and images to finish downloading etc..
 $BIN test all --wait 240 --progress=false $PLATFORM_OPTIONS_FLAGS
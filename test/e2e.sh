@@ -53,7 +53,7 @@ $BIN deploy all -v
 
 # deploy the opa bundles first, as they can take some time to load, this effectively
 # parallelizes this work to make the entire test complete faster
-$BIN opa bundle automobile -v
+$BIN opa bundle automobile --bundle test/opa/bundles/automobile.tar.gz -v
 # wait for up to 4 minutes, rerunning tests if they fail
 # this allows for all resources to reconcile and images to finish downloading etc..
 $BIN test all -v --wait 240 --progress=false